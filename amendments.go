@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reason codes accepted for an amendment, code -> description
+var amendmentReasonCodes = map[string]string{
+	"DOCUMENTATION_ERROR": "Original entry was documented incorrectly",
+	"WRONG_PATIENT":       "Original entry was documented on the wrong patient",
+	"LATE_ENTRY":          "Round was performed but not documented at the time",
+	"DEVICE_DOWNTIME":     "Documentation was delayed by a device or network outage",
+	"OTHER":               "Other reason, explained in the note",
+}
+
+// Statuses a round can be amended to
+var amendableRoundStatuses = map[string]bool{
+	"STARTED":  true,
+	"COMPLETE": true,
+	"MISSED":   true,
+}
+
+// The body of a request to amend a round's status
+type RoundStatusAmendmentRequest struct {
+	RoundTimestamp string `json:"roundTimestamp"`
+	Status         string `json:"status"`
+	ReasonCode     string `json:"reasonCode"`
+	Note           string `json:"note"`
+	StaffId        string `json:"staffId"`
+}
+
+// The body of a request to amend a round member's observation
+type ObservationAmendmentRequest struct {
+	Observation string `json:"observation"`
+	ReasonCode  string `json:"reasonCode"`
+	Note        string `json:"note"`
+}
+
+// Check that a reason code is known, and that OTHER comes with a note
+func validateAmendmentReason(reasonCode string, note string) error {
+	if _, ok := amendmentReasonCodes[reasonCode]; !ok {
+		return fmt.Errorf("unknown amendment reason code %q", reasonCode)
+	}
+	if reasonCode == "OTHER" && note == "" {
+		return errors.New("a note is required when the reason code is OTHER")
+	}
+	return nil
+}
+
+// Amend the status of the round at a given clinical round time, on behalf of staffId
+// If there is no round at that time yet (i.e. it shows as NOT_STARTED or MISSED), rounds are created up to it the same
+// way starting it would, so it has its round types and members and can be documented late. A time that isn't on the
+// schedule, or is after amendedAt, is refused
+// A round amended to STARTED or COMPLETE is given staffId and the round time for whichever of its start or completion
+// is missing, since the clinical time is the round time rather than when it was charted
+// The original status is kept on the amendment, and amendedAt is recorded separately from the round timestamp
+func AmendRoundStatus(store RoundsStore, roundTime time.Time, status string, reasonCode string, note string, staffId string, amendedAt time.Time) (RoundAmendment, error) {
+	if err := validateAmendmentReason(reasonCode, note); err != nil {
+		return RoundAmendment{}, err
+	}
+	if !amendableRoundStatuses[status] {
+		return RoundAmendment{}, fmt.Errorf("round status cannot be amended to %q", status)
+	}
+	if staffId == "" {
+		return RoundAmendment{}, errors.New("staff id is required")
+	}
+	if roundTime.After(amendedAt) {
+		return RoundAmendment{}, fmt.Errorf("%w: %s is after %s", errRoundInFuture, roundTime.UTC().Format(time.RFC3339), amendedAt.UTC().Format(time.RFC3339))
+	}
+
+	round, err := store.GetRoundForTime(roundTime)
+	if err != nil {
+		panic("Failed to get round for time")
+	}
+
+	// Work out what the round looked like before the amendment
+	// A round with no row is displayed as NOT_STARTED or MISSED by StartRounds
+	originalStatus := round.Status
+	if round.ID == 0 {
+		originalStatus = "NOT_STARTED"
+		if amendedAt.Sub(roundTime) >= missedRoundAfter {
+			originalStatus = "MISSED"
+		}
+	}
+	if originalStatus == status {
+		return RoundAmendment{}, fmt.Errorf("round is already %s", status)
+	}
+
+	if round.ID == 0 {
+		scheduled, err := onRoundSchedule(store, roundTime)
+		if err != nil {
+			return RoundAmendment{}, err
+		}
+		if !scheduled {
+			return RoundAmendment{}, fmt.Errorf("no round is scheduled at %s", roundTime.UTC().Format(time.RFC3339))
+		}
+		round, err = getOrCreateRoundForTime(store, roundTime, amendedAt)
+		if err != nil {
+			return RoundAmendment{}, err
+		}
+	}
+
+	amendment := RoundAmendment{
+		Field:         "status",
+		OriginalValue: originalStatus,
+		AmendedValue:  status,
+		ReasonCode:    reasonCode,
+		Note:          note,
+		LateEntry:     isLateEntry(originalStatus, roundTime, amendedAt),
+		AmendedAt:     amendedAt.UTC().Format(time.RFC3339),
+	}
+
+	round.Status = status
+	if (status == "STARTED" || status == "COMPLETE") && round.StartedAt == "" {
+		round.StartedAt = round.RoundTimestamp
+		round.StartedBy = staffId
+	}
+	if status == "COMPLETE" && round.CompletedAt == "" {
+		round.CompletedAt = round.RoundTimestamp
+		round.CompletedBy = staffId
+	}
+	if err := store.AmendRoundStatus(&round, &amendment, amendedAt); err != nil {
+		return RoundAmendment{}, err
+	}
+
+	return amendment, nil
+}
+
+// Amend the observation recorded for a round member
+// A member with no observation yet is treated as a late entry once the round would have been MISSED
+func AmendObservation(store RoundsStore, roundMemberId uint, observation string, reasonCode string, note string, amendedAt time.Time) (RoundAmendment, error) {
+	if err := validateAmendmentReason(reasonCode, note); err != nil {
+		return RoundAmendment{}, err
+	}
+	if observation == "" {
+		return RoundAmendment{}, errors.New("observation is required")
+	}
+
+	roundMember, err := store.GetRoundMember(roundMemberId)
+	if err != nil {
+		panic("Failed to get round member")
+	}
+	if roundMember.ID == 0 {
+		return RoundAmendment{}, fmt.Errorf("round member %d not found", roundMemberId)
+	}
+	if roundMember.Observation == observation {
+		return RoundAmendment{}, fmt.Errorf("observation is already %q", observation)
+	}
+
+	round, err := store.GetRound(roundMember.RoundId)
+	if err != nil {
+		panic("Failed to get round")
+	}
+	roundTime, _ := time.Parse(time.RFC3339, round.RoundTimestamp)
+
+	// The clinical time of the observation stays the round time, not the time it was charted
+	observedAt := roundMember.ObservedAt
+	if observedAt == "" {
+		observedAt = round.RoundTimestamp
+	}
+
+	amendment := RoundAmendment{
+		RoundId:       round.ID,
+		RoundMemberId: roundMember.ID,
+		Field:         "observation",
+		OriginalValue: roundMember.Observation,
+		AmendedValue:  observation,
+		ReasonCode:    reasonCode,
+		Note:          note,
+		LateEntry:     roundMember.Observation == "" && amendedAt.Sub(roundTime) >= missedRoundAfter,
+		AmendedAt:     amendedAt.UTC().Format(time.RFC3339),
+	}
+
+	roundMember.Observation = observation
+	roundMember.ObservedAt = observedAt
+	if err := store.AmendRoundMemberObservation(&roundMember, &amendment); err != nil {
+		return RoundAmendment{}, err
+	}
+
+	return amendment, nil
+}
+
+// A status change is a late entry if the round was never completed and is being charted after it would have been MISSED
+func isLateEntry(originalStatus string, roundTime time.Time, amendedAt time.Time) bool {
+	if originalStatus == "COMPLETE" {
+		return false
+	}
+	return amendedAt.Sub(roundTime) >= missedRoundAfter
+}
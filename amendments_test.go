@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAmendRoundStatus(t *testing.T) {
+	tests := []struct {
+		name                string
+		existingRounds      []Round
+		roundTime           time.Time
+		status              string
+		reasonCode          string
+		note                string
+		amendedAt           time.Time
+		expectError         bool
+		expectedOriginal    string
+		expectedLateEntry   bool
+		expectedRoundStatus string
+	}{
+		{
+			name: "Correct a COMPLETE round - keeps the original status",
+			existingRounds: []Round{
+				{
+					ID:             1,
+					RoundTimestamp: "2022-01-10T09:00:00Z",
+					Status:         "COMPLETE",
+				},
+			},
+			roundTime:           time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC),
+			status:              "MISSED",
+			reasonCode:          "DOCUMENTATION_ERROR",
+			amendedAt:           time.Date(2022, time.January, 10, 11, 0, 0, 0, time.UTC),
+			expectedOriginal:    "COMPLETE",
+			expectedLateEntry:   false,
+			expectedRoundStatus: "MISSED",
+		},
+		{
+			name:                "Document a MISSED round late - creates the round and flags a late entry",
+			existingRounds:      []Round{},
+			roundTime:           time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC),
+			status:              "COMPLETE",
+			reasonCode:          "DEVICE_DOWNTIME",
+			amendedAt:           time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC),
+			expectedOriginal:    "MISSED",
+			expectedLateEntry:   true,
+			expectedRoundStatus: "COMPLETE",
+		},
+		{
+			name:           "Unknown reason code is rejected",
+			existingRounds: []Round{},
+			roundTime:      time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC),
+			status:         "COMPLETE",
+			reasonCode:     "FORGOT",
+			amendedAt:      time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC),
+			expectError:    true,
+		},
+		{
+			name:           "OTHER reason code requires a note",
+			existingRounds: []Round{},
+			roundTime:      time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC),
+			status:         "COMPLETE",
+			reasonCode:     "OTHER",
+			amendedAt:      time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC),
+			expectError:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		db := setupDatabase()
+		setupRoundConfigs(db)
+
+		// Create existing rounds
+		for _, round := range tt.existingRounds {
+			db.Create(&round)
+		}
+
+		amendment, err := AmendRoundStatus(NewGormRoundsStore(db), tt.roundTime, tt.status, tt.reasonCode, tt.note, "nurseA", tt.amendedAt)
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("%s: expected an error, got none", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: AmendRoundStatus failed: %v", tt.name, err)
+		}
+
+		if amendment.OriginalValue != tt.expectedOriginal {
+			t.Errorf("%s: expected original value %v, got %v", tt.name, tt.expectedOriginal, amendment.OriginalValue)
+		}
+		if amendment.LateEntry != tt.expectedLateEntry {
+			t.Errorf("%s: expected late entry %v, got %v", tt.name, tt.expectedLateEntry, amendment.LateEntry)
+		}
+		if amendment.AmendedAt != tt.amendedAt.Format(time.RFC3339) {
+			t.Errorf("%s: expected amended at %v, got %v", tt.name, tt.amendedAt.Format(time.RFC3339), amendment.AmendedAt)
+		}
+
+		// The round keeps its clinical timestamp and takes the amended status
+		round, _ := getRoundForTime(db, tt.roundTime)
+		if round.Status != tt.expectedRoundStatus {
+			t.Errorf("%s: expected round status %v, got %v", tt.name, tt.expectedRoundStatus, round.Status)
+		}
+	}
+}
+
+func TestAmendRoundStatusCreatesScheduledRound(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	amendedAt := time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC)
+	CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC))
+	var before int64
+	db.Model(&Round{}).Count(&before)
+
+	// Only times on the schedule, and not after the amendment, can be documented
+	if _, err := AmendRoundStatus(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 9, 7, 0, 0, time.UTC), "COMPLETE", "LATE_ENTRY", "", "nurseA", amendedAt); err == nil {
+		t.Errorf("Expected an error amending a round that isn't on the schedule")
+	}
+	if _, err := AmendRoundStatus(NewGormRoundsStore(db), time.Date(2030, time.January, 10, 9, 0, 0, 0, time.UTC), "COMPLETE", "LATE_ENTRY", "", "nurseA", amendedAt); !errors.Is(err, errRoundInFuture) {
+		t.Errorf("Expected errRoundInFuture amending a round in the future, got %v", err)
+	}
+	if _, err := AmendRoundStatus(NewGormRoundsStore(db), roundTime, "COMPLETE", "LATE_ENTRY", "", "", amendedAt); err == nil {
+		t.Errorf("Expected an error amending without a staff id")
+	}
+	var count int64
+	db.Model(&Round{}).Count(&count)
+	if count != before {
+		t.Errorf("Expected no rounds to be created by rejected amendments, got %d more", count-before)
+	}
+
+	// A round documented late gets its round types and members, and is completed by the staff member at the round time
+	if _, err := AmendRoundStatus(NewGormRoundsStore(db), roundTime, "COMPLETE", "LATE_ENTRY", "", "nurseA", amendedAt); err != nil {
+		t.Fatalf("AmendRoundStatus failed: %v", err)
+	}
+	round, _ := getRoundForTime(db, roundTime)
+	if round.StartedAt != "2022-01-10T09:00:00Z" || round.StartedBy != "nurseA" || round.CompletedAt != "2022-01-10T09:00:00Z" || round.CompletedBy != "nurseA" {
+		t.Errorf("Expected the round to be started and completed by nurseA at 9:00, got %+v", round)
+	}
+	var roundTypes int64
+	db.Model(&RoundRoundType{}).Where("round_id = ?", round.ID).Count(&roundTypes)
+	if roundTypes != 3 {
+		t.Errorf("Expected the round to have 3 round types, got %d", roundTypes)
+	}
+	roundMembers, _ := getRoundMembersForRound(db, round.ID)
+	if len(roundMembers) == 0 {
+		t.Errorf("Expected the round to have members")
+	}
+}
+
+func TestAmendObservation(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+
+	db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T09:00:00Z", Status: "COMPLETE"})
+	db.Create(&RoundMember{ID: 1, RoundId: 1, PatientId: "patient1", Observation: "SLEEPING", ObservedAt: "2022-01-10T09:02:00Z"})
+	db.Create(&RoundMember{ID: 2, RoundId: 1, PatientId: "patient2"})
+
+	// Correcting an existing observation keeps the original and the clinical time
+	amendment, err := AmendObservation(NewGormRoundsStore(db), 1, "AWAKE", "DOCUMENTATION_ERROR", "", time.Date(2022, time.January, 10, 9, 10, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("AmendObservation failed: %v", err)
+	}
+	if amendment.OriginalValue != "SLEEPING" || amendment.LateEntry {
+		t.Errorf("Expected a non-late amendment of SLEEPING, got %+v", amendment)
+	}
+	roundMember, _ := getRoundMember(db, 1)
+	if roundMember.Observation != "AWAKE" || roundMember.ObservedAt != "2022-01-10T09:02:00Z" {
+		t.Errorf("Expected AWAKE observed at 2022-01-10T09:02:00Z, got %v at %v", roundMember.Observation, roundMember.ObservedAt)
+	}
+
+	// Charting a blank observation after the round would have been MISSED is a late entry
+	amendment, err = AmendObservation(NewGormRoundsStore(db), 2, "AWAKE", "LATE_ENTRY", "", time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("AmendObservation failed: %v", err)
+	}
+	if !amendment.LateEntry {
+		t.Errorf("Expected a late entry, got %+v", amendment)
+	}
+	roundMember, _ = getRoundMember(db, 2)
+	if roundMember.ObservedAt != "2022-01-10T09:00:00Z" {
+		t.Errorf("Expected late entry to be observed at the round time, got %v", roundMember.ObservedAt)
+	}
+}
+
+func TestStartRoundsShowsAmendments(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+
+	db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T08:30:00Z", Status: "COMPLETE"})
+
+	// Correct the 8:30 round, and chart the 8:45 round late
+	if _, err := AmendRoundStatus(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 8, 30, 0, 0, time.UTC), "MISSED", "DOCUMENTATION_ERROR", "", "nurseA", time.Date(2022, time.January, 10, 8, 40, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("AmendRoundStatus failed: %v", err)
+	}
+	if _, err := AmendRoundStatus(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 8, 45, 0, 0, time.UTC), "COMPLETE", "LATE_ENTRY", "", "nurseA", time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("AmendRoundStatus failed: %v", err)
+	}
+
+	startRoundsItems, err := StartRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 8, 30, 0, 0, time.UTC), time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("StartRounds failed: %v", err)
+	}
+
+	expectedRounds := []StartRoundsItem{
+		{RoundTimestamp: "2022-01-10T08:30:00Z", Status: "MISSED", Amended: true},
+		{RoundTimestamp: "2022-01-10T08:45:00Z", Status: "COMPLETE", LateCharted: true},
+		{RoundTimestamp: "2022-01-10T09:00:00Z", Status: "MISSED"},
+		{RoundTimestamp: "2022-01-10T09:15:00Z", Status: "NOT_STARTED"},
+		{RoundTimestamp: "2022-01-10T09:30:00Z", Status: "NOT_STARTED"},
+	}
+	if len(startRoundsItems) != len(expectedRounds) {
+		t.Fatalf("Expected %v rounds, got %v", len(expectedRounds), len(startRoundsItems))
+	}
+	for i, expectedRound := range expectedRounds {
+		if startRoundsItems[i] != expectedRound {
+			t.Errorf("Expected %+v, got %+v", expectedRound, startRoundsItems[i])
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Get the round type ids that are assigned to patients on admission to a unit
+// An empty unit returns nothing, since the patient is not on any unit
+func admissionRoundTypesForUnit(db *gorm.DB, unit string) (map[uint]bool, error) {
+	roundTypeIds := make(map[uint]bool)
+	if unit == "" {
+		return roundTypeIds, nil
+	}
+
+	roundConfigs, err := getRoundConfigs(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, roundConfig := range roundConfigs {
+		if roundConfig.Enabled && roundConfig.AssignOnAdmit && (roundConfig.Unit == "" || roundConfig.Unit == unit) {
+			roundTypeIds[roundConfig.RoundTypeId] = true
+		}
+	}
+	return roundTypeIds, nil
+}
+
+// Bring a patient's open assignments in line with their move from oldUnit to newUnit
+// Round types that came with the old unit are ended and the new unit's are opened
+// Assignments that were made by hand (e.g. a 15 minute round for a high risk patient) are left alone
+func syncAdmissionAssignments(db *gorm.DB, patientId string, oldUnit string, newUnit string, at time.Time) error {
+	oldRoundTypeIds, err := admissionRoundTypesForUnit(db, oldUnit)
+	if err != nil {
+		return err
+	}
+	newRoundTypeIds, err := admissionRoundTypesForUnit(db, newUnit)
+	if err != nil {
+		return err
+	}
+
+	openAssignments, err := getOpenRoundAssignmentsForPatient(db, patientId)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// End the old unit's round types that the new unit doesn't have
+		assigned := make(map[uint]bool)
+		for _, roundAssignment := range openAssignments {
+			if oldRoundTypeIds[roundAssignment.RoundTypeId] && !newRoundTypeIds[roundAssignment.RoundTypeId] {
+				err := tx.Model(&roundAssignment).Update("effective_to", at.UTC().Format(time.RFC3339)).Error
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			assigned[roundAssignment.RoundTypeId] = true
+		}
+
+		// Open the new unit's round types that the patient doesn't already have
+		for roundTypeId := range newRoundTypeIds {
+			if assigned[roundTypeId] {
+				continue
+			}
+			err := tx.Create(&RoundAssignment{
+				RoundTypeId:   roundTypeId,
+				PatientId:     patientId,
+				EffectiveFrom: at.UTC().Format(time.RFC3339),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// End all of a patient's open round assignments, e.g. on discharge
+func EndRoundAssignments(db *gorm.DB, patientId string, at time.Time) error {
+	return db.Model(&RoundAssignment{}).
+		Where("patient_id = ? AND (effective_to IS NULL OR effective_to = '')", patientId).
+		Update("effective_to", at.UTC().Format(time.RFC3339)).Error
+}
+
+// Assign a round type to a patient from a given time. A zero to leaves the assignment open
+func AssignRoundType(db *gorm.DB, patientId string, roundTypeId uint, from time.Time, to time.Time) (RoundAssignment, error) {
+	if patientId == "" {
+		return RoundAssignment{}, errors.New("patient id is required")
+	}
+	if !to.IsZero() && !to.After(from) {
+		return RoundAssignment{}, fmt.Errorf("assignment must end after it starts at %s", from.UTC().Format(time.RFC3339))
+	}
+	roundType, err := getRoundType(db, roundTypeId)
+	if err != nil {
+		panic("Failed to get round type")
+	}
+	if roundType.ID == 0 {
+		return RoundAssignment{}, fmt.Errorf("round type %d not found", roundTypeId)
+	}
+
+	roundAssignment := RoundAssignment{
+		RoundTypeId:   roundTypeId,
+		PatientId:     patientId,
+		EffectiveFrom: from.UTC().Format(time.RFC3339),
+	}
+	if !to.IsZero() {
+		roundAssignment.EffectiveTo = to.UTC().Format(time.RFC3339)
+	}
+	err = db.Create(&roundAssignment).Error
+	return roundAssignment, err
+}
+
+// End a single round assignment at a given time, e.g. when a 15 minute round is no longer needed
+// An assignment that already ended can be brought forward but not extended
+func EndRoundAssignment(db *gorm.DB, roundAssignmentId uint, at time.Time) (RoundAssignment, error) {
+	roundAssignment, err := getRoundAssignment(db, roundAssignmentId)
+	if err != nil {
+		panic("Failed to get round assignment")
+	}
+	if roundAssignment.ID == 0 {
+		return roundAssignment, fmt.Errorf("round assignment %d not found", roundAssignmentId)
+	}
+
+	effectiveTo := at.UTC().Format(time.RFC3339)
+	if roundAssignment.EffectiveTo != "" && roundAssignment.EffectiveTo <= effectiveTo {
+		return roundAssignment, fmt.Errorf("round assignment %d already ended at %s", roundAssignmentId, roundAssignment.EffectiveTo)
+	}
+	if effectiveTo <= roundAssignment.EffectiveFrom {
+		return roundAssignment, fmt.Errorf("round assignment %d starts at %s, after %s", roundAssignmentId, roundAssignment.EffectiveFrom, effectiveTo)
+	}
+
+	roundAssignment.EffectiveTo = effectiveTo
+	err = db.Model(&roundAssignment).Update("effective_to", roundAssignment.EffectiveTo).Error
+	return roundAssignment, err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Admit a patient to a unit and bed
+// The patient record is created on first admission and reused on readmission
+func AdmitPatient(db *gorm.DB, patientId string, name string, unit string, bed string, at time.Time) (Patient, error) {
+	patient, err := getPatient(db, patientId)
+	if err != nil {
+		panic("Failed to get patient")
+	}
+	if patient.ID != 0 && patient.CensusStatus != "DISCHARGED" {
+		return patient, fmt.Errorf("patient %s is already admitted", patientId)
+	}
+
+	patient.PatientId = patientId
+	if name != "" {
+		patient.Name = name
+	}
+	return patient, recordCensusEvent(db, &patient, "ADMITTED", unit, bed, at)
+}
+
+// Move an admitted patient to a new unit and bed
+func TransferPatient(db *gorm.DB, patientId string, unit string, bed string, at time.Time) (Patient, error) {
+	patient, err := getAdmittedPatient(db, patientId)
+	if err != nil {
+		return patient, err
+	}
+	return patient, recordCensusEvent(db, &patient, patient.CensusStatus, unit, bed, at)
+}
+
+// Put an admitted patient on leave of absence. They keep their unit and bed
+func StartLeaveOfAbsence(db *gorm.DB, patientId string, at time.Time) (Patient, error) {
+	patient, err := getAdmittedPatient(db, patientId)
+	if err != nil {
+		return patient, err
+	}
+	if patient.CensusStatus == "ON_LEAVE" {
+		return patient, fmt.Errorf("patient %s is already on leave", patientId)
+	}
+	return patient, recordCensusEvent(db, &patient, "ON_LEAVE", patient.Unit, patient.Bed, at)
+}
+
+// Bring a patient back from leave of absence
+func ReturnFromLeave(db *gorm.DB, patientId string, at time.Time) (Patient, error) {
+	patient, err := getAdmittedPatient(db, patientId)
+	if err != nil {
+		return patient, err
+	}
+	if patient.CensusStatus != "ON_LEAVE" {
+		return patient, fmt.Errorf("patient %s is not on leave", patientId)
+	}
+	return patient, recordCensusEvent(db, &patient, "ADMITTED", patient.Unit, patient.Bed, at)
+}
+
+// Discharge a patient. They are no longer added to rounds from this time on
+func DischargePatient(db *gorm.DB, patientId string, at time.Time) (Patient, error) {
+	patient, err := getAdmittedPatient(db, patientId)
+	if err != nil {
+		return patient, err
+	}
+	return patient, recordCensusEvent(db, &patient, "DISCHARGED", "", "", at)
+}
+
+// Get a patient that is currently admitted or on leave
+func getAdmittedPatient(db *gorm.DB, patientId string) (Patient, error) {
+	patient, err := getPatient(db, patientId)
+	if err != nil {
+		panic("Failed to get patient")
+	}
+	if patient.ID == 0 {
+		return patient, fmt.Errorf("patient %s not found", patientId)
+	}
+	if patient.CensusStatus == "DISCHARGED" {
+		return patient, fmt.Errorf("patient %s is discharged", patientId)
+	}
+	return patient, nil
+}
+
+// Save the patient's new census state and keep a history entry for it
+func recordCensusEvent(db *gorm.DB, patient *Patient, censusStatus string, unit string, bed string, at time.Time) error {
+	patient.CensusStatus = censusStatus
+	patient.Unit = unit
+	patient.Bed = bed
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(patient).Error; err != nil {
+			return err
+		}
+		return tx.Create(&PatientCensusEvent{
+			PatientId:    patient.PatientId,
+			CensusStatus: censusStatus,
+			Unit:         unit,
+			Bed:          bed,
+			EffectiveAt:  at.UTC().Format(time.RFC3339),
+		}).Error
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCreateRoundsUsesPatientCensus(t *testing.T) {
+	tests := []struct {
+		name            string
+		unitForType3    string
+		expectedMembers map[string]string
+	}{
+		{
+			name:         "Clinic-wide configs - discharged patients are left out and LOA patients are marked",
+			unitForType3: "",
+			expectedMembers: map[string]string{
+				"2022-01-10T08:45:00Z": "patient1:",
+				"2022-01-10T09:00:00Z": "patient1:,patient2:LEAVE_OF_ABSENCE",
+				"2022-01-10T09:15:00Z": "patient1:",
+				"2022-01-10T09:30:00Z": "patient1:,patient2:,patient4:",
+			},
+		},
+		{
+			name:         "60 minute rounds scoped to unit A - patient 4 on unit B is off-unit",
+			unitForType3: "A",
+			expectedMembers: map[string]string{
+				"2022-01-10T08:45:00Z": "patient1:",
+				"2022-01-10T09:00:00Z": "patient1:,patient2:LEAVE_OF_ABSENCE",
+				"2022-01-10T09:15:00Z": "patient1:",
+				"2022-01-10T09:30:00Z": "patient1:,patient2:",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		db := setupDatabase()
+		setupRoundConfigs(db)
+		db.Model(&RoundConfig{}).Where("round_type_id = ?", 3).Update("unit", tt.unitForType3)
+
+		// Existing round from 60 minutes ago, so rounds are backfilled for the last hour
+		db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T08:30:00Z", Status: "CREATED"})
+		for _, roundTypeId := range []uint{1, 2, 3} {
+			db.Create(&RoundRoundType{RoundID: 1, RoundTypeID: roundTypeId})
+		}
+
+		// Patient 1 stays on unit A the whole time
+		AdmitPatient(db, "patient1", "Patient One", "A", "101", time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC))
+		// Patient 2 goes on leave at 8:50 and comes back at 9:10
+		AdmitPatient(db, "patient2", "Patient Two", "A", "102", time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC))
+		StartLeaveOfAbsence(db, "patient2", time.Date(2022, time.January, 10, 8, 50, 0, 0, time.UTC))
+		ReturnFromLeave(db, "patient2", time.Date(2022, time.January, 10, 9, 10, 0, 0, time.UTC))
+		// Patient 3 is discharged at 9:05
+		AdmitPatient(db, "patient3", "Patient Three", "A", "103", time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC))
+		DischargePatient(db, "patient3", time.Date(2022, time.January, 10, 9, 5, 0, 0, time.UTC))
+		// Patient 4 is on unit B with 60 minute rounds
+		AdmitPatient(db, "patient4", "Patient Four", "B", "201", time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC))
+		db.Create(&RoundAssignment{RoundTypeId: 3, PatientId: "patient4"})
+
+		CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC))
+
+		var roundsWithMembers []*RoundWithTypesAndMembers
+		db.Table("rounds").
+			Select("rounds.id, round_timestamp, group_concat(member) as round_members").
+			Joins("JOIN (SELECT round_id, patient_id || ':' || status AS member FROM round_members ORDER BY patient_id) m ON rounds.id = m.round_id").
+			Where("rounds.id > 1").
+			Group("rounds.id, round_timestamp").
+			Scan(&roundsWithMembers)
+
+		if len(roundsWithMembers) != len(tt.expectedMembers) {
+			t.Fatalf("%s: expected %d rounds, got %d", tt.name, len(tt.expectedMembers), len(roundsWithMembers))
+		}
+		for _, round := range roundsWithMembers {
+			if round.RoundMembers != tt.expectedMembers[round.RoundTimestamp] {
+				t.Errorf("%s: expected members %v at %v, got %v", tt.name, tt.expectedMembers[round.RoundTimestamp], round.RoundTimestamp, round.RoundMembers)
+			}
+		}
+	}
+}
+
+func TestCensusTransitions(t *testing.T) {
+	db := setupDatabase()
+	at := time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC)
+
+	if _, err := StartLeaveOfAbsence(db, "patient1", at); err == nil {
+		t.Errorf("Expected an error putting an unknown patient on leave")
+	}
+	if _, err := AdmitPatient(db, "patient1", "Patient One", "A", "101", at); err != nil {
+		t.Fatalf("AdmitPatient failed: %v", err)
+	}
+	if _, err := AdmitPatient(db, "patient1", "Patient One", "A", "101", at); err == nil {
+		t.Errorf("Expected an error admitting an admitted patient")
+	}
+	if _, err := ReturnFromLeave(db, "patient1", at); err == nil {
+		t.Errorf("Expected an error returning a patient who is not on leave")
+	}
+
+	patient, err := TransferPatient(db, "patient1", "B", "201", at.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("TransferPatient failed: %v", err)
+	}
+	if patient.Unit != "B" || patient.Bed != "201" || patient.CensusStatus != "ADMITTED" {
+		t.Errorf("Expected patient admitted to B/201, got %+v", patient)
+	}
+
+	// The census history keeps where the patient was before the transfer
+	census, _ := getPatientCensusAtTime(db, "patient1", at.Add(30*time.Minute))
+	if census.Unit != "A" {
+		t.Errorf("Expected patient on unit A before the transfer, got %v", census.Unit)
+	}
+
+	if _, err := DischargePatient(db, "patient1", at.Add(2*time.Hour)); err != nil {
+		t.Fatalf("DischargePatient failed: %v", err)
+	}
+	// Readmission reuses the patient record
+	patient, err = AdmitPatient(db, "patient1", "", "C", "301", at.Add(3*time.Hour))
+	if err != nil {
+		t.Fatalf("AdmitPatient failed: %v", err)
+	}
+	if patient.Name != "Patient One" || patient.Unit != "C" {
+		t.Errorf("Expected readmitted Patient One on unit C, got %+v", patient)
+	}
+}
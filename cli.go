@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The database commands use when -db isn't given
+const defaultDatabasePath = "rounds.db"
+
+// Add the -db flag, defaulting to $ROUNDS_DB so a shell can point every command at one database
+func databaseFlag(flags *flag.FlagSet) *string {
+	dsn := os.Getenv("ROUNDS_DB")
+	if dsn == "" {
+		dsn = defaultDatabasePath
+	}
+	return flags.String("db", dsn, "path to the SQLite database, or a postgres:// URL (default $ROUNDS_DB or rounds.db)")
+}
+
+// Parse an optional RFC3339 flag value, falling back to a default when it's empty
+func parseTimeFlag(name string, value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s time %q, expected RFC3339", name, value)
+	}
+	return t.UTC(), nil
+}
+
+func writeIndentedJSON(w io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// Create rounds up to a given time, as the scheduler does, and print how many were created
+func runCreateRounds(args []string) {
+	flags := flag.NewFlagSet("create-rounds", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	at := flags.String("at", "", "create rounds up to this time, RFC3339 (default now)")
+	flags.Parse(args)
+
+	currTime, err := parseTimeFlag("at", *at, time.Now().UTC())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	db := mustOpenDatabase(*dbPath)
+	created, err := createRoundsAt(db, currTime)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("created %d rounds up to %s\n", created, currTime.Format(time.RFC3339))
+}
+
+// Run CreateRounds and count the rounds it added
+func createRoundsAt(db *gorm.DB, currTime time.Time) (int64, error) {
+	var before, after int64
+	if err := db.Model(&Round{}).Count(&before).Error; err != nil {
+		return 0, err
+	}
+	CreateRounds(NewGormRoundsStore(db), currTime)
+	if err := db.Model(&Round{}).Count(&after).Error; err != nil {
+		return 0, err
+	}
+	return after - before, nil
+}
+
+// Print the start rounds board for a time window as a table or JSON
+func runStartRounds(args []string) {
+	flags := flag.NewFlagSet("start-rounds", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	start := flags.String("start", "", "start of the window, RFC3339 (default 12 hours before end)")
+	end := flags.String("end", "", "end of the window, RFC3339 (default now)")
+	format := flags.String("format", "table", "table or json")
+	tz := flags.String("tz", "UTC", "IANA time zone for round times in the table")
+	flags.Parse(args)
+
+	startTime, endTime, err := parseTimeWindow(*start, *end, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid format %q, expected table or json\n", *format)
+		os.Exit(2)
+	}
+	location, err := time.LoadLocation(*tz)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid tz %q\n", *tz)
+		os.Exit(2)
+	}
+
+	db := mustOpenDatabase(*dbPath)
+	items, err := StartRounds(NewGormRoundsStore(db), startTime, endTime)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *format == "json" {
+		err = writeIndentedJSON(os.Stdout, items)
+	} else {
+		err = writeStartRoundsTable(os.Stdout, items, location)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// One line per round with its time in the given location, flagging amended and late charted rounds
+func writeStartRoundsTable(w io.Writer, items []StartRoundsItem, location *time.Location) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ROUND TIME\tSTATUS\tAMENDED\tLATE CHARTED")
+	for _, item := range items {
+		roundTime := item.RoundTimestamp
+		if t, err := time.Parse(time.RFC3339, item.RoundTimestamp); err == nil {
+			roundTime = t.In(location).Format("2006-01-02 15:04 MST")
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", roundTime, item.Status, yesOrBlank(item.Amended), yesOrBlank(item.LateCharted))
+	}
+	return table.Flush()
+}
+
+func yesOrBlank(value bool) string {
+	if value {
+		return "yes"
+	}
+	return ""
+}
+
+// Seed an empty database with demo round types, configs and assignments
+func runSeed(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	flags.Parse(args)
+
+	db := mustOpenDatabase(*dbPath)
+	seeded, err := SeedDemoData(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !seeded {
+		fmt.Println("database already has round types, nothing seeded")
+		return
+	}
+	fmt.Println("seeded 15, 30 and 60 minute round types for patient1, patient2 and patient3")
+}
+
+// Add a round type with -name, or list the round types
+func runRoundTypes(args []string) {
+	flags := flag.NewFlagSet("round-types", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	name := flags.String("name", "", "name of a round type to add (default list the round types)")
+	minutes := flags.Int("minutes", 0, "how often rounds of the new type happen, in minutes")
+	flags.Parse(args)
+
+	db := mustOpenDatabase(*dbPath)
+	var output interface{}
+	var err error
+	if *name == "" {
+		var roundTypes []RoundType
+		err = db.Order("id").Find(&roundTypes).Error
+		output = roundTypes
+	} else {
+		output, err = AddRoundType(db, RoundType{Name: *name, DurationAmt: *minutes, DurationUnit: "minutes"})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	writeIndentedJSON(os.Stdout, output)
+}
+
+// Add a round config with -round-type, turn one on or off with -enable or -disable, or list the round configs
+func runRoundConfigs(args []string) {
+	flags := flag.NewFlagSet("round-configs", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	roundTypeId := flags.Uint("round-type", 0, "id of the round type to add a config for (default list the round configs)")
+	unit := flags.String("unit", "", "unit the new config applies to (default the whole clinic)")
+	assignOnAdmit := flags.Bool("assign-on-admit", false, "assign the round type to patients admitted or transferred to the unit")
+	disabled := flags.Bool("disabled", false, "add the config turned off")
+	windowStart := flags.String("window-start", "", "time of day the new config's rounds start, HH:MM in UTC (default all day)")
+	windowEnd := flags.String("window-end", "", "time of day the new config's rounds stop, HH:MM in UTC, before the start to run overnight")
+	enable := flags.Uint("enable", 0, "id of a round config to turn on")
+	disable := flags.Uint("disable", 0, "id of a round config to turn off")
+	flags.Parse(args)
+
+	db := mustOpenDatabase(*dbPath)
+	var output interface{}
+	var err error
+	switch {
+	case *enable != 0:
+		output, err = SetRoundConfigEnabled(db, *enable, true)
+	case *disable != 0:
+		output, err = SetRoundConfigEnabled(db, *disable, false)
+	case *roundTypeId != 0:
+		output, err = AddRoundConfig(db, RoundConfig{
+			RoundTypeId:   *roundTypeId,
+			Enabled:       !*disabled,
+			Unit:          *unit,
+			AssignOnAdmit: *assignOnAdmit,
+			WindowStart:   *windowStart,
+			WindowEnd:     *windowEnd,
+		})
+	default:
+		var roundConfigs []RoundConfig
+		err = db.Order("id").Find(&roundConfigs).Error
+		output = roundConfigs
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	writeIndentedJSON(os.Stdout, output)
+}
+
+// Assign a round type to a patient with -round-type, end an assignment with -end, or list a patient's assignments
+func runAssignments(args []string) {
+	flags := flag.NewFlagSet("assignments", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	patientId := flags.String("patient", "", "patient to assign or list (default list every assignment)")
+	roundTypeId := flags.Uint("round-type", 0, "id of the round type to assign to the patient")
+	from := flags.String("from", "", "when the assignment starts, RFC3339 (default now)")
+	to := flags.String("to", "", "when the assignment ends, RFC3339 (default open ended)")
+	end := flags.Uint("end", 0, "id of an assignment to end instead of adding one")
+	at := flags.String("at", "", "when to end the assignment, RFC3339 (default now)")
+	flags.Parse(args)
+
+	now := time.Now().UTC()
+	times := make(map[string]time.Time)
+	for _, value := range []struct {
+		name     string
+		value    string
+		fallback time.Time
+	}{
+		{"from", *from, now},
+		{"to", *to, time.Time{}},
+		{"at", *at, now},
+	} {
+		t, err := parseTimeFlag(value.name, value.value, value.fallback)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		times[value.name] = t
+	}
+
+	db := mustOpenDatabase(*dbPath)
+	var output interface{}
+	var err error
+	switch {
+	case *end != 0:
+		output, err = EndRoundAssignment(db, *end, times["at"])
+	case *roundTypeId != 0:
+		output, err = AssignRoundType(db, *patientId, *roundTypeId, times["from"], times["to"])
+	default:
+		query := db.Order("id")
+		if *patientId != "" {
+			query = query.Where("patient_id = ?", *patientId)
+		}
+		var roundAssignments []RoundAssignment
+		err = query.Find(&roundAssignments).Error
+		output = roundAssignments
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	writeIndentedJSON(os.Stdout, output)
+}
+
+// Read and parse the clinic config file a command was given, exiting if it can't be used
+func mustReadClinicConfig(path string) ClinicConfig {
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "-file is required")
+		os.Exit(2)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	config, err := ParseClinicConfig(path, file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return config
+}
+
+// Check a clinic config file without touching a database
+func runValidateConfig(args []string) {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	path := flags.String("file", "", "YAML or JSON clinic config to check")
+	flags.Parse(args)
+
+	config := mustReadClinicConfig(*path)
+	if err := ValidateClinicConfig(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	fmt.Printf("%s is valid: %d round types, %d round configs, %d assignments\n",
+		*path, len(config.RoundTypes), len(config.RoundConfigs), len(config.Assignments))
+}
+
+// Apply a clinic config file to the database and print what changed, or what would change with -dry-run
+func runApplyConfig(args []string) {
+	flags := flag.NewFlagSet("apply-config", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	path := flags.String("file", "", "YAML or JSON clinic config to apply")
+	dryRun := flags.Bool("dry-run", false, "print the changes without making them")
+	flags.Parse(args)
+
+	config := mustReadClinicConfig(*path)
+	if err := ValidateClinicConfig(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	db := mustOpenDatabase(*dbPath)
+	changes, err := ApplyClinicConfig(db, config, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	applied, drift := 0, 0
+	for _, change := range changes {
+		fmt.Println(change)
+		if change.Action == "drift" {
+			drift++
+		} else {
+			applied++
+		}
+	}
+	switch {
+	case len(changes) == 0:
+		fmt.Println("database already matches the config")
+	case applied == 0:
+		fmt.Println("nothing to apply")
+	case *dryRun:
+		fmt.Printf("dry run, %d changes not applied\n", applied)
+	default:
+		fmt.Printf("applied %d changes\n", applied)
+	}
+	if drift > 0 {
+		fmt.Printf("%d rows in the database are not in the config and were left alone\n", drift)
+	}
+}
+
+// Replay a clinic config file on a virtual clock with synthetic staff, on a scratch database, and print the timeline
+// and compliance. Nothing is written to the real database
+func runSimulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	path := flags.String("file", "", "YAML or JSON clinic config to simulate")
+	start := flags.String("start", "", "start of the simulation, RFC3339 (default 24 hours before end)")
+	end := flags.String("end", "", "end of the simulation, RFC3339 (default the start of the current hour)")
+	step := flags.Duration("step", 5*time.Minute, "how far the virtual clock moves each step")
+	lateRate := flags.Float64("late-rate", 0.1, "fraction of rounds staff start late")
+	skipRate := flags.Float64("skip-rate", 0.05, "fraction of rounds staff never start")
+	maxLateness := flags.Duration("max-lateness", missedRoundAfter, "latest a late round is started after its round time")
+	staff := flags.String("staff", "staff1", "comma separated staff ids who take rounds in turn")
+	seed := flags.Int64("seed", 1, "seed for staff behavior, the same seed replays the same behavior")
+	format := flags.String("format", "text", "text or json")
+	tz := flags.String("tz", "UTC", "IANA time zone for times in the text output")
+	flags.Parse(args)
+
+	endTime, err := parseTimeFlag("end", *end, time.Now().UTC().Truncate(time.Hour))
+	if err == nil && *start == "" {
+		*start = endTime.Add(-24 * time.Hour).Format(time.RFC3339)
+	}
+	startTime, startErr := parseTimeFlag("start", *start, time.Time{})
+	if err = errors.Join(err, startErr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid format %q, expected text or json\n", *format)
+		os.Exit(2)
+	}
+	location, err := time.LoadLocation(*tz)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid tz %q\n", *tz)
+		os.Exit(2)
+	}
+
+	options := SimulationOptions{
+		Config:    mustReadClinicConfig(*path),
+		StartTime: startTime,
+		EndTime:   endTime,
+		Step:      *step,
+		Behavior: StaffBehavior{
+			LateRate:    *lateRate,
+			SkipRate:    *skipRate,
+			MaxLateness: *maxLateness,
+			Staff:       strings.Split(*staff, ","),
+			Seed:        *seed,
+		},
+	}
+	if err := validateSimulationOptions(&options); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	dir, err := os.MkdirTemp("", "rounds-simulation")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	db, err := openDatabase(filepath.Join(dir, "simulation.db"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	db.Logger = db.Logger.LogMode(logger.Silent)
+
+	result, err := RunSimulation(db, options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *format == "json" {
+		err = writeIndentedJSON(os.Stdout, result)
+	} else {
+		err = writeSimulationText(os.Stdout, result, location)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// The timeline, one event per line, then compliance overall and per round type
+func writeSimulationText(w io.Writer, result SimulationResult, location *time.Location) error {
+	localTime := func(value string) string {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t.In(location).Format("2006-01-02 15:04")
+		}
+		return value
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "AT\tROUND\tEVENT\tDETAIL")
+	for _, event := range result.Timeline {
+		detail := event.StaffId
+		if event.Event == "CREATED" {
+			detail = fmt.Sprintf("%d patients", event.Patients)
+			if event.Patients == 1 {
+				detail = "1 patient"
+			}
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", localTime(event.At), localTime(event.RoundTimestamp), event.Event, detail)
+	}
+	fmt.Fprintln(table)
+
+	fmt.Fprintln(table, "ROUNDS\tTOTAL\tON TIME\tLATE\tMISSED\tPENDING\tMEDIAN LATENESS")
+	writeStats := func(name string, stats *ComplianceStats) {
+		fmt.Fprintf(table, "%s\t%d\t%d (%.0f%%)\t%d (%.0f%%)\t%d (%.0f%%)\t%d\t%.0fm\n", name, stats.Total,
+			stats.OnTime, 100*stats.OnTimeRate, stats.Late, 100*stats.LateRate, stats.Missed, 100*stats.MissedRate,
+			stats.Pending, stats.MedianLatenessMinutes)
+	}
+	writeStats("All", result.Report.Overall)
+	var roundTypes []string
+	for roundType := range result.Report.ByRoundType {
+		roundTypes = append(roundTypes, roundType)
+	}
+	sort.Strings(roundTypes)
+	for _, roundType := range roundTypes {
+		writeStats(roundType, result.Report.ByRoundType[roundType])
+	}
+	return table.Flush()
+}
+
+// Write to the file at path, or to stdout when path is empty
+// A file that can't be written in full is removed, so a failed command never leaves a partial export behind
+func writeOutput(path string, write func(io.Writer) error) error {
+	if path == "" {
+		return write(os.Stdout)
+	}
+	output, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDatabaseFlag(t *testing.T) {
+	t.Setenv("ROUNDS_DB", "")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	if dsn := databaseFlag(flags); *dsn != "rounds.db" {
+		t.Errorf("Expected rounds.db, got %q", *dsn)
+	}
+
+	t.Setenv("ROUNDS_DB", "/var/lib/rounds/ward.db")
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	dsn := databaseFlag(flags)
+	if *dsn != "/var/lib/rounds/ward.db" {
+		t.Errorf("Expected the database from $ROUNDS_DB, got %q", *dsn)
+	}
+	flags.Parse([]string{"-db", "other.db"})
+	if *dsn != "other.db" {
+		t.Errorf("Expected -db to win over $ROUNDS_DB, got %q", *dsn)
+	}
+}
+
+func TestWriteStartRoundsTable(t *testing.T) {
+	items := []StartRoundsItem{
+		{RoundTimestamp: "2022-01-10T09:00:00Z", Status: "COMPLETE", Amended: true},
+		{RoundTimestamp: "2022-01-10T09:15:00Z", Status: "MISSED", LateCharted: true},
+		{RoundTimestamp: "2022-01-10T09:30:00Z", Status: "NOT_STARTED"},
+	}
+	location, _ := time.LoadLocation("America/New_York")
+
+	var out bytes.Buffer
+	if err := writeStartRoundsTable(&out, items, location); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	expected := "ROUND TIME            STATUS       AMENDED  LATE CHARTED\n" +
+		"2022-01-10 04:00 EST  COMPLETE     yes      \n" +
+		"2022-01-10 04:15 EST  MISSED                yes\n" +
+		"2022-01-10 04:30 EST  NOT_STARTED           \n"
+	if out.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestParseTimeFlag(t *testing.T) {
+	fallback := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+	if parsed, err := parseTimeFlag("at", "", fallback); err != nil || !parsed.Equal(fallback) {
+		t.Errorf("Expected the fallback, got %v and %v", parsed, err)
+	}
+	if parsed, err := parseTimeFlag("at", "2022-01-10T04:30:00-05:00", time.Time{}); err != nil || !parsed.Equal(fallback) || parsed.Location() != time.UTC {
+		t.Errorf("Expected %v in UTC, got %v and %v", fallback, parsed, err)
+	}
+	if _, err := parseTimeFlag("at", "9:30", time.Time{}); err == nil {
+		t.Errorf("Expected an error for a time that isn't RFC3339")
+	}
+}
+
+func TestWriteSimulationText(t *testing.T) {
+	result := SimulationResult{
+		Timeline: []SimulationEvent{
+			{At: "2022-01-10T09:00:00Z", RoundTimestamp: "2022-01-10T09:00:00Z", Event: "CREATED", Patients: 1},
+			{At: "2022-01-10T09:04:00Z", RoundTimestamp: "2022-01-10T09:00:00Z", Event: "STARTED", StaffId: "nurse1"},
+			{At: "2022-01-10T09:45:00Z", RoundTimestamp: "2022-01-10T09:15:00Z", Event: "MISSED"},
+		},
+		Report: ComplianceReport{
+			Overall: &ComplianceStats{Total: 2, OnTime: 1, Missed: 1, OnTimeRate: 0.5, MissedRate: 0.5, MedianLatenessMinutes: 4},
+			ByRoundType: map[string]*ComplianceStats{
+				"15 Minute Round": {Total: 2, OnTime: 1, Missed: 1, OnTimeRate: 0.5, MissedRate: 0.5, MedianLatenessMinutes: 4},
+			},
+		},
+	}
+
+	var out bytes.Buffer
+	if err := writeSimulationText(&out, result, time.UTC); err != nil {
+		t.Fatalf("Failed to write simulation: %v", err)
+	}
+	expected := "AT                ROUND             EVENT    DETAIL\n" +
+		"2022-01-10 09:00  2022-01-10 09:00  CREATED  1 patient\n" +
+		"2022-01-10 09:04  2022-01-10 09:00  STARTED  nurse1\n" +
+		"2022-01-10 09:45  2022-01-10 09:15  MISSED   \n" +
+		"\n" +
+		"ROUNDS           TOTAL  ON TIME  LATE    MISSED   PENDING  MEDIAN LATENESS\n" +
+		"All              2      1 (50%)  0 (0%)  1 (50%)  0        4m\n" +
+		"15 Minute Round  2      1 (50%)  0 (0%)  1 (50%)  0        4m\n"
+	if out.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.csv")
+	err := writeOutput(path, func(output io.Writer) error {
+		_, err := io.WriteString(output, "roundTimestamp\n")
+		return err
+	})
+	if data, _ := os.ReadFile(path); err != nil || string(data) != "roundTimestamp\n" {
+		t.Errorf("Expected the file to be written, got %q and %v", data, err)
+	}
+
+	// A failed write doesn't leave a partial file behind
+	err = writeOutput(path, func(output io.Writer) error {
+		io.WriteString(output, "roundTimestamp\n2022-01-10")
+		return errors.New("database went away")
+	})
+	if err == nil {
+		t.Errorf("Expected the write error")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial file to be removed, got %v", err)
+	}
+}
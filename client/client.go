@@ -0,0 +1,372 @@
+// Package client is a typed Go client for the rounds HTTP API described in openapi.json
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// Create a client for the API at a base URL, e.g. http://localhost:8080
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+// An error response from the API
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rounds api returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Parameters for ListStartRoundItems. Zero values are left out, so the server defaults apply
+// Setting any of Statuses, RoundTypeIds, Descending, Cursor or Limit gets a page instead of the whole window
+type StartRoundItemsParams struct {
+	Start        time.Time
+	End          time.Time
+	Statuses     []string
+	RoundTypeIds []uint
+	Descending   bool
+	Cursor       string
+	Limit        int
+}
+
+// NextCursor is empty on the last page
+type StartRoundItemsPage struct {
+	Items      []StartRoundsItem
+	NextCursor string
+}
+
+func (c *Client) ListStartRoundItems(ctx context.Context, params StartRoundItemsParams) (StartRoundItemsPage, error) {
+	query := url.Values{}
+	setTime(query, "start", params.Start)
+	setTime(query, "end", params.End)
+	if len(params.Statuses) > 0 {
+		query.Set("status", strings.Join(params.Statuses, ","))
+	}
+	if len(params.RoundTypeIds) > 0 {
+		var roundTypeIds []string
+		for _, roundTypeId := range params.RoundTypeIds {
+			roundTypeIds = append(roundTypeIds, strconv.FormatUint(uint64(roundTypeId), 10))
+		}
+		query.Set("roundType", strings.Join(roundTypeIds, ","))
+	}
+	if params.Descending {
+		query.Set("order", "desc")
+	}
+	if params.Cursor != "" {
+		query.Set("cursor", params.Cursor)
+	}
+	if params.Limit != 0 {
+		query.Set("limit", strconv.Itoa(params.Limit))
+	}
+
+	var page StartRoundItemsPage
+	resp, err := c.do(ctx, http.MethodGet, "/start-round-items", query, nil)
+	if err != nil {
+		return page, err
+	}
+	defer resp.Body.Close()
+	page.NextCursor = resp.Header.Get("X-Next-Cursor")
+	return page, json.NewDecoder(resp.Body).Decode(&page.Items)
+}
+
+// Follow the live feed of board changes, calling handle for each event until the context is cancelled or handle returns an error
+// An empty lastEventId starts from now
+func (c *Client) StreamStartRoundItems(ctx context.Context, unit string, lastEventId string, handle func(RoundFeedEvent) error) error {
+	query := url.Values{}
+	if unit != "" {
+		query.Set("unit", unit)
+	}
+	if lastEventId != "" {
+		query.Set("lastEventId", lastEventId)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/start-round-items/stream", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for ctx.Err() == nil && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event RoundFeedEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return err
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
+
+func (c *Client) ExportFHIR(ctx context.Context, start time.Time, end time.Time) (FHIRBundle, error) {
+	query := url.Values{}
+	setTime(query, "start", start)
+	setTime(query, "end", end)
+	var bundle FHIRBundle
+	return bundle, c.getJSON(ctx, "/fhir/export", query, &bundle)
+}
+
+type ComplianceReportParams struct {
+	Start       time.Time
+	End         time.Time
+	Unit        string
+	RoundTypeId uint
+	TZ          string
+}
+
+func (c *Client) GetComplianceReport(ctx context.Context, params ComplianceReportParams) (ComplianceReport, error) {
+	query := url.Values{}
+	setTime(query, "start", params.Start)
+	setTime(query, "end", params.End)
+	if params.Unit != "" {
+		query.Set("unit", params.Unit)
+	}
+	if params.RoundTypeId != 0 {
+		query.Set("roundType", strconv.FormatUint(uint64(params.RoundTypeId), 10))
+	}
+	if params.TZ != "" {
+		query.Set("tz", params.TZ)
+	}
+	var report ComplianceReport
+	return report, c.getJSON(ctx, "/reports/compliance", query, &report)
+}
+
+func (c *Client) ListObservationGaps(ctx context.Context, patientId string, start time.Time, end time.Time) ([]ObservationGap, error) {
+	query := url.Values{}
+	setTime(query, "start", start)
+	setTime(query, "end", end)
+	var gaps []ObservationGap
+	return gaps, c.getJSON(ctx, "/patients/"+url.PathEscape(patientId)+"/observation-gaps", query, &gaps)
+}
+
+func (c *Client) ListObservationGapAlerts(ctx context.Context) ([]ObservationGap, error) {
+	var gaps []ObservationGap
+	return gaps, c.getJSON(ctx, "/alerts/observation-gaps", nil, &gaps)
+}
+
+type ExportParams struct {
+	Format  string
+	Start   time.Time
+	End     time.Time
+	Unit    string
+	Columns []string
+	TZ      string
+}
+
+// Download an export of a dataset. The caller closes the body
+func (c *Client) Export(ctx context.Context, dataset string, params ExportParams) (io.ReadCloser, error) {
+	query := url.Values{}
+	if params.Format != "" {
+		query.Set("format", params.Format)
+	}
+	setTime(query, "start", params.Start)
+	setTime(query, "end", params.End)
+	if params.Unit != "" {
+		query.Set("unit", params.Unit)
+	}
+	if len(params.Columns) > 0 {
+		query.Set("columns", strings.Join(params.Columns, ","))
+	}
+	if params.TZ != "" {
+		query.Set("tz", params.TZ)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/exports/"+url.PathEscape(dataset), query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+type RoundsSheetParams struct {
+	Unit  string
+	Start time.Time
+	Hours int
+	TZ    string
+}
+
+// Download the PDF rounds sheet. The caller closes the body
+func (c *Client) GetRoundsSheet(ctx context.Context, params RoundsSheetParams) (io.ReadCloser, error) {
+	query := sheetQuery(params.Unit, params.Start, params.Hours)
+	if params.TZ != "" {
+		query.Set("tz", params.TZ)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/rounds-sheet", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) SyncDownload(ctx context.Context, unit string, start time.Time, hours int) (SyncSnapshot, error) {
+	var snapshot SyncSnapshot
+	return snapshot, c.getJSON(ctx, "/sync/download", sheetQuery(unit, start, hours), &snapshot)
+}
+
+func (c *Client) SyncUpload(ctx context.Context, upload SyncUpload) ([]SyncResult, error) {
+	var response struct {
+		Results []SyncResult `json:"results"`
+	}
+	err := c.sendJSON(ctx, http.MethodPost, "/sync/upload", upload, &response)
+	return response.Results, err
+}
+
+func (c *Client) AmendRoundStatus(ctx context.Context, amendment RoundStatusAmendmentInput) (RoundAmendment, error) {
+	var created RoundAmendment
+	return created, c.sendJSON(ctx, http.MethodPost, "/round-amendments", amendment, &created)
+}
+
+func (c *Client) AmendObservation(ctx context.Context, roundMemberId uint, amendment ObservationAmendmentInput) (RoundAmendment, error) {
+	var created RoundAmendment
+	path := "/round-members/" + strconv.FormatUint(uint64(roundMemberId), 10) + "/amendments"
+	return created, c.sendJSON(ctx, http.MethodPost, path, amendment, &created)
+}
+
+func (c *Client) AddEscalationContact(ctx context.Context, contact EscalationContactInput) (EscalationContact, error) {
+	var created EscalationContact
+	return created, c.sendJSON(ctx, http.MethodPost, "/escalation-contacts", contact, &created)
+}
+
+func (c *Client) ListNotifications(ctx context.Context, staffId string, unreadOnly bool) ([]Notification, error) {
+	query := url.Values{"staff": {staffId}}
+	if unreadOnly {
+		query.Set("unread", "true")
+	}
+	var notifications []Notification
+	return notifications, c.getJSON(ctx, "/notifications", query, &notifications)
+}
+
+func (c *Client) MarkNotificationRead(ctx context.Context, notificationId uint) (Notification, error) {
+	var notification Notification
+	path := "/notifications/" + strconv.FormatUint(uint64(notificationId), 10) + "/read"
+	return notification, c.sendJSON(ctx, http.MethodPost, path, nil, &notification)
+}
+
+func (c *Client) AddWebhookSubscription(ctx context.Context, subscription WebhookSubscriptionInput) (WebhookSubscription, error) {
+	var created WebhookSubscription
+	return created, c.sendJSON(ctx, http.MethodPost, "/webhook-subscriptions", subscription, &created)
+}
+
+func (c *Client) ListWebhookDeliveries(ctx context.Context, subscriptionId uint) ([]WebhookDeliveryAttempt, error) {
+	var attempts []WebhookDeliveryAttempt
+	path := "/webhook-subscriptions/" + strconv.FormatUint(uint64(subscriptionId), 10) + "/deliveries"
+	return attempts, c.getJSON(ctx, path, nil, &attempts)
+}
+
+func (c *Client) ListWebhookDeadLetters(ctx context.Context) ([]WebhookDeadLetter, error) {
+	var deadLetters []WebhookDeadLetter
+	return deadLetters, c.getJSON(ctx, "/webhook-dead-letters", nil, &deadLetters)
+}
+
+func (c *Client) ReplayWebhookDeadLetter(ctx context.Context, deadLetterId uint) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	path := "/webhook-dead-letters/" + strconv.FormatUint(uint64(deadLetterId), 10) + "/replay"
+	return delivery, c.sendJSON(ctx, http.MethodPost, path, nil, &delivery)
+}
+
+func setTime(query url.Values, name string, t time.Time) {
+	if !t.IsZero() {
+		query.Set(name, t.Format(time.RFC3339))
+	}
+}
+
+func sheetQuery(unit string, start time.Time, hours int) url.Values {
+	query := url.Values{}
+	if unit != "" {
+		query.Set("unit", unit)
+	}
+	setTime(query, "start", start)
+	if hours != 0 {
+		query.Set("hours", strconv.Itoa(hours))
+	}
+	return query
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, out interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) sendJSON(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	resp, err := c.do(ctx, method, path, nil, reader)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Send a request, turning error responses into *Error. The caller closes the body of a successful response
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	apiError := &Error{StatusCode: resp.StatusCode}
+	var errorBody struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&errorBody); err == nil {
+		apiError.Message = errorBody.Error
+	} else {
+		apiError.Message = http.StatusText(resp.StatusCode)
+	}
+	return nil, apiError
+}
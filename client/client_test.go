@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestListStartRoundItemsQuery(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Header().Set("X-Next-Cursor", "2022-01-10T09:00:00Z")
+		w.Write([]byte(`[{"roundTimestamp": "2022-01-10T09:00:00Z", "status": "MISSED", "amended": false, "lateCharted": false}]`))
+	}))
+	defer server.Close()
+
+	page, err := New(server.URL+"/").ListStartRoundItems(context.Background(), StartRoundItemsParams{
+		Start:        time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC),
+		Statuses:     []string{"MISSED", "NOT_STARTED"},
+		RoundTypeIds: []uint{1, 3},
+		Descending:   true,
+		Limit:        1,
+	})
+	if err != nil {
+		t.Fatalf("ListStartRoundItems failed: %v", err)
+	}
+
+	// Zero values are left out so the server defaults apply
+	expected := "limit=1&order=desc&roundType=1%2C3&start=2022-01-10T08%3A00%3A00Z&status=MISSED%2CNOT_STARTED"
+	if query != expected {
+		t.Errorf("Expected query %s, got %s", expected, query)
+	}
+	if len(page.Items) != 1 || page.Items[0].Status != "MISSED" || page.NextCursor != "2022-01-10T09:00:00Z" {
+		t.Errorf("Unexpected page %+v", page)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/notifications" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "staff is required"}`))
+			return
+		}
+		// A proxy in front of the API won't answer in JSON
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html>Bad Gateway</html>"))
+	}))
+	defer server.Close()
+	rounds := New(server.URL)
+
+	var apiError *Error
+	_, err := rounds.ListNotifications(context.Background(), "", false)
+	if !errors.As(err, &apiError) || apiError.StatusCode != http.StatusBadRequest || apiError.Message != "staff is required" {
+		t.Errorf("Expected the server's error message, got %v", err)
+	}
+	_, err = rounds.ListWebhookDeadLetters(context.Background())
+	if !errors.As(err, &apiError) || apiError.StatusCode != http.StatusBadGateway || apiError.Message != "Bad Gateway" {
+		t.Errorf("Expected the status text for a non-JSON error, got %v", err)
+	}
+}
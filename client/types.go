@@ -0,0 +1,275 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// When a stored record was created and last changed
+type Timestamps struct {
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Status is NOT_STARTED, CREATED, STARTED, COMPLETE or MISSED
+type StartRoundsItem struct {
+	RoundTimestamp string `json:"roundTimestamp"`
+	Status         string `json:"status"`
+	Amended        bool   `json:"amended"`
+	LateCharted    bool   `json:"lateCharted"`
+}
+
+type RoundFeedEvent struct {
+	Id   uint            `json:"id"`
+	Type string          `json:"type"`
+	Item StartRoundsItem `json:"item"`
+}
+
+type Round struct {
+	Timestamps
+	Id             uint   `json:"id"`
+	RoundTimestamp string `json:"roundTimestamp"`
+	Status         string `json:"status"`
+	StartedAt      string `json:"startedAt"`
+	StartedBy      string `json:"startedBy"`
+	CompletedAt    string `json:"completedAt"`
+	CompletedBy    string `json:"completedBy"`
+}
+
+type RoundMember struct {
+	Timestamps
+	Id          uint   `json:"id"`
+	RoundId     uint   `json:"round"`
+	Status      string `json:"status"`
+	PatientId   string `json:"patientId"`
+	Unit        string `json:"unit"`
+	Observation string `json:"observation"`
+	ObservedAt  string `json:"observedAt"`
+	ObservedBy  string `json:"observedBy"`
+}
+
+// Resources are FHIR R4 Tasks and Observations, left as raw JSON for a FHIR library to decode
+type FHIRBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Timestamp    string            `json:"timestamp"`
+	Entry        []FHIRBundleEntry `json:"entry"`
+}
+
+type FHIRBundleEntry struct {
+	Resource json.RawMessage `json:"resource"`
+}
+
+type ComplianceStats struct {
+	Total                 int     `json:"total"`
+	OnTime                int     `json:"onTime"`
+	Late                  int     `json:"late"`
+	Missed                int     `json:"missed"`
+	Pending               int     `json:"pending"`
+	OnTimeRate            float64 `json:"onTimeRate"`
+	LateRate              float64 `json:"lateRate"`
+	MissedRate            float64 `json:"missedRate"`
+	MedianLatenessMinutes float64 `json:"medianLatenessMinutes"`
+}
+
+type PatientObservationGap struct {
+	PatientId  string  `json:"patientId"`
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	GapMinutes float64 `json:"gapMinutes"`
+}
+
+type ComplianceReport struct {
+	StartTime   string                     `json:"startTime"`
+	EndTime     string                     `json:"endTime"`
+	Overall     ComplianceStats            `json:"overall"`
+	ByUnit      map[string]ComplianceStats `json:"byUnit"`
+	ByRoundType map[string]ComplianceStats `json:"byRoundType"`
+	ByShift     map[string]ComplianceStats `json:"byShift"`
+	ByStaff     map[string]ComplianceStats `json:"byStaff"`
+	PatientGaps []PatientObservationGap    `json:"patientGaps"`
+}
+
+type ObservationGap struct {
+	PatientId      string  `json:"patientId"`
+	From           string  `json:"from"`
+	To             string  `json:"to"`
+	GapMinutes     float64 `json:"gapMinutes"`
+	AllowedMinutes float64 `json:"allowedMinutes"`
+	Open           bool    `json:"open"`
+}
+
+type SyncSnapshot struct {
+	GeneratedAt string           `json:"generatedAt"`
+	Unit        string           `json:"unit"`
+	Slots       []SyncSlot       `json:"slots"`
+	Assignments []SyncAssignment `json:"assignments"`
+}
+
+type SyncSlot struct {
+	RoundTimestamp string        `json:"roundTimestamp"`
+	Status         string        `json:"status"`
+	RoundTypes     []string      `json:"roundTypes"`
+	Patients       []SyncPatient `json:"patients"`
+}
+
+type SyncPatient struct {
+	PatientId   string `json:"patientId"`
+	Name        string `json:"name"`
+	Bed         string `json:"bed"`
+	Status      string `json:"status"`
+	Observation string `json:"observation"`
+	ObservedAt  string `json:"observedAt"`
+}
+
+type SyncAssignment struct {
+	PatientId     string `json:"patientId"`
+	RoundTypeId   uint   `json:"roundType"`
+	RoundTypeName string `json:"roundTypeName"`
+	EffectiveFrom string `json:"effectiveFrom"`
+	EffectiveTo   string `json:"effectiveTo"`
+}
+
+type SyncUpload struct {
+	DeviceId   string          `json:"deviceId"`
+	Operations []SyncOperation `json:"operations"`
+}
+
+// Type is start_round, complete_round or record_observation. PatientId and Observation are only for observations
+type SyncOperation struct {
+	ClientId       string `json:"clientId"`
+	Type           string `json:"type"`
+	RoundTimestamp string `json:"roundTimestamp"`
+	PatientId      string `json:"patientId,omitempty"`
+	Observation    string `json:"observation,omitempty"`
+	StaffId        string `json:"staffId"`
+	DeviceTime     string `json:"deviceTime"`
+}
+
+// Outcome is APPLIED, SUPERSEDED or REJECTED
+type SyncResult struct {
+	ClientId    string       `json:"clientId"`
+	Type        string       `json:"type"`
+	Outcome     string       `json:"outcome"`
+	Detail      string       `json:"detail"`
+	Duplicate   bool         `json:"duplicate"`
+	Round       *Round       `json:"round"`
+	RoundMember *RoundMember `json:"roundMember"`
+}
+
+type RoundStatusAmendmentInput struct {
+	RoundTimestamp string `json:"roundTimestamp"`
+	Status         string `json:"status"`
+	ReasonCode     string `json:"reasonCode"`
+	Note           string `json:"note,omitempty"`
+	StaffId        string `json:"staffId"`
+}
+
+type ObservationAmendmentInput struct {
+	Observation string `json:"observation"`
+	ReasonCode  string `json:"reasonCode"`
+	Note        string `json:"note,omitempty"`
+}
+
+type RoundAmendment struct {
+	Timestamps
+	Id            uint   `json:"id"`
+	RoundId       uint   `json:"round"`
+	RoundMemberId uint   `json:"roundMember"`
+	Field         string `json:"field"`
+	OriginalValue string `json:"originalValue"`
+	AmendedValue  string `json:"amendedValue"`
+	ReasonCode    string `json:"reasonCode"`
+	Note          string `json:"note"`
+	LateEntry     bool   `json:"lateEntry"`
+	AmendedAt     string `json:"amendedAt"`
+}
+
+type EscalationContactInput struct {
+	Unit    string `json:"unit,omitempty"`
+	Tier    string `json:"tier"`
+	Name    string `json:"name,omitempty"`
+	Channel string `json:"channel"`
+	Address string `json:"address"`
+}
+
+type EscalationContact struct {
+	Timestamps
+	Id      uint   `json:"id"`
+	Unit    string `json:"unit"`
+	Tier    string `json:"tier"`
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+	Address string `json:"address"`
+}
+
+type Notification struct {
+	Timestamps
+	Id             uint   `json:"id"`
+	Event          string `json:"event"`
+	RoundTimestamp string `json:"roundTimestamp"`
+	PatientId      string `json:"patientId"`
+	Unit           string `json:"unit"`
+	Tier           string `json:"tier"`
+	ContactId      uint   `json:"contact"`
+	Channel        string `json:"channel"`
+	Address        string `json:"address"`
+	Message        string `json:"message"`
+	SentAt         string `json:"sentAt"`
+	Error          string `json:"error"`
+	Attempts       int    `json:"attempts"`
+	NextAttemptAt  string `json:"nextAttemptAt"`
+	ReadAt         string `json:"readAt"`
+}
+
+type WebhookSubscriptionInput struct {
+	URL        string `json:"url"`
+	Secret     string `json:"secret,omitempty"`
+	EventTypes string `json:"eventTypes,omitempty"`
+}
+
+type WebhookSubscription struct {
+	Timestamps
+	Id         uint   `json:"id"`
+	URL        string `json:"url"`
+	Secret     string `json:"secret"`
+	EventTypes string `json:"eventTypes"`
+	Active     bool   `json:"active"`
+}
+
+type WebhookDelivery struct {
+	Timestamps
+	Id             uint   `json:"id"`
+	SubscriptionId uint   `json:"subscription"`
+	OutboxEventId  uint   `json:"outboxEvent"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	NextAttemptAt  string `json:"nextAttemptAt"`
+	DeliveredAt    string `json:"deliveredAt"`
+}
+
+type WebhookDeliveryAttempt struct {
+	Timestamps
+	Id             uint   `json:"id"`
+	DeliveryId     uint   `json:"delivery"`
+	SubscriptionId uint   `json:"subscription"`
+	OutboxEventId  uint   `json:"outboxEvent"`
+	Attempt        int    `json:"attempt"`
+	AttemptedAt    string `json:"attemptedAt"`
+	ResponseStatus int    `json:"responseStatus"`
+	Error          string `json:"error"`
+}
+
+type WebhookDeadLetter struct {
+	Timestamps
+	Id             uint   `json:"id"`
+	DeliveryId     uint   `json:"delivery"`
+	SubscriptionId uint   `json:"subscription"`
+	OutboxEventId  uint   `json:"outboxEvent"`
+	EventType      string `json:"eventType"`
+	Payload        string `json:"payload"`
+	Attempts       int    `json:"attempts"`
+	LastError      string `json:"lastError"`
+	DeadAt         string `json:"deadAt"`
+	ReplayedAt     string `json:"replayedAt"`
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// A clinic's round types, round configs and round assignments, as declared in a YAML or JSON file
+// Round configs and assignments name their round type rather than using its id, so a file works against any database
+type ClinicConfig struct {
+	RoundTypes   []ClinicRoundType   `json:"roundTypes" yaml:"roundTypes"`
+	RoundConfigs []ClinicRoundConfig `json:"roundConfigs" yaml:"roundConfigs"`
+	Assignments  []ClinicAssignment  `json:"assignments" yaml:"assignments"`
+}
+
+// A round type is identified by its name. Minutes is how often its rounds happen
+type ClinicRoundType struct {
+	Name    string `json:"name" yaml:"name"`
+	Minutes int    `json:"minutes" yaml:"minutes"`
+}
+
+// A round config is identified by its round type and unit. An empty unit applies to the whole clinic
+// Enabled defaults to true so a config can be declared with just its round type
+// WindowStart and WindowEnd are HH:MM in UTC, as on RoundConfig. Leaving both out schedules rounds all day
+type ClinicRoundConfig struct {
+	RoundType     string `json:"roundType" yaml:"roundType"`
+	Unit          string `json:"unit" yaml:"unit"`
+	Enabled       *bool  `json:"enabled" yaml:"enabled"`
+	AssignOnAdmit bool   `json:"assignOnAdmit" yaml:"assignOnAdmit"`
+	WindowStart   string `json:"windowStart" yaml:"windowStart"`
+	WindowEnd     string `json:"windowEnd" yaml:"windowEnd"`
+}
+
+// An assignment is identified by its patient, round type and From. From and To are RFC3339 and either can be
+// empty to leave that end of the assignment open
+type ClinicAssignment struct {
+	PatientId string `json:"patientId" yaml:"patientId"`
+	RoundType string `json:"roundType" yaml:"roundType"`
+	From      string `json:"from" yaml:"from"`
+	To        string `json:"to" yaml:"to"`
+}
+
+// One row apply created or updated, or found in the database but not in the config
+// Action is create, update or drift, and Detail says what the row is or what changed. Drift is reported, not changed
+type ClinicConfigChange struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	Detail string `json:"detail"`
+}
+
+func (change ClinicConfigChange) String() string {
+	symbol := "+"
+	switch change.Action {
+	case "update":
+		symbol = "~"
+	case "drift":
+		symbol = "!"
+	}
+	return fmt.Sprintf("%s %s %s: %s", symbol, change.Kind, change.Key, change.Detail)
+}
+
+// Returned inside the transaction to roll a dry run back
+var errClinicConfigDryRun = errors.New("dry run")
+
+// Read a clinic config from YAML, or JSON when the file name ends in .json. Unknown fields are an error,
+// so a misspelt field isn't silently ignored
+func ParseClinicConfig(name string, r io.Reader) (ClinicConfig, error) {
+	var config ClinicConfig
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return config, err
+	}
+
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&config)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return config, fmt.Errorf("invalid config %s: %w", name, err)
+	}
+	return config, nil
+}
+
+// Check a clinic config on its own, without a database. Every problem is reported, not just the first
+func ValidateClinicConfig(config ClinicConfig) error {
+	var problems []error
+
+	roundTypes := make(map[string]bool)
+	for i, roundType := range config.RoundTypes {
+		if roundType.Name == "" {
+			problems = append(problems, fmt.Errorf("roundTypes[%d]: name is required", i))
+			continue
+		}
+		if roundTypes[roundType.Name] {
+			problems = append(problems, fmt.Errorf("roundTypes[%d]: round type %q is declared twice", i, roundType.Name))
+		}
+		roundTypes[roundType.Name] = true
+		if roundType.Minutes <= 0 {
+			problems = append(problems, fmt.Errorf("roundTypes[%d]: minutes must be positive, got %d", i, roundType.Minutes))
+		}
+	}
+
+	roundConfigs := make(map[string]bool)
+	for i, roundConfig := range config.RoundConfigs {
+		if !roundTypes[roundConfig.RoundType] {
+			problems = append(problems, fmt.Errorf("roundConfigs[%d]: round type %q is not declared", i, roundConfig.RoundType))
+		}
+		key := roundConfigKey(roundConfig.RoundType, roundConfig.Unit)
+		if roundConfigs[key] {
+			problems = append(problems, fmt.Errorf("roundConfigs[%d]: round config %s is declared twice", i, key))
+		}
+		roundConfigs[key] = true
+		if err := validateRoundConfigWindow(roundConfig.WindowStart, roundConfig.WindowEnd); err != nil {
+			problems = append(problems, fmt.Errorf("roundConfigs[%d]: %w", i, err))
+		}
+	}
+
+	assignments := make(map[string]bool)
+	for i, assignment := range config.Assignments {
+		if assignment.PatientId == "" {
+			problems = append(problems, fmt.Errorf("assignments[%d]: patientId is required", i))
+		}
+		if !roundTypes[assignment.RoundType] {
+			problems = append(problems, fmt.Errorf("assignments[%d]: round type %q is not declared", i, assignment.RoundType))
+		}
+		from, fromErr := parseAssignmentTime(assignment.From)
+		to, toErr := parseAssignmentTime(assignment.To)
+		for _, err := range []error{fromErr, toErr} {
+			if err != nil {
+				problems = append(problems, fmt.Errorf("assignments[%d]: %w", i, err))
+			}
+		}
+		if fromErr == nil && toErr == nil && to != "" && to <= from {
+			problems = append(problems, fmt.Errorf("assignments[%d]: assignment must end after it starts", i))
+		}
+		key := assignmentKey(assignment.PatientId, assignment.RoundType, from)
+		if assignments[key] {
+			problems = append(problems, fmt.Errorf("assignments[%d]: assignment %s is declared twice", i, key))
+		}
+		assignments[key] = true
+	}
+
+	return errors.Join(problems...)
+}
+
+// Bring the database in line with a clinic config, creating what is missing and updating what differs
+// Rows the config doesn't mention are left alone, since rounds and their history refer to them and assignments
+// are also made on admission, but they are reported as drift. Assignments that have ended aren't drift
+// Applying the same config again changes nothing. A dry run works out the same changes and rolls them back
+func ApplyClinicConfig(db *gorm.DB, config ClinicConfig, dryRun bool) ([]ClinicConfigChange, error) {
+	if err := ValidateClinicConfig(config); err != nil {
+		return nil, err
+	}
+
+	var changes []ClinicConfigChange
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		changes, err = applyClinicConfig(tx, config)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return errClinicConfigDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errClinicConfigDryRun) {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func applyClinicConfig(tx *gorm.DB, config ClinicConfig) ([]ClinicConfigChange, error) {
+	var changes []ClinicConfigChange
+
+	roundTypeIds := make(map[string]uint)
+	for _, declared := range config.RoundTypes {
+		var roundType RoundType
+		if err := tx.Where("name = ?", declared.Name).Order("id").Limit(1).Find(&roundType).Error; err != nil {
+			return nil, err
+		}
+		if roundType.ID == 0 {
+			created, err := AddRoundType(tx, RoundType{Name: declared.Name, DurationAmt: declared.Minutes, DurationUnit: "minutes"})
+			if err != nil {
+				return nil, err
+			}
+			roundTypeIds[declared.Name] = created.ID
+			changes = append(changes, ClinicConfigChange{"create", "round type", declared.Name, fmt.Sprintf("every %d minutes", declared.Minutes)})
+			continue
+		}
+		roundTypeIds[declared.Name] = roundType.ID
+		if roundType.DurationAmt != declared.Minutes || roundType.DurationUnit != "minutes" {
+			detail := fmt.Sprintf("every %d %s -> every %d minutes", roundType.DurationAmt, roundType.DurationUnit, declared.Minutes)
+			err := tx.Model(&roundType).Updates(map[string]interface{}{"duration_amt": declared.Minutes, "duration_unit": "minutes"}).Error
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, ClinicConfigChange{"update", "round type", declared.Name, detail})
+		}
+	}
+
+	for _, declared := range config.RoundConfigs {
+		enabled := declared.Enabled == nil || *declared.Enabled
+		key := roundConfigKey(declared.RoundType, declared.Unit)
+		var roundConfig RoundConfig
+		err := tx.Where("round_type_id = ? AND unit = ?", roundTypeIds[declared.RoundType], declared.Unit).Order("id").Limit(1).Find(&roundConfig).Error
+		if err != nil {
+			return nil, err
+		}
+		if roundConfig.ID == 0 {
+			_, err := AddRoundConfig(tx, RoundConfig{
+				RoundTypeId:   roundTypeIds[declared.RoundType],
+				Enabled:       enabled,
+				Unit:          declared.Unit,
+				AssignOnAdmit: declared.AssignOnAdmit,
+				WindowStart:   declared.WindowStart,
+				WindowEnd:     declared.WindowEnd,
+			})
+			if err != nil {
+				return nil, err
+			}
+			detail := fmt.Sprintf("enabled %t, assign on admit %t", enabled, declared.AssignOnAdmit)
+			if declared.WindowStart != "" {
+				detail += ", window " + roundConfigWindowString(declared.WindowStart, declared.WindowEnd)
+			}
+			changes = append(changes, ClinicConfigChange{"create", "round config", key, detail})
+			continue
+		}
+		var differences []string
+		if roundConfig.Enabled != enabled {
+			differences = append(differences, fmt.Sprintf("enabled %t -> %t", roundConfig.Enabled, enabled))
+		}
+		if roundConfig.AssignOnAdmit != declared.AssignOnAdmit {
+			differences = append(differences, fmt.Sprintf("assign on admit %t -> %t", roundConfig.AssignOnAdmit, declared.AssignOnAdmit))
+		}
+		if roundConfig.WindowStart != declared.WindowStart || roundConfig.WindowEnd != declared.WindowEnd {
+			differences = append(differences, fmt.Sprintf("window %s -> %s",
+				roundConfigWindowString(roundConfig.WindowStart, roundConfig.WindowEnd), roundConfigWindowString(declared.WindowStart, declared.WindowEnd)))
+		}
+		if len(differences) > 0 {
+			err := tx.Model(&roundConfig).Updates(map[string]interface{}{
+				"enabled":         enabled,
+				"assign_on_admit": declared.AssignOnAdmit,
+				"window_start":    declared.WindowStart,
+				"window_end":      declared.WindowEnd,
+			}).Error
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, ClinicConfigChange{"update", "round config", key, strings.Join(differences, ", ")})
+		}
+	}
+
+	for _, declared := range config.Assignments {
+		// Validation has already checked the times
+		from, _ := parseAssignmentTime(declared.From)
+		to, _ := parseAssignmentTime(declared.To)
+		key := assignmentKey(declared.PatientId, declared.RoundType, from)
+		var roundAssignment RoundAssignment
+		err := tx.Where("patient_id = ? AND round_type_id = ? AND effective_from = ?", declared.PatientId, roundTypeIds[declared.RoundType], from).
+			Order("id").Limit(1).Find(&roundAssignment).Error
+		if err != nil {
+			return nil, err
+		}
+		if roundAssignment.ID == 0 {
+			roundAssignment = RoundAssignment{
+				RoundTypeId:   roundTypeIds[declared.RoundType],
+				PatientId:     declared.PatientId,
+				EffectiveFrom: from,
+				EffectiveTo:   to,
+			}
+			if err := tx.Create(&roundAssignment).Error; err != nil {
+				return nil, err
+			}
+			detail := "open ended"
+			if to != "" {
+				detail = "until " + to
+			}
+			changes = append(changes, ClinicConfigChange{"create", "assignment", key, detail})
+			continue
+		}
+		if roundAssignment.EffectiveTo != to {
+			detail := fmt.Sprintf("until %s -> %s", openEnded(roundAssignment.EffectiveTo), openEnded(to))
+			if err := tx.Model(&roundAssignment).Update("effective_to", to).Error; err != nil {
+				return nil, err
+			}
+			changes = append(changes, ClinicConfigChange{"update", "assignment", key, detail})
+		}
+	}
+
+	drift, err := clinicConfigDrift(tx, config, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, drift...), nil
+}
+
+// Find the round types, round configs and current assignments in the database that a clinic config doesn't declare
+func clinicConfigDrift(tx *gorm.DB, config ClinicConfig, now time.Time) ([]ClinicConfigChange, error) {
+	var changes []ClinicConfigChange
+
+	declaredRoundTypes := make(map[string]bool)
+	for _, declared := range config.RoundTypes {
+		declaredRoundTypes[declared.Name] = true
+	}
+	declaredRoundConfigs := make(map[string]bool)
+	for _, declared := range config.RoundConfigs {
+		declaredRoundConfigs[roundConfigKey(declared.RoundType, declared.Unit)] = true
+	}
+	declaredAssignments := make(map[string]bool)
+	for _, declared := range config.Assignments {
+		from, _ := parseAssignmentTime(declared.From)
+		declaredAssignments[assignmentKey(declared.PatientId, declared.RoundType, from)] = true
+	}
+
+	var roundTypes []RoundType
+	if err := tx.Order("id").Find(&roundTypes).Error; err != nil {
+		return nil, err
+	}
+	roundTypeNames := make(map[uint]string)
+	for _, roundType := range roundTypes {
+		roundTypeNames[roundType.ID] = roundType.Name
+		if !declaredRoundTypes[roundType.Name] {
+			detail := fmt.Sprintf("every %d %s, not in the config", roundType.DurationAmt, roundType.DurationUnit)
+			changes = append(changes, ClinicConfigChange{"drift", "round type", roundType.Name, detail})
+		}
+	}
+
+	var roundConfigs []RoundConfig
+	if err := tx.Order("id").Find(&roundConfigs).Error; err != nil {
+		return nil, err
+	}
+	for _, roundConfig := range roundConfigs {
+		key := roundConfigKey(roundTypeNames[roundConfig.RoundTypeId], roundConfig.Unit)
+		if !declaredRoundConfigs[key] {
+			detail := fmt.Sprintf("enabled %t, assign on admit %t, window %s, not in the config",
+				roundConfig.Enabled, roundConfig.AssignOnAdmit, roundConfigWindowString(roundConfig.WindowStart, roundConfig.WindowEnd))
+			changes = append(changes, ClinicConfigChange{"drift", "round config", key, detail})
+		}
+	}
+
+	var roundAssignments []RoundAssignment
+	err := tx.Where("effective_to = '' OR effective_to > ?", now.UTC().Format(time.RFC3339)).Order("id").Find(&roundAssignments).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, roundAssignment := range roundAssignments {
+		key := assignmentKey(roundAssignment.PatientId, roundTypeNames[roundAssignment.RoundTypeId], roundAssignment.EffectiveFrom)
+		if !declaredAssignments[key] {
+			detail := fmt.Sprintf("until %s, not in the config", openEnded(roundAssignment.EffectiveTo))
+			changes = append(changes, ClinicConfigChange{"drift", "assignment", key, detail})
+		}
+	}
+
+	return changes, nil
+}
+
+// Normalise an assignment time to RFC3339 in UTC, as assignments are stored. Empty stays empty
+func parseAssignmentTime(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("invalid time %q, expected RFC3339", value)
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+func roundConfigKey(roundType string, unit string) string {
+	if unit == "" {
+		return fmt.Sprintf("%q for the clinic", roundType)
+	}
+	return fmt.Sprintf("%q on %s", roundType, unit)
+}
+
+func assignmentKey(patientId string, roundType string, from string) string {
+	if from == "" {
+		return fmt.Sprintf("%s on %q", patientId, roundType)
+	}
+	return fmt.Sprintf("%s on %q from %s", patientId, roundType, from)
+}
+
+func openEnded(to string) string {
+	if to == "" {
+		return "open"
+	}
+	return to
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const clinicConfigYAML = `
+roundTypes:
+  - name: 15 Minute Round
+    minutes: 15
+  - name: 30 Minute Round
+    minutes: 30
+  - name: 60 Minute Round
+    minutes: 60
+roundConfigs:
+  - roundType: 15 Minute Round
+  - roundType: 30 Minute Round
+  - roundType: 60 Minute Round
+  - roundType: 30 Minute Round
+    unit: 4 West
+    assignOnAdmit: true
+assignments:
+  - patientId: patient1
+    roundType: 15 Minute Round
+  - patientId: patient1
+    roundType: 30 Minute Round
+  - patientId: patient1
+    roundType: 60 Minute Round
+  - patientId: patient2
+    roundType: 30 Minute Round
+  - patientId: patient3
+    roundType: 60 Minute Round
+  - patientId: patient4
+    roundType: 15 Minute Round
+    from: 2022-01-10T04:00:00-05:00
+    to: 2022-01-10T12:00:00Z
+`
+
+func parseTestClinicConfig(t *testing.T, name string, text string) ClinicConfig {
+	t.Helper()
+	config, err := ParseClinicConfig(name, strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	return config
+}
+
+func TestParseClinicConfig(t *testing.T) {
+	config := parseTestClinicConfig(t, "clinic.yaml", clinicConfigYAML)
+	if len(config.RoundTypes) != 3 || len(config.RoundConfigs) != 4 || len(config.Assignments) != 6 {
+		t.Errorf("Expected 3 round types, 4 configs and 6 assignments, got %+v", config)
+	}
+	if config.RoundConfigs[0].Enabled != nil || config.RoundConfigs[3].Unit != "4 West" || !config.RoundConfigs[3].AssignOnAdmit {
+		t.Errorf("Expected the configs as declared, got %+v", config.RoundConfigs)
+	}
+
+	json := `{"roundTypes": [{"name": "15 Minute Round", "minutes": 15}], "roundConfigs": [{"roundType": "15 Minute Round", "enabled": false}]}`
+	config = parseTestClinicConfig(t, "clinic.json", json)
+	if len(config.RoundTypes) != 1 || config.RoundConfigs[0].Enabled == nil || *config.RoundConfigs[0].Enabled {
+		t.Errorf("Expected the JSON config, got %+v", config)
+	}
+
+	if _, err := ParseClinicConfig("clinic.yaml", strings.NewReader("roundTypes:\n  - name: x\n    minute: 15\n")); err == nil {
+		t.Errorf("Expected an error for an unknown field")
+	}
+	if _, err := ParseClinicConfig("clinic.json", strings.NewReader(`{"roundtype": []}`)); err == nil {
+		t.Errorf("Expected an error for an unknown JSON field")
+	}
+	if config, err := ParseClinicConfig("clinic.yaml", strings.NewReader("")); err != nil || len(config.RoundTypes) != 0 {
+		t.Errorf("Expected an empty config, got %+v and %v", config, err)
+	}
+}
+
+func TestValidateClinicConfig(t *testing.T) {
+	if err := ValidateClinicConfig(parseTestClinicConfig(t, "clinic.yaml", clinicConfigYAML)); err != nil {
+		t.Errorf("Expected the config to be valid, got %v", err)
+	}
+
+	config := ClinicConfig{
+		RoundTypes: []ClinicRoundType{
+			{Name: "15 Minute Round", Minutes: 15},
+			{Name: "15 Minute Round", Minutes: 15},
+			{Name: "Never", Minutes: 0},
+			{Minutes: 30},
+		},
+		RoundConfigs: []ClinicRoundConfig{
+			{RoundType: "15 Minute Round"},
+			{RoundType: "15 Minute Round"},
+			{RoundType: "Hourly"},
+		},
+		Assignments: []ClinicAssignment{
+			{RoundType: "15 Minute Round"},
+			{PatientId: "patient1", RoundType: "Hourly"},
+			{PatientId: "patient1", RoundType: "15 Minute Round", From: "yesterday"},
+			{PatientId: "patient1", RoundType: "15 Minute Round", From: "2022-01-10T09:00:00Z", To: "2022-01-10T08:00:00Z"},
+		},
+	}
+	err := ValidateClinicConfig(config)
+	if err == nil {
+		t.Fatalf("Expected the config to be invalid")
+	}
+	expected := []string{
+		`roundTypes[1]: round type "15 Minute Round" is declared twice`,
+		`roundTypes[2]: minutes must be positive, got 0`,
+		`roundTypes[3]: name is required`,
+		`roundConfigs[1]: round config "15 Minute Round" for the clinic is declared twice`,
+		`roundConfigs[2]: round type "Hourly" is not declared`,
+		`assignments[0]: patientId is required`,
+		`assignments[1]: round type "Hourly" is not declared`,
+		`assignments[2]: invalid time "yesterday", expected RFC3339`,
+		`assignments[3]: assignment must end after it starts`,
+	}
+	if problems := strings.Split(err.Error(), "\n"); strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expected, "\n"), err)
+	}
+}
+
+func TestApplyClinicConfig(t *testing.T) {
+	currTime := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+	expectedDb := setupDatabase()
+	setupRoundConfigs(expectedDb)
+	expected, _ := createRoundsAt(expectedDb, currTime)
+
+	db := setupDatabase()
+	config := parseTestClinicConfig(t, "clinic.yaml", clinicConfigYAML)
+
+	// A dry run reports every row as new and leaves the database empty
+	changes, err := ApplyClinicConfig(db, config, true)
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if len(changes) != 13 {
+		t.Errorf("Expected 13 changes, got %d: %v", len(changes), changes)
+	}
+	if count := countRows(db, "round_types"); count != 0 {
+		t.Errorf("Expected a dry run to change nothing, got %d round types", count)
+	}
+
+	applied, err := ApplyClinicConfig(db, config, false)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if len(applied) != len(changes) {
+		t.Errorf("Expected the dry run's %d changes applied, got %v", len(changes), applied)
+	}
+	if applied[0].String() != "+ round type 15 Minute Round: every 15 minutes" {
+		t.Errorf("Unexpected change %q", applied[0])
+	}
+	var assignment RoundAssignment
+	db.Where("patient_id = ?", "patient4").First(&assignment)
+	if assignment.EffectiveFrom != "2022-01-10T09:00:00Z" || assignment.EffectiveTo != "2022-01-10T12:00:00Z" {
+		t.Errorf("Expected patient4's window in UTC, got %+v", assignment)
+	}
+
+	// The config declares what setupRoundConfigs creates, so rounds come out the same
+	if created, _ := createRoundsAt(db, currTime); created != expected {
+		t.Errorf("Expected %d rounds, got %d", expected, created)
+	}
+
+	// Applying again changes nothing
+	if changes, err := ApplyClinicConfig(db, config, false); err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v and %v", changes, err)
+	}
+
+	// Edits update the matching rows in place
+	disabled := false
+	config.RoundTypes[2].Minutes = 45
+	config.RoundConfigs[1].Enabled = &disabled
+	config.Assignments[5].To = ""
+	changes, err = ApplyClinicConfig(db, config, false)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	expectedChanges := []string{
+		"~ round type 60 Minute Round: every 60 minutes -> every 45 minutes",
+		`~ round config "30 Minute Round" for the clinic: enabled true -> false`,
+		`~ assignment patient4 on "15 Minute Round" from 2022-01-10T09:00:00Z: until 2022-01-10T12:00:00Z -> open`,
+	}
+	if len(changes) != len(expectedChanges) {
+		t.Fatalf("Expected %d changes, got %v", len(expectedChanges), changes)
+	}
+	for i, change := range changes {
+		if change.String() != expectedChanges[i] {
+			t.Errorf("Expected %q, got %q", expectedChanges[i], change)
+		}
+	}
+	if count := countRows(db, "round_assignments"); count != 6 {
+		t.Errorf("Expected the 6 assignments updated rather than added, got %d", count)
+	}
+
+	if _, err := ApplyClinicConfig(db, ClinicConfig{RoundTypes: []ClinicRoundType{{Name: "x"}}}, false); err == nil {
+		t.Errorf("Expected an invalid config to be refused")
+	}
+}
+
+func TestApplyClinicConfigWindowsAndDrift(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	db.Create(&RoundAssignment{RoundTypeId: 1, PatientId: "patient9", EffectiveFrom: "2022-01-10T09:00:00Z", EffectiveTo: "2022-01-10T10:00:00Z"})
+
+	// The file leaves out the 60 minute round type, its config and assignments, and windows the 15 minute config
+	config := parseTestClinicConfig(t, "clinic.yaml", `
+roundTypes:
+  - name: 15 Minute Round
+    minutes: 15
+  - name: 30 Minute Round
+    minutes: 30
+roundConfigs:
+  - roundType: 15 Minute Round
+    windowStart: "08:00"
+    windowEnd: "20:00"
+  - roundType: 30 Minute Round
+assignments:
+  - patientId: patient1
+    roundType: 15 Minute Round
+  - patientId: patient1
+    roundType: 30 Minute Round
+  - patientId: patient2
+    roundType: 30 Minute Round
+`)
+	expectedChanges := []string{
+		`~ round config "15 Minute Round" for the clinic: window all day -> 08:00-20:00`,
+		"! round type 60 Minute Round: every 60 minutes, not in the config",
+		`! round config "60 Minute Round" for the clinic: enabled true, assign on admit false, window all day, not in the config`,
+		`! assignment patient1 on "60 Minute Round": until open, not in the config`,
+		`! assignment patient3 on "60 Minute Round": until open, not in the config`,
+	}
+	for _, dryRun := range []bool{true, false} {
+		changes, err := ApplyClinicConfig(db, config, dryRun)
+		if err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+		var got []string
+		for _, change := range changes {
+			got = append(got, change.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(expectedChanges, "\n") {
+			t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expectedChanges, "\n"), strings.Join(got, "\n"))
+		}
+	}
+
+	// Drift is left alone, and applying again only reports it
+	if count := countRows(db, "round_types"); count != 3 {
+		t.Errorf("Expected the 60 minute round type kept, got %d round types", count)
+	}
+	changes, _ := ApplyClinicConfig(db, config, false)
+	for _, change := range changes {
+		if change.Action != "drift" {
+			t.Errorf("Expected only drift, got %q", change)
+		}
+	}
+	var roundConfig RoundConfig
+	db.Where("round_type_id = ?", 1).First(&roundConfig)
+	if roundConfig.WindowStart != "08:00" || roundConfig.WindowEnd != "20:00" {
+		t.Errorf("Expected the window applied, got %+v", roundConfig)
+	}
+
+	config.RoundConfigs[0].WindowEnd = ""
+	if err := ValidateClinicConfig(config); err == nil || !strings.Contains(err.Error(), "roundConfigs[0]: invalid window time") {
+		t.Errorf("Expected a window with no end to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Where anything that needs "now", or waits, gets the time, so tests can drive it with a FakeClock
+// The engine functions take the time as an argument, and the servers and workers that call them get it from a Clock
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// A time.Ticker behind an interface, so a FakeClock can hand out its own
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// A time.Timer behind an interface. Stop reports whether it stopped the timer before it fired
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// The Clock backed by the time package. Now is in UTC, since timestamps are stored and compared as RFC3339 text
+type RealClock struct{}
+
+func (RealClock) Now() time.Time { return time.Now().UTC() }
+
+func (RealClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+func (RealClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTicker struct{ ticker *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t realTicker) Stop()               { t.ticker.Stop() }
+
+type realTimer struct{ timer *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.timer.C }
+func (t realTimer) Stop() bool          { return t.timer.Stop() }
+
+// A Clock that only moves when Advance or Set moves it, firing the timers and tickers it passes in time order
+// A tick is handed over as the clock reaches it, and Advance waits for it to be received or the ticker stopped,
+// so once Advance returns the worker waiting on the ticker has finished its previous run and started the next
+// Timers fire into a buffered channel, as time.Timer does, and never hold Advance up
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+	changed chan struct{}
+}
+
+// A timer, or a ticker when period isn't zero
+type fakeWaiter struct {
+	clock   *FakeClock
+	at      time.Time
+	period  time.Duration
+	c       chan time.Time
+	stopped chan struct{}
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, changed: make(chan struct{})}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.addWaiter(d, d, make(chan time.Time))}
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return fakeTimer{c.addWaiter(d, 0, make(chan time.Time, 1))}
+}
+
+func (c *FakeClock) addWaiter(d time.Duration, period time.Duration, ch chan time.Time) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	waiter := &fakeWaiter{clock: c, at: c.now.Add(d), period: period, c: ch, stopped: make(chan struct{})}
+	c.waiters = append(c.waiters, waiter)
+	c.notifyLocked()
+	// A timer for no time at all fires straight away
+	if period == 0 && d <= 0 {
+		c.fireLocked(waiter)
+	}
+	return waiter
+}
+
+// Move the clock forward, firing everything due on the way at the time it was due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Move the clock to a time, firing everything due up to it. Setting it back fires nothing
+func (c *FakeClock) Set(t time.Time) {
+	for {
+		c.mu.Lock()
+		waiter := c.nextDueLocked(t)
+		if waiter == nil {
+			if t.After(c.now) {
+				c.now = t
+			}
+			c.mu.Unlock()
+			return
+		}
+		if waiter.at.After(c.now) {
+			c.now = waiter.at
+		}
+		if waiter.period == 0 {
+			c.fireLocked(waiter)
+			c.mu.Unlock()
+			continue
+		}
+		tick := waiter.at
+		waiter.at = waiter.at.Add(waiter.period)
+		c.mu.Unlock()
+
+		// Hand the tick over outside the lock, so the receiver can use the clock
+		select {
+		case waiter.c <- tick:
+		case <-waiter.stopped:
+		}
+	}
+}
+
+// Wait until at least n timers and tickers are waiting on the clock, e.g. for a worker to create its ticker
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		waiting, changed := len(c.waiters), c.changed
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+// The earliest waiter due by t, or nil
+func (c *FakeClock) nextDueLocked(t time.Time) *fakeWaiter {
+	due := make([]*fakeWaiter, 0, len(c.waiters))
+	for _, waiter := range c.waiters {
+		if !waiter.at.After(t) {
+			due = append(due, waiter)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	return due[0]
+}
+
+func (c *FakeClock) fireLocked(waiter *fakeWaiter) {
+	waiter.c <- waiter.at
+	c.removeLocked(waiter)
+}
+
+func (c *FakeClock) removeLocked(waiter *fakeWaiter) bool {
+	for i, w := range c.waiters {
+		if w == waiter {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			c.notifyLocked()
+			return true
+		}
+	}
+	return false
+}
+
+func (c *FakeClock) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (w *fakeWaiter) C() <-chan time.Time { return w.c }
+
+// Take the waiter off the clock, reporting whether it was still waiting
+func (w *fakeWaiter) stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	if !w.clock.removeLocked(w) {
+		return false
+	}
+	close(w.stopped)
+	return true
+}
+
+type fakeTicker struct{ *fakeWaiter }
+
+func (t fakeTicker) Stop() { t.stop() }
+
+type fakeTimer struct{ *fakeWaiter }
+
+func (t fakeTimer) Stop() bool { return t.stop() }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockTimers(t *testing.T) {
+	start := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	timer := clock.NewTimer(10 * time.Minute)
+	stopped := clock.NewTimer(5 * time.Minute)
+	clock.Advance(4 * time.Minute)
+	if !clock.Now().Equal(start.Add(4 * time.Minute)) {
+		t.Errorf("Expected the clock at 9:04, got %v", clock.Now())
+	}
+	select {
+	case <-timer.C():
+		t.Errorf("Expected the timer not to fire before it's due")
+	default:
+	}
+	if !stopped.Stop() {
+		t.Errorf("Expected stopping a waiting timer to report it stopped")
+	}
+
+	clock.Advance(time.Hour)
+	select {
+	case fired := <-timer.C():
+		if !fired.Equal(start.Add(10 * time.Minute)) {
+			t.Errorf("Expected the timer to fire at 9:10, got %v", fired)
+		}
+	default:
+		t.Errorf("Expected the timer to fire")
+	}
+	select {
+	case <-stopped.C():
+		t.Errorf("Expected a stopped timer not to fire")
+	default:
+	}
+	if timer.Stop() {
+		t.Errorf("Expected stopping a fired timer to report it had already fired")
+	}
+
+	// Setting the clock back fires nothing and doesn't move it
+	clock.Set(start)
+	if !clock.Now().Equal(start.Add(64 * time.Minute)) {
+		t.Errorf("Expected the clock to stay at 10:04, got %v", clock.Now())
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	start := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	// Every tick an advance passes is handed over in order, at the time it was due
+	ticks := make(chan time.Time, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := clock.NewTicker(15 * time.Minute)
+		defer ticker.Stop()
+		for len(ticks) < 3 {
+			ticks <- <-ticker.C()
+		}
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(50 * time.Minute)
+	<-done
+	if len(ticks) != 3 {
+		t.Fatalf("Expected 3 ticks, got %d", len(ticks))
+	}
+	for i := 1; i <= 3; i++ {
+		if tick := <-ticks; !tick.Equal(start.Add(time.Duration(i) * 15 * time.Minute)) {
+			t.Errorf("Expected tick %d at %v, got %v", i, start.Add(time.Duration(i)*15*time.Minute), tick)
+		}
+	}
+	if !clock.Now().Equal(start.Add(50 * time.Minute)) {
+		t.Errorf("Expected the clock at 9:50, got %v", clock.Now())
+	}
+
+	// A stopped ticker doesn't hold Advance up
+	clock.Advance(time.Hour)
+}
+
+// The real clock is in UTC, and a clock in another zone still stores and compares times as UTC text
+func TestNonUTCClock(t *testing.T) {
+	if location := (RealClock{}).Now().Location(); location != time.UTC {
+		t.Errorf("Expected the real clock in UTC, got %v", location)
+	}
+
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No time zone data: %v", err)
+	}
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	store := NewGormRoundsStore(db)
+	clock := NewFakeClock(time.Date(2022, time.January, 10, 4, 0, 0, 0, newYork))
+
+	CreateRounds(store, clock.Now())
+	if _, err := AdmitPatient(db, "patient9", "Pat Nine", "A", "1", clock.Now()); err != nil {
+		t.Fatalf("AdmitPatient failed: %v", err)
+	}
+	if _, err := StartRound(store, clock.Now(), "nurseA", clock.Now()); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+
+	round, _ := getRoundForTime(db, clock.Now())
+	if round.RoundTimestamp != "2022-01-10T09:00:00Z" || round.StartedAt != "2022-01-10T09:00:00Z" {
+		t.Errorf("Expected the 9:00 UTC round started at 9:00 UTC, got %+v", round)
+	}
+	var censusEvent PatientCensusEvent
+	db.Where("patient_id = ?", "patient9").First(&censusEvent)
+	if censusEvent.EffectiveAt != "2022-01-10T09:00:00Z" {
+		t.Errorf("Expected the admission in UTC, got %q", censusEvent.EffectiveAt)
+	}
+
+	// The 8:00 UTC round is an hour overdue, as is every other round before 8:30 that wasn't started
+	var overdue int64
+	db.Model(&Round{}).Where("status = ? AND round_timestamp >= ? AND round_timestamp <= ?", "CREATED", "2022-01-09T21:00:00Z", "2022-01-10T08:30:00Z").Count(&overdue)
+	count, err := RecordMissedRoundEvents(db, clock.Now())
+	if err != nil || count == 0 || int64(count) != overdue {
+		t.Errorf("Expected %d missed events, got %d and %v", overdue, count, err)
+	}
+}
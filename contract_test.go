@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ritten-rounds-test/client"
+)
+
+func loadOpenAPIDocument(t *testing.T) map[string]interface{} {
+	var document map[string]interface{}
+	if err := json.Unmarshal(openAPIDocument, &document); err != nil {
+		t.Fatalf("Invalid OpenAPI document: %v", err)
+	}
+	return document
+}
+
+// Every route registered in newServer is documented, and every documented operation has a route
+func TestOpenAPIDocumentMatchesRoutes(t *testing.T) {
+	document := loadOpenAPIDocument(t)
+
+	file, err := parser.ParseFile(token.NewFileSet(), "server.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse server.go: %v", err)
+	}
+	routes := make(map[string]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		selector, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || selector.Sel.Name != "HandleFunc" {
+			return true
+		}
+		if pattern, ok := call.Args[0].(*ast.BasicLit); ok {
+			unquoted, _ := strconv.Unquote(pattern.Value)
+			routes[unquoted] = true
+		}
+		return true
+	})
+
+	documented := make(map[string]bool)
+	for path, item := range document["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	for route := range routes {
+		if !documented[route] {
+			t.Errorf("Route %s is not in openapi.json", route)
+		}
+	}
+	for operation := range documented {
+		if !routes[operation] {
+			t.Errorf("openapi.json documents %s, which has no route", operation)
+		}
+	}
+}
+
+// A request and response that went through the client, with the bodies as they were sent and received
+type contractExchange struct {
+	method       string
+	path         string
+	status       int
+	contentType  string
+	requestBody  []byte
+	responseBody *bytes.Buffer
+}
+
+// Records every exchange so it can be checked against the document once the test has run
+type contractRecorder struct {
+	mu        sync.Mutex
+	exchanges []*contractExchange
+}
+
+func (recorder *contractRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	exchange := &contractExchange{method: req.Method, path: req.URL.Path, responseBody: &bytes.Buffer{}}
+	if req.Body != nil {
+		exchange.requestBody, _ = io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(exchange.requestBody))
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	exchange.status = resp.StatusCode
+	exchange.contentType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, exchange.responseBody), resp.Body}
+
+	recorder.mu.Lock()
+	recorder.exchanges = append(recorder.exchanges, exchange)
+	recorder.mu.Unlock()
+	return resp, nil
+}
+
+// Resolve a local $ref like #/components/schemas/Round
+func resolveOpenAPIRef(document map[string]interface{}, schema map[string]interface{}) map[string]interface{} {
+	for {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return schema
+		}
+		var node interface{} = document
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			node = node.(map[string]interface{})[part]
+		}
+		schema = node.(map[string]interface{})
+	}
+}
+
+// Check a decoded JSON value against a schema. Objects are closed: a property the document doesn't describe is an error
+// unless the schema allows additionalProperties, so the document can't fall behind the handlers
+func validateOpenAPISchema(document map[string]interface{}, schema map[string]interface{}, value interface{}, at string) []string {
+	schema = resolveOpenAPIRef(document, schema)
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable {
+			return nil
+		}
+		return []string{at + ": is null"}
+	}
+
+	var problems []string
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: %v is not one of %v", at, value, enum))
+		}
+	}
+
+	switch schema["type"] {
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: expected a string, got %T", at, value))
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, text); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not an RFC3339 date-time", at, text))
+			}
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			problems = append(problems, fmt.Sprintf("%s: expected an integer, got %v", at, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected a number, got %T", at, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected a boolean, got %T", at, value))
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: expected an array, got %T", at, value))
+		}
+		for i, item := range items {
+			problems = append(problems, validateOpenAPISchema(document, schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: expected an object, got %T", at, value))
+		}
+
+		// Properties and required fields from allOf are merged into the object
+		properties := make(map[string]interface{})
+		var required []interface{}
+		allOf, _ := schema["allOf"].([]interface{})
+		for _, part := range append([]interface{}{schema}, allOf...) {
+			part := resolveOpenAPIRef(document, part.(map[string]interface{}))
+			if partProperties, ok := part["properties"].(map[string]interface{}); ok {
+				for name, property := range partProperties {
+					properties[name] = property
+				}
+			}
+			if partRequired, ok := part["required"].([]interface{}); ok {
+				required = append(required, partRequired...)
+			}
+		}
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing %s", at, name))
+			}
+		}
+
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := properties[name]; ok {
+				problems = append(problems, validateOpenAPISchema(document, property.(map[string]interface{}), object[name], at+"."+name)...)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case map[string]interface{}:
+				problems = append(problems, validateOpenAPISchema(document, additional, object[name], at+"."+name)...)
+			case bool:
+				if !additional {
+					problems = append(problems, fmt.Sprintf("%s: undocumented property %s", at, name))
+				}
+			default:
+				problems = append(problems, fmt.Sprintf("%s: undocumented property %s", at, name))
+			}
+		}
+	}
+	return problems
+}
+
+// Find the documented path and operation for a request path
+func findOpenAPIOperation(document map[string]interface{}, method string, path string) (string, map[string]interface{}) {
+	for template, item := range document["paths"].(map[string]interface{}) {
+		pattern := "^" + regexp.MustCompile(`\\\{[^}]+\\\}`).ReplaceAllString(regexp.QuoteMeta(template), `[^/]+`) + "$"
+		if !regexp.MustCompile(pattern).MatchString(path) {
+			continue
+		}
+		if operation, ok := item.(map[string]interface{})[strings.ToLower(method)].(map[string]interface{}); ok {
+			return template, operation
+		}
+	}
+	return "", nil
+}
+
+// Check an exchange against the document, returning the documented response it was an example of
+func checkContractExchange(document map[string]interface{}, exchange *contractExchange) (string, []string) {
+	template, operation := findOpenAPIOperation(document, exchange.method, exchange.path)
+	if operation == nil {
+		return "", []string{fmt.Sprintf("%s %s is not documented", exchange.method, exchange.path)}
+	}
+	key := fmt.Sprintf("%s %s %d", exchange.method, template, exchange.status)
+	at := fmt.Sprintf("%s %s %d", exchange.method, exchange.path, exchange.status)
+
+	var problems []string
+	// Requests the server rejected were meant to be invalid
+	if requestBody, ok := operation["requestBody"].(map[string]interface{}); ok && len(exchange.requestBody) > 0 && exchange.status < 400 {
+		schema := requestBody["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+		var value interface{}
+		if err := json.Unmarshal(exchange.requestBody, &value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid request body: %v", at, err))
+		} else {
+			problems = append(problems, validateOpenAPISchema(document, schema, value, at+" request")...)
+		}
+	}
+
+	response, ok := operation["responses"].(map[string]interface{})[strconv.Itoa(exchange.status)].(map[string]interface{})
+	if !ok {
+		return key, append(problems, at+": status is not documented")
+	}
+	response = resolveOpenAPIRef(document, response)
+	media, ok := response["content"].(map[string]interface{})[exchange.contentType].(map[string]interface{})
+	if !ok {
+		return key, append(problems, fmt.Sprintf("%s: content type %q is not documented", at, exchange.contentType))
+	}
+	schema := media["schema"].(map[string]interface{})
+
+	switch {
+	case exchange.contentType == "text/event-stream":
+		// Each data line is a document in its own right. The stream was cut off, so the last line may be partial
+		lines := strings.Split(exchange.responseBody.String(), "\n")
+		for _, line := range lines[:len(lines)-1] {
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok {
+				continue
+			}
+			var value interface{}
+			if err := json.Unmarshal([]byte(data), &value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid event data: %v", at, err))
+				continue
+			}
+			problems = append(problems, validateOpenAPISchema(document, schema, value, at+" event")...)
+		}
+	case strings.HasSuffix(exchange.contentType, "json"):
+		var value interface{}
+		if err := json.Unmarshal(exchange.responseBody.Bytes(), &value); err != nil {
+			return key, append(problems, fmt.Sprintf("%s: invalid JSON: %v", at, err))
+		}
+		problems = append(problems, validateOpenAPISchema(document, schema, value, at)...)
+	default:
+		if exchange.responseBody.Len() == 0 {
+			problems = append(problems, at+": empty body")
+		}
+	}
+	return key, problems
+}
+
+// Rounds, observations and integrations on 10 Jan 2022, so every endpoint has something to return
+func setupContractData(t *testing.T) *httptest.Server {
+	db := setupRoundsSheet(t)
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	CreateRounds(NewGormRoundsStore(db), roundTime)
+	StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(2*time.Minute))
+	round, _ := getRoundForTime(db, roundTime)
+	roundMembers, _ := getRoundMembersForRound(db, round.ID)
+	RecordObservation(NewGormRoundsStore(db), roundMembers[0].ID, "SLEEPING", "nurseA", roundTime.Add(3*time.Minute))
+	CompleteRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(5*time.Minute))
+	AmendRoundStatus(NewGormRoundsStore(db), roundTime.Add(-15*time.Minute), "COMPLETE", "LATE_ENTRY", "", "nurseA", roundTime.Add(10*time.Minute))
+
+	AddEscalationContact(db, EscalationContact{Tier: "CHARGE_NURSE", Channel: "in_app", Address: "nurseA"})
+	if _, err := CheckRoundNotifications(db, roundTime.Add(time.Hour), map[string]Notifier{"in_app": InAppNotifier{}}); err != nil {
+		t.Fatalf("CheckRoundNotifications failed: %v", err)
+	}
+
+	// A receiver that is down, so there is a failed attempt in the delivery log and a dead letter to replay
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(receiver.Close)
+	subscription, _ := AddWebhookSubscription(db, WebhookSubscription{URL: receiver.URL, EventTypes: "round.completed"})
+	DispatchWebhooks(db, nil, roundTime.Add(time.Hour))
+	db.Create(&WebhookDeadLetter{SubscriptionId: subscription.ID, OutboxEventId: 1, EventType: "round.created", Payload: "{}", Attempts: webhookMaxAttempts, DeadAt: roundTime.Add(time.Hour).Format(time.RFC3339)})
+
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	document := loadOpenAPIDocument(t)
+	server := setupContractData(t)
+	recorder := &contractRecorder{}
+	rounds := client.New(server.URL)
+	rounds.HTTPClient = &http.Client{Transport: recorder}
+	ctx := context.Background()
+
+	start := time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC)
+	end := time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC)
+
+	// Calls that should succeed, made through the typed client
+	page, err := rounds.ListStartRoundItems(ctx, client.StartRoundItemsParams{Start: start, End: end, Limit: 3})
+	if err != nil || len(page.Items) != 3 || page.NextCursor == "" {
+		t.Errorf("Expected a page of 3 start round items with a cursor, got %+v, %v", page, err)
+	}
+	page, err = rounds.ListStartRoundItems(ctx, client.StartRoundItemsParams{Start: start, End: end})
+	if err != nil || len(page.Items) != 9 {
+		t.Errorf("Expected 9 start round items, got %+v, %v", page, err)
+	}
+
+	streamCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	var feedEvents []client.RoundFeedEvent
+	err = rounds.StreamStartRoundItems(streamCtx, "A", "0", func(event client.RoundFeedEvent) error {
+		feedEvents = append(feedEvents, event)
+		if len(feedEvents) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	cancel()
+	if !errors.Is(err, context.Canceled) || len(feedEvents) != 3 {
+		t.Errorf("Expected 3 feed events before cancelling, got %d, %v", len(feedEvents), err)
+	}
+
+	bundle, err := rounds.ExportFHIR(ctx, start, end)
+	if err != nil || bundle.ResourceType != "Bundle" || len(bundle.Entry) == 0 {
+		t.Errorf("Expected a FHIR bundle with entries, got %+v, %v", bundle, err)
+	}
+	report, err := rounds.GetComplianceReport(ctx, client.ComplianceReportParams{Start: start, End: end, Unit: "A", TZ: "America/New_York"})
+	if err != nil || report.Overall.Total == 0 {
+		t.Errorf("Expected a compliance report, got %+v, %v", report, err)
+	}
+	if _, err := rounds.ListObservationGaps(ctx, "patient1", start, end); err != nil {
+		t.Errorf("ListObservationGaps failed: %v", err)
+	}
+	if _, err := rounds.ListObservationGapAlerts(ctx); err != nil {
+		t.Errorf("ListObservationGapAlerts failed: %v", err)
+	}
+	for _, format := range []string{"csv", "xlsx"} {
+		body, err := rounds.Export(ctx, "rounds", client.ExportParams{Format: format, Start: start, End: end})
+		if err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		io.Copy(io.Discard, body)
+		body.Close()
+	}
+	body, err := rounds.GetRoundsSheet(ctx, client.RoundsSheetParams{Unit: "A", Start: start, Hours: 2})
+	if err != nil {
+		t.Fatalf("GetRoundsSheet failed: %v", err)
+	}
+	io.Copy(io.Discard, body)
+	body.Close()
+
+	snapshot, err := rounds.SyncDownload(ctx, "A", start, 2)
+	if err != nil || len(snapshot.Slots) == 0 {
+		t.Errorf("Expected a sync snapshot, got %+v, %v", snapshot, err)
+	}
+	results, err := rounds.SyncUpload(ctx, client.SyncUpload{DeviceId: "tabletA", Operations: []client.SyncOperation{
+		{ClientId: "a-1", Type: "record_observation", RoundTimestamp: "2022-01-10T09:30:00Z", PatientId: "patient1", Observation: "AWAKE", StaffId: "nurseB", DeviceTime: "2022-01-10T09:31:00Z"},
+		{ClientId: "a-2", Type: "complete_round", RoundTimestamp: "2022-01-10T09:30:00Z", StaffId: "nurseB", DeviceTime: "2022-01-10T09:33:00Z"},
+		{ClientId: "a-3", Type: "start_round", RoundTimestamp: "2022-01-10T09:07:00Z", StaffId: "nurseB", DeviceTime: "2022-01-10T09:07:00Z"},
+	}})
+	if err != nil || len(results) != 3 || results[0].RoundMember == nil || results[1].Round == nil || results[2].Outcome != "REJECTED" {
+		t.Errorf("Expected applied and rejected sync results, got %+v, %v", results, err)
+	}
+
+	amendment, err := rounds.AmendRoundStatus(ctx, client.RoundStatusAmendmentInput{RoundTimestamp: "2022-01-10T09:15:00Z", Status: "COMPLETE", ReasonCode: "LATE_ENTRY", StaffId: "nurseB"})
+	if err != nil || !amendment.LateEntry || amendment.AmendedValue != "COMPLETE" {
+		t.Errorf("Expected a late entry for the 9:15 round, got %+v, %v", amendment, err)
+	}
+	if results[0].RoundMember != nil {
+		amendment, err = rounds.AmendObservation(ctx, results[0].RoundMember.Id, client.ObservationAmendmentInput{Observation: "SLEEPING", ReasonCode: "DOCUMENTATION_ERROR"})
+		if err != nil || amendment.OriginalValue != "AWAKE" {
+			t.Errorf("Expected the observation to be amended from AWAKE, got %+v, %v", amendment, err)
+		}
+	}
+
+	contact, err := rounds.AddEscalationContact(ctx, client.EscalationContactInput{Unit: "A", Tier: "SUPERVISOR", Channel: "smtp", Address: "supervisor@example.com"})
+	if err != nil || contact.Id == 0 {
+		t.Errorf("Expected an escalation contact, got %+v, %v", contact, err)
+	}
+	notifications, err := rounds.ListNotifications(ctx, "nurseA", true)
+	if err != nil || len(notifications) == 0 {
+		t.Fatalf("Expected notifications, got %+v, %v", notifications, err)
+	}
+	if _, err := rounds.MarkNotificationRead(ctx, notifications[0].Id); err != nil {
+		t.Errorf("MarkNotificationRead failed: %v", err)
+	}
+	subscription, err := rounds.AddWebhookSubscription(ctx, client.WebhookSubscriptionInput{URL: "https://example.com/hooks"})
+	if err != nil || len(subscription.Secret) != 64 {
+		t.Errorf("Expected a subscription with a secret, got %+v, %v", subscription, err)
+	}
+	attempts, err := rounds.ListWebhookDeliveries(ctx, 1)
+	if err != nil || len(attempts) != 2 {
+		t.Errorf("Expected a failed attempt for each completed round, got %+v, %v", attempts, err)
+	}
+	deadLetters, err := rounds.ListWebhookDeadLetters(ctx)
+	if err != nil || len(deadLetters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %+v, %v", deadLetters, err)
+	}
+	if _, err := rounds.ReplayWebhookDeadLetter(ctx, deadLetters[0].Id); err != nil {
+		t.Errorf("ReplayWebhookDeadLetter failed: %v", err)
+	}
+
+	// Calls that should fail come back as *client.Error with the server's message
+	failures := []struct {
+		name   string
+		call   func() error
+		status int
+	}{
+		{"negative limit", func() error {
+			_, err := rounds.ListStartRoundItems(ctx, client.StartRoundItemsParams{Limit: -1})
+			return err
+		}, http.StatusBadRequest},
+		{"invalid last event id", func() error {
+			return rounds.StreamStartRoundItems(ctx, "", "latest", func(client.RoundFeedEvent) error { return nil })
+		}, http.StatusBadRequest},
+		{"FHIR window backwards", func() error { _, err := rounds.ExportFHIR(ctx, end, start); return err }, http.StatusBadRequest},
+		{"compliance in an unknown zone", func() error {
+			_, err := rounds.GetComplianceReport(ctx, client.ComplianceReportParams{TZ: "Mars/Olympus_Mons"})
+			return err
+		}, http.StatusBadRequest},
+		{"gaps window backwards", func() error { _, err := rounds.ListObservationGaps(ctx, "patient1", end, start); return err }, http.StatusBadRequest},
+		{"unknown dataset", func() error { _, err := rounds.Export(ctx, "patients", client.ExportParams{}); return err }, http.StatusBadRequest},
+		{"sheet in an unknown zone", func() error {
+			_, err := rounds.GetRoundsSheet(ctx, client.RoundsSheetParams{TZ: "Mars/Olympus_Mons"})
+			return err
+		}, http.StatusBadRequest},
+		{"sync snapshot for negative hours", func() error { _, err := rounds.SyncDownload(ctx, "", start, -1); return err }, http.StatusBadRequest},
+		{"sync upload without a device", func() error { _, err := rounds.SyncUpload(ctx, client.SyncUpload{}); return err }, http.StatusBadRequest},
+		{"amending a round off the schedule", func() error {
+			_, err := rounds.AmendRoundStatus(ctx, client.RoundStatusAmendmentInput{RoundTimestamp: "2022-01-10T09:07:00Z", Status: "COMPLETE", ReasonCode: "LATE_ENTRY", StaffId: "nurseB"})
+			return err
+		}, http.StatusBadRequest},
+		{"amending an unknown round member", func() error {
+			_, err := rounds.AmendObservation(ctx, 9999, client.ObservationAmendmentInput{Observation: "AWAKE", ReasonCode: "LATE_ENTRY"})
+			return err
+		}, http.StatusNotFound},
+		{"amending an observation without a reason", func() error {
+			_, err := rounds.AmendObservation(ctx, results[0].RoundMember.Id, client.ObservationAmendmentInput{Observation: "AWAKE"})
+			return err
+		}, http.StatusBadRequest},
+		{"contact without a channel", func() error {
+			_, err := rounds.AddEscalationContact(ctx, client.EscalationContactInput{Tier: "SUPERVISOR", Address: "x"})
+			return err
+		}, http.StatusBadRequest},
+		{"notifications without staff", func() error { _, err := rounds.ListNotifications(ctx, "", false); return err }, http.StatusBadRequest},
+		{"unknown notification", func() error { _, err := rounds.MarkNotificationRead(ctx, 9999); return err }, http.StatusNotFound},
+		{"subscription without a url", func() error {
+			_, err := rounds.AddWebhookSubscription(ctx, client.WebhookSubscriptionInput{URL: "mailto:ops"})
+			return err
+		}, http.StatusBadRequest},
+		{"replaying twice", func() error { _, err := rounds.ReplayWebhookDeadLetter(ctx, deadLetters[0].Id); return err }, http.StatusBadRequest},
+	}
+	for _, failure := range failures {
+		var apiError *client.Error
+		if err := failure.call(); !errors.As(err, &apiError) || apiError.StatusCode != failure.status || apiError.Message == "" {
+			t.Errorf("%s: expected a %d error with a message, got %v", failure.name, failure.status, err)
+		}
+	}
+
+	// Ids in the path that aren't numbers can't be sent through the typed client
+	for _, path := range []string{"/round-members/abc/amendments", "/notifications/abc/read", "/webhook-subscriptions/abc/deliveries", "/webhook-dead-letters/abc/replay"} {
+		method := http.MethodPost
+		if strings.HasSuffix(path, "deliveries") {
+			method = http.MethodGet
+		}
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := rounds.HTTPClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	resp, err := rounds.HTTPClient.Get(server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// Every response matches the document, and every documented response was seen
+	seen := make(map[string]bool)
+	for _, exchange := range recorder.exchanges {
+		key, problems := checkContractExchange(document, exchange)
+		seen[key] = true
+		for _, problem := range problems {
+			t.Error(problem)
+		}
+	}
+	for path, item := range document["paths"].(map[string]interface{}) {
+		for method, operation := range item.(map[string]interface{}) {
+			for status := range operation.(map[string]interface{})["responses"].(map[string]interface{}) {
+				key := fmt.Sprintf("%s %s %s", strings.ToUpper(method), path, status)
+				if !seen[key] {
+					t.Errorf("No contract test covers %s", key)
+				}
+			}
+		}
+	}
+}
+
+// The document itself has the parts tools rely on
+func TestOpenAPIDocument(t *testing.T) {
+	document := loadOpenAPIDocument(t)
+	if document["openapi"] != "3.0.3" {
+		t.Errorf("Expected OpenAPI 3.0.3, got %v", document["openapi"])
+	}
+
+	operationIds := make(map[string]bool)
+	for path, item := range document["paths"].(map[string]interface{}) {
+		for method, operation := range item.(map[string]interface{}) {
+			operationId, _ := operation.(map[string]interface{})["operationId"].(string)
+			if operationId == "" || operationIds[operationId] {
+				t.Errorf("Expected a unique operationId for %s %s, got %q", method, path, operationId)
+			}
+			operationIds[operationId] = true
+		}
+	}
+
+	// Every $ref points at something
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch node := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := node["$ref"].(string); ok {
+				var target interface{} = document
+				for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+					object, _ := target.(map[string]interface{})
+					target = object[part]
+				}
+				if target == nil {
+					t.Errorf("Unresolved $ref %s", ref)
+				}
+			}
+			for _, child := range node {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range node {
+				walk(child)
+			}
+		}
+	}
+	walk(document)
+}
@@ -2,29 +2,40 @@ package main
 
 import (
 	"time"
-
-	"gorm.io/gorm"
 )
 
 // Create rounds for a given current time
 // In production, whatever async task runner we use would call this function and pass in the appropriate time
-func CreateRounds(db *gorm.DB, currTime time.Time) {
+// Only one scheduler creates rounds at a time, so instances running this at once don't fill the same window twice
+func CreateRounds(store RoundsStore, currTime time.Time) {
+	err := store.WithSchedulingLock(func() error {
+		createRounds(store, currTime)
+		return nil
+	})
+	if err != nil {
+		panic("Failed to take the scheduling lock")
+	}
+}
+
+func createRounds(store RoundsStore, currTime time.Time) {
 	// Fetch all round configs for clinic
-	roundConfigs, err := getRoundConfigs(db)
+	roundConfigs, err := store.GetRoundConfigs()
 	if err != nil {
 		panic("Failed to get round configs")
 	}
 
+	// Most recent round per round type, looked up before any rounds are created
+	// Configs for different units can share a round type, and each of them needs to fill the same window
+	lastRounds := make(map[uint]Round)
+
 	for _, roundConfig := range roundConfigs {
 		// If round config is not enabled, skip
 		if !roundConfig.Enabled {
 			continue
 		}
 
-		// TODO: the "enabled time window" logic would go here
-
 		// Get the round type for this config
-		roundType, err := getRoundType(db, roundConfig.RoundTypeId)
+		roundType, err := store.GetRoundType(roundConfig.RoundTypeId)
 		if err != nil {
 			panic("Failed to get round types")
 		}
@@ -36,19 +47,23 @@ func CreateRounds(db *gorm.DB, currTime time.Time) {
 		}
 
 		// Get the most recent round of this type
-		lastRound, err := getLastRoundForType(db, roundType.ID)
-		if err != nil {
-			panic("Failed to get last round")
+		lastRound, ok := lastRounds[roundType.ID]
+		if !ok {
+			lastRound, err = store.GetLastRoundForType(roundType.ID)
+			if err != nil {
+				panic("Failed to get last round")
+			}
+			lastRounds[roundType.ID] = lastRound
 		}
 
 		// Given a last round (if any), and a round type, fill the time window with rounds
-		fillTimeWithRounds(db, lastRound, roundType, currTime)
+		fillTimeWithRounds(store, lastRound, roundType, roundConfig, currTime)
 	}
 }
 
 // Given a last round (if any), and a round type, fill the time window with rounds
-// Eventually, we would need to pass along building/program info here to get the right patients to add to the round
-func fillTimeWithRounds(db *gorm.DB, lastRound Round, roundType RoundType, currTime time.Time) {
+// Slots outside the round config's window are stepped over, so rounds stay on the round type's schedule
+func fillTimeWithRounds(store RoundsStore, lastRound Round, roundType RoundType, roundConfig RoundConfig, currTime time.Time) {
 	// Declare start time as 12 hours before the current time
 	startTime := currTime.Add(-12 * time.Hour)
 
@@ -62,9 +77,14 @@ func fillTimeWithRounds(db *gorm.DB, lastRound Round, roundType RoundType, currT
 	tempTime := startTime
 
 	// Walk forward in time, creating rounds as needed, until we reach the current time
-	for !tempTime.After(currTime) {
+	for ; !tempTime.After(currTime); tempTime = tempTime.Add(time.Duration(roundType.DurationAmt) * time.Minute) {
+		// Skip times outside the config's window
+		if !roundConfigActiveAt(roundConfig, tempTime) {
+			continue
+		}
+
 		// Look to see if a round already exists for this time
-		round, err := getRoundForTime(db, tempTime)
+		round, err := store.GetRoundForTime(tempTime)
 		if err != nil {
 			panic("Failed to get round for time")
 		}
@@ -73,33 +93,43 @@ func fillTimeWithRounds(db *gorm.DB, lastRound Round, roundType RoundType, currT
 		if round.ID == 0 {
 			// Create a new round
 			round = Round{
-				RoundTimestamp: tempTime.Format(time.RFC3339),
+				RoundTimestamp: tempTime.UTC().Format(time.RFC3339),
 				Status:         "CREATED",
 			}
-			db.Create(&round)
+			// The round and its created event are written together so webhook subscribers hear about every round
+			if err := store.CreateRound(&round, currTime); err != nil {
+				panic("Failed to create round")
+			}
 		}
 
-		// Add the round type to the round round type table
-		db.Create(&RoundRoundType{
-			RoundID:     round.ID,
-			RoundTypeID: roundType.ID,
-		})
+		// Add the round type to the round round type table, unless another config already did
+		hasRoundType, err := store.RoundHasRoundType(round.ID, roundType.ID)
+		if err != nil {
+			panic("Failed to get round round types")
+		}
+		if !hasRoundType {
+			err := store.CreateRoundRoundType(&RoundRoundType{
+				RoundID:     round.ID,
+				RoundTypeID: roundType.ID,
+			})
+			if err != nil {
+				panic("Failed to create round round type")
+			}
+		}
 
 		// Add members to the round
-		// Eventually, we would need to pass along building/program info here to get the right patients to add to the round
-		addMembersToRound(db, round.ID, roundType.ID)
-
-		// Move to the next time slice
-		tempTime = tempTime.Add(time.Duration(roundType.DurationAmt) * time.Minute)
+		addMembersToRound(store, round.ID, roundType.ID, roundConfig.Unit, tempTime)
 	}
 
 }
 
 // Add members to the round
-// Eventually, we would need to pass along building/program info here to get the right patients to add to the round
-func addMembersToRound(db *gorm.DB, roundId uint, roundTypeId uint) {
+// Only assignments that were active at the round's timestamp are used, so backfilled rounds get the patients assigned at that time
+// Patients who were discharged, not yet admitted, or off the config's unit at the round time are left out
+// Patients on leave of absence are added with a LEAVE_OF_ABSENCE status so the round shows why they were not observed
+func addMembersToRound(store RoundsStore, roundId uint, roundTypeId uint, unit string, roundTime time.Time) {
 	// Get existing round members for this roundId
-	roundMembers, err := getRoundMembersForRound(db, roundId)
+	roundMembers, err := store.GetRoundMembersForRound(roundId)
 	if err != nil {
 		panic("Failed to get round members")
 	}
@@ -110,20 +140,65 @@ func addMembersToRound(db *gorm.DB, roundId uint, roundTypeId uint) {
 		patientIds[roundMember.PatientId] = true
 	}
 
-	// Get round assignments for this roundTypeId
-	roundAssignments, err := getRoundAssignmentsForRoundType(db, roundTypeId)
+	// Get round assignments for this roundTypeId that were active at the round time
+	roundAssignments, err := store.GetRoundAssignmentsForRoundType(roundTypeId, roundTime)
 	if err != nil {
 		panic("Failed to get round assignments")
 	}
 
 	// Iterate through round assignments, adding any new patients to the round
 	for _, roundAssignment := range roundAssignments {
-		// If patient id is not in the set, add it
-		if _, ok := patientIds[roundAssignment.PatientId]; !ok {
-			db.Create(&RoundMember{
-				RoundId:   roundId,
-				PatientId: roundAssignment.PatientId,
-			})
+		// If patient id is already in the set, skip
+		if _, ok := patientIds[roundAssignment.PatientId]; ok {
+			continue
 		}
+
+		roundMember, include := memberForCensus(store, roundId, roundAssignment.PatientId, unit, roundTime)
+		if !include {
+			continue
+		}
+		if err := store.CreateRoundMember(&roundMember); err != nil {
+			panic("Failed to create round member")
+		}
+		patientIds[roundAssignment.PatientId] = true
+	}
+}
+
+// Build the round member for a patient based on their census at the round time
+// Returns false if the patient should not be on the round
+func memberForCensus(store RoundsStore, roundId uint, patientId string, unit string, roundTime time.Time) (RoundMember, bool) {
+	roundMember := RoundMember{
+		RoundId:   roundId,
+		PatientId: patientId,
+	}
+
+	// Patients without a census record are added as before, so free-form patient ids keep working
+	patient, err := store.GetPatient(patientId)
+	if err != nil {
+		panic("Failed to get patient")
+	}
+	if patient.ID == 0 {
+		return roundMember, true
+	}
+
+	census, err := store.GetPatientCensusAtTime(patientId, roundTime)
+	if err != nil {
+		panic("Failed to get patient census")
+	}
+
+	// Not admitted yet, or already discharged
+	if census.ID == 0 || census.CensusStatus == "DISCHARGED" {
+		return roundMember, false
+	}
+
+	// Off the unit this round config covers
+	if unit != "" && census.Unit != unit {
+		return roundMember, false
+	}
+
+	roundMember.Unit = census.Unit
+	if census.CensusStatus == "ON_LEAVE" {
+		roundMember.Status = "LEAVE_OF_ABSENCE"
 	}
+	return roundMember, true
 }
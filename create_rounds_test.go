@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -207,60 +208,177 @@ func TestCreateRounds(t *testing.T) {
 		},
 	}
 
-	for _, tt := range tests {
-		db := setupDatabase()
-		setupRoundConfigs(db)
+	for _, database := range testDatabases() {
+		t.Run(database.name, func(t *testing.T) {
+			for _, tt := range tests {
+				db := database.setup()
+				setupRoundConfigs(db)
 
-		// Create existing rounds
-		for _, round := range tt.existingRounds {
-			db.Create(&round)
-		}
-		// Create existing round-round-types
-		for _, roundRoundType := range tt.existingRoundRoundTypes {
-			db.Create(&roundRoundType)
-		}
-		// Create existing round members
-		for _, roundMember := range tt.existingRoundMembers {
-			db.Create(&roundMember)
-		}
+				// Create existing rounds
+				for _, round := range tt.existingRounds {
+					db.Create(&round)
+				}
+				// Create existing round-round-types
+				for _, roundRoundType := range tt.existingRoundRoundTypes {
+					db.Create(&roundRoundType)
+				}
+				// Create existing round members
+				for _, roundMember := range tt.existingRoundMembers {
+					db.Create(&roundMember)
+				}
+				resetTestSequences(db)
 
-		// Call CreateRounds
-		CreateRounds(db, tt.currTime)
+				// Call CreateRounds
+				CreateRounds(NewGormRoundsStore(db), tt.currTime)
 
-		// Get rounds with types by joining round_round_types and grouping by round id and timestamp
-		var roundsWithTypes []*RoundWithTypesAndMembers
-		db.Table("rounds").
-			Select("rounds.id, round_timestamp, group_concat(name) as round_types").
-			Joins("JOIN round_round_types ON rounds.id = round_round_types.round_id").
-			Joins("JOIN round_types ON round_round_types.round_type_id = round_types.id").
-			Group("rounds.id, round_timestamp").
-			Scan(&roundsWithTypes)
+				// Get rounds with types by joining round_round_types and grouping by round id and timestamp
+				var roundsWithTypes []*RoundWithTypesAndMembers
+				db.Table("rounds").
+					Select("rounds.id, round_timestamp, " + groupConcatSQL(db, "name") + " as round_types").
+					Joins("JOIN round_round_types ON rounds.id = round_round_types.round_id").
+					Joins("JOIN round_types ON round_round_types.round_type_id = round_types.id").
+					Group("rounds.id, round_timestamp").
+					Order("rounds.id").
+					Scan(&roundsWithTypes)
 
-		//Compare with expected
-		if len(roundsWithTypes) != tt.expectedRoundsCount {
-			t.Errorf("Expected %d rounds, got %d", len(tt.expectedRounds), len(roundsWithTypes))
-		}
-		for i := range tt.expectedRounds {
-			if roundsWithTypes[i].ID != tt.expectedRounds[i].ID ||
-				roundsWithTypes[i].RoundTimestamp != tt.expectedRounds[i].RoundTimestamp {
-				t.Errorf("Expected %v, got %v", tt.expectedRounds[i], roundsWithTypes[i])
+				//Compare with expected
+				if len(roundsWithTypes) != tt.expectedRoundsCount {
+					t.Errorf("Expected %d rounds, got %d", len(tt.expectedRounds), len(roundsWithTypes))
+				}
+				for i := range tt.expectedRounds {
+					if roundsWithTypes[i].ID != tt.expectedRounds[i].ID ||
+						roundsWithTypes[i].RoundTimestamp != tt.expectedRounds[i].RoundTimestamp {
+						t.Errorf("Expected %v, got %v", tt.expectedRounds[i], roundsWithTypes[i])
+					}
+				}
+
+				// Get rounds with members by joining round_members and grouping by round id and timestamp
+				var roundsWithMembers []*RoundWithTypesAndMembers
+				db.Table("rounds").
+					Select("rounds.id, round_timestamp, " + groupConcatSQL(db, "patient_id") + " as round_members").
+					Joins("JOIN round_members ON rounds.id = round_members.round_id").
+					Group("rounds.id, round_timestamp").
+					Order("rounds.id").
+					Scan(&roundsWithMembers)
+
+				//Compare with expected
+				for i := range tt.expectedRounds {
+					if roundsWithMembers[i].ID != tt.expectedRounds[i].ID ||
+						roundsWithMembers[i].RoundTimestamp != tt.expectedRounds[i].RoundTimestamp {
+						t.Errorf("Expected %v, got %v", tt.expectedRounds[i], roundsWithMembers[i])
+					}
+				}
 			}
-		}
+		})
+	}
+}
+
+func TestCreateRoundsUsesAssignmentEffectiveDates(t *testing.T) {
+	for _, database := range testDatabases() {
+		t.Run(database.name, func(t *testing.T) {
+			db := database.setup()
+			setupRoundConfigs(db)
+
+			// Existing round from 60 minutes ago, so rounds are backfilled for the last hour
+			db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T08:30:00Z", Status: "CREATED"})
+			for _, roundTypeId := range []uint{1, 2, 3} {
+				db.Create(&RoundRoundType{RoundID: 1, RoundTypeID: roundTypeId})
+			}
+			resetTestSequences(db)
+
+			// Patient 4 was on 30 minute rounds from 8:45 until 9:15
+			db.Create(&RoundAssignment{
+				RoundTypeId:   2,
+				PatientId:     "patient4",
+				EffectiveFrom: "2022-01-10T08:45:00Z",
+				EffectiveTo:   "2022-01-10T09:15:00Z",
+			})
+			// Patient 5 was put on 15 minute rounds at 9:20
+			db.Create(&RoundAssignment{
+				RoundTypeId:   1,
+				PatientId:     "patient5",
+				EffectiveFrom: "2022-01-10T09:20:00Z",
+			})
+
+			CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC))
+
+			expectedMembers := map[string]string{
+				"2022-01-10T08:45:00Z": "patient1",
+				"2022-01-10T09:00:00Z": "patient1,patient2,patient4",
+				"2022-01-10T09:15:00Z": "patient1",
+				"2022-01-10T09:30:00Z": "patient1,patient2,patient3,patient5",
+			}
+
+			var roundsWithMembers []*RoundWithTypesAndMembers
+			db.Table("rounds").
+				Select("rounds.id, round_timestamp, " + groupConcatSQL(db, "patient_id") + " as round_members").
+				Joins("JOIN (SELECT round_id, patient_id FROM round_members ORDER BY patient_id) m ON rounds.id = m.round_id").
+				Where("rounds.id > 1").
+				Group("rounds.id, round_timestamp").
+				Scan(&roundsWithMembers)
 
-		// Get rounds with members by joining round_members and grouping by round id and timestamp
-		var roundsWithMembers []*RoundWithTypesAndMembers
-		db.Table("rounds").
-			Select("rounds.id, round_timestamp, group_concat(patient_id) as round_members").
-			Joins("JOIN round_members ON rounds.id = round_members.round_id").
-			Group("rounds.id, round_timestamp").
-			Scan(&roundsWithMembers)
+			if len(roundsWithMembers) != len(expectedMembers) {
+				t.Fatalf("Expected %d rounds, got %d", len(expectedMembers), len(roundsWithMembers))
+			}
+			for _, round := range roundsWithMembers {
+				if round.RoundMembers != expectedMembers[round.RoundTimestamp] {
+					t.Errorf("Expected members %v at %v, got %v", expectedMembers[round.RoundTimestamp], round.RoundTimestamp, round.RoundMembers)
+				}
+			}
+		})
+	}
+}
+
+// An hourly round type with a clinic-wide config from 22:00 to 02:00, and patient1 on it
+func setupNightRounds(t *testing.T, db *gorm.DB) RoundType {
+	t.Helper()
+	roundType, _ := AddRoundType(db, RoundType{Name: "Night Round", DurationAmt: 60})
+	if _, err := AddRoundConfig(db, RoundConfig{RoundTypeId: roundType.ID, Enabled: true, WindowStart: "22:00", WindowEnd: "02:00"}); err != nil {
+		t.Fatalf("Failed to add round config: %v", err)
+	}
+	db.Create(&RoundAssignment{RoundTypeId: roundType.ID, PatientId: "patient1"})
+	return roundType
+}
+
+func TestCreateRoundsWithinWindow(t *testing.T) {
+	for _, database := range testDatabases() {
+		t.Run(database.name, func(t *testing.T) {
+			db := database.setup()
+			roundType := setupNightRounds(t, db)
+			db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T20:00:00Z", Status: "COMPLETE"})
+			db.Create(&RoundRoundType{RoundID: 1, RoundTypeID: roundType.ID})
+			resetTestSequences(db)
 
-		//Compare with expected
-		for i := range tt.expectedRounds {
-			if roundsWithMembers[i].ID != tt.expectedRounds[i].ID ||
-				roundsWithMembers[i].RoundTimestamp != tt.expectedRounds[i].RoundTimestamp {
-				t.Errorf("Expected %v, got %v", tt.expectedRounds[i], roundsWithMembers[i])
+			// The window runs overnight, and the slots outside it are stepped over without moving the schedule
+			store := NewGormRoundsStore(db)
+			CreateRounds(store, time.Date(2022, time.January, 11, 4, 30, 0, 0, time.UTC))
+			CreateRounds(store, time.Date(2022, time.January, 11, 22, 0, 0, 0, time.UTC))
+
+			var timestamps []string
+			db.Model(&Round{}).Where("id > 1").Order("round_timestamp").Pluck("round_timestamp", &timestamps)
+			expected := []string{
+				"2022-01-10T22:00:00Z", "2022-01-10T23:00:00Z", "2022-01-11T00:00:00Z", "2022-01-11T01:00:00Z",
+				"2022-01-11T22:00:00Z",
+			}
+			if strings.Join(timestamps, ",") != strings.Join(expected, ",") {
+				t.Errorf("Expected rounds at %v, got %v", expected, timestamps)
+			}
+			if count := countRows(db, "round_members"); count != int64(len(expected)) {
+				t.Errorf("Expected patient1 on each round in the window, got %d members", count)
 			}
+		})
+	}
+}
+
+func TestValidateRoundConfigWindow(t *testing.T) {
+	for _, window := range [][2]string{{"", ""}, {"08:00", "20:00"}, {"22:00", "06:00"}} {
+		if err := validateRoundConfigWindow(window[0], window[1]); err != nil {
+			t.Errorf("Expected %v to be valid, got %v", window, err)
+		}
+	}
+	for _, window := range [][2]string{{"08:00", ""}, {"8:00", "20:00"}, {"08:00", "24:00"}, {"08:00", "08:00"}} {
+		if err := validateRoundConfigWindow(window[0], window[1]); err == nil {
+			t.Errorf("Expected %v to be invalid", window)
 		}
 	}
 }
@@ -13,10 +13,12 @@ func getRoundConfigs(db *gorm.DB) ([]RoundConfig, error) {
 	return roundConfigs, nil
 }
 
-// Get all rounds for clinic from start time to end time
+// Get all rounds for clinic from start time to end time, in round time order
 func getRounds(db *gorm.DB, startTime time.Time, endTime time.Time) ([]Round, error) {
 	var rounds []Round
-	db.Where("round_timestamp >= ? AND round_timestamp <= ?", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339)).Find(&rounds)
+	db.Where("round_timestamp >= ? AND round_timestamp <= ?", startTime.UTC().Format(time.RFC3339), endTime.UTC().Format(time.RFC3339)).
+		Order("round_timestamp, id").
+		Find(&rounds)
 	return rounds, nil
 }
 
@@ -37,10 +39,17 @@ func getLastRoundForType(db *gorm.DB, roundTypeId uint) (Round, error) {
 	return round, nil
 }
 
+// Check whether a round already has a given round type
+func roundHasRoundType(db *gorm.DB, roundId uint, roundTypeId uint) (bool, error) {
+	var count int64
+	db.Model(&RoundRoundType{}).Where("round_id = ? AND round_type_id = ?", roundId, roundTypeId).Count(&count)
+	return count > 0, nil
+}
+
 // Get the round for a given time
 func getRoundForTime(db *gorm.DB, t time.Time) (Round, error) {
 	var round Round
-	db.Where("round_timestamp = ?", t.Format(time.RFC3339)).First(&round)
+	db.Where("round_timestamp = ?", t.UTC().Format(time.RFC3339)).First(&round)
 	return round, nil
 }
 
@@ -51,9 +60,223 @@ func getRoundMembersForRound(db *gorm.DB, roundId uint) ([]RoundMember, error) {
 	return roundMembers, nil
 }
 
-// Get round assignments for a given round type id
-func getRoundAssignmentsForRoundType(db *gorm.DB, roundTypeId uint) ([]RoundAssignment, error) {
+// Get round assignments for a given round type id that were active at a given time
+func getRoundAssignmentsForRoundType(db *gorm.DB, roundTypeId uint, t time.Time) ([]RoundAssignment, error) {
+	var roundAssignments []RoundAssignment
+	db.Where("round_type_id = ?", roundTypeId).
+		Where("(effective_from IS NULL OR effective_from = '' OR effective_from <= ?)", t.UTC().Format(time.RFC3339)).
+		Where("(effective_to IS NULL OR effective_to = '' OR effective_to > ?)", t.UTC().Format(time.RFC3339)).
+		Find(&roundAssignments)
+	return roundAssignments, nil
+}
+
+// Get round by ID
+func getRound(db *gorm.DB, roundId uint) (Round, error) {
+	var round Round
+	db.Where("id = ?", roundId).First(&round)
+	return round, nil
+}
+
+// Get round member by ID
+func getRoundMember(db *gorm.DB, roundMemberId uint) (RoundMember, error) {
+	var roundMember RoundMember
+	db.Where("id = ?", roundMemberId).First(&roundMember)
+	return roundMember, nil
+}
+
+// Get all amendments for the given round ids
+func getAmendmentsForRounds(db *gorm.DB, roundIds []uint) ([]RoundAmendment, error) {
+	var amendments []RoundAmendment
+	if len(roundIds) == 0 {
+		return amendments, nil
+	}
+	db.Where("round_id IN ?", roundIds).Order("amended_at").Find(&amendments)
+	return amendments, nil
+}
+
+// Get patient by their patient id
+func getPatient(db *gorm.DB, patientId string) (Patient, error) {
+	var patient Patient
+	db.Where("patient_id = ?", patientId).First(&patient)
+	return patient, nil
+}
+
+// Get the receipt for an ADT message that was already applied, by its sender and MSH-10 control ID
+func getHL7MessageReceipt(db *gorm.DB, sendingApplication string, sendingFacility string, controlId string) (HL7MessageReceipt, error) {
+	var receipt HL7MessageReceipt
+	db.Where("sending_application = ? AND sending_facility = ? AND control_id = ?", sendingApplication, sendingFacility, controlId).First(&receipt)
+	return receipt, nil
+}
+
+// Get the census event that was in effect for a patient at a given time
+func getPatientCensusAtTime(db *gorm.DB, patientId string, t time.Time) (PatientCensusEvent, error) {
+	var censusEvent PatientCensusEvent
+	db.Where("patient_id = ? AND effective_at <= ?", patientId, t.UTC().Format(time.RFC3339)).
+		Order("effective_at desc, id desc").
+		First(&censusEvent)
+	return censusEvent, nil
+}
+
+// Get the census events for a patient that took effect after start time, up to and including end time, in order
+func getPatientCensusEvents(db *gorm.DB, patientId string, startTime time.Time, endTime time.Time) ([]PatientCensusEvent, error) {
+	var censusEvents []PatientCensusEvent
+	db.Where("patient_id = ? AND effective_at > ? AND effective_at <= ?", patientId, startTime.UTC().Format(time.RFC3339), endTime.UTC().Format(time.RFC3339)).
+		Order("effective_at, id").
+		Find(&censusEvents)
+	return censusEvents, nil
+}
+
+// Get the open round assignments for a patient, i.e. ones with no end date
+func getOpenRoundAssignmentsForPatient(db *gorm.DB, patientId string) ([]RoundAssignment, error) {
+	var roundAssignments []RoundAssignment
+	db.Where("patient_id = ? AND (effective_to IS NULL OR effective_to = '')", patientId).Find(&roundAssignments)
+	return roundAssignments, nil
+}
+
+// Get the round members for a set of round ids
+func getRoundMembersForRounds(db *gorm.DB, roundIds []uint) ([]RoundMember, error) {
+	var roundMembers []RoundMember
+	if len(roundIds) == 0 {
+		return roundMembers, nil
+	}
+	db.Where("round_id IN ?", roundIds).Order("round_id, patient_id").Find(&roundMembers)
+	return roundMembers, nil
+}
+
+// Get all round assignments for a patient, including ended ones
+func getRoundAssignmentsForPatient(db *gorm.DB, patientId string) ([]RoundAssignment, error) {
 	var roundAssignments []RoundAssignment
-	db.Where("round_type_id = ?", roundTypeId).Find(&roundAssignments)
+	db.Where("patient_id = ?", patientId).Find(&roundAssignments)
 	return roundAssignments, nil
 }
+
+// Get the round members for a patient that were observed from start time to end time, oldest first
+func getObservedRoundMembersForPatient(db *gorm.DB, patientId string, startTime time.Time, endTime time.Time) ([]RoundMember, error) {
+	var roundMembers []RoundMember
+	db.Where("patient_id = ? AND observed_at >= ? AND observed_at <= ?", patientId, startTime.UTC().Format(time.RFC3339), endTime.UTC().Format(time.RFC3339)).
+		Order("observed_at").
+		Find(&roundMembers)
+	return roundMembers, nil
+}
+
+// Get the most recent observed round member for a patient at or before a given time
+func getLastObservedRoundMemberForPatient(db *gorm.DB, patientId string, t time.Time) (RoundMember, error) {
+	var roundMember RoundMember
+	db.Where("patient_id = ? AND observed_at <> '' AND observed_at <= ?", patientId, t.UTC().Format(time.RFC3339)).
+		Order("observed_at desc").
+		First(&roundMember)
+	return roundMember, nil
+}
+
+// Get the patient ids with a round assignment active at a given time
+func getAssignedPatientIds(db *gorm.DB, t time.Time) ([]string, error) {
+	var patientIds []string
+	db.Model(&RoundAssignment{}).
+		Where("(effective_from IS NULL OR effective_from = '' OR effective_from <= ?)", t.UTC().Format(time.RFC3339)).
+		Where("(effective_to IS NULL OR effective_to = '' OR effective_to > ?)", t.UTC().Format(time.RFC3339)).
+		Distinct().
+		Order("patient_id").
+		Pluck("patient_id", &patientIds)
+	return patientIds, nil
+}
+
+// Get the escalation contacts for a unit and tier. An empty unit gets the clinic-wide contacts
+func getEscalationContacts(db *gorm.DB, unit string, tier string) ([]EscalationContact, error) {
+	var contacts []EscalationContact
+	db.Where("unit = ? AND tier = ?", unit, tier).Order("id").Find(&contacts)
+	return contacts, nil
+}
+
+// Get the notification for an event about a round sent to a contact, if there is one
+func getNotification(db *gorm.DB, event string, roundTimestamp string, unit string, contactId uint) (Notification, error) {
+	var notification Notification
+	db.Where("event = ? AND round_timestamp = ? AND unit = ? AND contact_id = ?", event, roundTimestamp, unit, contactId).First(&notification)
+	return notification, nil
+}
+
+// Get the notification about a patient for an event, such as an observation gap starting at a given time, sent to a contact
+func getPatientNotification(db *gorm.DB, event string, patientId string, roundTimestamp string, contactId uint) (Notification, error) {
+	var notification Notification
+	db.Where("event = ? AND patient_id = ? AND round_timestamp = ? AND contact_id = ?", event, patientId, roundTimestamp, contactId).First(&notification)
+	return notification, nil
+}
+
+// Get the latest notification about a patient for an event sent to a contact
+func getLatestPatientNotification(db *gorm.DB, event string, patientId string, contactId uint) (Notification, error) {
+	var notification Notification
+	db.Where("event = ? AND patient_id = ? AND contact_id = ?", event, patientId, contactId).Order("round_timestamp desc, id desc").First(&notification)
+	return notification, nil
+}
+
+// Get the in-app notifications for a staff member, newest first
+func getInAppNotifications(db *gorm.DB, address string, unreadOnly bool) ([]Notification, error) {
+	var notifications []Notification
+	query := db.Where("channel = ? AND address = ? AND sent_at <> ''", "in_app", address)
+	if unreadOnly {
+		query = query.Where("read_at = ''")
+	}
+	query.Order("sent_at desc, id desc").Find(&notifications)
+	return notifications, nil
+}
+
+// Get a page of rounds from start time to end time, inclusive, in timestamp order
+// Statuses and round type ids narrow the rounds when they aren't empty, and a limit of 0 gets every round
+func getRoundsPage(db *gorm.DB, startTime string, endTime string, statuses []string, roundTypeIds []uint, descending bool, limit int) ([]Round, error) {
+	var rounds []Round
+	query := db.Where("round_timestamp >= ? AND round_timestamp <= ?", startTime, endTime)
+	if len(statuses) > 0 {
+		query = query.Where("status IN ?", statuses)
+	}
+	if len(roundTypeIds) > 0 {
+		query = query.Where("EXISTS (SELECT 1 FROM round_round_types WHERE round_round_types.round_id = rounds.id "+
+			"AND round_round_types.round_type_id IN ?)", roundTypeIds)
+	}
+	if descending {
+		query = query.Order("round_timestamp desc")
+	} else {
+		query = query.Order("round_timestamp")
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	query.Find(&rounds)
+	return rounds, nil
+}
+
+// Get which of the given round timestamps already have a round
+func getExistingRoundTimestamps(db *gorm.DB, roundTimestamps []string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	if len(roundTimestamps) == 0 {
+		return existing, nil
+	}
+	var found []string
+	db.Model(&Round{}).Where("round_timestamp IN ?", roundTimestamps).Pluck("round_timestamp", &found)
+	for _, roundTimestamp := range found {
+		existing[roundTimestamp] = true
+	}
+	return existing, nil
+}
+
+// Get round assignment by ID
+func getRoundAssignment(db *gorm.DB, roundAssignmentId uint) (RoundAssignment, error) {
+	var roundAssignment RoundAssignment
+	db.Where("id = ?", roundAssignmentId).First(&roundAssignment)
+	return roundAssignment, nil
+}
+
+// Get a sync operation by the client id the device gave it
+func getSyncOperation(db *gorm.DB, clientId string) (SyncOperation, error) {
+	var operation SyncOperation
+	db.Where("client_id = ?", clientId).First(&operation)
+	return operation, nil
+}
+
+// Get the client id of the latest applied sync operation of one of the types that set a value at a device time,
+// or empty if it was set online
+func getAppliedSyncClientId(db *gorm.DB, roundTimestamp string, patientId string, deviceTime string, types []string) (string, error) {
+	var operation SyncOperation
+	db.Where("round_timestamp = ? AND patient_id = ? AND device_time = ? AND outcome = ? AND type IN ?", roundTimestamp, patientId, deviceTime, "APPLIED", types).
+		Order("id desc").
+		First(&operation)
+	return operation.ClientId, nil
+}
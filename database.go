@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// The Postgres advisory lock CreateRounds holds, so only one instance schedules rounds at a time
+const schedulingLockKey int64 = 0x726f756e6473 // "rounds"
+
+// SQLite has no advisory locks, so only the schedulers in this process are kept apart. One in another process, such as
+// create-rounds next to serve, can fill the same window, and CreateRound's upsert keeps it from creating a round twice
+var sqliteSchedulingLock sync.Mutex
+
+// The Postgres advisory lock MigrateSchema holds, so instances starting at once don't run the same migration twice
+const migrationLockKey int64 = 0x6d696772617465 // "migrate"
+
+// SQLite's stand-in for the migration lock, which like sqliteSchedulingLock only covers this process
+var sqliteMigrationLock sync.Mutex
+
+// Every model in the current schema. Migrations create the tables; this list is for checking and clearing them
+var schemaModels = []interface{}{
+	&RoundType{},
+	&RoundConfig{},
+	&RoundAssignment{},
+	&Round{},
+	&RoundRoundType{},
+	&RoundMember{},
+	&RoundAmendment{},
+	&Patient{},
+	&PatientCensusEvent{},
+	&EscalationContact{},
+	&Notification{},
+	&OutboxEvent{},
+	&WebhookSubscription{},
+	&WebhookDelivery{},
+	&WebhookDeliveryAttempt{},
+	&WebhookDeadLetter{},
+	&SyncOperation{},
+	&RetentionHold{},
+	&ArchivedRound{},
+	&ArchivedRoundRoundType{},
+	&ArchivedRoundMember{},
+	&ArchivedRoundAmendment{},
+	&QuarantinedRow{},
+	&HL7MessageReceipt{},
+}
+
+// Pick the driver for a database. A postgres:// or postgresql:// URL, or a key=value DSN such as
+// "host=db user=rounds dbname=rounds", opens Postgres. Anything else is the path to a SQLite file
+func dialectorFor(dsn string) gorm.Dialector {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") || strings.HasPrefix(dsn, "host=") {
+		return postgres.Open(dsn)
+	}
+	// SQLite only enforces foreign keys on connections that ask for it
+	if strings.Contains(dsn, "?") {
+		return sqlite.Open(dsn + "&_foreign_keys=on")
+	}
+	return sqlite.Open(dsn + "?_foreign_keys=on")
+}
+
+func isPostgres(db *gorm.DB) bool {
+	return db.Dialector.Name() == "postgres"
+}
+
+// Run fn holding a lock for key. Postgres takes a session advisory lock, which works across instances
+// SQLite has no advisory locks, so sqliteLock keeps fn apart from other callers in this process only
+func withDatabaseLock(db *gorm.DB, key int64, sqliteLock *sync.Mutex, fn func() error) error {
+	if !isPostgres(db) {
+		sqliteLock.Lock()
+		defer sqliteLock.Unlock()
+		return fn()
+	}
+
+	// The lock belongs to the connection that took it, so it is taken and released on one reserved connection
+	return db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", key).Error; err != nil {
+			return err
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?)", key)
+		return fn()
+	})
+}
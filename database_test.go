@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"gorm.io/gorm"
+)
+
+// A database the engine suites run against
+type testDatabase struct {
+	name  string
+	setup func() *gorm.DB
+}
+
+// The Postgres database the suites run against, set by TestMain, or empty when Postgres is turned off
+var testPostgresURL string
+
+// Run the suites against Postgres as well as SQLite. ROUNDS_TEST_POSTGRES_URL points them at a scratch database the
+// tests can empty, and without it an embedded Postgres is started for the run. Its binaries are downloaded the first
+// time and cached, and it won't run as root, so if it can't start the Postgres pass is skipped and only SQLite runs
+// ROUNDS_TEST_POSTGRES=off runs SQLite only without trying, and ROUNDS_TEST_POSTGRES=on fails the run instead of skipping
+func TestMain(m *testing.M) {
+	stop := func() {}
+	if os.Getenv("ROUNDS_TEST_POSTGRES") != "off" {
+		testPostgresURL = os.Getenv("ROUNDS_TEST_POSTGRES_URL")
+		if testPostgresURL == "" {
+			var err error
+			testPostgresURL, stop, err = startEmbeddedPostgres()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to start embedded Postgres: %v\n"+
+					"Set ROUNDS_TEST_POSTGRES_URL to a scratch database to run the Postgres pass\n", err)
+				if os.Getenv("ROUNDS_TEST_POSTGRES") == "on" {
+					os.Exit(1)
+				}
+				fmt.Fprintln(os.Stderr, "Skipping the Postgres pass, running SQLite only")
+				testPostgresURL, stop = "", func() {}
+			}
+		}
+	}
+
+	if testPostgresURL != "" {
+		roundsStoreFactories["postgres"] = func() RoundsStore { return NewGormRoundsStore(setupPostgresDatabase(testPostgresURL)) }
+	}
+
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// Start a throwaway Postgres on a free port, returning its URL and how to stop it
+func startEmbeddedPostgres() (string, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	dir, err := os.MkdirTemp("", "rounds-postgres-")
+	if err != nil {
+		return "", nil, err
+	}
+	config := embeddedpostgres.DefaultConfig().
+		Port(uint32(port)).
+		Database("rounds_test").
+		RuntimePath(filepath.Join(dir, "runtime")).
+		DataPath(filepath.Join(dir, "data")).
+		Logger(io.Discard)
+	postgres := embeddedpostgres.NewDatabase(config)
+	if err := postgres.Start(); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	stop := func() {
+		postgres.Stop()
+		os.RemoveAll(dir)
+	}
+	return config.GetConnectionURL() + "?sslmode=disable", stop, nil
+}
+
+// SQLite always, and Postgres unless it is turned off
+func testDatabases() []testDatabase {
+	databases := []testDatabase{{name: "sqlite", setup: setupDatabase}}
+	if testPostgresURL != "" {
+		databases = append(databases, testDatabase{name: "postgres", setup: func() *gorm.DB {
+			return setupPostgresDatabase(testPostgresURL)
+		}})
+	}
+	return databases
+}
+
+// Drop every table so each test starts fresh, the same as removing test.db does for SQLite
+func setupPostgresDatabase(url string) *gorm.DB {
+	db, err := connectDatabase(url)
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Migrator().DropTable(append(schemaModels, &SchemaVersion{})...); err != nil {
+		panic("failed to drop tables")
+	}
+	db, err = openDatabase(url)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// Concatenate a column within a group, ordered by its value
+func groupConcatSQL(db *gorm.DB, column string) string {
+	if isPostgres(db) {
+		return fmt.Sprintf("string_agg(%s, ',' ORDER BY %s)", column, column)
+	}
+	return fmt.Sprintf("group_concat(%s)", column)
+}
+
+// Postgres doesn't move a table's id sequence past rows inserted with explicit IDs, so tests that seed them catch it up
+func resetTestSequences(db *gorm.DB) {
+	if !isPostgres(db) {
+		return
+	}
+	for _, table := range []string{"rounds", "round_round_types", "round_members"} {
+		db.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s", table, table))
+	}
+}
+
+func TestDialectorFor(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		expected string
+	}{
+		{dsn: "test.db", expected: "sqlite"},
+		{dsn: "/var/lib/rounds/rounds.db", expected: "sqlite"},
+		{dsn: "postgres://rounds@localhost/rounds", expected: "postgres"},
+		{dsn: "postgresql://rounds@localhost/rounds", expected: "postgres"},
+		{dsn: "host=localhost user=rounds dbname=rounds", expected: "postgres"},
+	}
+	for _, tt := range tests {
+		if name := dialectorFor(tt.dsn).Name(); name != tt.expected {
+			t.Errorf("Expected %v for %v, got %v", tt.expected, tt.dsn, name)
+		}
+	}
+}
+
+func TestCreateRoundKeepsExistingRoundForTimestamp(t *testing.T) {
+	for _, database := range testDatabases() {
+		t.Run(database.name, func(t *testing.T) {
+			db := database.setup()
+			store := NewGormRoundsStore(db)
+			at := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+
+			first := Round{RoundTimestamp: "2022-01-10T09:30:00Z", Status: "CREATED"}
+			if err := store.CreateRound(&first, at); err != nil {
+				t.Fatalf("Failed to create round: %v", err)
+			}
+
+			// A second round at the same time, from a scheduler in another process, hands back the first
+			second := Round{RoundTimestamp: "2022-01-10T09:30:00Z", Status: "CREATED"}
+			if err := store.CreateRound(&second, at); err != nil {
+				t.Fatalf("Failed to upsert round: %v", err)
+			}
+			if second.ID != first.ID {
+				t.Errorf("Expected the existing round %d, got %d", first.ID, second.ID)
+			}
+
+			var rounds, events int64
+			db.Model(&Round{}).Count(&rounds)
+			db.Model(&OutboxEvent{}).Count(&events)
+			if rounds != 1 || events != 1 {
+				t.Errorf("Expected 1 round and 1 event, got %d rounds and %d events", rounds, events)
+			}
+		})
+	}
+}
+
+func TestCreateRoundsConcurrentSchedulers(t *testing.T) {
+	for _, database := range testDatabases() {
+		t.Run(database.name, func(t *testing.T) {
+			db := database.setup()
+			setupRoundConfigs(db)
+			currTime := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+
+			// Each scheduler has its own store, as separate instances would
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					CreateRounds(NewGormRoundsStore(db), currTime)
+				}()
+			}
+			wg.Wait()
+
+			var rounds, roundRoundTypes, events int64
+			db.Model(&Round{}).Count(&rounds)
+			db.Model(&RoundRoundType{}).Count(&roundRoundTypes)
+			db.Model(&OutboxEvent{}).Count(&events)
+			// 49 15 minute, 25 30 minute and 13 60 minute round types over the last 12 hours
+			if rounds != 49 || roundRoundTypes != 87 || events != 49 {
+				t.Errorf("Expected 49 rounds, 87 round types and 49 events, got %d, %d and %d", rounds, roundRoundTypes, events)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSchedulingLock(t *testing.T) {
+	store := NewMemoryRoundsStore()
+	seedRoundsStore(t, store)
+	currTime := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			CreateRounds(store, currTime)
+		}()
+	}
+	wg.Wait()
+
+	rounds, _ := store.GetRounds(currTime.Add(-12*time.Hour), currTime)
+	if len(rounds) != len(store.OutboxEvents()) {
+		t.Errorf("Expected one event per round, got %d rounds and %d events", len(rounds), len(store.OutboxEvents()))
+	}
+	seen := make(map[string]bool)
+	for _, round := range rounds {
+		if seen[round.RoundTimestamp] {
+			t.Errorf("Round at %v was created twice", round.RoundTimestamp)
+		}
+		seen[round.RoundTimestamp] = true
+	}
+}
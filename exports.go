@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Layout for timestamps in exports, in the export's location
+const exportTimeLayout = "2006-01-02 15:04:05"
+
+type ExportOptions struct {
+	Dataset   string
+	Format    string
+	StartTime time.Time
+	EndTime   time.Time
+	// Only rounds with members on this unit, and only those members. Empty for the whole clinic
+	Unit     string
+	Columns  []string
+	Location *time.Location
+	// Compliance rounds less than missedRoundAfter before Now are still pending. Defaults to the end time
+	Now time.Time
+}
+
+// A dataset that can be exported
+// Rows are handed to emit one at a time as column name -> value, so nothing is held in memory beyond the current row
+type exportDataset struct {
+	columns        []string
+	defaultColumns []string
+	numeric        map[string]bool
+	rows           func(db *gorm.DB, options ExportOptions, emit func(map[string]string) error) error
+}
+
+var exportDatasets = map[string]exportDataset{
+	"rounds": {
+		columns:        []string{"roundId", "roundTimestamp", "status", "startedAt", "startedBy", "completedAt", "completedBy"},
+		defaultColumns: []string{"roundId", "roundTimestamp", "status", "startedAt", "startedBy", "completedAt", "completedBy"},
+		numeric:        map[string]bool{"roundId": true},
+		rows:           exportRoundRows,
+	},
+	"members": {
+		columns:        []string{"roundId", "roundTimestamp", "roundStatus", "memberId", "patientId", "unit", "memberStatus", "observation", "observedAt", "observedBy", "amended", "lateEntry"},
+		defaultColumns: []string{"roundId", "roundTimestamp", "roundStatus", "memberId", "patientId", "unit", "memberStatus", "observation", "observedAt", "observedBy"},
+		numeric:        map[string]bool{"roundId": true, "memberId": true},
+		rows:           exportMemberRows(false),
+	},
+	"observations": {
+		columns:        []string{"roundId", "roundTimestamp", "roundStatus", "memberId", "patientId", "unit", "memberStatus", "observation", "observedAt", "observedBy", "amended", "lateEntry"},
+		defaultColumns: []string{"roundTimestamp", "patientId", "unit", "observation", "observedAt", "observedBy", "amended", "lateEntry"},
+		numeric:        map[string]bool{"roundId": true, "memberId": true},
+		rows:           exportMemberRows(true),
+	},
+	"compliance": {
+		columns:        []string{"group", "key", "total", "onTime", "late", "missed", "pending", "onTimeRate", "lateRate", "missedRate", "medianLatenessMinutes"},
+		defaultColumns: []string{"group", "key", "total", "onTime", "late", "missed", "pending", "onTimeRate", "lateRate", "missedRate", "medianLatenessMinutes"},
+		numeric:        map[string]bool{"total": true, "onTime": true, "late": true, "missed": true, "pending": true, "onTimeRate": true, "lateRate": true, "missedRate": true, "medianLatenessMinutes": true},
+		rows:           exportComplianceRows,
+	},
+}
+
+// Check the export options and fill in defaults, returning the dataset to export
+func validateExportOptions(options *ExportOptions) (exportDataset, error) {
+	dataset, ok := exportDatasets[options.Dataset]
+	if !ok {
+		return dataset, fmt.Errorf("unknown dataset %q", options.Dataset)
+	}
+	if options.Format != "csv" && options.Format != "xlsx" {
+		return dataset, fmt.Errorf("unknown format %q, expected csv or xlsx", options.Format)
+	}
+	if options.Location == nil {
+		options.Location = time.UTC
+	}
+
+	if len(options.Columns) == 0 {
+		options.Columns = dataset.defaultColumns
+	}
+	available := make(map[string]bool)
+	for _, column := range dataset.columns {
+		available[column] = true
+	}
+	for _, column := range options.Columns {
+		if !available[column] {
+			return dataset, fmt.Errorf("unknown column %q for %s, expected one of %s", column, options.Dataset, strings.Join(dataset.columns, ", "))
+		}
+	}
+	return dataset, nil
+}
+
+// Stream an export of a dataset to a writer as CSV or XLSX. Archived rounds are exported along with live ones
+func WriteExport(db *gorm.DB, w io.Writer, options ExportOptions) error {
+	dataset, err := validateExportOptions(&options)
+	if err != nil {
+		return err
+	}
+
+	var writeRow func([]string) error
+	var finish func() error
+	if options.Format == "xlsx" {
+		numeric := make([]bool, len(options.Columns))
+		for i, column := range options.Columns {
+			numeric[i] = dataset.numeric[column]
+		}
+		xw, err := newXLSXWriter(w, options.Dataset, numeric)
+		if err != nil {
+			return err
+		}
+		writeRow = xw.WriteRow
+		finish = xw.Close
+	} else {
+		cw := csv.NewWriter(w)
+		writeRow = cw.Write
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	}
+
+	if err := writeRow(options.Columns); err != nil {
+		return err
+	}
+
+	values := make([]string, len(options.Columns))
+	err = dataset.rows(db, options, func(row map[string]string) error {
+		for i, column := range options.Columns {
+			values[i] = row[column]
+			if !dataset.numeric[column] || !xlsxNumber.MatchString(values[i]) {
+				values[i] = escapeFormula(values[i])
+			}
+		}
+		return writeRow(values)
+	})
+	if err != nil {
+		return err
+	}
+
+	return finish()
+}
+
+// Prefix text that a spreadsheet would read as a formula with a quote, so it's shown rather than run
+// Staff ids, patient ids and notes come from clients, so they can't be trusted to be plain text
+func escapeFormula(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// Format a stored RFC3339 timestamp in the export's location
+func localizeTimestamp(value string, location *time.Location) string {
+	if value == "" {
+		return ""
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	return t.In(location).Format(exportTimeLayout)
+}
+
+// A row from the rounds or round members export queries. Member fields are empty for rounds
+type exportRow struct {
+	RoundId        uint
+	RoundTimestamp string
+	RoundStatus    string
+	StartedAt      string
+	StartedBy      string
+	CompletedAt    string
+	CompletedBy    string
+	MemberId       uint
+	PatientId      string
+	Unit           string
+	MemberStatus   string
+	Observation    string
+	ObservedAt     string
+	ObservedBy     string
+	Amended        bool
+	LateEntry      bool
+}
+
+// Scan rows from a query one at a time
+func scanExportRows(db *gorm.DB, query *gorm.DB, emit func(exportRow) error) error {
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row exportRow
+		if err := db.ScanRows(rows, &row); err != nil {
+			return err
+		}
+		if err := emit(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func exportRoundRows(db *gorm.DB, options ExportOptions, emit func(map[string]string) error) error {
+	query := db.Table("report_rounds AS rounds").
+		Select("rounds.id AS round_id, rounds.round_timestamp, rounds.status AS round_status, rounds.started_at, rounds.started_by, rounds.completed_at, rounds.completed_by").
+		Where("rounds.round_timestamp >= ? AND rounds.round_timestamp <= ?", options.StartTime.UTC().Format(time.RFC3339), options.EndTime.UTC().Format(time.RFC3339)).
+		Order("rounds.round_timestamp, rounds.id")
+	if options.Unit != "" {
+		query = query.Where("EXISTS (SELECT 1 FROM report_round_members AS round_members WHERE round_members.round_id = rounds.id AND round_members.unit = ?)", options.Unit)
+	}
+
+	return scanExportRows(db, query, func(row exportRow) error {
+		return emit(map[string]string{
+			"roundId":        strconv.FormatUint(uint64(row.RoundId), 10),
+			"roundTimestamp": localizeTimestamp(row.RoundTimestamp, options.Location),
+			"status":         row.RoundStatus,
+			"startedAt":      localizeTimestamp(row.StartedAt, options.Location),
+			"startedBy":      row.StartedBy,
+			"completedAt":    localizeTimestamp(row.CompletedAt, options.Location),
+			"completedBy":    row.CompletedBy,
+		})
+	})
+}
+
+// Export round members, or only the ones with an observation
+func exportMemberRows(observedOnly bool) func(db *gorm.DB, options ExportOptions, emit func(map[string]string) error) error {
+	return func(db *gorm.DB, options ExportOptions, emit func(map[string]string) error) error {
+		query := db.Table("report_round_members AS round_members").
+			Select("rounds.id AS round_id, rounds.round_timestamp, rounds.status AS round_status, "+
+				"round_members.id AS member_id, round_members.patient_id, round_members.unit, round_members.status AS member_status, "+
+				"round_members.observation, round_members.observed_at, round_members.observed_by, "+
+				"EXISTS (SELECT 1 FROM report_round_amendments AS round_amendments WHERE round_amendments.round_member_id = round_members.id AND round_amendments.late_entry = ?) AS amended, "+
+				"EXISTS (SELECT 1 FROM report_round_amendments AS round_amendments WHERE round_amendments.round_member_id = round_members.id AND round_amendments.late_entry = ?) AS late_entry", false, true).
+			Joins("JOIN report_rounds AS rounds ON rounds.id = round_members.round_id").
+			Where("rounds.round_timestamp >= ? AND rounds.round_timestamp <= ?", options.StartTime.UTC().Format(time.RFC3339), options.EndTime.UTC().Format(time.RFC3339)).
+			Order("rounds.round_timestamp, round_members.patient_id, round_members.id")
+		if options.Unit != "" {
+			query = query.Where("round_members.unit = ?", options.Unit)
+		}
+		if observedOnly {
+			query = query.Where("round_members.observation <> ''")
+		}
+
+		return scanExportRows(db, query, func(row exportRow) error {
+			return emit(map[string]string{
+				"roundId":        strconv.FormatUint(uint64(row.RoundId), 10),
+				"roundTimestamp": localizeTimestamp(row.RoundTimestamp, options.Location),
+				"roundStatus":    row.RoundStatus,
+				"memberId":       strconv.FormatUint(uint64(row.MemberId), 10),
+				"patientId":      row.PatientId,
+				"unit":           row.Unit,
+				"memberStatus":   row.MemberStatus,
+				"observation":    row.Observation,
+				"observedAt":     localizeTimestamp(row.ObservedAt, options.Location),
+				"observedBy":     row.ObservedBy,
+				"amended":        strconv.FormatBool(row.Amended),
+				"lateEntry":      strconv.FormatBool(row.LateEntry),
+			})
+		})
+	}
+}
+
+// Export the compliance report as one row per group and key, e.g. "unit", "B"
+// The report is a summary, so it is small enough to build in memory
+func exportComplianceRows(db *gorm.DB, options ExportOptions, emit func(map[string]string) error) error {
+	report, err := BuildComplianceReport(db, ComplianceFilter{
+		StartTime: options.StartTime,
+		EndTime:   options.EndTime,
+		Unit:      options.Unit,
+		Location:  options.Location,
+		Now:       options.Now,
+	})
+	if err != nil {
+		return err
+	}
+
+	groups := []struct {
+		name  string
+		stats map[string]*ComplianceStats
+	}{
+		{"overall", map[string]*ComplianceStats{"": report.Overall}},
+		{"unit", report.ByUnit},
+		{"roundType", report.ByRoundType},
+		{"shift", report.ByShift},
+		{"staff", report.ByStaff},
+	}
+	for _, group := range groups {
+		for _, key := range sortedKeys(group.stats) {
+			stats := group.stats[key]
+			err := emit(map[string]string{
+				"group":                 group.name,
+				"key":                   key,
+				"total":                 strconv.Itoa(stats.Total),
+				"onTime":                strconv.Itoa(stats.OnTime),
+				"late":                  strconv.Itoa(stats.Late),
+				"missed":                strconv.Itoa(stats.Missed),
+				"pending":               strconv.Itoa(stats.Pending),
+				"onTimeRate":            strconv.FormatFloat(stats.OnTimeRate, 'f', 4, 64),
+				"lateRate":              strconv.FormatFloat(stats.LateRate, 'f', 4, 64),
+				"missedRate":            strconv.FormatFloat(stats.MissedRate, 'f', 4, 64),
+				"medianLatenessMinutes": strconv.FormatFloat(stats.MedianLatenessMinutes, 'f', 1, 64),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys(stats map[string]*ComplianceStats) []string {
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func setupExportRounds(t *testing.T) *gorm.DB {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+
+	db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T09:00:00Z", Status: "COMPLETE", StartedAt: "2022-01-10T09:01:00Z", StartedBy: "nurseA", CompletedAt: "2022-01-10T09:05:00Z", CompletedBy: "nurseA"})
+	db.Create(&Round{ID: 2, RoundTimestamp: "2022-01-10T09:15:00Z", Status: "STARTED", StartedAt: "2022-01-10T09:16:00Z", StartedBy: "nurseB"})
+	db.Create(&RoundMember{ID: 1, RoundId: 1, PatientId: "patient1", Unit: "A", Observation: "SLEEPING", ObservedAt: "2022-01-10T09:02:00Z", ObservedBy: "nurseA"})
+	db.Create(&RoundMember{ID: 2, RoundId: 1, PatientId: "007", Unit: "B", Observation: "DAYROOM", ObservedAt: "2022-01-10T09:03:00Z", ObservedBy: "nurseA"})
+	db.Create(&RoundMember{ID: 3, RoundId: 2, PatientId: "patient1", Unit: "A"})
+
+	if _, err := AmendObservation(NewGormRoundsStore(db), 2, "GROUP", "DOCUMENTATION_ERROR", "", time.Date(2022, time.January, 10, 9, 20, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("AmendObservation failed: %v", err)
+	}
+	return db
+}
+
+func readCSVExport(t *testing.T, db *gorm.DB, options ExportOptions) [][]string {
+	var buf bytes.Buffer
+	if err := WriteExport(db, &buf, options); err != nil {
+		t.Fatalf("WriteExport failed: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+	return records
+}
+
+func TestWriteExportCSV(t *testing.T) {
+	db := setupExportRounds(t)
+	newYork, _ := time.LoadLocation("America/New_York")
+	startTime := time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC)
+	endTime := time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		options  ExportOptions
+		expected [][]string
+	}{
+		{
+			name:    "Rounds with the default columns",
+			options: ExportOptions{Dataset: "rounds", Format: "csv", StartTime: startTime, EndTime: endTime},
+			expected: [][]string{
+				{"roundId", "roundTimestamp", "status", "startedAt", "startedBy", "completedAt", "completedBy"},
+				{"1", "2022-01-10 09:00:00", "COMPLETE", "2022-01-10 09:01:00", "nurseA", "2022-01-10 09:05:00", "nurseA"},
+				{"2", "2022-01-10 09:15:00", "STARTED", "2022-01-10 09:16:00", "nurseB", "", ""},
+			},
+		},
+		{
+			name:    "Observations with chosen columns in New York time",
+			options: ExportOptions{Dataset: "observations", Format: "csv", StartTime: startTime, EndTime: endTime, Columns: []string{"patientId", "observation", "observedAt", "amended"}, Location: newYork},
+			expected: [][]string{
+				{"patientId", "observation", "observedAt", "amended"},
+				{"007", "GROUP", "2022-01-10 04:03:00", "true"},
+				{"patient1", "SLEEPING", "2022-01-10 04:02:00", "false"},
+			},
+		},
+		{
+			name:    "Members scoped to unit A",
+			options: ExportOptions{Dataset: "members", Format: "csv", StartTime: startTime, EndTime: endTime, Unit: "A", Columns: []string{"roundId", "memberId", "unit", "observation"}},
+			expected: [][]string{
+				{"roundId", "memberId", "unit", "observation"},
+				{"1", "1", "A", "SLEEPING"},
+				{"2", "3", "A", ""},
+			},
+		},
+		{
+			name:    "Rounds scoped to unit B",
+			options: ExportOptions{Dataset: "rounds", Format: "csv", StartTime: startTime, EndTime: endTime, Unit: "B", Columns: []string{"roundId"}},
+			expected: [][]string{
+				{"roundId"},
+				{"1"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		records := readCSVExport(t, db, tt.options)
+		if len(records) != len(tt.expected) {
+			t.Fatalf("%s: expected %d records, got %v", tt.name, len(tt.expected), records)
+		}
+		for i, expectedRecord := range tt.expected {
+			if strings.Join(records[i], "|") != strings.Join(expectedRecord, "|") {
+				t.Errorf("%s: expected record %d to be %v, got %v", tt.name, i, expectedRecord, records[i])
+			}
+		}
+	}
+}
+
+func TestWriteExportCompliance(t *testing.T) {
+	db := setupExportRounds(t)
+
+	records := readCSVExport(t, db, ExportOptions{
+		Dataset:   "compliance",
+		Format:    "csv",
+		StartTime: time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2022, time.January, 10, 9, 15, 0, 0, time.UTC),
+		Columns:   []string{"group", "key", "total"},
+		Now:       time.Date(2022, time.January, 10, 12, 0, 0, 0, time.UTC),
+	})
+	if len(records) < 2 {
+		t.Fatalf("Expected a header and rows, got %v", records)
+	}
+	if strings.Join(records[1], "|") != "overall||2" {
+		t.Errorf("Expected the overall row first with 2 rounds, got %v", records[1])
+	}
+}
+
+func TestWriteExportXLSX(t *testing.T) {
+	db := setupExportRounds(t)
+
+	var buf bytes.Buffer
+	err := WriteExport(db, &buf, ExportOptions{
+		Dataset:   "observations",
+		Format:    "xlsx",
+		StartTime: time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC),
+		Columns:   []string{"memberId", "patientId", "observation"},
+	})
+	if err != nil {
+		t.Fatalf("WriteExport failed: %v", err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Export is not a zip: %v", err)
+	}
+	parts := make(map[string]string)
+	for _, f := range reader.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", f.Name, err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[f.Name] = string(content)
+	}
+
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("Expected part %s in the workbook", name)
+		}
+	}
+
+	sheet := parts["xl/worksheets/sheet1.xml"]
+	expected := []string{
+		`<c r="A1" t="inlineStr"><is><t xml:space="preserve">memberId</t></is></c>`,
+		// Member ids are numbers, patient ids stay text so 007 keeps its leading zeros
+		`<c r="A2"><v>2</v></c>`,
+		`<c r="B2" t="inlineStr"><is><t xml:space="preserve">007</t></is></c>`,
+		`<c r="C3" t="inlineStr"><is><t xml:space="preserve">SLEEPING</t></is></c>`,
+	}
+	for _, fragment := range expected {
+		if !strings.Contains(sheet, fragment) {
+			t.Errorf("Expected the sheet to contain %s, got %s", fragment, sheet)
+		}
+	}
+	if !strings.HasSuffix(sheet, "</sheetData></worksheet>") {
+		t.Errorf("Expected the sheet to be closed, got %s", sheet)
+	}
+}
+
+// Text that a spreadsheet would run as a formula is written with a leading quote, in CSV and XLSX alike
+func TestWriteExportEscapesFormulas(t *testing.T) {
+	db := setupExportRounds(t)
+	db.Create(&Round{ID: 3, RoundTimestamp: "2022-01-10T09:30:00Z", Status: "STARTED"})
+	db.Create(&RoundMember{ID: 4, RoundId: 3, PatientId: "+1", Unit: "@SUM(A1)", Observation: "-2+3", ObservedBy: `=HYPERLINK("http://example.com","x")`})
+	options := ExportOptions{
+		Dataset:   "members",
+		StartTime: time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC),
+		EndTime:   time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC),
+		Columns:   []string{"roundId", "observedBy", "patientId", "unit", "observation"},
+	}
+
+	options.Format = "csv"
+	records := readCSVExport(t, db, options)
+	expected := []string{"3", `'=HYPERLINK("http://example.com","x")`, "'+1", "'@SUM(A1)", "'-2+3"}
+	if len(records) != 2 || strings.Join(records[1], "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected %v, got %v", expected, records)
+	}
+
+	options.Format = "xlsx"
+	var buf bytes.Buffer
+	if err := WriteExport(db, &buf, options); err != nil {
+		t.Fatalf("WriteExport failed: %v", err)
+	}
+	reader, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	sheet, _ := reader.Open("xl/worksheets/sheet1.xml")
+	content, _ := io.ReadAll(sheet)
+	for _, fragment := range []string{
+		`<c r="A2"><v>3</v></c>`,
+		`<c r="B2" t="inlineStr"><is><t xml:space="preserve">&#39;=HYPERLINK(&#34;http://example.com&#34;,&#34;x&#34;)</t></is></c>`,
+		`<c r="E2" t="inlineStr"><is><t xml:space="preserve">&#39;-2+3</t></is></c>`,
+	} {
+		if !strings.Contains(string(content), fragment) {
+			t.Errorf("Expected the sheet to contain %s, got %s", fragment, content)
+		}
+	}
+}
+
+func TestWriteExportInvalidOptions(t *testing.T) {
+	db := setupExportRounds(t)
+
+	invalid := []ExportOptions{
+		{Dataset: "patients", Format: "csv"},
+		{Dataset: "rounds", Format: "pdf"},
+		{Dataset: "rounds", Format: "csv", Columns: []string{"roundId", "observation"}},
+	}
+	for _, options := range invalid {
+		if err := WriteExport(db, io.Discard, options); err == nil {
+			t.Errorf("Expected an error exporting %+v", options)
+		}
+	}
+}
+
+func TestExportEndpoint(t *testing.T) {
+	db := setupExportRounds(t)
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/exports/rounds?start=2022-01-10T08:00:00Z&end=2022-01-10T10:00:00Z&columns=roundId,status&tz=Europe/London")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != `attachment; filename="rounds.csv"` {
+		t.Errorf("Expected a rounds.csv attachment, got %q", disposition)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "roundId,status\n1,COMPLETE\n2,STARTED\n" {
+		t.Errorf("Unexpected export %q", body)
+	}
+
+	resp, err = http.Get(server.URL + "/exports/rounds?columns=nope")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown column, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Code system for the codes used on exported resources
+const fhirRoundsCodeSystem = "urn:rounds:codes"
+
+// Minimal FHIR R4 resource shapes for exporting rounds. Only the elements we populate are declared
+type FHIRBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Timestamp    string            `json:"timestamp"`
+	Entry        []FHIRBundleEntry `json:"entry,omitempty"`
+}
+
+type FHIRBundleEntry struct {
+	Resource interface{} `json:"resource"`
+}
+
+type FHIRReference struct {
+	Reference string `json:"reference"`
+}
+
+type FHIRCoding struct {
+	System  string `json:"system"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+type FHIRCodeableConcept struct {
+	Coding []FHIRCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+type FHIRPeriod struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+type FHIRAnnotation struct {
+	Time string `json:"time,omitempty"`
+	Text string `json:"text"`
+}
+
+// A Round is exported as a Task, since a round covers many patients and an Encounter belongs to one
+type FHIRTask struct {
+	ResourceType    string              `json:"resourceType"`
+	Id              string              `json:"id"`
+	Status          string              `json:"status"`
+	Intent          string              `json:"intent"`
+	Code            FHIRCodeableConcept `json:"code"`
+	Description     string              `json:"description,omitempty"`
+	ExecutionPeriod FHIRPeriod          `json:"executionPeriod"`
+	AuthoredOn      string              `json:"authoredOn,omitempty"`
+	Output          []FHIRTaskOutput    `json:"output,omitempty"`
+}
+
+type FHIRTaskOutput struct {
+	Type           FHIRCodeableConcept `json:"type"`
+	ValueReference FHIRReference       `json:"valueReference"`
+}
+
+// An observed RoundMember is exported as an Observation on the patient
+type FHIRObservation struct {
+	ResourceType         string                `json:"resourceType"`
+	Id                   string                `json:"id"`
+	Status               string                `json:"status"`
+	Category             []FHIRCodeableConcept `json:"category"`
+	Code                 FHIRCodeableConcept   `json:"code"`
+	Subject              FHIRReference         `json:"subject"`
+	EffectiveDateTime    string                `json:"effectiveDateTime"`
+	Issued               string                `json:"issued,omitempty"`
+	ValueCodeableConcept FHIRCodeableConcept   `json:"valueCodeableConcept"`
+	Note                 []FHIRAnnotation      `json:"note,omitempty"`
+}
+
+// Round status -> FHIR Task status
+var fhirTaskStatuses = map[string]string{
+	"CREATED":  "requested",
+	"STARTED":  "in-progress",
+	"COMPLETE": "completed",
+	"MISSED":   "failed",
+}
+
+// Characters not allowed in a FHIR id
+var fhirIdInvalidChars = regexp.MustCompile(`[^A-Za-z0-9\-.]`)
+
+// Build a FHIR id from one of our identifiers. FHIR ids are limited to 64 characters of [A-Za-z0-9-.]
+func fhirId(value string) string {
+	id := fhirIdInvalidChars.ReplaceAllString(value, "-")
+	if len(id) > 64 {
+		id = id[:64]
+	}
+	return id
+}
+
+// Build a FHIR collection Bundle of the rounds in a time window, including archived rounds
+// Each round is a Task, followed by an Observation for each of its members that has an observation
+func BuildRoundsBundle(db *gorm.DB, startTime time.Time, endTime time.Time, now time.Time) (FHIRBundle, error) {
+	bundle := FHIRBundle{
+		ResourceType: "Bundle",
+		Type:         "collection",
+		Timestamp:    now.UTC().Format(time.RFC3339),
+	}
+
+	rounds, err := getRounds(withArchived(db, "rounds"), startTime, endTime)
+	if err != nil {
+		return bundle, err
+	}
+
+	var roundIds []uint
+	for _, round := range rounds {
+		roundIds = append(roundIds, round.ID)
+	}
+
+	roundMembers, err := getRoundMembersForRounds(withArchived(db, "round_members"), roundIds)
+	if err != nil {
+		return bundle, err
+	}
+	membersByRound := make(map[uint][]RoundMember)
+	for _, roundMember := range roundMembers {
+		membersByRound[roundMember.RoundId] = append(membersByRound[roundMember.RoundId], roundMember)
+	}
+
+	// Observation amendments by round member, so amended observations are exported as such
+	amendments, err := getAmendmentsForRounds(withArchived(db, "round_amendments"), roundIds)
+	if err != nil {
+		return bundle, err
+	}
+	memberAmendments := make(map[uint][]RoundAmendment)
+	for _, amendment := range amendments {
+		if amendment.Field == "observation" {
+			memberAmendments[amendment.RoundMemberId] = append(memberAmendments[amendment.RoundMemberId], amendment)
+		}
+	}
+
+	for _, round := range rounds {
+		task := roundToFHIRTask(round)
+		var observations []FHIRObservation
+		for _, roundMember := range membersByRound[round.ID] {
+			if roundMember.Observation == "" {
+				continue
+			}
+			observation := roundMemberToFHIRObservation(round, roundMember, memberAmendments[roundMember.ID])
+			observations = append(observations, observation)
+			task.Output = append(task.Output, FHIRTaskOutput{
+				Type:           FHIRCodeableConcept{Text: "Round observation"},
+				ValueReference: FHIRReference{Reference: "Observation/" + observation.Id},
+			})
+		}
+
+		bundle.Entry = append(bundle.Entry, FHIRBundleEntry{Resource: task})
+		for _, observation := range observations {
+			bundle.Entry = append(bundle.Entry, FHIRBundleEntry{Resource: observation})
+		}
+	}
+
+	return bundle, nil
+}
+
+// Map a round to a FHIR Task
+func roundToFHIRTask(round Round) FHIRTask {
+	status, ok := fhirTaskStatuses[round.Status]
+	if !ok {
+		status = "requested"
+	}
+
+	return FHIRTask{
+		ResourceType: "Task",
+		Id:           fmt.Sprintf("round-%d", round.ID),
+		Status:       status,
+		Intent:       "order",
+		Code: FHIRCodeableConcept{
+			Coding: []FHIRCoding{{System: fhirRoundsCodeSystem, Code: "safety-round", Display: "Safety round"}},
+		},
+		Description:     "Safety round at " + round.RoundTimestamp,
+		ExecutionPeriod: FHIRPeriod{Start: round.RoundTimestamp},
+		AuthoredOn:      round.CreatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// Map an observed round member to a FHIR Observation
+// Amended observations get the "amended" status, and every amendment or late entry adds a note with its reason
+func roundMemberToFHIRObservation(round Round, roundMember RoundMember, amendments []RoundAmendment) FHIRObservation {
+	effective := roundMember.ObservedAt
+	if effective == "" {
+		effective = round.RoundTimestamp
+	}
+
+	observation := FHIRObservation{
+		ResourceType: "Observation",
+		Id:           fmt.Sprintf("round-member-%d", roundMember.ID),
+		Status:       "final",
+		Category: []FHIRCodeableConcept{{
+			Coding: []FHIRCoding{{
+				System:  "http://terminology.hl7.org/CodeSystem/observation-category",
+				Code:    "exam",
+				Display: "Exam",
+			}},
+		}},
+		Code: FHIRCodeableConcept{
+			Coding: []FHIRCoding{{System: fhirRoundsCodeSystem, Code: "round-observation", Display: "Safety round observation"}},
+		},
+		Subject:           FHIRReference{Reference: "Patient/" + fhirId(roundMember.PatientId)},
+		EffectiveDateTime: effective,
+		ValueCodeableConcept: FHIRCodeableConcept{
+			Coding: []FHIRCoding{{System: fhirRoundsCodeSystem, Code: fhirId(roundMember.Observation)}},
+			Text:   roundMember.Observation,
+		},
+	}
+
+	// Issued is when the value was last charted, which for a late entry or amendment is after the effective time
+	for _, amendment := range amendments {
+		observation.Issued = amendment.AmendedAt
+		text := fmt.Sprintf("Late entry (%s)", amendment.ReasonCode)
+		if !amendment.LateEntry {
+			observation.Status = "amended"
+			text = fmt.Sprintf("Amended from %q (%s)", amendment.OriginalValue, amendment.ReasonCode)
+		}
+		if amendment.Note != "" {
+			text += ": " + amendment.Note
+		}
+		observation.Note = append(observation.Note, FHIRAnnotation{Time: amendment.AmendedAt, Text: strings.TrimSpace(text)})
+	}
+
+	return observation
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Patterns from the FHIR R4 datatype definitions
+var (
+	fhirIdPattern        = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`)
+	fhirDateTimePattern  = regexp.MustCompile(`^([0-9]{4})(-(0[1-9]|1[0-2])(-(0[1-9]|[12][0-9]|3[01])(T([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?(Z|(\+|-)((0[0-9]|1[0-3]):[0-5][0-9]|14:00)))?)?)?$`)
+	fhirInstantPattern   = regexp.MustCompile(`^([0-9]{4})-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01])T([01][0-9]|2[0-3]):[0-5][0-9]:([0-5][0-9]|60)(\.[0-9]+)?(Z|(\+|-)((0[0-9]|1[0-3]):[0-5][0-9]|14:00))$`)
+	fhirReferencePattern = regexp.MustCompile(`^[A-Z][A-Za-z]+/[A-Za-z0-9\-.]{1,64}$`)
+)
+
+// Value sets for the required coded elements we populate
+var fhirValueSets = map[string]map[string]bool{
+	"Bundle.type":        {"document": true, "message": true, "transaction": true, "transaction-response": true, "batch": true, "batch-response": true, "history": true, "searchset": true, "collection": true},
+	"Task.status":        {"draft": true, "requested": true, "received": true, "accepted": true, "rejected": true, "ready": true, "cancelled": true, "in-progress": true, "on-hold": true, "failed": true, "completed": true, "entered-in-error": true},
+	"Task.intent":        {"unknown": true, "proposal": true, "plan": true, "order": true, "original-order": true, "reflex-order": true, "filler-order": true, "instance-order": true, "option": true},
+	"Observation.status": {"registered": true, "preliminary": true, "final": true, "amended": true, "corrected": true, "cancelled": true, "entered-in-error": true, "unknown": true},
+}
+
+// Check a decoded JSON value against the FHIR JSON rules that apply to every element:
+// no empty strings, objects or arrays, and no nulls
+func validateFHIRElements(t *testing.T, path string, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		t.Errorf("%s: null values are not allowed", path)
+	case string:
+		if v == "" {
+			t.Errorf("%s: empty strings are not allowed", path)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			t.Errorf("%s: empty arrays are not allowed", path)
+		}
+		for _, item := range v {
+			validateFHIRElements(t, path+"[]", item)
+		}
+	case map[string]interface{}:
+		if len(v) == 0 {
+			t.Errorf("%s: empty objects are not allowed", path)
+		}
+		for key, item := range v {
+			validateFHIRElements(t, path+"."+key, item)
+		}
+	}
+}
+
+func requireFHIRString(t *testing.T, resource map[string]interface{}, path string, field string, pattern *regexp.Regexp) string {
+	value, ok := resource[field].(string)
+	if !ok {
+		t.Errorf("%s.%s is required", path, field)
+		return ""
+	}
+	if pattern != nil && !pattern.MatchString(value) {
+		t.Errorf("%s.%s %q does not match the FHIR format", path, field, value)
+	}
+	return value
+}
+
+func requireFHIRCode(t *testing.T, resource map[string]interface{}, path string, field string) string {
+	value := requireFHIRString(t, resource, path, field, nil)
+	if value != "" && !fhirValueSets[path+"."+field][value] {
+		t.Errorf("%s.%s %q is not in the value set", path, field, value)
+	}
+	return value
+}
+
+func requireFHIRReference(t *testing.T, resource map[string]interface{}, path string, field string) string {
+	reference, ok := resource[field].(map[string]interface{})
+	if !ok {
+		t.Errorf("%s.%s is required", path, field)
+		return ""
+	}
+	return requireFHIRString(t, reference, path+"."+field, "reference", fhirReferencePattern)
+}
+
+func requireFHIRCodeableConcept(t *testing.T, resource map[string]interface{}, path string, field string) {
+	concept, ok := resource[field].(map[string]interface{})
+	if !ok {
+		t.Errorf("%s.%s is required", path, field)
+		return
+	}
+	codings, _ := concept["coding"].([]interface{})
+	if len(codings) == 0 && concept["text"] == nil {
+		t.Errorf("%s.%s needs a coding or text", path, field)
+	}
+	for _, coding := range codings {
+		coding := coding.(map[string]interface{})
+		requireFHIRString(t, coding, path+"."+field+".coding", "system", nil)
+		requireFHIRString(t, coding, path+"."+field+".coding", "code", nil)
+	}
+}
+
+// Validate a Bundle of Tasks and Observations against the FHIR R4 JSON structure
+// Returns the resources by reference, e.g. "Task/round-1"
+func validateFHIRBundle(t *testing.T, body []byte) map[string]map[string]interface{} {
+	var bundle map[string]interface{}
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		t.Fatalf("Bundle is not valid JSON: %v", err)
+	}
+	validateFHIRElements(t, "Bundle", bundle)
+
+	if bundle["resourceType"] != "Bundle" {
+		t.Fatalf("Expected resourceType Bundle, got %v", bundle["resourceType"])
+	}
+	requireFHIRCode(t, bundle, "Bundle", "type")
+	requireFHIRString(t, bundle, "Bundle", "timestamp", fhirInstantPattern)
+
+	resources := make(map[string]map[string]interface{})
+	entries, _ := bundle["entry"].([]interface{})
+	for _, entry := range entries {
+		resource, ok := entry.(map[string]interface{})["resource"].(map[string]interface{})
+		if !ok {
+			t.Errorf("Bundle.entry.resource is required")
+			continue
+		}
+
+		resourceType, _ := resource["resourceType"].(string)
+		id := requireFHIRString(t, resource, resourceType, "id", fhirIdPattern)
+		switch resourceType {
+		case "Task":
+			requireFHIRCode(t, resource, "Task", "status")
+			requireFHIRCode(t, resource, "Task", "intent")
+			requireFHIRCodeableConcept(t, resource, "Task", "code")
+			period, _ := resource["executionPeriod"].(map[string]interface{})
+			requireFHIRString(t, period, "Task.executionPeriod", "start", fhirDateTimePattern)
+			outputs, _ := resource["output"].([]interface{})
+			for _, output := range outputs {
+				output := output.(map[string]interface{})
+				requireFHIRCodeableConcept(t, output, "Task.output", "type")
+				requireFHIRReference(t, output, "Task.output", "valueReference")
+			}
+		case "Observation":
+			requireFHIRCode(t, resource, "Observation", "status")
+			requireFHIRCodeableConcept(t, resource, "Observation", "code")
+			requireFHIRReference(t, resource, "Observation", "subject")
+			requireFHIRString(t, resource, "Observation", "effectiveDateTime", fhirDateTimePattern)
+			requireFHIRCodeableConcept(t, resource, "Observation", "valueCodeableConcept")
+			if _, ok := resource["issued"]; ok {
+				requireFHIRString(t, resource, "Observation", "issued", fhirInstantPattern)
+			}
+		default:
+			t.Errorf("Unexpected resourceType %q", resourceType)
+		}
+		resources[resourceType+"/"+id] = resource
+	}
+
+	// Every Task output has to resolve within the Bundle
+	for reference, resource := range resources {
+		outputs, _ := resource["output"].([]interface{})
+		for _, output := range outputs {
+			target := output.(map[string]interface{})["valueReference"].(map[string]interface{})["reference"].(string)
+			if _, ok := resources[target]; !ok {
+				t.Errorf("%s references %s, which is not in the Bundle", reference, target)
+			}
+		}
+	}
+
+	return resources
+}
+
+func setupFHIRRounds(t *testing.T) *gorm.DB {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+
+	db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T09:00:00Z", Status: "COMPLETE"})
+	db.Create(&Round{ID: 2, RoundTimestamp: "2022-01-10T09:15:00Z", Status: "STARTED"})
+	db.Create(&RoundMember{ID: 1, RoundId: 1, PatientId: "patient1", Observation: "SLEEPING", ObservedAt: "2022-01-10T09:02:00Z"})
+	db.Create(&RoundMember{ID: 2, RoundId: 1, PatientId: "patient 2/x", Observation: "DAYROOM", ObservedAt: "2022-01-10T09:03:00Z"})
+	db.Create(&RoundMember{ID: 3, RoundId: 2, PatientId: "patient1"})
+
+	if _, err := AmendObservation(NewGormRoundsStore(db), 2, "GROUP", "DOCUMENTATION_ERROR", "", time.Date(2022, time.January, 10, 9, 20, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("AmendObservation failed: %v", err)
+	}
+	return db
+}
+
+func TestBuildRoundsBundle(t *testing.T) {
+	db := setupFHIRRounds(t)
+
+	bundle, err := BuildRoundsBundle(db, time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC), time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC), time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("BuildRoundsBundle failed: %v", err)
+	}
+	body, _ := json.Marshal(bundle)
+	resources := validateFHIRBundle(t, body)
+
+	expected := []struct {
+		reference string
+		field     string
+		value     string
+	}{
+		{"Task/round-1", "status", "completed"},
+		{"Task/round-2", "status", "in-progress"},
+		{"Observation/round-member-1", "status", "final"},
+		{"Observation/round-member-1", "effectiveDateTime", "2022-01-10T09:02:00Z"},
+		{"Observation/round-member-2", "status", "amended"},
+		{"Observation/round-member-2", "issued", "2022-01-10T09:20:00Z"},
+	}
+	for _, tt := range expected {
+		resource, ok := resources[tt.reference]
+		if !ok {
+			t.Errorf("Expected %s in the Bundle", tt.reference)
+			continue
+		}
+		if resource[tt.field] != tt.value {
+			t.Errorf("Expected %s.%s to be %v, got %v", tt.reference, tt.field, tt.value, resource[tt.field])
+		}
+	}
+
+	// Patient references are derived from the patient id
+	subject := resources["Observation/round-member-2"]["subject"].(map[string]interface{})["reference"]
+	if subject != "Patient/patient-2-x" {
+		t.Errorf("Expected subject Patient/patient-2-x, got %v", subject)
+	}
+
+	// Members without an observation are not exported
+	if _, ok := resources["Observation/round-member-3"]; ok {
+		t.Errorf("Expected no Observation for an unobserved round member")
+	}
+	if len(resources) != 4 {
+		t.Errorf("Expected 4 resources, got %d", len(resources))
+	}
+}
+
+func TestFHIRExportEndpoint(t *testing.T) {
+	db := setupFHIRRounds(t)
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/fhir/export?start=2022-01-10T08:00:00Z&end=2022-01-10T10:00:00Z")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/fhir+json" {
+		t.Errorf("Expected application/fhir+json, got %v", resp.Header.Get("Content-Type"))
+	}
+
+	var body json.RawMessage
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resources := validateFHIRBundle(t, body); len(resources) != 4 {
+		t.Errorf("Expected 4 resources, got %d", len(resources))
+	}
+
+	// Bad time windows are rejected
+	resp, err = http.Get(server.URL + "/fhir/export?start=yesterday")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", resp.StatusCode)
+	}
+}
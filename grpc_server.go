@@ -0,0 +1,308 @@
+package main
+
+//go:generate protoc -I proto --go_out=. --go_opt=module=ritten-rounds-test --go-grpc_out=. --go-grpc_opt=module=ritten-rounds-test rounds/v1/rounds.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+
+	"ritten-rounds-test/roundspb"
+)
+
+// The gRPC rounds service, a thin layer over the same functions the HTTP API uses
+type roundsGRPCServer struct {
+	roundspb.UnimplementedRoundsServiceServer
+	db    *gorm.DB
+	clock Clock
+}
+
+// Build the gRPC server for the rounds system
+func newGRPCServer(db *gorm.DB, clock Clock) *grpc.Server {
+	server := grpc.NewServer()
+	roundspb.RegisterRoundsServiceServer(server, &roundsGRPCServer{db: db, clock: clock})
+	return server
+}
+
+func (s *roundsGRPCServer) ListStartRounds(ctx context.Context, req *roundspb.ListStartRoundsRequest) (*roundspb.ListStartRoundsResponse, error) {
+	startTime, endTime, err := parseTimeWindow(req.Start, req.End, s.clock.Now())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Without paging or filters this is the board as StartRounds shows it, upcoming round included
+	response := &roundspb.ListStartRoundsResponse{}
+	paged := len(req.Statuses) > 0 || len(req.RoundTypeIds) > 0 || req.Descending || req.Cursor != "" || req.Limit != 0
+	if !paged {
+		startRoundsItems, err := StartRounds(NewGormRoundsStore(s.db), startTime, endTime)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		for _, item := range startRoundsItems {
+			response.Items = append(response.Items, startRoundsItemToProto(item))
+		}
+		return response, nil
+	}
+
+	query := StartRoundsQuery{
+		StartTime:  startTime,
+		CurrTime:   endTime,
+		Statuses:   req.Statuses,
+		Descending: req.Descending,
+		Cursor:     req.Cursor,
+		Limit:      int(req.Limit),
+	}
+	for _, roundTypeId := range req.RoundTypeIds {
+		query.RoundTypeIds = append(query.RoundTypeIds, uint(roundTypeId))
+	}
+	page, err := QueryStartRounds(NewGormRoundsStore(s.db), query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for _, item := range page.Items {
+		response.Items = append(response.Items, startRoundsItemToProto(item))
+	}
+	response.NextCursor = page.NextCursor
+	return response, nil
+}
+
+func (s *roundsGRPCServer) StartRound(ctx context.Context, req *roundspb.StartRoundRequest) (*roundspb.Round, error) {
+	roundTime, err := parseRoundRequest(req.RoundTimestamp, req.StaffId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	round, err := StartRound(NewGormRoundsStore(s.db), roundTime, req.StaffId, s.clock.Now())
+	if err != nil {
+		return nil, roundStatusError(err)
+	}
+	return roundToProto(round), nil
+}
+
+func (s *roundsGRPCServer) CompleteRound(ctx context.Context, req *roundspb.CompleteRoundRequest) (*roundspb.Round, error) {
+	roundTime, err := parseRoundRequest(req.RoundTimestamp, req.StaffId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	round, err := CompleteRound(NewGormRoundsStore(s.db), roundTime, req.StaffId, s.clock.Now())
+	if err != nil {
+		return nil, roundStatusError(err)
+	}
+	return roundToProto(round), nil
+}
+
+// A round time too far ahead is a bad request, anything else is the round being in the wrong state
+func roundStatusError(err error) error {
+	if errors.Is(err, errRoundInFuture) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.FailedPrecondition, err.Error())
+}
+
+func (s *roundsGRPCServer) RecordObservation(ctx context.Context, req *roundspb.RecordObservationRequest) (*roundspb.RoundMember, error) {
+	if req.Observation == "" || req.StaffId == "" {
+		return nil, status.Error(codes.InvalidArgument, "observation and staff id are required")
+	}
+	roundMember, err := getRoundMember(s.db, uint(req.RoundMemberId))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if roundMember.ID == 0 {
+		return nil, status.Errorf(codes.NotFound, "round member %d not found", req.RoundMemberId)
+	}
+
+	roundMember, err = RecordObservation(NewGormRoundsStore(s.db), roundMember.ID, req.Observation, req.StaffId, s.clock.Now())
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return roundMemberToProto(roundMember), nil
+}
+
+func (s *roundsGRPCServer) ListAssignments(ctx context.Context, req *roundspb.ListAssignmentsRequest) (*roundspb.ListAssignmentsResponse, error) {
+	if req.PatientId == "" {
+		return nil, status.Error(codes.InvalidArgument, "patient id is required")
+	}
+
+	var roundAssignments []RoundAssignment
+	var err error
+	if req.IncludeEnded {
+		roundAssignments, err = getRoundAssignmentsForPatient(s.db, req.PatientId)
+	} else {
+		roundAssignments, err = getOpenRoundAssignmentsForPatient(s.db, req.PatientId)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &roundspb.ListAssignmentsResponse{}
+	for _, roundAssignment := range roundAssignments {
+		response.Assignments = append(response.Assignments, roundAssignmentToProto(roundAssignment))
+	}
+	return response, nil
+}
+
+func (s *roundsGRPCServer) AssignRoundType(ctx context.Context, req *roundspb.AssignRoundTypeRequest) (*roundspb.Assignment, error) {
+	now := s.clock.Now()
+	from, err := parseRequestTime("effective from", req.EffectiveFrom, now)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var to time.Time
+	if req.EffectiveTo != "" {
+		to, err = parseRequestTime("effective to", req.EffectiveTo, now)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	roundAssignment, err := AssignRoundType(s.db, req.PatientId, uint(req.RoundTypeId), from, to)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return roundAssignmentToProto(roundAssignment), nil
+}
+
+func (s *roundsGRPCServer) EndAssignment(ctx context.Context, req *roundspb.EndAssignmentRequest) (*roundspb.Assignment, error) {
+	at, err := parseRequestTime("effective to", req.EffectiveTo, s.clock.Now())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	roundAssignment, err := getRoundAssignment(s.db, uint(req.AssignmentId))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if roundAssignment.ID == 0 {
+		return nil, status.Errorf(codes.NotFound, "round assignment %d not found", req.AssignmentId)
+	}
+
+	roundAssignment, err = EndRoundAssignment(s.db, roundAssignment.ID, at)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return roundAssignmentToProto(roundAssignment), nil
+}
+
+// Stream round feed events to the client until it cancels, from the poller the SSE feed shares
+// A client that falls too far behind gets Unavailable, and resumes with the id of the last event it got
+func (s *roundsGRPCServer) WatchRounds(req *roundspb.WatchRoundsRequest, stream roundspb.RoundsService_WatchRoundsServer) error {
+	afterId := uint(req.LastEventId)
+	if afterId == 0 {
+		id, err := getLastOutboxEventId(s.db)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		afterId = id
+	}
+
+	subscriber, err := subscribeRoundFeed(s.db, s.clock, req.Unit, afterId)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer subscriber.unsubscribe()
+
+	send := func(feedEvents []RoundFeedEvent) error {
+		for _, feedEvent := range feedEvents {
+			err := stream.Send(&roundspb.RoundEvent{
+				Id:   uint64(feedEvent.Id),
+				Type: feedEvent.Type,
+				Item: startRoundsItemToProto(feedEvent.Item),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := subscriber.catchUp(send); err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case feedEvents, ok := <-subscriber.events:
+			if !ok {
+				return status.Error(codes.Unavailable, "fell behind the round feed, resume from the last event id")
+			}
+			if err := send(subscriber.unseen(feedEvents)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Parse the round timestamp and staff id every round status change needs
+func parseRoundRequest(roundTimestamp string, staffId string) (time.Time, error) {
+	if roundTimestamp == "" || staffId == "" {
+		return time.Time{}, errors.New("round timestamp and staff id are required")
+	}
+	return parseRequestTime("round timestamp", roundTimestamp, time.Time{})
+}
+
+// Parse an RFC3339 timestamp from a request, defaulting to now when it's empty
+func parseRequestTime(name string, value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return now.UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q, expected RFC3339", name, value)
+	}
+	return t.UTC(), nil
+}
+
+func startRoundsItemToProto(item StartRoundsItem) *roundspb.StartRoundsItem {
+	return &roundspb.StartRoundsItem{
+		RoundTimestamp: item.RoundTimestamp,
+		Status:         item.Status,
+		Amended:        item.Amended,
+		LateCharted:    item.LateCharted,
+	}
+}
+
+func roundToProto(round Round) *roundspb.Round {
+	return &roundspb.Round{
+		Id:             uint32(round.ID),
+		RoundTimestamp: round.RoundTimestamp,
+		Status:         round.Status,
+		StartedAt:      round.StartedAt,
+		StartedBy:      round.StartedBy,
+		CompletedAt:    round.CompletedAt,
+		CompletedBy:    round.CompletedBy,
+	}
+}
+
+func roundMemberToProto(roundMember RoundMember) *roundspb.RoundMember {
+	return &roundspb.RoundMember{
+		Id:          uint32(roundMember.ID),
+		RoundId:     uint32(roundMember.RoundId),
+		Status:      roundMember.Status,
+		PatientId:   roundMember.PatientId,
+		Unit:        roundMember.Unit,
+		Observation: roundMember.Observation,
+		ObservedAt:  roundMember.ObservedAt,
+		ObservedBy:  roundMember.ObservedBy,
+	}
+}
+
+func roundAssignmentToProto(roundAssignment RoundAssignment) *roundspb.Assignment {
+	return &roundspb.Assignment{
+		Id:            uint32(roundAssignment.ID),
+		RoundTypeId:   uint32(roundAssignment.RoundTypeId),
+		PatientId:     roundAssignment.PatientId,
+		EffectiveFrom: roundAssignment.EffectiveFrom,
+		EffectiveTo:   roundAssignment.EffectiveTo,
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gorm.io/gorm"
+
+	"ritten-rounds-test/roundspb"
+)
+
+// Serve the gRPC API over an in-memory connection and return a client for it
+func setupGRPCClient(t *testing.T, db *gorm.DB) roundspb.RoundsServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer(db, RealClock{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return roundspb.NewRoundsServiceClient(conn)
+}
+
+func TestGRPCRoundLifecycle(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	client := setupGRPCClient(t, db)
+	ctx := context.Background()
+
+	round, err := client.StartRound(ctx, &roundspb.StartRoundRequest{RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA"})
+	if err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	if round.Status != "STARTED" || round.StartedBy != "nurseA" {
+		t.Errorf("Expected the round started by nurseA, got %+v", round)
+	}
+
+	_, err = client.StartRound(ctx, &roundspb.StartRoundRequest{RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition starting the round twice, got %v", err)
+	}
+	_, err = client.StartRound(ctx, &roundspb.StartRoundRequest{RoundTimestamp: "9am", StaffId: "nurseA"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a bad timestamp, got %v", err)
+	}
+
+	// A round far in the future is refused without creating the rounds up to it
+	var rounds int64
+	db.Model(&Round{}).Count(&rounds)
+	_, err = client.CompleteRound(ctx, &roundspb.CompleteRoundRequest{RoundTimestamp: "2999-01-01T00:00:00Z", StaffId: "nurseA"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a round in the future, got %v", err)
+	}
+	var after int64
+	db.Model(&Round{}).Count(&after)
+	if after != rounds {
+		t.Errorf("Expected no rounds to be created, went from %d to %d", rounds, after)
+	}
+
+	roundMembers, _ := getRoundMembersForRound(db, uint(round.Id))
+	roundMember, err := client.RecordObservation(ctx, &roundspb.RecordObservationRequest{
+		RoundMemberId: uint32(roundMembers[0].ID),
+		Observation:   "SLEEPING",
+		StaffId:       "nurseA",
+	})
+	if err != nil {
+		t.Fatalf("RecordObservation failed: %v", err)
+	}
+	if roundMember.Observation != "SLEEPING" || roundMember.RoundId != round.Id {
+		t.Errorf("Expected the observation recorded on the round, got %+v", roundMember)
+	}
+	_, err = client.RecordObservation(ctx, &roundspb.RecordObservationRequest{RoundMemberId: 999, Observation: "SLEEPING", StaffId: "nurseA"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown round member, got %v", err)
+	}
+
+	round, err = client.CompleteRound(ctx, &roundspb.CompleteRoundRequest{RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseB"})
+	if err != nil {
+		t.Fatalf("CompleteRound failed: %v", err)
+	}
+	if round.Status != "COMPLETE" || round.StartedBy != "nurseA" || round.CompletedBy != "nurseB" {
+		t.Errorf("Expected the round completed by nurseB, got %+v", round)
+	}
+
+	// Observations on a completed round are amendments
+	_, err = client.RecordObservation(ctx, &roundspb.RecordObservationRequest{
+		RoundMemberId: uint32(roundMembers[0].ID),
+		Observation:   "AWAKE",
+		StaffId:       "nurseA",
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition recording on a completed round, got %v", err)
+	}
+}
+
+func TestGRPCListStartRounds(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	client := setupGRPCClient(t, db)
+	ctx := context.Background()
+
+	if _, err := client.CompleteRound(ctx, &roundspb.CompleteRoundRequest{RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA"}); err != nil {
+		t.Fatalf("CompleteRound failed: %v", err)
+	}
+
+	// The whole window, as StartRounds shows it with the upcoming round on the end
+	response, err := client.ListStartRounds(ctx, &roundspb.ListStartRoundsRequest{Start: "2022-01-10T09:00:00Z", End: "2022-01-10T10:00:00Z"})
+	if err != nil {
+		t.Fatalf("ListStartRounds failed: %v", err)
+	}
+	expected, _ := StartRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC), time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC))
+	if len(response.Items) != len(expected) || response.NextCursor != "" {
+		t.Fatalf("Expected %d items with no cursor, got %+v", len(expected), response)
+	}
+	if response.Items[0].Status != "COMPLETE" || response.Items[len(response.Items)-1].Status != "NOT_STARTED" {
+		t.Errorf("Expected the completed round first and the upcoming round last, got %+v", response.Items)
+	}
+
+	// A limit pages through the same window
+	var paged []*roundspb.StartRoundsItem
+	request := &roundspb.ListStartRoundsRequest{Start: "2022-01-10T09:00:00Z", End: "2022-01-10T10:00:00Z", Limit: 2}
+	for {
+		page, err := client.ListStartRounds(ctx, request)
+		if err != nil {
+			t.Fatalf("ListStartRounds failed: %v", err)
+		}
+		paged = append(paged, page.Items...)
+		if page.NextCursor == "" {
+			break
+		}
+		request.Cursor = page.NextCursor
+	}
+	all, _ := QueryStartRounds(NewGormRoundsStore(db), StartRoundsQuery{
+		StartTime: time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC),
+		CurrTime:  time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC),
+	})
+	if len(paged) != len(all.Items) || paged[1].Status != all.Items[1].Status {
+		t.Errorf("Expected the pages to hold the %d items QueryStartRounds finds, got %+v", len(all.Items), paged)
+	}
+
+	_, err = client.ListStartRounds(ctx, &roundspb.ListStartRoundsRequest{Statuses: []string{"DONE"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an unknown status, got %v", err)
+	}
+}
+
+func TestGRPCAssignments(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	client := setupGRPCClient(t, db)
+	ctx := context.Background()
+
+	assignment, err := client.AssignRoundType(ctx, &roundspb.AssignRoundTypeRequest{
+		PatientId:     "patient2",
+		RoundTypeId:   1,
+		EffectiveFrom: "2022-01-10T09:00:00Z",
+	})
+	if err != nil {
+		t.Fatalf("AssignRoundType failed: %v", err)
+	}
+	if assignment.EffectiveFrom != "2022-01-10T09:00:00Z" || assignment.EffectiveTo != "" {
+		t.Errorf("Expected an open assignment from 9:00, got %+v", assignment)
+	}
+	_, err = client.AssignRoundType(ctx, &roundspb.AssignRoundTypeRequest{PatientId: "patient2", RoundTypeId: 99})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an unknown round type, got %v", err)
+	}
+
+	response, err := client.ListAssignments(ctx, &roundspb.ListAssignmentsRequest{PatientId: "patient2"})
+	if err != nil {
+		t.Fatalf("ListAssignments failed: %v", err)
+	}
+	if len(response.Assignments) != 2 {
+		t.Errorf("Expected 2 open assignments, got %+v", response.Assignments)
+	}
+
+	ended, err := client.EndAssignment(ctx, &roundspb.EndAssignmentRequest{AssignmentId: assignment.Id, EffectiveTo: "2022-01-10T12:00:00Z"})
+	if err != nil {
+		t.Fatalf("EndAssignment failed: %v", err)
+	}
+	if ended.EffectiveTo != "2022-01-10T12:00:00Z" {
+		t.Errorf("Expected the assignment to end at 12:00, got %+v", ended)
+	}
+	_, err = client.EndAssignment(ctx, &roundspb.EndAssignmentRequest{AssignmentId: assignment.Id, EffectiveTo: "2022-01-10T13:00:00Z"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition extending an ended assignment, got %v", err)
+	}
+	_, err = client.EndAssignment(ctx, &roundspb.EndAssignmentRequest{AssignmentId: 999})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown assignment, got %v", err)
+	}
+
+	response, _ = client.ListAssignments(ctx, &roundspb.ListAssignmentsRequest{PatientId: "patient2"})
+	if len(response.Assignments) != 1 {
+		t.Errorf("Expected 1 open assignment after ending one, got %+v", response.Assignments)
+	}
+	response, _ = client.ListAssignments(ctx, &roundspb.ListAssignmentsRequest{PatientId: "patient2", IncludeEnded: true})
+	if len(response.Assignments) != 2 {
+		t.Errorf("Expected 2 assignments including the ended one, got %+v", response.Assignments)
+	}
+}
+
+func TestGRPCWatchRounds(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	client := setupGRPCClient(t, db)
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+
+	// An event from before the watch started, which a new watch skips
+	StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(time.Minute))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.WatchRounds(ctx, &roundspb.WatchRoundsRequest{})
+	if err != nil {
+		t.Fatalf("WatchRounds failed: %v", err)
+	}
+	// Wait for the server to pick its starting point before changing anything
+	time.Sleep(2 * roundFeedPollInterval)
+
+	CompleteRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(5*time.Minute))
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if event.Type != "round.completed" || event.Item.RoundTimestamp != "2022-01-10T09:00:00Z" || event.Item.Status != "COMPLETE" {
+		t.Errorf("Expected the round completed event, got %+v", event)
+	}
+
+	// Resuming from before the completion replays it
+	resumed, err := client.WatchRounds(ctx, &roundspb.WatchRoundsRequest{LastEventId: event.Id - 1})
+	if err != nil {
+		t.Fatalf("WatchRounds failed: %v", err)
+	}
+	replayed, err := resumed.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if replayed.Id != event.Id {
+		t.Errorf("Expected event %d to be replayed, got %+v", event.Id, replayed)
+	}
+
+	cancel()
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Errorf("Expected the stream to end when cancelled, got %v", err)
+	}
+}
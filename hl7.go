@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A parsed HL7 v2 message
+// Fields are numbered as in the HL7 spec, so Fields[3] of PID is PID-3. Fields[0] is the segment name
+// For MSH, Fields[1] is the field separator itself, so MSH-9 is Fields[9] like any other segment
+type HL7Message struct {
+	Segments           []HL7Segment
+	fieldSeparator     string
+	componentSeparator string
+	repetitionSep      string
+	escapeCharacter    string
+	subcomponentSep    string
+}
+
+type HL7Segment struct {
+	Name   string
+	Fields []string
+}
+
+// An admit, transfer, discharge or update event pulled out of an ADT message
+type ADTEvent struct {
+	EventType  string
+	ControlId  string
+	PatientId  string
+	Name       string
+	Unit       string
+	Bed        string
+	OccurredAt time.Time
+}
+
+// Parse errors and unsupported messages are rejected (AR) rather than failed (AE)
+var errHL7Rejected = errors.New("message rejected")
+
+// Parse a raw HL7 v2 message. Segments may be separated by \r, \n or \r\n
+func ParseHL7(raw string) (HL7Message, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.HasPrefix(raw, "MSH") || len(raw) < 8 {
+		return HL7Message{}, fmt.Errorf("%w: message must start with an MSH segment", errHL7Rejected)
+	}
+
+	// MSH-1 is the field separator and MSH-2 the encoding characters
+	fieldSeparator := raw[3:4]
+	encodingEnd := strings.Index(raw[4:], fieldSeparator)
+	if encodingEnd < 4 {
+		return HL7Message{}, fmt.Errorf("%w: MSH-2 must have the four encoding characters", errHL7Rejected)
+	}
+	encoding := raw[4 : 4+encodingEnd]
+	msg := HL7Message{
+		fieldSeparator:     fieldSeparator,
+		componentSeparator: encoding[0:1],
+		repetitionSep:      encoding[1:2],
+		escapeCharacter:    encoding[2:3],
+		subcomponentSep:    encoding[3:4],
+	}
+
+	lines := strings.FieldsFunc(raw, func(r rune) bool { return r == '\r' || r == '\n' })
+	for _, line := range lines {
+		parts := strings.Split(line, fieldSeparator)
+		if len(parts[0]) != 3 {
+			return HL7Message{}, fmt.Errorf("%w: invalid segment %q", errHL7Rejected, parts[0])
+		}
+
+		segment := HL7Segment{Name: parts[0]}
+		if segment.Name == "MSH" {
+			segment.Fields = append([]string{"MSH", fieldSeparator}, parts[1:]...)
+		} else {
+			segment.Fields = parts
+		}
+		msg.Segments = append(msg.Segments, segment)
+	}
+
+	return msg, nil
+}
+
+// Get the first segment with the given name
+func (msg HL7Message) Segment(name string) (HL7Segment, bool) {
+	for _, segment := range msg.Segments {
+		if segment.Name == name {
+			return segment, true
+		}
+	}
+	return HL7Segment{}, false
+}
+
+// Get a component of the first repetition of a field, e.g. Get("PID", 5, 1) for the family name
+// Component 0 returns the whole first repetition. Missing values return an empty string
+func (msg HL7Message) Get(segmentName string, field int, component int) string {
+	segment, ok := msg.Segment(segmentName)
+	if !ok || field >= len(segment.Fields) {
+		return ""
+	}
+
+	value := segment.Fields[field]
+	if segmentName == "MSH" && field <= 2 {
+		return value
+	}
+
+	value = strings.Split(value, msg.repetitionSep)[0]
+	if component > 0 {
+		components := strings.Split(value, msg.componentSeparator)
+		if component > len(components) {
+			return ""
+		}
+		value = components[component-1]
+	}
+	return msg.unescape(value)
+}
+
+// Replace the standard HL7 escape sequences with the characters they stand for
+func (msg HL7Message) unescape(value string) string {
+	if !strings.Contains(value, msg.escapeCharacter) {
+		return value
+	}
+	e := msg.escapeCharacter
+	return strings.NewReplacer(
+		e+"F"+e, msg.fieldSeparator,
+		e+"S"+e, msg.componentSeparator,
+		e+"R"+e, msg.repetitionSep,
+		e+"T"+e, msg.subcomponentSep,
+		e+"E"+e, e,
+	).Replace(value)
+}
+
+// Parse an HL7 TS/DTM value. Values without a UTC offset are taken as UTC
+func parseHL7Time(value string) (time.Time, error) {
+	// Drop fractional seconds, keeping any offset
+	if dot := strings.Index(value, "."); dot != -1 {
+		end := strings.IndexAny(value[dot:], "+-")
+		if end == -1 {
+			value = value[:dot]
+		} else {
+			value = value[:dot] + value[dot+end:]
+		}
+	}
+
+	layouts := []string{
+		"20060102150405-0700",
+		"200601021504-0700",
+		"20060102150405",
+		"200601021504",
+		"2006010215",
+		"20060102",
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid HL7 timestamp %q", value)
+}
+
+// Pull the ADT event out of a parsed message
+func parseADTEvent(msg HL7Message) (ADTEvent, error) {
+	if msg.Get("MSH", 9, 1) != "ADT" {
+		return ADTEvent{}, fmt.Errorf("%w: unsupported message type %q", errHL7Rejected, msg.Get("MSH", 9, 0))
+	}
+
+	event := ADTEvent{
+		EventType: msg.Get("MSH", 9, 2),
+		ControlId: msg.Get("MSH", 10, 0),
+		PatientId: msg.Get("PID", 3, 1),
+		Unit:      msg.Get("PV1", 3, 1),
+	}
+	switch event.EventType {
+	case "A01", "A02", "A03", "A08":
+	default:
+		return ADTEvent{}, fmt.Errorf("%w: unsupported ADT event %q", errHL7Rejected, event.EventType)
+	}
+	if event.PatientId == "" {
+		return ADTEvent{}, fmt.Errorf("%w: PID-3 patient identifier is required", errHL7Rejected)
+	}
+
+	// PID-5 is family^given
+	event.Name = strings.TrimSpace(msg.Get("PID", 5, 2) + " " + msg.Get("PID", 5, 1))
+
+	// PV1-3 is point of care^room^bed. The point of care is the unit
+	var bedParts []string
+	for _, part := range []string{msg.Get("PV1", 3, 2), msg.Get("PV1", 3, 3)} {
+		if part != "" {
+			bedParts = append(bedParts, part)
+		}
+	}
+	event.Bed = strings.Join(bedParts, "-")
+
+	// Prefer when the event occurred (EVN-6), then when it was recorded (EVN-2), then the message time (MSH-7)
+	for _, value := range []string{msg.Get("EVN", 6, 1), msg.Get("EVN", 2, 1), msg.Get("MSH", 7, 1)} {
+		if value == "" {
+			continue
+		}
+		occurredAt, err := parseHL7Time(value)
+		if err != nil {
+			return ADTEvent{}, fmt.Errorf("%w: %v", errHL7Rejected, err)
+		}
+		event.OccurredAt = occurredAt
+		break
+	}
+	if event.OccurredAt.IsZero() {
+		return ADTEvent{}, fmt.Errorf("%w: no event time in EVN or MSH", errHL7Rejected)
+	}
+
+	return event, nil
+}
+
+// Apply an ADT event to the patient census and the patient's round assignments
+// The census change and the assignment changes that follow it are made in one transaction, so a failure leaves neither
+func ApplyADTEvent(db *gorm.DB, event ADTEvent) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return applyADTEvent(tx, event)
+	})
+}
+
+func applyADTEvent(db *gorm.DB, event ADTEvent) error {
+	switch event.EventType {
+	// Admit
+	case "A01":
+		if event.Unit == "" {
+			return errors.New("PV1-3 assigned location is required to admit a patient")
+		}
+		if _, err := AdmitPatient(db, event.PatientId, event.Name, event.Unit, event.Bed, event.OccurredAt); err != nil {
+			return err
+		}
+		return syncAdmissionAssignments(db, event.PatientId, "", event.Unit, event.OccurredAt)
+
+	// Transfer
+	case "A02":
+		if event.Unit == "" {
+			return errors.New("PV1-3 assigned location is required to transfer a patient")
+		}
+		return transferForADT(db, event)
+
+	// Discharge
+	case "A03":
+		if _, err := DischargePatient(db, event.PatientId, event.OccurredAt); err != nil {
+			return err
+		}
+		return EndRoundAssignments(db, event.PatientId, event.OccurredAt)
+
+	// Update patient information. A changed location is treated as a transfer
+	case "A08":
+		patient, err := getAdmittedPatient(db, event.PatientId)
+		if err != nil {
+			return err
+		}
+		if event.Name != "" && event.Name != patient.Name {
+			if err := db.Model(&patient).Update("name", event.Name).Error; err != nil {
+				return err
+			}
+		}
+		if event.Unit != "" && (event.Unit != patient.Unit || event.Bed != patient.Bed) {
+			return transferForADT(db, event)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported ADT event %q", event.EventType)
+}
+
+// Move a patient to the event's location, and swap their unit's round types if the unit changed
+func transferForADT(db *gorm.DB, event ADTEvent) error {
+	patient, err := getAdmittedPatient(db, event.PatientId)
+	if err != nil {
+		return err
+	}
+	oldUnit := patient.Unit
+
+	if _, err := TransferPatient(db, event.PatientId, event.Unit, event.Bed, event.OccurredAt); err != nil {
+		return err
+	}
+	if oldUnit == event.Unit {
+		return nil
+	}
+	return syncAdmissionAssignments(db, event.PatientId, oldUnit, event.Unit, event.OccurredAt)
+}
+
+// Parse and apply a raw ADT message, returning the ACK (or NAK) to send back
+// A sender that didn't get the ACK resends the message, so one with a control ID that was already applied
+// gets the original ACK back instead of being applied again
+func HandleHL7Message(db *gorm.DB, raw string, now time.Time) string {
+	msg, err := ParseHL7(raw)
+	if err != nil {
+		return buildHL7Ack(HL7Message{}, "AR", err.Error(), now)
+	}
+
+	event, err := parseADTEvent(msg)
+	if err != nil {
+		return buildHL7Ack(msg, "AR", err.Error(), now)
+	}
+
+	sendingApplication, sendingFacility := msg.Get("MSH", 3, 0), msg.Get("MSH", 4, 0)
+	if event.ControlId != "" {
+		receipt, err := getHL7MessageReceipt(db, sendingApplication, sendingFacility, event.ControlId)
+		if err != nil {
+			panic("Failed to get HL7 message receipt")
+		}
+		if receipt.ID != 0 {
+			return receipt.Ack
+		}
+	}
+
+	// The receipt is stored with the changes, so a message is either applied and remembered or neither
+	ack := buildHL7Ack(msg, "AA", "", now)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := ApplyADTEvent(tx, event); err != nil {
+			return err
+		}
+		if event.ControlId == "" {
+			return nil
+		}
+		return tx.Create(&HL7MessageReceipt{
+			SendingApplication: sendingApplication,
+			SendingFacility:    sendingFacility,
+			ControlId:          event.ControlId,
+			Ack:                ack,
+			ReceivedAt:         now.UTC().Format(time.RFC3339),
+		}).Error
+	})
+	if err != nil {
+		return buildHL7Ack(msg, "AE", err.Error(), now)
+	}
+	return ack
+}
+
+// Build an ACK for a message. The sending and receiving applications are swapped from the original MSH
+// Segments are separated by \r, as HL7 requires
+func buildHL7Ack(msg HL7Message, code string, text string, now time.Time) string {
+	controlId := msg.Get("MSH", 10, 0)
+	version := msg.Get("MSH", 12, 0)
+	if version == "" {
+		version = "2.5.1"
+	}
+
+	// Keep the error text from breaking the message structure
+	text = strings.NewReplacer("|", " ", "^", " ", "~", " ", "\\", " ", "&", " ", "\r", " ", "\n", " ").Replace(text)
+
+	msh := strings.Join([]string{
+		"MSH",
+		"^~\\&",
+		msg.Get("MSH", 5, 0),
+		msg.Get("MSH", 6, 0),
+		msg.Get("MSH", 3, 0),
+		msg.Get("MSH", 4, 0),
+		now.UTC().Format("20060102150405"),
+		"",
+		"ACK^" + msg.Get("MSH", 9, 2) + "^ACK",
+		"ACK" + controlId,
+		"P",
+		version,
+	}, "|")
+	msa := strings.Join([]string{"MSA", code, controlId, text}, "|")
+
+	return msh + "\r" + msa + "\r"
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHL7(t *testing.T) {
+	raw := "MSH|^~\\&|EHR|HOSP|ROUNDS|HOSP|20220110080000||ADT^A01^ADT_A01|MSG001|P|2.5.1\r" +
+		"EVN|A01|20220110075500|||nurse1|20220110075000-0500\r" +
+		"PID|1||MRN100^^^HOSP^MR~ALT100||Doe^Jane^Q||19800101|F\r" +
+		"PV1|1|I|A^101^1|||||||||||||||||V100\r"
+
+	msg, err := ParseHL7(raw)
+	if err != nil {
+		t.Fatalf("ParseHL7 failed: %v", err)
+	}
+
+	tests := []struct {
+		segment   string
+		field     int
+		component int
+		expected  string
+	}{
+		{"MSH", 1, 0, "|"},
+		{"MSH", 2, 0, "^~\\&"},
+		{"MSH", 9, 0, "ADT^A01^ADT_A01"},
+		{"MSH", 9, 2, "A01"},
+		{"MSH", 10, 0, "MSG001"},
+		{"PID", 3, 1, "MRN100"},
+		{"PID", 3, 4, "HOSP"},
+		{"PID", 5, 2, "Jane"},
+		{"PV1", 3, 3, "1"},
+		{"PV1", 3, 9, ""},
+		{"PV1", 99, 0, ""},
+		{"ZZZ", 1, 0, ""},
+	}
+	for _, tt := range tests {
+		if got := msg.Get(tt.segment, tt.field, tt.component); got != tt.expected {
+			t.Errorf("Expected %s-%d.%d to be %q, got %q", tt.segment, tt.field, tt.component, tt.expected, got)
+		}
+	}
+
+	event, err := parseADTEvent(msg)
+	if err != nil {
+		t.Fatalf("parseADTEvent failed: %v", err)
+	}
+	expected := ADTEvent{
+		EventType:  "A01",
+		ControlId:  "MSG001",
+		PatientId:  "MRN100",
+		Name:       "Jane Doe",
+		Unit:       "A",
+		Bed:        "101-1",
+		OccurredAt: time.Date(2022, time.January, 10, 12, 50, 0, 0, time.UTC),
+	}
+	if event != expected {
+		t.Errorf("Expected %+v, got %+v", expected, event)
+	}
+}
+
+func TestParseHL7Escapes(t *testing.T) {
+	msg, err := ParseHL7("MSH|^~\\&|EHR\nPID|1||MRN100||O\\S\\Brien^Pat\\T\\Q")
+	if err != nil {
+		t.Fatalf("ParseHL7 failed: %v", err)
+	}
+	if got := msg.Get("PID", 5, 1); got != "O^Brien" {
+		t.Errorf("Expected O^Brien, got %q", got)
+	}
+	if got := msg.Get("PID", 5, 2); got != "Pat&Q" {
+		t.Errorf("Expected Pat&Q, got %q", got)
+	}
+
+	// \F\ is whatever MSH-1 declares the field separator to be
+	msg, err = ParseHL7("MSH#^~\\&#EHR\nPID#1##MRN100##Unit\\F\\B^Pat")
+	if err != nil {
+		t.Fatalf("ParseHL7 failed: %v", err)
+	}
+	if got := msg.Get("PID", 5, 1); got != "Unit#B" {
+		t.Errorf("Expected Unit#B, got %q", got)
+	}
+}
+
+func TestParseHL7Rejects(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"Not HL7", "hello world"},
+		{"Short encoding characters", "MSH|^~|EHR"},
+		{"Bad segment name", "MSH|^~\\&|EHR\rPIDX|1"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseHL7(tt.raw); err == nil {
+			t.Errorf("%s: expected an error, got none", tt.name)
+		}
+	}
+}
+
+func TestParseHL7Time(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"20220110083000", time.Date(2022, time.January, 10, 8, 30, 0, 0, time.UTC)},
+		{"202201100830", time.Date(2022, time.January, 10, 8, 30, 0, 0, time.UTC)},
+		{"20220110083000.1234-0500", time.Date(2022, time.January, 10, 13, 30, 0, 0, time.UTC)},
+		{"20220110", time.Date(2022, time.January, 10, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseHL7Time(tt.value)
+		if err != nil {
+			t.Errorf("parseHL7Time(%q) failed: %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.expected) {
+			t.Errorf("Expected %v for %q, got %v", tt.expected, tt.value, got)
+		}
+	}
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -12,23 +22,432 @@ func setupDatabase() *gorm.DB {
 	// Clear the database so we start fresh Delete test.db
 	os.Remove("test.db")
 
-	// Open a database connection
-	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
+	db, err := openDatabase("test.db")
 	if err != nil {
-		panic("failed to connect database")
+		panic(err)
 	}
+	return db
+}
+
+// Connect to the database at a SQLite path or Postgres URL without touching the schema
+func connectDatabase(dsn string) (*gorm.DB, error) {
+	db, err := gorm.Open(dialectorFor(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect database: %w", err)
+	}
+	return db, nil
+}
 
-	// Migrate the schema
-	db.AutoMigrate(&RoundType{})
-	db.AutoMigrate(&RoundConfig{})
-	db.AutoMigrate(&RoundAssignment{})
-	db.AutoMigrate(&Round{})
-	db.AutoMigrate(&RoundRoundType{})
-	db.AutoMigrate(&RoundMember{})
+// Open the database at a SQLite path or Postgres URL and run any pending migrations, keeping any existing data
+// A schema newer than this build is left alone and returns ErrSchemaTooNew
+func openDatabase(dsn string) (*gorm.DB, error) {
+	db, err := connectDatabase(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := MigrateSchema(db, latestSchemaVersion(), time.Now()); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
 
+// Open the database for a command, exiting if it can't be used
+func mustOpenDatabase(dsn string) *gorm.DB {
+	db, err := openDatabase(dsn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	return db
 }
 
 func main() {
-	fmt.Println("Hello, World!")
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: rounds <serve|migrate|create-rounds|start-rounds|seed|round-types|round-configs|assignments|validate-config|apply-config|simulate|retention|hold|export-fhir|export|rounds-sheet> [flags]")
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "serve":
+		runServe(os.Args[2:])
+	case "migrate":
+		runMigrate(os.Args[2:])
+	case "create-rounds":
+		runCreateRounds(os.Args[2:])
+	case "start-rounds":
+		runStartRounds(os.Args[2:])
+	case "seed":
+		runSeed(os.Args[2:])
+	case "round-types":
+		runRoundTypes(os.Args[2:])
+	case "round-configs":
+		runRoundConfigs(os.Args[2:])
+	case "assignments":
+		runAssignments(os.Args[2:])
+	case "validate-config":
+		runValidateConfig(os.Args[2:])
+	case "apply-config":
+		runApplyConfig(os.Args[2:])
+	case "simulate":
+		runSimulate(os.Args[2:])
+	case "retention":
+		runRetention(os.Args[2:])
+	case "hold":
+		runHold(os.Args[2:])
+	case "export-fhir":
+		runExportFHIR(os.Args[2:])
+	case "export":
+		runExport(os.Args[2:])
+	case "rounds-sheet":
+		runRoundsSheet(os.Args[2:])
+	default:
+		fmt.Printf("Unknown command %q\n", os.Args[1])
+		os.Exit(2)
+	}
+}
+
+// Serve the rounds HTTP API, the gRPC API alongside it when -grpc-addr is set, and HL7 ADT feeds over MLLP when
+// -mllp-addr is set. An interrupt or SIGTERM stops the workers and shuts every listener down together
+func runServe(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	grpcAddr := flags.String("grpc-addr", "", "address to serve the gRPC API on, e.g. :9090 (default gRPC off)")
+	mllpAddr := flags.String("mllp-addr", "", "address to accept HL7 ADT messages over MLLP on, e.g. :2575 (default MLLP off)")
+	smtpAddr := flags.String("smtp-addr", "", "SMTP server for email notifications, host:port (default email notifications off)")
+	smtpFrom := flags.String("smtp-from", "rounds@localhost", "sender address for email notifications")
+	notifyInterval := flags.Duration("notify-interval", time.Minute, "how often to check for round notifications")
+	webhookInterval := flags.Duration("webhook-interval", 10*time.Second, "how often to dispatch webhooks")
+	archiveAfter := flags.Duration("archive-after", 0, "archive rounds older than this, e.g. 2160h for 90 days (default retention off)")
+	purgeAfter := flags.Duration("purge-after", 0, "purge archived rounds older than this (default keep archives forever)")
+	retentionInterval := flags.Duration("retention-interval", time.Hour, "how often to apply the retention policy")
+	flags.Parse(args)
+
+	policy := RetentionPolicy{ArchiveAfter: *archiveAfter, PurgeAfter: *purgeAfter}
+	if *archiveAfter != 0 {
+		if err := validateRetentionPolicy(policy); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	db := mustOpenDatabase(*dbPath)
+	clock := RealClock{}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	notifiers := map[string]Notifier{
+		"webhook": WebhookNotifier{},
+		"in_app":  InAppNotifier{},
+	}
+	if *smtpAddr != "" {
+		notifiers["smtp"] = SMTPNotifier{Addr: *smtpAddr, From: *smtpFrom}
+	}
+	go RunNotificationWorker(ctx, db, clock, notifiers, *notifyInterval)
+	go RunWebhookWorker(ctx, db, clock, nil, *webhookInterval)
+	if *archiveAfter != 0 {
+		go RunRetentionWorker(ctx, db, clock, policy, *retentionInterval)
+	}
+
+	if *grpcAddr != "" {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		grpcServer := newGRPCServer(db, clock)
+		go grpcServer.Serve(listener)
+		defer grpcServer.Stop()
+	}
+
+	if *mllpAddr != "" {
+		listener, err := net.Listen("tcp", *mllpAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// ServeMLLP returns once the listener is closed and the open connections are done with
+		mllpDone := make(chan struct{})
+		go func() {
+			defer close(mllpDone)
+			if err := ServeMLLP(listener, db, clock); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				stop()
+			}
+		}()
+		defer func() {
+			listener.Close()
+			<-mllpDone
+		}()
+	}
+
+	// Live feeds hold their requests open, so shutdown gives them a moment and then cuts them off
+	server := &http.Server{Addr: *addr, Handler: newServer(db, clock)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			server.Close()
+		}
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Migrate the schema up to the latest version, or up or down to -to, or print where it is with -status
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	to := flags.Int("to", -1, "schema version to migrate up or down to, 0 drops everything (default the latest version)")
+	status := flags.Bool("status", false, "print the applied and pending migrations without changing anything")
+	flags.Parse(args)
+
+	db, err := connectDatabase(*dbPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *status {
+		applied, err := getAppliedMigrations(db)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		appliedAt := make(map[int]string)
+		for _, version := range applied {
+			appliedAt[version.Version] = version.AppliedAt
+		}
+		for _, migration := range migrations {
+			state := "pending"
+			if at, ok := appliedAt[migration.Version]; ok {
+				state = "applied " + at
+			}
+			fmt.Printf("%d %s: %s\n", migration.Version, migration.Name, state)
+		}
+		if len(applied) > 0 && applied[len(applied)-1].Version > latestSchemaVersion() {
+			fmt.Printf("database is at version %d, newer than this build\n", applied[len(applied)-1].Version)
+		}
+		return
+	}
+
+	target := *to
+	if target < 0 {
+		target = latestSchemaVersion()
+	}
+	current, err := getSchemaVersion(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ran, err := MigrateSchema(db, target, time.Now())
+	for _, migration := range ran {
+		if migration.Version > current {
+			fmt.Printf("applied %d %s\n", migration.Version, migration.Name)
+		} else {
+			fmt.Printf("rolled back %d %s\n", migration.Version, migration.Name)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("schema is at version %d\n", target)
+}
+
+// Apply the retention policy once, archiving and purging old rounds, and print what was done
+func runRetention(args []string) {
+	flags := flag.NewFlagSet("retention", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	archiveAfter := flags.Duration("archive-after", 90*24*time.Hour, "archive rounds older than this")
+	purgeAfter := flags.Duration("purge-after", 0, "purge archived rounds older than this (default keep archives forever)")
+	flags.Parse(args)
+
+	policy := RetentionPolicy{ArchiveAfter: *archiveAfter, PurgeAfter: *purgeAfter}
+	if err := validateRetentionPolicy(policy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	db := mustOpenDatabase(*dbPath)
+	result, err := RunRetention(db, policy, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("archived %d rounds, purged %d, %d held\n", result.Archived, result.Purged, result.Held)
+}
+
+// Place a legal or audit hold on rounds, or release one with -release, or list the holds in effect with -list
+func runHold(args []string) {
+	flags := flag.NewFlagSet("hold", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	kind := flags.String("kind", "LEGAL_HOLD", "LEGAL_HOLD or AUDIT")
+	patientId := flags.String("patient", "", "only hold rounds this patient was on (default every round in the window)")
+	start := flags.String("start", "", "first round time the hold covers, RFC3339 (default no start)")
+	end := flags.String("end", "", "last round time the hold covers, RFC3339 (default no end)")
+	reason := flags.String("reason", "", "why the rounds are held, e.g. a case or audit reference")
+	placedBy := flags.String("by", "", "who placed the hold")
+	release := flags.Uint("release", 0, "id of a hold to release instead of placing one")
+	list := flags.Bool("list", false, "list the holds in effect instead of placing one")
+	flags.Parse(args)
+
+	db := mustOpenDatabase(*dbPath)
+	var output interface{}
+	var err error
+	switch {
+	case *list:
+		output, err = getActiveRetentionHolds(db)
+	case *release != 0:
+		output, err = ReleaseRetentionHold(db, *release, time.Now())
+	default:
+		output, err = PlaceRetentionHold(db, RetentionHold{
+			Kind:      *kind,
+			PatientId: *patientId,
+			StartTime: *start,
+			EndTime:   *end,
+			Reason:    *reason,
+			PlacedBy:  *placedBy,
+		}, time.Now())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(output)
+}
+
+// Write a FHIR Bundle of rounds and observations for a time window to stdout or a file
+func runExportFHIR(args []string) {
+	flags := flag.NewFlagSet("export-fhir", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	start := flags.String("start", "", "start of the window, RFC3339 (default 12 hours before end)")
+	end := flags.String("end", "", "end of the window, RFC3339 (default now)")
+	out := flags.String("out", "", "file to write the bundle to (default stdout)")
+	flags.Parse(args)
+
+	startTime, endTime, err := parseTimeWindow(*start, *end, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	db := mustOpenDatabase(*dbPath)
+	bundle, err := BuildRoundsBundle(db, startTime, endTime, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = writeOutput(*out, func(output io.Writer) error {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(bundle)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Write a CSV or XLSX export of rounds, members, observations or compliance for a time window to stdout or a file
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	dataset := flags.String("dataset", "rounds", "rounds, members, observations or compliance")
+	format := flags.String("format", "csv", "csv or xlsx")
+	start := flags.String("start", "", "start of the window, RFC3339 (default 12 hours before end)")
+	end := flags.String("end", "", "end of the window, RFC3339 (default now)")
+	unit := flags.String("unit", "", "only export this unit (default the whole clinic)")
+	columns := flags.String("columns", "", "comma separated columns to export (default the dataset's standard columns)")
+	tz := flags.String("tz", "UTC", "IANA time zone for timestamps")
+	out := flags.String("out", "", "file to write the export to (default stdout)")
+	flags.Parse(args)
+
+	now := time.Now()
+	startTime, endTime, err := parseTimeWindow(*start, *end, now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	location, err := time.LoadLocation(*tz)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid tz %q\n", *tz)
+		os.Exit(2)
+	}
+
+	options := ExportOptions{
+		Dataset:   *dataset,
+		Format:    *format,
+		StartTime: startTime,
+		EndTime:   endTime,
+		Unit:      *unit,
+		Location:  location,
+		Now:       now,
+	}
+	if *columns != "" {
+		options.Columns = strings.Split(*columns, ",")
+	}
+	if _, err := validateExportOptions(&options); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	db := mustOpenDatabase(*dbPath)
+	err = writeOutput(*out, func(output io.Writer) error {
+		return WriteExport(db, output, options)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Write a printable PDF rounds sheet for downtime from a local database
+func runRoundsSheet(args []string) {
+	flags := flag.NewFlagSet("rounds-sheet", flag.ExitOnError)
+	dbPath := databaseFlag(flags)
+	unit := flags.String("unit", "", "unit to print the sheet for (default the whole clinic)")
+	start := flags.String("start", "", "first round time, RFC3339 (default the start of the current hour)")
+	hours := flags.Int("hours", 8, "number of hours the sheet covers")
+	tz := flags.String("tz", "UTC", "IANA time zone for round times")
+	out := flags.String("out", "rounds-sheet.pdf", "file to write the PDF to")
+	flags.Parse(args)
+
+	now := time.Now()
+	startTime := now.Truncate(time.Hour).UTC()
+	if *start != "" {
+		t, err := time.Parse(time.RFC3339, *start)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid start time %q, expected RFC3339\n", *start)
+			os.Exit(2)
+		}
+		startTime = t.UTC()
+	}
+	location, err := time.LoadLocation(*tz)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid tz %q\n", *tz)
+		os.Exit(2)
+	}
+
+	db := mustOpenDatabase(*dbPath)
+	sheet, err := BuildRoundsSheet(db, *unit, startTime, *hours)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	err = writeOutput(*out, func(output io.Writer) error {
+		return WriteRoundsSheetPDF(output, sheet, location, now)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A RoundsStore that keeps everything in memory, for running the rounds engine without a database
+// It answers every query the same way GormRoundsStore does, including ordering, which the conformance tests check
+type MemoryRoundsStore struct {
+	mu                  sync.Mutex
+	schedulingMu        sync.Mutex
+	roundTypes          []RoundType
+	roundConfigs        []RoundConfig
+	roundAssignments    []RoundAssignment
+	rounds              []Round
+	roundRoundTypes     []RoundRoundType
+	roundMembers        []RoundMember
+	roundAmendments     []RoundAmendment
+	patients            []Patient
+	patientCensusEvents []PatientCensusEvent
+	escalationContacts  []EscalationContact
+	notifications       []Notification
+	outboxEvents        []OutboxEvent
+	syncOperations      []SyncOperation
+	// Stamps CreatedAt and UpdatedAt on new records
+	clock Clock
+}
+
+func NewMemoryRoundsStore() *MemoryRoundsStore {
+	return NewMemoryRoundsStoreWithClock(RealClock{})
+}
+
+func NewMemoryRoundsStoreWithClock(clock Clock) *MemoryRoundsStore {
+	return &MemoryRoundsStore{clock: clock}
+}
+
+// The outbox events written alongside rounds, oldest first
+func (s *MemoryRoundsStore) OutboxEvents() []OutboxEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]OutboxEvent{}, s.outboxEvents...)
+}
+
+func (s *MemoryRoundsStore) GetRoundConfigs() ([]RoundConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RoundConfig{}, s.roundConfigs...), nil
+}
+
+func (s *MemoryRoundsStore) GetRoundType(roundTypeId uint) (RoundType, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, roundType := range s.roundTypes {
+		if roundType.ID == roundTypeId {
+			return roundType, nil
+		}
+	}
+	return RoundType{}, nil
+}
+
+// Rounds are kept in the order they were created, so the last one with the round type is the most recent
+func (s *MemoryRoundsStore) GetLastRoundForType(roundTypeId uint) (Round, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.rounds) - 1; i >= 0; i-- {
+		if s.roundHasRoundType(s.rounds[i].ID, roundTypeId) {
+			return s.rounds[i], nil
+		}
+	}
+	return Round{}, nil
+}
+
+func (s *MemoryRoundsStore) GetRounds(startTime time.Time, endTime time.Time) ([]Round, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start, end := startTime.UTC().Format(time.RFC3339), endTime.UTC().Format(time.RFC3339)
+	var rounds []Round
+	for _, round := range s.rounds {
+		if round.RoundTimestamp >= start && round.RoundTimestamp <= end {
+			rounds = append(rounds, round)
+		}
+	}
+	sort.SliceStable(rounds, func(i, j int) bool {
+		return rounds[i].RoundTimestamp < rounds[j].RoundTimestamp
+	})
+	return rounds, nil
+}
+
+func (s *MemoryRoundsStore) GetRoundsPage(startTime string, endTime string, statuses []string, roundTypeIds []uint, descending bool, limit int) ([]Round, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rounds []Round
+	for _, round := range s.rounds {
+		if round.RoundTimestamp < startTime || round.RoundTimestamp > endTime {
+			continue
+		}
+		if len(statuses) > 0 && !containsString(statuses, round.Status) {
+			continue
+		}
+		if len(roundTypeIds) > 0 {
+			found := false
+			for _, roundTypeId := range roundTypeIds {
+				if s.roundHasRoundType(round.ID, roundTypeId) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		rounds = append(rounds, round)
+	}
+
+	sort.SliceStable(rounds, func(i, j int) bool {
+		if descending {
+			return rounds[i].RoundTimestamp > rounds[j].RoundTimestamp
+		}
+		return rounds[i].RoundTimestamp < rounds[j].RoundTimestamp
+	})
+	if limit > 0 && len(rounds) > limit {
+		rounds = rounds[:limit]
+	}
+	return rounds, nil
+}
+
+func (s *MemoryRoundsStore) GetExistingRoundTimestamps(roundTimestamps []string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing := make(map[string]bool)
+	for _, round := range s.rounds {
+		if containsString(roundTimestamps, round.RoundTimestamp) {
+			existing[round.RoundTimestamp] = true
+		}
+	}
+	return existing, nil
+}
+
+func (s *MemoryRoundsStore) GetRound(roundId uint) (Round, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, round := range s.rounds {
+		if round.ID == roundId {
+			return round, nil
+		}
+	}
+	return Round{}, nil
+}
+
+func (s *MemoryRoundsStore) GetRoundForTime(t time.Time) (Round, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, round := range s.rounds {
+		if round.RoundTimestamp == t.UTC().Format(time.RFC3339) {
+			return round, nil
+		}
+	}
+	return Round{}, nil
+}
+
+func (s *MemoryRoundsStore) RoundHasRoundType(roundId uint, roundTypeId uint) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roundHasRoundType(roundId, roundTypeId), nil
+}
+
+func (s *MemoryRoundsStore) roundHasRoundType(roundId uint, roundTypeId uint) bool {
+	for _, roundRoundType := range s.roundRoundTypes {
+		if roundRoundType.RoundID == roundId && roundRoundType.RoundTypeID == roundTypeId {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryRoundsStore) GetRoundMember(roundMemberId uint) (RoundMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, roundMember := range s.roundMembers {
+		if roundMember.ID == roundMemberId {
+			return roundMember, nil
+		}
+	}
+	return RoundMember{}, nil
+}
+
+func (s *MemoryRoundsStore) GetRoundMembersForRound(roundId uint) ([]RoundMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var roundMembers []RoundMember
+	for _, roundMember := range s.roundMembers {
+		if roundMember.RoundId == roundId {
+			roundMembers = append(roundMembers, roundMember)
+		}
+	}
+	return roundMembers, nil
+}
+
+func (s *MemoryRoundsStore) GetRoundMembersForRounds(roundIds []uint) ([]RoundMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var roundMembers []RoundMember
+	for _, roundMember := range s.roundMembers {
+		if containsUint(roundIds, roundMember.RoundId) {
+			roundMembers = append(roundMembers, roundMember)
+		}
+	}
+	sort.SliceStable(roundMembers, func(i, j int) bool {
+		if roundMembers[i].RoundId != roundMembers[j].RoundId {
+			return roundMembers[i].RoundId < roundMembers[j].RoundId
+		}
+		return roundMembers[i].PatientId < roundMembers[j].PatientId
+	})
+	return roundMembers, nil
+}
+
+func (s *MemoryRoundsStore) GetObservedRoundMembersForPatient(patientId string, startTime time.Time, endTime time.Time) ([]RoundMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start, end := startTime.UTC().Format(time.RFC3339), endTime.UTC().Format(time.RFC3339)
+	var roundMembers []RoundMember
+	for _, roundMember := range s.roundMembers {
+		if roundMember.PatientId == patientId && roundMember.ObservedAt >= start && roundMember.ObservedAt <= end {
+			roundMembers = append(roundMembers, roundMember)
+		}
+	}
+	sort.SliceStable(roundMembers, func(i, j int) bool {
+		return roundMembers[i].ObservedAt < roundMembers[j].ObservedAt
+	})
+	return roundMembers, nil
+}
+
+func (s *MemoryRoundsStore) GetLastObservedRoundMemberForPatient(patientId string, t time.Time) (RoundMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var last RoundMember
+	for _, roundMember := range s.roundMembers {
+		if roundMember.PatientId != patientId || roundMember.ObservedAt == "" || roundMember.ObservedAt > t.UTC().Format(time.RFC3339) {
+			continue
+		}
+		if last.ID == 0 || roundMember.ObservedAt > last.ObservedAt {
+			last = roundMember
+		}
+	}
+	return last, nil
+}
+
+func (s *MemoryRoundsStore) GetAmendmentsForRounds(roundIds []uint) ([]RoundAmendment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var amendments []RoundAmendment
+	for _, amendment := range s.roundAmendments {
+		if containsUint(roundIds, amendment.RoundId) {
+			amendments = append(amendments, amendment)
+		}
+	}
+	sort.SliceStable(amendments, func(i, j int) bool {
+		return amendments[i].AmendedAt < amendments[j].AmendedAt
+	})
+	return amendments, nil
+}
+
+func (s *MemoryRoundsStore) GetRoundAssignment(roundAssignmentId uint) (RoundAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, roundAssignment := range s.roundAssignments {
+		if roundAssignment.ID == roundAssignmentId {
+			return roundAssignment, nil
+		}
+	}
+	return RoundAssignment{}, nil
+}
+
+func (s *MemoryRoundsStore) GetRoundAssignmentsForRoundType(roundTypeId uint, t time.Time) ([]RoundAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var roundAssignments []RoundAssignment
+	for _, roundAssignment := range s.roundAssignments {
+		if roundAssignment.RoundTypeId == roundTypeId && roundAssignmentActiveAt(roundAssignment, t) {
+			roundAssignments = append(roundAssignments, roundAssignment)
+		}
+	}
+	return roundAssignments, nil
+}
+
+func (s *MemoryRoundsStore) GetRoundAssignmentsForPatient(patientId string) ([]RoundAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var roundAssignments []RoundAssignment
+	for _, roundAssignment := range s.roundAssignments {
+		if roundAssignment.PatientId == patientId {
+			roundAssignments = append(roundAssignments, roundAssignment)
+		}
+	}
+	return roundAssignments, nil
+}
+
+func (s *MemoryRoundsStore) GetOpenRoundAssignmentsForPatient(patientId string) ([]RoundAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var roundAssignments []RoundAssignment
+	for _, roundAssignment := range s.roundAssignments {
+		if roundAssignment.PatientId == patientId && roundAssignment.EffectiveTo == "" {
+			roundAssignments = append(roundAssignments, roundAssignment)
+		}
+	}
+	return roundAssignments, nil
+}
+
+func (s *MemoryRoundsStore) GetAssignedPatientIds(t time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var patientIds []string
+	for _, roundAssignment := range s.roundAssignments {
+		if roundAssignmentActiveAt(roundAssignment, t) && !containsString(patientIds, roundAssignment.PatientId) {
+			patientIds = append(patientIds, roundAssignment.PatientId)
+		}
+	}
+	sort.Strings(patientIds)
+	return patientIds, nil
+}
+
+func (s *MemoryRoundsStore) GetPatient(patientId string) (Patient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, patient := range s.patients {
+		if patient.PatientId == patientId {
+			return patient, nil
+		}
+	}
+	return Patient{}, nil
+}
+
+// The latest event at or before the time wins, and the later one of events at the same time
+func (s *MemoryRoundsStore) GetPatientCensusAtTime(patientId string, t time.Time) (PatientCensusEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var census PatientCensusEvent
+	for _, censusEvent := range s.patientCensusEvents {
+		if censusEvent.PatientId != patientId || censusEvent.EffectiveAt > t.UTC().Format(time.RFC3339) {
+			continue
+		}
+		if census.ID == 0 || censusEvent.EffectiveAt >= census.EffectiveAt {
+			census = censusEvent
+		}
+	}
+	return census, nil
+}
+
+func (s *MemoryRoundsStore) GetEscalationContacts(unit string, tier string) ([]EscalationContact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var contacts []EscalationContact
+	for _, contact := range s.escalationContacts {
+		if contact.Unit == unit && contact.Tier == tier {
+			contacts = append(contacts, contact)
+		}
+	}
+	return contacts, nil
+}
+
+func (s *MemoryRoundsStore) GetNotification(event string, roundTimestamp string, unit string, contactId uint) (Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, notification := range s.notifications {
+		if notification.Event == event && notification.RoundTimestamp == roundTimestamp && notification.Unit == unit && notification.ContactId == contactId {
+			return notification, nil
+		}
+	}
+	return Notification{}, nil
+}
+
+func (s *MemoryRoundsStore) GetInAppNotifications(address string, unreadOnly bool) ([]Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var notifications []Notification
+	for _, notification := range s.notifications {
+		if notification.Channel != "in_app" || notification.Address != address || notification.SentAt == "" {
+			continue
+		}
+		if unreadOnly && notification.ReadAt != "" {
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+	sort.SliceStable(notifications, func(i, j int) bool {
+		if notifications[i].SentAt != notifications[j].SentAt {
+			return notifications[i].SentAt > notifications[j].SentAt
+		}
+		return notifications[i].ID > notifications[j].ID
+	})
+	return notifications, nil
+}
+
+func (s *MemoryRoundsStore) GetSyncOperation(clientId string) (SyncOperation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, operation := range s.syncOperations {
+		if operation.ClientId == clientId {
+			return operation, nil
+		}
+	}
+	return SyncOperation{}, nil
+}
+
+func (s *MemoryRoundsStore) GetAppliedSyncClientId(roundTimestamp string, patientId string, deviceTime string, types []string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.syncOperations) - 1; i >= 0; i-- {
+		operation := s.syncOperations[i]
+		if operation.RoundTimestamp == roundTimestamp && operation.PatientId == patientId && operation.DeviceTime == deviceTime &&
+			operation.Outcome == "APPLIED" && containsString(types, operation.Type) {
+			return operation.ClientId, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *MemoryRoundsStore) CreateRoundType(roundType *RoundType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roundType.ID = uint(len(s.roundTypes) + 1)
+	roundType.CreatedAt, roundType.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.roundTypes = append(s.roundTypes, *roundType)
+	return nil
+}
+
+func (s *MemoryRoundsStore) CreateRoundConfig(roundConfig *RoundConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roundConfig.ID = uint(len(s.roundConfigs) + 1)
+	roundConfig.CreatedAt, roundConfig.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.roundConfigs = append(s.roundConfigs, *roundConfig)
+	return nil
+}
+
+func (s *MemoryRoundsStore) CreateRoundAssignment(roundAssignment *RoundAssignment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roundAssignment.ID = uint(len(s.roundAssignments) + 1)
+	roundAssignment.CreatedAt, roundAssignment.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.roundAssignments = append(s.roundAssignments, *roundAssignment)
+	return nil
+}
+
+func (s *MemoryRoundsStore) CreateRound(round *Round, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.rounds {
+		if existing.RoundTimestamp == round.RoundTimestamp {
+			*round = existing
+			return nil
+		}
+	}
+
+	created := *round
+	created.ID = uint(len(s.rounds) + 1)
+	created.CreatedAt, created.UpdatedAt = s.clock.Now(), s.clock.Now()
+	event, err := s.newRoundEvent(created, at)
+	if err != nil {
+		return err
+	}
+
+	*round = created
+	s.rounds = append(s.rounds, created)
+	s.outboxEvents = append(s.outboxEvents, event)
+	return nil
+}
+
+// The outbox event for a round's status, numbered to follow the events already written. The caller holds mu
+func (s *MemoryRoundsStore) newRoundEvent(round Round, at time.Time) (OutboxEvent, error) {
+	eventType, ok := roundEventTypes[round.Status]
+	if !ok {
+		return OutboxEvent{}, fmt.Errorf("no event for round status %q", round.Status)
+	}
+	event, err := newRoundEvent(eventType, round, at)
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+	event.ID = uint(len(s.outboxEvents) + 1)
+	event.CreatedAt, event.UpdatedAt = s.clock.Now(), s.clock.Now()
+	return event, nil
+}
+
+func (s *MemoryRoundsStore) CreateRoundRoundType(roundRoundType *RoundRoundType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roundRoundType.ID = uint(len(s.roundRoundTypes) + 1)
+	roundRoundType.CreatedAt, roundRoundType.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.roundRoundTypes = append(s.roundRoundTypes, *roundRoundType)
+	return nil
+}
+
+func (s *MemoryRoundsStore) CreateRoundMember(roundMember *RoundMember) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roundMember.ID = uint(len(s.roundMembers) + 1)
+	roundMember.CreatedAt, roundMember.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.roundMembers = append(s.roundMembers, *roundMember)
+	return nil
+}
+
+func (s *MemoryRoundsStore) CreateRoundAmendment(amendment *RoundAmendment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	amendment.ID = uint(len(s.roundAmendments) + 1)
+	amendment.CreatedAt, amendment.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.roundAmendments = append(s.roundAmendments, *amendment)
+	return nil
+}
+
+// Patient ids are unique, as they are in the database
+func (s *MemoryRoundsStore) CreatePatient(patient *Patient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.patients {
+		if existing.PatientId == patient.PatientId {
+			return fmt.Errorf("patient %q already exists", patient.PatientId)
+		}
+	}
+	patient.ID = uint(len(s.patients) + 1)
+	patient.CreatedAt, patient.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.patients = append(s.patients, *patient)
+	return nil
+}
+
+func (s *MemoryRoundsStore) CreatePatientCensusEvent(censusEvent *PatientCensusEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	censusEvent.ID = uint(len(s.patientCensusEvents) + 1)
+	censusEvent.CreatedAt, censusEvent.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.patientCensusEvents = append(s.patientCensusEvents, *censusEvent)
+	return nil
+}
+
+func (s *MemoryRoundsStore) CreateEscalationContact(contact *EscalationContact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	contact.ID = uint(len(s.escalationContacts) + 1)
+	contact.CreatedAt, contact.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.escalationContacts = append(s.escalationContacts, *contact)
+	return nil
+}
+
+func (s *MemoryRoundsStore) CreateNotification(notification *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	notification.ID = uint(len(s.notifications) + 1)
+	notification.CreatedAt, notification.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.notifications = append(s.notifications, *notification)
+	return nil
+}
+
+func (s *MemoryRoundsStore) CreateSyncOperation(operation *SyncOperation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createSyncOperation(operation)
+}
+
+// Client ids are unique, as the unique index makes them in the database
+func (s *MemoryRoundsStore) createSyncOperation(operation *SyncOperation) error {
+	for _, existing := range s.syncOperations {
+		if existing.ClientId == operation.ClientId {
+			return fmt.Errorf("sync operation %q already exists", operation.ClientId)
+		}
+	}
+	operation.ID = uint(len(s.syncOperations) + 1)
+	operation.CreatedAt, operation.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.syncOperations = append(s.syncOperations, *operation)
+	return nil
+}
+
+func (s *MemoryRoundsStore) UpdateRoundStatus(round *Round, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rounds {
+		if s.rounds[i].ID != round.ID {
+			continue
+		}
+		updated := s.rounds[i]
+		updated.Status = round.Status
+		updated.StartedAt, updated.StartedBy = round.StartedAt, round.StartedBy
+		updated.CompletedAt, updated.CompletedBy = round.CompletedAt, round.CompletedBy
+		updated.UpdatedAt = s.clock.Now()
+		event, err := s.newRoundEvent(updated, at)
+		if err != nil {
+			return err
+		}
+
+		*round = updated
+		s.rounds[i] = updated
+		s.outboxEvents = append(s.outboxEvents, event)
+		return nil
+	}
+	return fmt.Errorf("round %d not found", round.ID)
+}
+
+func (s *MemoryRoundsStore) UpdateRoundMemberObservation(roundMember *RoundMember) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.roundMembers {
+		if s.roundMembers[i].ID != roundMember.ID {
+			continue
+		}
+		updated := s.roundMembers[i]
+		updated.Observation, updated.ObservedAt, updated.ObservedBy = roundMember.Observation, roundMember.ObservedAt, roundMember.ObservedBy
+		updated.UpdatedAt = s.clock.Now()
+		*roundMember = updated
+		s.roundMembers[i] = updated
+		return nil
+	}
+	return fmt.Errorf("round member %d not found", roundMember.ID)
+}
+
+// Round timestamps are unique, as they are in the database, so amending a round that was created meanwhile fails
+func (s *MemoryRoundsStore) AmendRoundStatus(round *Round, amendment *RoundAmendment, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := -1
+	for i, existing := range s.rounds {
+		if round.ID == 0 && existing.RoundTimestamp == round.RoundTimestamp {
+			return fmt.Errorf("round at %s already exists", round.RoundTimestamp)
+		}
+		if round.ID != 0 && existing.ID == round.ID {
+			index = i
+		}
+	}
+	if round.ID != 0 && index == -1 {
+		return fmt.Errorf("round %d not found", round.ID)
+	}
+
+	amended := *round
+	if index == -1 {
+		amended.ID = uint(len(s.rounds) + 1)
+		amended.CreatedAt = s.clock.Now()
+	} else {
+		existing := s.rounds[index]
+		existing.Status, existing.StartedAt, existing.StartedBy = amended.Status, amended.StartedAt, amended.StartedBy
+		existing.CompletedAt, existing.CompletedBy = amended.CompletedAt, amended.CompletedBy
+		amended = existing
+	}
+	amended.UpdatedAt = s.clock.Now()
+	event, err := s.newRoundEvent(amended, at)
+	if err != nil {
+		return err
+	}
+
+	*round = amended
+	if index == -1 {
+		s.rounds = append(s.rounds, amended)
+	} else {
+		s.rounds[index] = amended
+	}
+	amendment.RoundId = amended.ID
+	amendment.ID = uint(len(s.roundAmendments) + 1)
+	amendment.CreatedAt, amendment.UpdatedAt = s.clock.Now(), s.clock.Now()
+	s.roundAmendments = append(s.roundAmendments, *amendment)
+	s.outboxEvents = append(s.outboxEvents, event)
+	return nil
+}
+
+func (s *MemoryRoundsStore) AmendRoundMemberObservation(roundMember *RoundMember, amendment *RoundAmendment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.roundMembers {
+		if s.roundMembers[i].ID != roundMember.ID {
+			continue
+		}
+		updated := s.roundMembers[i]
+		updated.Observation, updated.ObservedAt = roundMember.Observation, roundMember.ObservedAt
+		updated.UpdatedAt = s.clock.Now()
+		*roundMember = updated
+		s.roundMembers[i] = updated
+
+		amendment.ID = uint(len(s.roundAmendments) + 1)
+		amendment.CreatedAt, amendment.UpdatedAt = s.clock.Now(), s.clock.Now()
+		s.roundAmendments = append(s.roundAmendments, *amendment)
+		return nil
+	}
+	return fmt.Errorf("round member %d not found", roundMember.ID)
+}
+
+func (s *MemoryRoundsStore) ApplySyncRound(round *Round, operation *SyncOperation, statusChanged bool, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rounds {
+		if s.rounds[i].ID != round.ID {
+			continue
+		}
+		updated := s.rounds[i]
+		updated.Status = round.Status
+		updated.StartedAt, updated.StartedBy = round.StartedAt, round.StartedBy
+		updated.CompletedAt, updated.CompletedBy = round.CompletedAt, round.CompletedBy
+		updated.UpdatedAt = s.clock.Now()
+		var events []OutboxEvent
+		if statusChanged {
+			event, err := s.newRoundEvent(updated, at)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		if err := s.createSyncOperation(operation); err != nil {
+			return err
+		}
+
+		*round = updated
+		s.rounds[i] = updated
+		s.outboxEvents = append(s.outboxEvents, events...)
+		return nil
+	}
+	return fmt.Errorf("round %d not found", round.ID)
+}
+
+func (s *MemoryRoundsStore) ApplySyncObservation(roundMember *RoundMember, operation *SyncOperation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.roundMembers {
+		if s.roundMembers[i].ID != roundMember.ID {
+			continue
+		}
+		if err := s.createSyncOperation(operation); err != nil {
+			return err
+		}
+		updated := s.roundMembers[i]
+		updated.Observation, updated.ObservedAt, updated.ObservedBy = roundMember.Observation, roundMember.ObservedAt, roundMember.ObservedBy
+		updated.UpdatedAt = s.clock.Now()
+		*roundMember = updated
+		s.roundMembers[i] = updated
+		return nil
+	}
+	return fmt.Errorf("round member %d not found", roundMember.ID)
+}
+
+func (s *MemoryRoundsStore) WithSchedulingLock(fn func() error) error {
+	s.schedulingMu.Lock()
+	defer s.schedulingMu.Unlock()
+	return fn()
+}
+
+// Whether an assignment was active at a given time, from EffectiveFrom (inclusive) up to EffectiveTo (exclusive)
+func roundAssignmentActiveAt(roundAssignment RoundAssignment, t time.Time) bool {
+	at := t.UTC().Format(time.RFC3339)
+	return (roundAssignment.EffectiveFrom == "" || roundAssignment.EffectiveFrom <= at) &&
+		(roundAssignment.EffectiveTo == "" || roundAssignment.EffectiveTo > at)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint(values []uint, value uint) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
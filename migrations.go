@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// One step in the schema's history. Up moves the schema from the previous version to Version, and Down moves it back
+// Each step runs in a transaction with its schema_version row, so a failed migration leaves the schema where it was
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// A row per applied migration. The highest version is the version of the schema
+type SchemaVersion struct {
+	Version   int    `json:"version" gorm:"primaryKey;autoIncrement:false"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"appliedAt"`
+}
+
+func (SchemaVersion) TableName() string { return "schema_version" }
+
+// Returned when the database was migrated by a newer build, which this build can't safely read or write
+var ErrSchemaTooNew = errors.New("database schema is newer than this build")
+
+// Every migration, oldest first. Versions are consecutive from 1
+// Add new migrations to the end, and never change one that has shipped; add another that fixes it up instead
+var migrations = []Migration{
+	{
+		// Databases that AutoMigrate built already have these tables, and AutoMigrate leaves them as they are
+		Version: 1,
+		Name:    "baseline",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(baselineModels...)
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(baselineModels...)
+		},
+	},
+	{
+		// Soft-deleted rows, and round types and members whose round doesn't exist, which the new foreign keys
+		// would reject, can't be carried over. They go to quarantined_rows instead, and rolling back restores them
+		Version: 2,
+		Name:    "explicit primary keys and foreign keys",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().CreateTable(&keyedQuarantinedRow{}); err != nil {
+				return err
+			}
+			if err := quarantineRows(tx, 2, baselineModels, explicitKeysFilters, "deleted_at IS NULL"); err != nil {
+				return err
+			}
+			return rebuildTables(tx, baselineModels, keyedModels, explicitKeysFilters, "deleted_at IS NULL")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := rebuildTables(tx, keyedModels, baselineModels, nil, ""); err != nil {
+				return err
+			}
+			if err := restoreQuarantinedRows(tx, 2); err != nil {
+				return err
+			}
+			return tx.Migrator().DropTable(&keyedQuarantinedRow{})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "retention holds and round archive",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().CreateTable(retentionModels...); err != nil {
+				return err
+			}
+			for name, query := range retentionViews {
+				if err := tx.Exec("CREATE VIEW " + tx.Statement.Quote(name) + " AS " + query).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for name := range retentionViews {
+				if err := tx.Exec("DROP VIEW IF EXISTS " + tx.Statement.Quote(name)).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropTable(retentionModels...)
+		},
+	},
+	{
+		Version: 4,
+		Name:    "notification retry backoff",
+		Up: func(tx *gorm.DB) error {
+			for _, field := range []string{"Attempts", "NextAttemptAt"} {
+				if err := tx.Migrator().AddColumn(&notificationRetry{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, field := range []string{"Attempts", "NextAttemptAt"} {
+				if err := tx.Migrator().DropColumn(&notificationRetry{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 5,
+		Name:    "hl7 message receipts",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&hl7MessageReceipt{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&hl7MessageReceipt{})
+		},
+	},
+	{
+		Version: 6,
+		Name:    "observation gap notifications",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&notificationPatient{}, "PatientId")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&notificationPatient{}, "PatientId")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "round config windows",
+		Up: func(tx *gorm.DB) error {
+			for _, field := range []string{"WindowStart", "WindowEnd"} {
+				if err := tx.Migrator().AddColumn(&roundConfigWindow{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, field := range []string{"WindowStart", "WindowEnd"} {
+				if err := tx.Migrator().DropColumn(&roundConfigWindow{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// The rows migration 2 carries over, for the tables that need more than the default of not being soft deleted
+var explicitKeysFilters = map[string]string{
+	"round_round_types": "deleted_at IS NULL AND round_id IN (SELECT id FROM rounds) AND round_type_id IN (SELECT id FROM round_types)",
+	"round_members":     "deleted_at IS NULL AND round_id IN (SELECT id FROM rounds)",
+}
+
+// The version the schema is at once every migration has run
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// The version the schema is at, or 0 for a database that has never been migrated
+func getSchemaVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		return 0, nil
+	}
+	var version int
+	err := db.Model(&SchemaVersion{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+func getAppliedMigrations(db *gorm.DB) ([]SchemaVersion, error) {
+	var versions []SchemaVersion
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		return versions, nil
+	}
+	err := db.Order("version").Find(&versions).Error
+	return versions, err
+}
+
+// Run migrations up or down until the schema is at the target version, and return the migrations that ran in order
+// Migrating a schema newer than this build knows about is refused, since its down migrations aren't here to run
+// The whole run holds the migration lock, so instances starting together take turns and the later ones find nothing to do
+func MigrateSchema(db *gorm.DB, target int, now time.Time) ([]Migration, error) {
+	if target < 0 || target > latestSchemaVersion() {
+		return nil, fmt.Errorf("invalid schema version %d, expected 0 to %d", target, latestSchemaVersion())
+	}
+
+	var ran []Migration
+	err := withDatabaseLock(db, migrationLockKey, &sqliteMigrationLock, func() error {
+		var err error
+		ran, err = migrateSchema(db, target, now)
+		return err
+	})
+	return ran, err
+}
+
+// MigrateSchema's work, run while it holds the migration lock
+func migrateSchema(db *gorm.DB, target int, now time.Time) ([]Migration, error) {
+	// The version is checked before anything is written, so even schema_version is left alone in a newer schema
+	current, err := getSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if current > latestSchemaVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, this build knows up to %d", ErrSchemaTooNew, current, latestSchemaVersion())
+	}
+	if err := db.AutoMigrate(&SchemaVersion{}); err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for _, migration := range migrations {
+		if migration.Version <= current || migration.Version > target {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaVersion{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: now.UTC().Format(time.RFC3339),
+			}).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("migration %d %s failed: %w", migration.Version, migration.Name, err)
+		}
+		ran = append(ran, migration)
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if migration.Version > current || migration.Version <= target {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaVersion{}, migration.Version).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("rolling back migration %d %s failed: %w", migration.Version, migration.Name, err)
+		}
+		ran = append(ran, migration)
+	}
+
+	return ran, nil
+}
+
+// Replace tables with new definitions, copying across the rows that match each table's filter, or defaultFilter
+// Columns that are in both definitions are copied. SQLite can't add constraints to an existing table, so
+// rebuilding is the only way to add foreign keys there, and Postgres is rebuilt the same way to keep them alike
+// The old and new models must list the same tables, parents first
+func rebuildTables(tx *gorm.DB, fromModels []interface{}, toModels []interface{}, filters map[string]string, defaultFilter string) error {
+	fromSchemas := make(map[string]*schema.Schema)
+	for _, model := range fromModels {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		fromSchemas[table] = stmt.Schema
+
+		// Move the old table aside. Index names are global, so its indexes go now to make way for the new ones
+		if err := tx.Migrator().RenameTable(table, table+"_rebuild"); err != nil {
+			return err
+		}
+		for name := range stmt.Schema.ParseIndexes() {
+			if err := tx.Exec("DROP INDEX IF EXISTS " + tx.Statement.Quote(name)).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, model := range toModels {
+		if err := tx.Migrator().CreateTable(model); err != nil {
+			return err
+		}
+	}
+
+	for _, model := range toModels {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		from, ok := fromSchemas[table]
+		if !ok {
+			return fmt.Errorf("no old definition for table %s", table)
+		}
+
+		var columns []string
+		for _, column := range stmt.Schema.DBNames {
+			if from.LookUpField(column) != nil {
+				columns = append(columns, tx.Statement.Quote(column))
+			}
+		}
+		filter, ok := filters[table]
+		if !ok {
+			filter = defaultFilter
+		}
+		where := ""
+		if filter != "" {
+			where = " WHERE " + filter
+		}
+		list := strings.Join(columns, ", ")
+		copySQL := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s%s ORDER BY id",
+			tx.Statement.Quote(table), list, list, tx.Statement.Quote(table+"_rebuild"), where)
+		if err := tx.Exec(copySQL).Error; err != nil {
+			return err
+		}
+
+		if err := resetIdSequence(tx, table); err != nil {
+			return err
+		}
+	}
+
+	// Children first, so nothing still references a table when it is dropped
+	for i := len(fromModels) - 1; i >= 0; i-- {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(fromModels[i]); err != nil {
+			return err
+		}
+		if err := tx.Migrator().DropTable(stmt.Schema.Table + "_rebuild"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rows copied with their IDs leave Postgres' id sequence behind them, so it has to catch up
+func resetIdSequence(tx *gorm.DB, table string) error {
+	if !isPostgres(tx) {
+		return nil
+	}
+	return tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s", table, tx.Statement.Quote(table))).Error
+}
+
+// Copy the rows a rebuild with the same filters would leave behind into quarantined_rows, so a migration never discards data
+func quarantineRows(tx *gorm.DB, migration int, models []interface{}, filters map[string]string, defaultFilter string) error {
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		filter, ok := filters[table]
+		if !ok {
+			filter = defaultFilter
+		}
+		if filter == "" {
+			continue
+		}
+
+		var rows []map[string]interface{}
+		err := tx.Table(table).Where("CASE WHEN " + filter + " THEN 0 ELSE 1 END = 1").Order("id").Find(&rows).Error
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			data, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			reason := "references a row that doesn't exist"
+			if row["deleted_at"] != nil {
+				reason = "soft deleted"
+			}
+			id, _ := row["id"].(int64)
+			err = tx.Create(&keyedQuarantinedRow{
+				Migration:   migration,
+				SourceTable: table,
+				RowId:       uint(id),
+				Reason:      reason,
+				Data:        string(data),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Put the rows a migration quarantined back in the tables they came from, once the schema is back where they fit
+func restoreQuarantinedRows(tx *gorm.DB, migration int) error {
+	var quarantined []keyedQuarantinedRow
+	if err := tx.Where("migration = ?", migration).Order("id").Find(&quarantined).Error; err != nil {
+		return err
+	}
+	tables := make(map[string]bool)
+	for _, quarantinedRow := range quarantined {
+		row := make(map[string]interface{})
+		decoder := json.NewDecoder(strings.NewReader(quarantinedRow.Data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&row); err != nil {
+			return fmt.Errorf("quarantined row %d: %w", quarantinedRow.ID, err)
+		}
+		if err := tx.Table(quarantinedRow.SourceTable).Create(row).Error; err != nil {
+			return fmt.Errorf("quarantined row %d: %w", quarantinedRow.ID, err)
+		}
+		tables[quarantinedRow.SourceTable] = true
+	}
+	for table := range tables {
+		if err := resetIdSequence(tx, table); err != nil {
+			return err
+		}
+	}
+	return tx.Where("migration = ?", migration).Delete(&keyedQuarantinedRow{}).Error
+}
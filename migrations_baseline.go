@@ -0,0 +1,248 @@
+package main
+
+import (
+	"gorm.io/gorm"
+)
+
+// The schema as it was when versioned migrations were introduced, which is what AutoMigrate had been building
+// These are frozen copies of the models so migration 1 creates the same tables no matter how the models change later
+var baselineModels = []interface{}{
+	&baselineRoundType{},
+	&baselineRoundConfig{},
+	&baselineRoundAssignment{},
+	&baselineRound{},
+	&baselineRoundRoundType{},
+	&baselineRoundMember{},
+	&baselineRoundAmendment{},
+	&baselinePatient{},
+	&baselinePatientCensusEvent{},
+	&baselineEscalationContact{},
+	&baselineNotification{},
+	&baselineOutboxEvent{},
+	&baselineWebhookSubscription{},
+	&baselineWebhookDelivery{},
+	&baselineWebhookDeliveryAttempt{},
+	&baselineWebhookDeadLetter{},
+	&baselineSyncOperation{},
+}
+
+type baselineRoundType struct {
+	gorm.Model
+	ID           uint `gorm:"primaryKey"`
+	Name         string
+	DurationAmt  int
+	DurationUnit string
+}
+
+func (baselineRoundType) TableName() string { return "round_types" }
+
+type baselineRoundConfig struct {
+	gorm.Model
+	ID            uint `gorm:"primaryKey"`
+	RoundTypeId   uint
+	Enabled       bool
+	Unit          string
+	AssignOnAdmit bool
+}
+
+func (baselineRoundConfig) TableName() string { return "round_configs" }
+
+type baselineRoundAssignment struct {
+	gorm.Model
+	ID            uint `gorm:"primaryKey"`
+	RoundTypeId   uint
+	PatientId     string
+	EffectiveFrom string
+	EffectiveTo   string
+}
+
+func (baselineRoundAssignment) TableName() string { return "round_assignments" }
+
+type baselineRound struct {
+	gorm.Model
+	ID             uint   `gorm:"primaryKey"`
+	RoundTimestamp string `gorm:"uniqueIndex"`
+	Status         string
+	StartedAt      string
+	StartedBy      string
+	CompletedAt    string
+	CompletedBy    string
+}
+
+func (baselineRound) TableName() string { return "rounds" }
+
+type baselineRoundRoundType struct {
+	gorm.Model
+	RoundID     uint
+	RoundTypeID uint
+}
+
+func (baselineRoundRoundType) TableName() string { return "round_round_types" }
+
+type baselineRoundMember struct {
+	gorm.Model
+	ID          uint `gorm:"primaryKey"`
+	RoundId     uint
+	Status      string
+	PatientId   string
+	Unit        string
+	Observation string
+	ObservedAt  string
+	ObservedBy  string
+}
+
+func (baselineRoundMember) TableName() string { return "round_members" }
+
+type baselineRoundAmendment struct {
+	gorm.Model
+	ID            uint `gorm:"primaryKey"`
+	RoundId       uint
+	RoundMemberId uint
+	Field         string
+	OriginalValue string
+	AmendedValue  string
+	ReasonCode    string
+	Note          string
+	LateEntry     bool
+	AmendedAt     string
+}
+
+func (baselineRoundAmendment) TableName() string { return "round_amendments" }
+
+type baselinePatient struct {
+	gorm.Model
+	ID           uint   `gorm:"primaryKey"`
+	PatientId    string `gorm:"uniqueIndex"`
+	Name         string
+	CensusStatus string
+	Unit         string
+	Bed          string
+}
+
+func (baselinePatient) TableName() string { return "patients" }
+
+type baselinePatientCensusEvent struct {
+	gorm.Model
+	ID           uint   `gorm:"primaryKey"`
+	PatientId    string `gorm:"index"`
+	CensusStatus string
+	Unit         string
+	Bed          string
+	EffectiveAt  string
+}
+
+func (baselinePatientCensusEvent) TableName() string { return "patient_census_events" }
+
+type baselineEscalationContact struct {
+	gorm.Model
+	ID      uint `gorm:"primaryKey"`
+	Unit    string
+	Tier    string
+	Name    string
+	Channel string
+	Address string
+}
+
+func (baselineEscalationContact) TableName() string { return "escalation_contacts" }
+
+type baselineNotification struct {
+	gorm.Model
+	ID             uint `gorm:"primaryKey"`
+	Event          string
+	RoundTimestamp string
+	Unit           string
+	Tier           string
+	ContactId      uint
+	Channel        string
+	Address        string
+	Message        string
+	SentAt         string
+	Error          string
+	ReadAt         string
+}
+
+func (baselineNotification) TableName() string { return "notifications" }
+
+type baselineOutboxEvent struct {
+	gorm.Model
+	ID          uint `gorm:"primaryKey"`
+	EventType   string
+	RoundId     uint `gorm:"index"`
+	Payload     string
+	OccurredAt  string
+	ProcessedAt string `gorm:"index"`
+}
+
+func (baselineOutboxEvent) TableName() string { return "outbox_events" }
+
+type baselineWebhookSubscription struct {
+	gorm.Model
+	ID         uint `gorm:"primaryKey"`
+	URL        string
+	Secret     string
+	EventTypes string
+	Active     bool
+}
+
+func (baselineWebhookSubscription) TableName() string { return "webhook_subscriptions" }
+
+type baselineWebhookDelivery struct {
+	gorm.Model
+	ID             uint `gorm:"primaryKey"`
+	SubscriptionId uint `gorm:"index"`
+	OutboxEventId  uint
+	Status         string `gorm:"index"`
+	Attempts       int
+	NextAttemptAt  string
+	DeliveredAt    string
+}
+
+func (baselineWebhookDelivery) TableName() string { return "webhook_deliveries" }
+
+type baselineWebhookDeliveryAttempt struct {
+	gorm.Model
+	ID             uint `gorm:"primaryKey"`
+	DeliveryId     uint `gorm:"index"`
+	SubscriptionId uint `gorm:"index"`
+	OutboxEventId  uint
+	Attempt        int
+	AttemptedAt    string
+	ResponseStatus int
+	Error          string
+}
+
+func (baselineWebhookDeliveryAttempt) TableName() string { return "webhook_delivery_attempts" }
+
+type baselineWebhookDeadLetter struct {
+	gorm.Model
+	ID             uint `gorm:"primaryKey"`
+	DeliveryId     uint
+	SubscriptionId uint
+	OutboxEventId  uint
+	EventType      string
+	Payload        string
+	Attempts       int
+	LastError      string
+	DeadAt         string
+	ReplayedAt     string
+}
+
+func (baselineWebhookDeadLetter) TableName() string { return "webhook_dead_letters" }
+
+type baselineSyncOperation struct {
+	gorm.Model
+	ID             uint   `gorm:"primaryKey"`
+	ClientId       string `gorm:"uniqueIndex"`
+	DeviceId       string
+	Type           string
+	RoundTimestamp string
+	PatientId      string
+	Observation    string
+	StaffId        string
+	DeviceTime     string
+	ReceivedAt     string
+	Outcome        string
+	Detail         string
+}
+
+func (baselineSyncOperation) TableName() string { return "sync_operations" }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"time"
+)
+
+// The table migration 5 adds, so a resent ADT message gets its original ACK back instead of being applied again
+// A frozen copy, like the baseline, so the migration doesn't change as the model does
+type hl7MessageReceipt struct {
+	ID                 uint   `gorm:"primaryKey"`
+	SendingApplication string `gorm:"uniqueIndex:idx_hl7_message_receipts_control_id"`
+	SendingFacility    string `gorm:"uniqueIndex:idx_hl7_message_receipts_control_id"`
+	ControlId          string `gorm:"uniqueIndex:idx_hl7_message_receipts_control_id"`
+	Ack                string
+	ReceivedAt         string
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
+
+func (hl7MessageReceipt) TableName() string { return "hl7_message_receipts" }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"time"
+)
+
+// The schema as migration 2 leaves it: explicit primary keys without gorm.Model, and foreign keys from
+// round_round_types and round_members to the rounds and round types they belong to
+// Frozen copies of the models, like the baseline, so the migration doesn't change as the models do
+// Parents come before the tables that reference them, which is the order the tables are created in
+var keyedModels = []interface{}{
+	&keyedRoundType{},
+	&keyedRoundConfig{},
+	&keyedRoundAssignment{},
+	&keyedRound{},
+	&keyedRoundRoundType{},
+	&keyedRoundMember{},
+	&keyedRoundAmendment{},
+	&keyedPatient{},
+	&keyedPatientCensusEvent{},
+	&keyedEscalationContact{},
+	&keyedNotification{},
+	&keyedOutboxEvent{},
+	&keyedWebhookSubscription{},
+	&keyedWebhookDelivery{},
+	&keyedWebhookDeliveryAttempt{},
+	&keyedWebhookDeadLetter{},
+	&keyedSyncOperation{},
+}
+
+type keyedRoundType struct {
+	ID           uint `gorm:"primaryKey"`
+	Name         string
+	DurationAmt  int
+	DurationUnit string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (keyedRoundType) TableName() string { return "round_types" }
+
+type keyedRoundConfig struct {
+	ID            uint `gorm:"primaryKey"`
+	RoundTypeId   uint
+	Enabled       bool
+	Unit          string
+	AssignOnAdmit bool
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (keyedRoundConfig) TableName() string { return "round_configs" }
+
+type keyedRoundAssignment struct {
+	ID            uint `gorm:"primaryKey"`
+	RoundTypeId   uint
+	PatientId     string
+	EffectiveFrom string
+	EffectiveTo   string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (keyedRoundAssignment) TableName() string { return "round_assignments" }
+
+type keyedRound struct {
+	ID             uint   `gorm:"primaryKey"`
+	RoundTimestamp string `gorm:"uniqueIndex"`
+	Status         string
+	StartedAt      string
+	StartedBy      string
+	CompletedAt    string
+	CompletedBy    string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (keyedRound) TableName() string { return "rounds" }
+
+type keyedRoundRoundType struct {
+	ID          uint `gorm:"primaryKey"`
+	RoundID     uint `gorm:"not null;index"`
+	RoundTypeID uint `gorm:"not null;index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Round       keyedRound     `gorm:"constraint:OnDelete:CASCADE"`
+	RoundType   keyedRoundType `gorm:"constraint:OnDelete:RESTRICT"`
+}
+
+func (keyedRoundRoundType) TableName() string { return "round_round_types" }
+
+type keyedRoundMember struct {
+	ID          uint `gorm:"primaryKey"`
+	RoundId     uint `gorm:"not null;index"`
+	Status      string
+	PatientId   string
+	Unit        string
+	Observation string
+	ObservedAt  string
+	ObservedBy  string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Round       keyedRound `gorm:"foreignKey:RoundId;constraint:OnDelete:CASCADE"`
+}
+
+func (keyedRoundMember) TableName() string { return "round_members" }
+
+type keyedRoundAmendment struct {
+	ID            uint `gorm:"primaryKey"`
+	RoundId       uint
+	RoundMemberId uint
+	Field         string
+	OriginalValue string
+	AmendedValue  string
+	ReasonCode    string
+	Note          string
+	LateEntry     bool
+	AmendedAt     string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (keyedRoundAmendment) TableName() string { return "round_amendments" }
+
+type keyedPatient struct {
+	ID           uint   `gorm:"primaryKey"`
+	PatientId    string `gorm:"uniqueIndex"`
+	Name         string
+	CensusStatus string
+	Unit         string
+	Bed          string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (keyedPatient) TableName() string { return "patients" }
+
+type keyedPatientCensusEvent struct {
+	ID           uint   `gorm:"primaryKey"`
+	PatientId    string `gorm:"index"`
+	CensusStatus string
+	Unit         string
+	Bed          string
+	EffectiveAt  string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (keyedPatientCensusEvent) TableName() string { return "patient_census_events" }
+
+type keyedEscalationContact struct {
+	ID        uint `gorm:"primaryKey"`
+	Unit      string
+	Tier      string
+	Name      string
+	Channel   string
+	Address   string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (keyedEscalationContact) TableName() string { return "escalation_contacts" }
+
+type keyedNotification struct {
+	ID             uint `gorm:"primaryKey"`
+	Event          string
+	RoundTimestamp string
+	Unit           string
+	Tier           string
+	ContactId      uint
+	Channel        string
+	Address        string
+	Message        string
+	SentAt         string
+	Error          string
+	ReadAt         string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (keyedNotification) TableName() string { return "notifications" }
+
+type keyedOutboxEvent struct {
+	ID          uint `gorm:"primaryKey"`
+	EventType   string
+	RoundId     uint `gorm:"index"`
+	Payload     string
+	OccurredAt  string
+	ProcessedAt string `gorm:"index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (keyedOutboxEvent) TableName() string { return "outbox_events" }
+
+type keyedWebhookSubscription struct {
+	ID         uint `gorm:"primaryKey"`
+	URL        string
+	Secret     string
+	EventTypes string
+	Active     bool
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (keyedWebhookSubscription) TableName() string { return "webhook_subscriptions" }
+
+type keyedWebhookDelivery struct {
+	ID             uint `gorm:"primaryKey"`
+	SubscriptionId uint `gorm:"index"`
+	OutboxEventId  uint
+	Status         string `gorm:"index"`
+	Attempts       int
+	NextAttemptAt  string
+	DeliveredAt    string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (keyedWebhookDelivery) TableName() string { return "webhook_deliveries" }
+
+type keyedWebhookDeliveryAttempt struct {
+	ID             uint `gorm:"primaryKey"`
+	DeliveryId     uint `gorm:"index"`
+	SubscriptionId uint `gorm:"index"`
+	OutboxEventId  uint
+	Attempt        int
+	AttemptedAt    string
+	ResponseStatus int
+	Error          string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (keyedWebhookDeliveryAttempt) TableName() string { return "webhook_delivery_attempts" }
+
+type keyedWebhookDeadLetter struct {
+	ID             uint `gorm:"primaryKey"`
+	DeliveryId     uint
+	SubscriptionId uint
+	OutboxEventId  uint
+	EventType      string
+	Payload        string
+	Attempts       int
+	LastError      string
+	DeadAt         string
+	ReplayedAt     string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (keyedWebhookDeadLetter) TableName() string { return "webhook_dead_letters" }
+
+type keyedSyncOperation struct {
+	ID             uint   `gorm:"primaryKey"`
+	ClientId       string `gorm:"uniqueIndex"`
+	DeviceId       string
+	Type           string
+	RoundTimestamp string
+	PatientId      string
+	Observation    string
+	StaffId        string
+	DeviceTime     string
+	ReceivedAt     string
+	Outcome        string
+	Detail         string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (keyedSyncOperation) TableName() string { return "sync_operations" }
+
+type keyedQuarantinedRow struct {
+	ID          uint `gorm:"primaryKey"`
+	Migration   int  `gorm:"index"`
+	SourceTable string
+	RowId       uint
+	Reason      string
+	Data        string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (keyedQuarantinedRow) TableName() string { return "quarantined_rows" }
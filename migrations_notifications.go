@@ -0,0 +1,17 @@
+package main
+
+// The columns migration 4 adds to notifications, so a failed send backs off like a webhook delivery
+// A frozen copy, like the baseline, so the migration doesn't change as the model does
+type notificationRetry struct {
+	Attempts      int
+	NextAttemptAt string
+}
+
+func (notificationRetry) TableName() string { return "notifications" }
+
+// The column migration 6 adds to notifications, so a patient's observation gap can be sent like a round notification
+type notificationPatient struct {
+	PatientId string
+}
+
+func (notificationPatient) TableName() string { return "notifications" }
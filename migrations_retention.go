@@ -0,0 +1,104 @@
+package main
+
+import (
+	"time"
+)
+
+// The tables migration 3 adds for retention: holds, and archive tables that mirror the round tables plus archived_at
+// Archived rows keep the IDs they had, so the archive tables don't generate IDs
+// Frozen copies of the models, like the baseline, so the migration doesn't change as the models do
+var retentionModels = []interface{}{
+	&retentionHold{},
+	&retentionArchivedRound{},
+	&retentionArchivedRoundRoundType{},
+	&retentionArchivedRoundMember{},
+	&retentionArchivedRoundAmendment{},
+}
+
+// Reports read rounds through these views, so archived rounds still count without every report knowing about the archive
+var retentionViews = map[string]string{
+	"report_rounds": "SELECT id, round_timestamp, status, started_at, started_by, completed_at, completed_by, created_at, updated_at FROM rounds " +
+		"UNION ALL SELECT id, round_timestamp, status, started_at, started_by, completed_at, completed_by, created_at, updated_at FROM archived_rounds",
+	"report_round_round_types": "SELECT id, round_id, round_type_id, created_at, updated_at FROM round_round_types " +
+		"UNION ALL SELECT id, round_id, round_type_id, created_at, updated_at FROM archived_round_round_types",
+	"report_round_members": "SELECT id, round_id, status, patient_id, unit, observation, observed_at, observed_by, created_at, updated_at FROM round_members " +
+		"UNION ALL SELECT id, round_id, status, patient_id, unit, observation, observed_at, observed_by, created_at, updated_at FROM archived_round_members",
+	"report_round_amendments": "SELECT id, round_id, round_member_id, field, original_value, amended_value, reason_code, note, late_entry, amended_at, created_at, updated_at FROM round_amendments " +
+		"UNION ALL SELECT id, round_id, round_member_id, field, original_value, amended_value, reason_code, note, late_entry, amended_at, created_at, updated_at FROM archived_round_amendments",
+}
+
+type retentionHold struct {
+	ID         uint `gorm:"primaryKey"`
+	Kind       string
+	PatientId  string
+	StartTime  string
+	EndTime    string
+	Reason     string
+	PlacedBy   string
+	PlacedAt   string
+	ReleasedAt string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (retentionHold) TableName() string { return "retention_holds" }
+
+type retentionArchivedRound struct {
+	ID             uint   `gorm:"primaryKey;autoIncrement:false"`
+	RoundTimestamp string `gorm:"index"`
+	Status         string
+	StartedAt      string
+	StartedBy      string
+	CompletedAt    string
+	CompletedBy    string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	ArchivedAt     string
+}
+
+func (retentionArchivedRound) TableName() string { return "archived_rounds" }
+
+type retentionArchivedRoundRoundType struct {
+	ID          uint `gorm:"primaryKey;autoIncrement:false"`
+	RoundID     uint `gorm:"index"`
+	RoundTypeID uint
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	ArchivedAt  string
+}
+
+func (retentionArchivedRoundRoundType) TableName() string { return "archived_round_round_types" }
+
+type retentionArchivedRoundMember struct {
+	ID          uint `gorm:"primaryKey;autoIncrement:false"`
+	RoundId     uint `gorm:"index"`
+	Status      string
+	PatientId   string `gorm:"index"`
+	Unit        string
+	Observation string
+	ObservedAt  string
+	ObservedBy  string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	ArchivedAt  string
+}
+
+func (retentionArchivedRoundMember) TableName() string { return "archived_round_members" }
+
+type retentionArchivedRoundAmendment struct {
+	ID            uint `gorm:"primaryKey;autoIncrement:false"`
+	RoundId       uint `gorm:"index"`
+	RoundMemberId uint
+	Field         string
+	OriginalValue string
+	AmendedValue  string
+	ReasonCode    string
+	Note          string
+	LateEntry     bool
+	AmendedAt     string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	ArchivedAt    string
+}
+
+func (retentionArchivedRoundAmendment) TableName() string { return "archived_round_amendments" }
@@ -0,0 +1,10 @@
+package main
+
+// The columns migration 7 adds to round configs, so a config can schedule rounds for part of the day
+// A frozen copy, like the baseline, so the migration doesn't change as the model does
+type roundConfigWindow struct {
+	WindowStart string
+	WindowEnd   string
+}
+
+func (roundConfigWindow) TableName() string { return "round_configs" }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrateSchemaUpAndDown(t *testing.T) {
+	db, err := connectDatabase(filepath.Join(t.TempDir(), "rounds.db"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	now := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+
+	ran, err := MigrateSchema(db, latestSchemaVersion(), now)
+	if err != nil {
+		t.Fatalf("Failed to migrate up: %v", err)
+	}
+	if len(ran) != len(migrations) {
+		t.Errorf("Expected %d migrations to run, got %d", len(migrations), len(ran))
+	}
+	if version, _ := getSchemaVersion(db); version != latestSchemaVersion() {
+		t.Errorf("Expected version %d, got %d", latestSchemaVersion(), version)
+	}
+	applied, _ := getAppliedMigrations(db)
+	if len(applied) != len(migrations) || applied[0].Name != "baseline" || applied[0].AppliedAt != "2022-01-10T09:30:00Z" {
+		t.Errorf("Expected every migration recorded, got %+v", applied)
+	}
+
+	// Running again has nothing to do
+	ran, err = MigrateSchema(db, latestSchemaVersion(), now)
+	if err != nil || len(ran) != 0 {
+		t.Errorf("Expected no migrations to run, got %d and %v", len(ran), err)
+	}
+
+	ran, err = MigrateSchema(db, 0, now)
+	if err != nil {
+		t.Fatalf("Failed to migrate down: %v", err)
+	}
+	if len(ran) != len(migrations) || ran[0].Version != latestSchemaVersion() {
+		t.Errorf("Expected every migration rolled back newest first, got %+v", ran)
+	}
+	if version, _ := getSchemaVersion(db); version != 0 {
+		t.Errorf("Expected version 0, got %d", version)
+	}
+	if db.Migrator().HasTable(&Round{}) {
+		t.Errorf("Expected the rounds table to be dropped")
+	}
+
+	if _, err := MigrateSchema(db, latestSchemaVersion()+1, now); err == nil {
+		t.Errorf("Expected an error migrating to a version that doesn't exist")
+	}
+}
+
+// Every column the models expect exists once the migrations have run, so a model change can't ship without its migration
+func TestMigrationsMatchModels(t *testing.T) {
+	db := setupDatabase()
+	for _, model := range schemaModels {
+		stmt := db.Model(model).Statement
+		if err := stmt.Parse(model); err != nil {
+			t.Fatalf("Failed to parse %T: %v", model, err)
+		}
+		if !db.Migrator().HasTable(model) {
+			t.Errorf("Missing table %v", stmt.Schema.Table)
+			continue
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !db.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("Missing column %v.%v", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+}
+
+// A database AutoMigrate built before versioned migrations is adopted at the baseline with its data intact
+func TestOpenDatabaseAdoptsAutoMigratedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rounds.db")
+	db, err := connectDatabase(path)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	for _, model := range baselineModels {
+		db.AutoMigrate(model)
+	}
+	db.Create(&Round{RoundTimestamp: "2022-01-10T09:30:00Z", Status: "COMPLETE"})
+
+	db, err = openDatabase(path)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if version, _ := getSchemaVersion(db); version != latestSchemaVersion() {
+		t.Errorf("Expected version %d, got %d", latestSchemaVersion(), version)
+	}
+	round, _ := getRoundForTime(db, time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC))
+	if round.Status != "COMPLETE" {
+		t.Errorf("Expected the existing round to be kept, got %+v", round)
+	}
+}
+
+func TestOpenDatabaseRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rounds.db")
+	if _, err := openDatabase(path); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	db, _ := connectDatabase(path)
+	db.Create(&SchemaVersion{Version: latestSchemaVersion() + 1, Name: "from the future", AppliedAt: "2030-01-01T00:00:00Z"})
+
+	if _, err := openDatabase(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+	if _, err := MigrateSchema(db, 0, time.Now()); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew rolling back, got %v", err)
+	}
+	if version, _ := getSchemaVersion(db); version != latestSchemaVersion()+1 {
+		t.Errorf("Expected the newer schema to be left alone, got version %d", version)
+	}
+}
+
+// A newer build may have changed schema_version itself, so it is checked before AutoMigrate can touch it
+func TestMigrateSchemaLeavesNewerSchemaVersionTableAlone(t *testing.T) {
+	db, err := connectDatabase(filepath.Join(t.TempDir(), "rounds.db"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	db.Exec("CREATE TABLE schema_version (version integer PRIMARY KEY, name text, applied_on text)")
+	db.Exec("INSERT INTO schema_version (version, name, applied_on) VALUES (?, ?, ?)", latestSchemaVersion()+1, "from the future", "2030-01-01")
+
+	if _, err := MigrateSchema(db, latestSchemaVersion(), time.Now()); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+	if db.Migrator().HasColumn(&SchemaVersion{}, "applied_at") {
+		t.Errorf("Expected the newer schema_version table to be left as it was")
+	}
+}
+
+// Instances starting at once take turns, so each migration runs once
+func TestMigrateSchemaConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rounds.db")
+	results := make(chan int, 4)
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			db, err := connectDatabase(path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			ran, err := MigrateSchema(db, latestSchemaVersion(), time.Now())
+			if err != nil {
+				errs <- err
+				return
+			}
+			results <- len(ran)
+		}()
+	}
+
+	total := 0
+	for i := 0; i < 4; i++ {
+		select {
+		case ran := <-results:
+			total += ran
+		case err := <-errs:
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+	}
+	if total != len(migrations) {
+		t.Errorf("Expected %d migrations to run between them, got %d", len(migrations), total)
+	}
+}
+
+func TestExplicitKeysMigrationPreservesData(t *testing.T) {
+	db, err := connectDatabase(filepath.Join(t.TempDir(), "rounds.db"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	now := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+	if _, err := MigrateSchema(db, 1, now); err != nil {
+		t.Fatalf("Failed to migrate to the baseline: %v", err)
+	}
+
+	// Data as the gorm.Model schema held it, with a soft-deleted member and a round type for a round that is gone
+	db.Create(&baselineRoundType{ID: 1, Name: "15 Minute Round", DurationAmt: 15, DurationUnit: "minutes"})
+	db.Create(&baselineRound{ID: 1, RoundTimestamp: "2022-01-10T09:00:00Z", Status: "COMPLETE"})
+	db.Create(&baselineRound{ID: 2, RoundTimestamp: "2022-01-10T09:15:00Z", Status: "CREATED"})
+	db.Create(&baselineRoundRoundType{RoundID: 1, RoundTypeID: 1})
+	db.Create(&baselineRoundRoundType{RoundID: 2, RoundTypeID: 1})
+	db.Create(&baselineRoundRoundType{RoundID: 9, RoundTypeID: 1})
+	db.Create(&baselineRoundMember{ID: 1, RoundId: 1, PatientId: "patient1", Observation: "sleeping"})
+	db.Create(&baselineRoundMember{ID: 2, RoundId: 1, PatientId: "patient2"})
+	db.Create(&baselineRoundMember{ID: 3, RoundId: 2, PatientId: "patient1"})
+	db.Delete(&baselineRoundMember{}, 2)
+
+	if _, err := MigrateSchema(db, 2, now); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if db.Migrator().HasColumn(&Round{}, "deleted_at") {
+		t.Errorf("Expected deleted_at to be gone")
+	}
+
+	var members []RoundMember
+	db.Order("id").Find(&members)
+	if len(members) != 2 || members[0].ID != 1 || members[0].Observation != "sleeping" || members[1].ID != 3 {
+		t.Errorf("Expected members 1 and 3 with their data, got %+v", members)
+	}
+	var roundRoundTypes []RoundRoundType
+	db.Order("id").Find(&roundRoundTypes)
+	if len(roundRoundTypes) != 2 || roundRoundTypes[0].ID != 1 || roundRoundTypes[1].RoundID != 2 {
+		t.Errorf("Expected the round types for rounds 1 and 2, got %+v", roundRoundTypes)
+	}
+
+	// The rows that couldn't be carried over are quarantined rather than lost
+	var quarantined []QuarantinedRow
+	db.Order("id").Find(&quarantined)
+	if len(quarantined) != 2 || quarantined[0].SourceTable != "round_round_types" || quarantined[0].Reason != "references a row that doesn't exist" ||
+		quarantined[1].SourceTable != "round_members" || quarantined[1].RowId != 2 || quarantined[1].Reason != "soft deleted" {
+		t.Errorf("Expected the orphaned round type and the soft-deleted member quarantined, got %+v", quarantined)
+	}
+
+	// New rows carry on from the copied IDs
+	round := Round{RoundTimestamp: "2022-01-10T09:30:00Z", Status: "CREATED"}
+	if err := db.Create(&round).Error; err != nil || round.ID != 3 {
+		t.Errorf("Expected round 3, got %d and %v", round.ID, err)
+	}
+
+	// The foreign keys are enforced
+	if err := db.Create(&RoundMember{RoundId: 99, PatientId: "patient1"}).Error; err == nil {
+		t.Errorf("Expected a member of a round that doesn't exist to be rejected")
+	}
+	if err := db.Create(&RoundRoundType{RoundID: 1, RoundTypeID: 99}).Error; err == nil {
+		t.Errorf("Expected a round type that doesn't exist to be rejected")
+	}
+	if err := db.Delete(&RoundType{}, 1).Error; err == nil {
+		t.Errorf("Expected a round type in use to be kept")
+	}
+
+	// Deleting a round takes its members and round types with it
+	if err := db.Delete(&Round{}, 1).Error; err != nil {
+		t.Fatalf("Failed to delete round: %v", err)
+	}
+	var remainingMembers, remainingRoundTypes int64
+	db.Model(&RoundMember{}).Where("round_id = ?", 1).Count(&remainingMembers)
+	db.Model(&RoundRoundType{}).Where("round_id = ?", 1).Count(&remainingRoundTypes)
+	if remainingMembers != 0 || remainingRoundTypes != 0 {
+		t.Errorf("Expected round 1's members and round types to be deleted, got %d and %d", remainingMembers, remainingRoundTypes)
+	}
+
+	// Rolling back keeps the data too
+	if _, err := MigrateSchema(db, 1, now); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	var baselineMembers []baselineRoundMember
+	db.Order("id").Find(&baselineMembers)
+	if len(baselineMembers) != 1 || baselineMembers[0].ID != 3 {
+		t.Errorf("Expected member 3 after rolling back, got %+v", baselineMembers)
+	}
+
+	// Along with the quarantined rows, soft deleted as they were
+	var deletedMember baselineRoundMember
+	db.Unscoped().First(&deletedMember, 2)
+	if !deletedMember.DeletedAt.Valid || deletedMember.PatientId != "patient2" {
+		t.Errorf("Expected soft-deleted member 2 to be restored, got %+v", deletedMember)
+	}
+	var orphaned baselineRoundRoundType
+	db.Where("round_id = ?", 9).First(&orphaned)
+	if orphaned.ID != 3 || orphaned.RoundTypeID != 1 {
+		t.Errorf("Expected the round type for round 9 to be restored, got %+v", orphaned)
+	}
+	if db.Migrator().HasTable(&QuarantinedRow{}) {
+		t.Errorf("Expected the quarantine table to be dropped")
+	}
+}
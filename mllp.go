@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// MLLP frames each message as <VT> message <FS><CR>
+const (
+	mllpStartBlock = 0x0b
+	mllpEndBlock   = 0x1c
+	mllpCarriage   = 0x0d
+)
+
+// Accept MLLP connections on a listener and apply each ADT message, answering with an ACK or NAK
+// Messages are applied one at a time across all connections so census changes stay in order
+// Returns when the listener is closed, once the open connections are closed and their handlers have finished
+func ServeMLLP(ln net.Listener, db *gorm.DB, clock Clock) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	// Senders keep their connections open between messages, so waiting for them to hang up could take forever
+	var connsMu sync.Mutex
+	conns := make(map[net.Conn]bool)
+	defer func() {
+		connsMu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		connsMu.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		connsMu.Lock()
+		conns[conn] = true
+		connsMu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				connsMu.Lock()
+				delete(conns, conn)
+				connsMu.Unlock()
+				conn.Close()
+			}()
+			serveMLLPConn(conn, func(raw string) string {
+				mu.Lock()
+				defer mu.Unlock()
+				return HandleHL7Message(db, raw, clock.Now())
+			})
+		}()
+	}
+}
+
+// Read framed messages from a connection until it closes, writing back the handler's response for each
+func serveMLLPConn(conn net.Conn, handle func(raw string) string) {
+	reader := bufio.NewReader(conn)
+	for {
+		raw, err := readMLLPFrame(reader)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(mllpFrame(handle(raw))); err != nil {
+			return
+		}
+	}
+}
+
+// Read the next MLLP frame, skipping anything before the start block
+func readMLLPFrame(reader *bufio.Reader) (string, error) {
+	if _, err := reader.ReadBytes(mllpStartBlock); err != nil {
+		return "", err
+	}
+
+	body, err := reader.ReadBytes(mllpEndBlock)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	// The end block must be followed by a carriage return
+	next, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if next != mllpCarriage {
+		reader.UnreadByte()
+	}
+
+	return string(body[:len(body)-1]), nil
+}
+
+// Wrap a message in an MLLP frame
+func mllpFrame(msg string) []byte {
+	frame := make([]byte, 0, len(msg)+3)
+	frame = append(frame, mllpStartBlock)
+	frame = append(frame, msg...)
+	frame = append(frame, mllpEndBlock, mllpCarriage)
+	return frame
+}
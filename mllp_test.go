@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adtMessage(controlId string, event string, eventTime string, patient string, location string) string {
+	return "MSH|^~\\&|EHR|HOSP|ROUNDS|HOSP|" + eventTime + "||ADT^" + event + "^ADT_" + event + "|" + controlId + "|P|2.5.1\r" +
+		"EVN|" + event + "|" + eventTime + "\r" +
+		"PID|1||" + patient + "^^^HOSP^MR||Doe^Jane\r" +
+		"PV1|1|I|" + location + "\r"
+}
+
+func TestMLLPADTFeed(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+
+	// 30 minute rounds are assigned on admission to unit A, 60 minute rounds on admission anywhere
+	db.Model(&RoundConfig{}).Where("round_type_id = ?", 2).Updates(map[string]interface{}{"unit": "A", "assign_on_admit": true})
+	db.Model(&RoundConfig{}).Where("round_type_id = ?", 3).Update("assign_on_admit", true)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- ServeMLLP(ln, db, RealClock{}) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		name        string
+		message     string
+		expectedAck string
+	}{
+		{"Admit to unit A", adtMessage("1", "A01", "202201100800", "MRN100", "A^101^1"), "MSA|AA|1"},
+		{"Admit again is an application error", adtMessage("2", "A01", "202201100805", "MRN100", "A^101^1"), "MSA|AE|2"},
+		{"Transfer to unit B", adtMessage("3", "A02", "202201100900", "MRN100", "B^201^1"), "MSA|AA|3"},
+		{"Update with the same location", adtMessage("4", "A08", "202201100915", "MRN100", "B^201^1"), "MSA|AA|4"},
+		{"Discharge", adtMessage("5", "A03", "202201101000", "MRN100", ""), "MSA|AA|5"},
+		{"Transfer of a discharged patient is an application error", adtMessage("6", "A02", "202201101030", "MRN100", "A^101^1"), "MSA|AE|6"},
+		{"Unsupported event is rejected", adtMessage("7", "A05", "202201101030", "MRN200", "A^101^1"), "MSA|AR|7"},
+		{"Garbage is rejected", "not an hl7 message", "MSA|AR|"},
+	}
+	for _, tt := range tests {
+		if _, err := conn.Write(mllpFrame(tt.message)); err != nil {
+			t.Fatalf("%s: failed to write: %v", tt.name, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		ack, err := readMLLPFrame(reader)
+		if err != nil {
+			t.Fatalf("%s: failed to read ack: %v", tt.name, err)
+		}
+		if !strings.Contains(ack, "\r"+tt.expectedAck+"|") {
+			t.Errorf("%s: expected ack with %q, got %q", tt.name, tt.expectedAck, ack)
+		}
+	}
+
+	ln.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("ServeMLLP failed: %v", err)
+	}
+
+	// The census followed the feed
+	patient, _ := getPatient(db, "MRN100")
+	if patient.CensusStatus != "DISCHARGED" || patient.Name != "Jane Doe" {
+		t.Errorf("Expected discharged Jane Doe, got %+v", patient)
+	}
+
+	// Assignments followed the feed: 30 minute rounds only while on unit A, 60 minute rounds until discharge
+	assignmentTests := []struct {
+		roundTypeId uint
+		at          time.Time
+		expected    bool
+	}{
+		{2, time.Date(2022, time.January, 10, 7, 59, 0, 0, time.UTC), false},
+		{2, time.Date(2022, time.January, 10, 8, 30, 0, 0, time.UTC), true},
+		{2, time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC), false},
+		{3, time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC), true},
+		{3, time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range assignmentTests {
+		roundAssignments, _ := getRoundAssignmentsForRoundType(db, tt.roundTypeId, tt.at)
+		found := false
+		for _, roundAssignment := range roundAssignments {
+			if roundAssignment.PatientId == "MRN100" {
+				found = true
+			}
+		}
+		if found != tt.expected {
+			t.Errorf("Expected MRN100 assigned to round type %d at %v to be %v", tt.roundTypeId, tt.at, tt.expected)
+		}
+	}
+}
+
+// A resent message is answered with the original ACK and isn't applied again
+func TestHandleHL7MessageResend(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	admit := adtMessage("10", "A01", "202201100800", "MRN300", "A^101^1")
+	first := HandleHL7Message(db, admit, time.Date(2022, time.January, 10, 8, 0, 1, 0, time.UTC))
+	if !strings.Contains(first, "\rMSA|AA|10|") {
+		t.Fatalf("Expected the admission to be accepted, got %q", first)
+	}
+
+	resent := HandleHL7Message(db, admit, time.Date(2022, time.January, 10, 8, 5, 0, 0, time.UTC))
+	if resent != first {
+		t.Errorf("Expected the original ACK %q, got %q", first, resent)
+	}
+	var censusEvents int64
+	db.Model(&PatientCensusEvent{}).Where("patient_id = ?", "MRN300").Count(&censusEvents)
+	if censusEvents != 1 {
+		t.Errorf("Expected the admission to be applied once, got %d census events", censusEvents)
+	}
+
+	// Control IDs are only unique to the sender, so the same one from another application is a new message
+	other := strings.Replace(adtMessage("10", "A01", "202201100810", "MRN301", "A^102^1"), "|EHR|", "|LAB|", 1)
+	if ack := HandleHL7Message(db, other, time.Date(2022, time.January, 10, 8, 10, 0, 0, time.UTC)); !strings.Contains(ack, "\rMSA|AA|10|") {
+		t.Errorf("Expected the other sender's message to be accepted, got %q", ack)
+	}
+	if patient, _ := getPatient(db, "MRN301"); patient.CensusStatus != "ADMITTED" {
+		t.Errorf("Expected MRN301 to be admitted, got %+v", patient)
+	}
+}
+
+// A census change whose assignment changes fail is rolled back with them
+func TestApplyADTEventIsAtomic(t *testing.T) {
+	db, err := openDatabase(filepath.Join(t.TempDir(), "rounds.db"))
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	db.Create(&RoundType{Name: "30 Minute Round", DurationAmt: 30, DurationUnit: "minutes"})
+	db.Create(&RoundConfig{RoundTypeId: 1, Enabled: true, AssignOnAdmit: true})
+	db.Migrator().DropTable(&RoundAssignment{})
+
+	event := ADTEvent{EventType: "A01", ControlId: "1", PatientId: "MRN400", Unit: "A", OccurredAt: time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC)}
+	if err := ApplyADTEvent(db, event); err == nil {
+		t.Fatalf("Expected the admission to fail without a round_assignments table")
+	}
+	if patient, _ := getPatient(db, "MRN400"); patient.ID != 0 {
+		t.Errorf("Expected the admission to be rolled back, got %+v", patient)
+	}
+}
+
+// Closing the listener closes idle connections too, rather than waiting for the sender to hang up
+func TestServeMLLPClosesIdleConnections(t *testing.T) {
+	db := setupDatabase()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- ServeMLLP(ln, db, RealClock{}) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	// A message round trip makes sure the server has the connection before it shuts down
+	conn.Write(mllpFrame("not an hl7 message"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	if _, err := readMLLPFrame(reader); err != nil {
+		t.Fatalf("Failed to read ack: %v", err)
+	}
+
+	ln.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ServeMLLP failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected ServeMLLP to return with a connection still open")
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How long before a round is due to send the DUE_SOON reminder
+const dueSoonLead = 5 * time.Minute
+
+// Rounds not started this long after their timestamp are OVERDUE, until they are MISSED at missedRoundAfter
+// This matches the grace the compliance report allows for a round to count as on time
+const roundOverdueAfter = defaultOnTimeGrace
+
+// How far back CheckRoundNotifications looks for MISSED rounds, so a restarted worker catches up without replaying history
+const notificationLookback = 2 * time.Hour
+
+// Which escalation tiers hear about each event. A missed round is escalated to the supervisor
+var notificationTiers = map[string][]string{
+	"DUE_SOON":        {"CHARGE_NURSE"},
+	"OVERDUE":         {"CHARGE_NURSE"},
+	"MISSED":          {"CHARGE_NURSE", "SUPERVISOR"},
+	"OBSERVATION_GAP": {"CHARGE_NURSE"},
+}
+
+var notificationChannels = map[string]bool{
+	"webhook": true,
+	"smtp":    true,
+	"in_app":  true,
+}
+
+// Delivers a notification over one channel, to the notification's Address
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// Posts the notification as JSON to the contact's URL
+type WebhookNotifier struct {
+	Client *http.Client
+}
+
+func (n WebhookNotifier) Notify(notification Notification) error {
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(notification.Address, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Emails the notification to the contact through an SMTP server
+type SMTPNotifier struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (n SMTPNotifier) Notify(notification Notification) error {
+	// Contacts are checked when they are added, but the address goes into the headers so check it again
+	to, err := mail.ParseAddress(notification.Address)
+	if err != nil || to.Address != notification.Address {
+		return fmt.Errorf("invalid email address %q", notification.Address)
+	}
+	subject := fmt.Sprintf("Round %s: %s", strings.ToLower(strings.ReplaceAll(notification.Event, "_", " ")), notification.RoundTimestamp)
+	if notification.PatientId != "" {
+		subject = fmt.Sprintf("Patient %s: %s", notification.PatientId, strings.ToLower(strings.ReplaceAll(notification.Event, "_", " ")))
+	}
+	// Patient ids come from outside, so encode the subject rather than let a line break start another header
+	subject = mime.QEncoding.Encode("utf-8", subject)
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		n.From, notification.Address, subject, notification.Message)
+	return smtp.SendMail(n.Addr, n.Auth, n.From, []string{notification.Address}, []byte(message))
+}
+
+// In-app notifications are delivered by being stored; staff read them from the notifications endpoint
+type InAppNotifier struct{}
+
+func (n InAppNotifier) Notify(notification Notification) error {
+	return nil
+}
+
+// Add someone to notify about rounds on a unit
+func AddEscalationContact(db *gorm.DB, contact EscalationContact) (EscalationContact, error) {
+	if contact.Tier != "CHARGE_NURSE" && contact.Tier != "SUPERVISOR" {
+		return contact, fmt.Errorf("invalid tier %q, expected CHARGE_NURSE or SUPERVISOR", contact.Tier)
+	}
+	if !notificationChannels[contact.Channel] {
+		return contact, fmt.Errorf("invalid channel %q, expected webhook, smtp or in_app", contact.Channel)
+	}
+	if contact.Address == "" {
+		return contact, fmt.Errorf("an address is required for %s contacts", contact.Channel)
+	}
+	// The address goes into the email's headers, so only a bare address will do
+	if contact.Channel == "smtp" {
+		address, err := mail.ParseAddress(contact.Address)
+		if err != nil || address.Address != contact.Address {
+			return contact, fmt.Errorf("invalid email address %q, expected a bare address such as nurse@example.com", contact.Address)
+		}
+	}
+
+	contact.ID = 0
+	if err := db.Create(&contact).Error; err != nil {
+		return contact, err
+	}
+	return contact, nil
+}
+
+// A round due for a unit, with the round types that schedule it
+type notificationSlot struct {
+	roundTime  time.Time
+	unit       string
+	roundTypes []string
+}
+
+// Send the DUE_SOON, OVERDUE and MISSED notifications that are due as of now, for each round and unit
+// Slots follow the schedule CreateRounds keeps for each round type. Each notification is sent once; ones that
+// failed are retried with the same backoff as webhook deliveries. Returns the notifications sent or attempted
+func CheckRoundNotifications(db *gorm.DB, now time.Time, notifiers map[string]Notifier) ([]Notification, error) {
+	notifications := []Notification{}
+
+	slots, err := notificationSlots(db, now)
+	if err != nil {
+		return notifications, err
+	}
+
+	for _, slot := range slots {
+		round, err := getRoundForTime(db, slot.roundTime)
+		if err != nil {
+			return notifications, err
+		}
+		event := roundNotificationEvent(round, slot.roundTime, now)
+		if event == "" {
+			continue
+		}
+
+		for _, tier := range notificationTiers[event] {
+			contacts, err := getUnitEscalationContacts(db, slot.unit, tier)
+			if err != nil {
+				return notifications, err
+			}
+			for _, contact := range contacts {
+				notification, sent, err := sendRoundNotification(db, event, slot, contact, now, notifiers)
+				if err != nil {
+					return notifications, err
+				}
+				if sent {
+					notifications = append(notifications, notification)
+				}
+			}
+		}
+	}
+	return notifications, nil
+}
+
+// Send an OBSERVATION_GAP notification for each patient who is overdue for an observation as of now
+// Contacts are picked by the patient's unit, and each gap is sent once, with failures retried like round notifications
+func CheckObservationGapNotifications(db *gorm.DB, now time.Time, notifiers map[string]Notifier) ([]Notification, error) {
+	notifications := []Notification{}
+
+	alerts, err := CheckObservationGaps(db, now)
+	if err != nil {
+		return notifications, err
+	}
+	for _, alert := range alerts {
+		patient, err := getPatient(db, alert.PatientId)
+		if err != nil {
+			return notifications, err
+		}
+		for _, tier := range notificationTiers["OBSERVATION_GAP"] {
+			contacts, err := getUnitEscalationContacts(db, patient.Unit, tier)
+			if err != nil {
+				return notifications, err
+			}
+			for _, contact := range contacts {
+				notification, err := getObservationGapNotification(db, alert, contact, now)
+				if err != nil {
+					return notifications, err
+				}
+				notification.Event = "OBSERVATION_GAP"
+				notification.RoundTimestamp = alert.From
+				notification.PatientId = alert.PatientId
+				notification.Unit = patient.Unit
+				notification.Message = observationGapMessage(alert)
+				notification, sent, err := deliverNotification(db, notification, contact, now, notifiers)
+				if err != nil {
+					return notifications, err
+				}
+				if sent {
+					notifications = append(notifications, notification)
+				}
+			}
+		}
+	}
+	return notifications, nil
+}
+
+// Get the notification already made for a gap, if any
+// A gap that started before CheckObservationGaps' lookback starts where the lookback does, which moves on with now,
+// so one of those is the gap last notified about as long as nobody has seen the patient since
+func getObservationGapNotification(db *gorm.DB, gap ObservationGap, contact EscalationContact, now time.Time) (Notification, error) {
+	notification, err := getPatientNotification(db, "OBSERVATION_GAP", gap.PatientId, gap.From, contact.ID)
+	if err != nil || notification.ID != 0 || gap.From != now.Add(-observationGapLookback).UTC().Format(time.RFC3339) {
+		return notification, err
+	}
+
+	latest, err := getLatestPatientNotification(db, "OBSERVATION_GAP", gap.PatientId, contact.ID)
+	if err != nil || latest.ID == 0 {
+		return Notification{}, err
+	}
+	lastObserved, err := getLastObservedRoundMemberForPatient(withArchived(db, "round_members"), gap.PatientId, now)
+	if err != nil {
+		return Notification{}, err
+	}
+	if lastObserved.ObservedAt > latest.RoundTimestamp {
+		return Notification{}, nil
+	}
+	return latest, nil
+}
+
+// Get a unit's escalation contacts for a tier. Units without their own contact for a tier fall back to the clinic-wide ones
+func getUnitEscalationContacts(db *gorm.DB, unit string, tier string) ([]EscalationContact, error) {
+	contacts, err := getEscalationContacts(db, unit, tier)
+	if err != nil || len(contacts) != 0 || unit == "" {
+		return contacts, err
+	}
+	return getEscalationContacts(db, "", tier)
+}
+
+// Get the rounds due for each unit from notificationLookback before now to dueSoonLead after it
+func notificationSlots(db *gorm.DB, now time.Time) ([]notificationSlot, error) {
+	roundConfigs, err := getRoundConfigs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	windowStart := now.Add(-notificationLookback)
+	windowEnd := now.Add(dueSoonLead)
+	store := NewGormRoundsStore(db)
+
+	slotMap := make(map[string]*notificationSlot)
+	for _, roundConfig := range roundConfigs {
+		if !roundConfig.Enabled {
+			continue
+		}
+		roundType, err := getRoundType(db, roundConfig.RoundTypeId)
+		if err != nil {
+			return nil, err
+		}
+
+		// A round type the scheduler hasn't created any rounds for yet has nothing due
+		slotTimes, scheduled, err := scheduledRoundTypeSlots(store, roundType, windowStart, windowEnd)
+		if err != nil {
+			return nil, err
+		}
+		if !scheduled {
+			continue
+		}
+		for _, slotTime := range slotTimes {
+			if !roundConfigActiveAt(roundConfig, slotTime) {
+				continue
+			}
+			key := roundConfig.Unit + "|" + slotTime.UTC().Format(time.RFC3339)
+			if _, ok := slotMap[key]; !ok {
+				slotMap[key] = &notificationSlot{roundTime: slotTime, unit: roundConfig.Unit}
+			}
+			slotMap[key].roundTypes = append(slotMap[key].roundTypes, roundType.Name)
+		}
+	}
+
+	var slots []notificationSlot
+	for _, slot := range slotMap {
+		slots = append(slots, *slot)
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if !slots[i].roundTime.Equal(slots[j].roundTime) {
+			return slots[i].roundTime.Before(slots[j].roundTime)
+		}
+		return slots[i].unit < slots[j].unit
+	})
+	return slots, nil
+}
+
+// Work out which event, if any, a round is in as of now. Rounds that have been started don't need a reminder
+func roundNotificationEvent(round Round, roundTime time.Time, now time.Time) string {
+	if round.Status == "STARTED" || round.Status == "COMPLETE" {
+		return ""
+	}
+
+	sinceDue := now.Sub(roundTime)
+	switch {
+	case round.Status == "MISSED" || sinceDue >= missedRoundAfter:
+		return "MISSED"
+	case sinceDue >= roundOverdueAfter:
+		return "OVERDUE"
+	case sinceDue < 0 && -sinceDue <= dueSoonLead:
+		return "DUE_SOON"
+	}
+	return ""
+}
+
+// Send the notification for a round event to a contact, through deliverNotification
+func sendRoundNotification(db *gorm.DB, event string, slot notificationSlot, contact EscalationContact, now time.Time, notifiers map[string]Notifier) (Notification, bool, error) {
+	roundTimestamp := slot.roundTime.UTC().Format(time.RFC3339)
+	notification, err := getNotification(db, event, roundTimestamp, slot.unit, contact.ID)
+	if err != nil {
+		return notification, false, err
+	}
+
+	notification.Event = event
+	notification.RoundTimestamp = roundTimestamp
+	notification.Unit = slot.unit
+	notification.Message = roundNotificationMessage(event, slot)
+	return deliverNotification(db, notification, contact, now, notifiers)
+}
+
+// Send a notification to a contact and save it, unless it was already sent or is waiting out its backoff
+// Returns false if there was nothing to send. Delivery failures are recorded on the notification, not returned
+func deliverNotification(db *gorm.DB, notification Notification, contact EscalationContact, now time.Time, notifiers map[string]Notifier) (Notification, bool, error) {
+	if notification.SentAt != "" {
+		return notification, false, nil
+	}
+	// A failed send waits out its backoff before it is tried again
+	if notification.NextAttemptAt != "" && notification.NextAttemptAt > now.UTC().Format(time.RFC3339) {
+		return notification, false, nil
+	}
+
+	notification.Tier = contact.Tier
+	notification.ContactId = contact.ID
+	notification.Channel = contact.Channel
+	notification.Address = contact.Address
+	notification.Error = ""
+
+	notification.Attempts++
+	notifier, ok := notifiers[contact.Channel]
+	if !ok {
+		notification.Error = fmt.Sprintf("no notifier for channel %s", contact.Channel)
+	} else if err := notifier.Notify(notification); err != nil {
+		notification.Error = err.Error()
+	} else {
+		notification.SentAt = now.UTC().Format(time.RFC3339)
+	}
+	notification.NextAttemptAt = ""
+	if notification.SentAt == "" {
+		notification.NextAttemptAt = now.Add(webhookBackoff(notification.Attempts)).UTC().Format(time.RFC3339)
+	}
+
+	if err := db.Save(&notification).Error; err != nil {
+		return notification, false, err
+	}
+	return notification, true, nil
+}
+
+func roundNotificationMessage(event string, slot notificationSlot) string {
+	unit := "the clinic"
+	if slot.unit != "" {
+		unit = "unit " + slot.unit
+	}
+	description := fmt.Sprintf("%s at %s for %s", strings.Join(slot.roundTypes, ", "), slot.roundTime.Format("15:04 MST"), unit)
+
+	switch event {
+	case "DUE_SOON":
+		return fmt.Sprintf("%s is due in %d minutes", description, int(dueSoonLead.Minutes()))
+	case "OVERDUE":
+		return fmt.Sprintf("%s is overdue and has not been started", description)
+	default:
+		return fmt.Sprintf("%s was missed", description)
+	}
+}
+
+func observationGapMessage(gap ObservationGap) string {
+	from, _ := time.Parse(time.RFC3339, gap.From)
+	return fmt.Sprintf("%s has not been observed since %s, and is on rounds every %d minutes", gap.PatientId, from.Format("15:04 MST"), int(gap.AllowedMinutes))
+}
+
+// Mark an in-app notification as read
+func MarkNotificationRead(db *gorm.DB, notificationId uint, at time.Time) (Notification, error) {
+	var notification Notification
+	db.Where("id = ?", notificationId).First(&notification)
+	if notification.ID == 0 {
+		return notification, fmt.Errorf("notification %d not found", notificationId)
+	}
+	if notification.ReadAt == "" {
+		notification.ReadAt = at.UTC().Format(time.RFC3339)
+		if err := db.Save(&notification).Error; err != nil {
+			return notification, err
+		}
+	}
+	return notification, nil
+}
+
+// Check for notifications every interval until the context is cancelled
+// Each check is for the time its tick fired, so a fake clock decides exactly what is checked
+func RunNotificationWorker(ctx context.Context, db *gorm.DB, clock Clock, notifiers map[string]Notifier, interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	now := clock.Now()
+	for {
+		if _, err := CheckRoundNotifications(db, now, notifiers); err != nil {
+			log.Printf("Notification check failed: %v", err)
+		}
+		if _, err := CheckObservationGapNotifications(db, now, notifiers); err != nil {
+			log.Printf("Observation gap notification check failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C():
+		}
+	}
+}
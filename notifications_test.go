@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A local SMTP stand-in that accepts every message and keeps it
+type localSMTPServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+}
+
+func startLocalSMTPServer(t *testing.T) *localSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &localSMTPServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (s *localSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 end with .")
+			var message strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				message.WriteString(dataLine)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, message.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *localSMTPServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+// A local webhook stand-in that keeps every notification posted to it
+type localWebhookServer struct {
+	*httptest.Server
+	mu            sync.Mutex
+	notifications []Notification
+}
+
+func startLocalWebhookServer(t *testing.T) *localWebhookServer {
+	server := &localWebhookServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification Notification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		server.mu.Lock()
+		server.notifications = append(server.notifications, notification)
+		server.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *localWebhookServer) Notifications() []Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Notification{}, s.notifications...)
+}
+
+func setupNotificationRounds(t *testing.T, webhookURL string) *gorm.DB {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	db.Create(&RoundConfig{RoundTypeId: 3, Enabled: true, Unit: "A"})
+
+	// Rounds up to 8:00 were scheduled and done; 8:15 and 8:30 were not started
+	CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC))
+	db.Model(&Round{}).Where("1 = 1").Update("status", "COMPLETE")
+
+	contacts := []EscalationContact{
+		{Tier: "CHARGE_NURSE", Name: "Clinic charge nurse", Channel: "webhook", Address: webhookURL},
+		{Tier: "SUPERVISOR", Name: "Clinic supervisor", Channel: "smtp", Address: "supervisor@example.com"},
+		{Unit: "A", Tier: "CHARGE_NURSE", Name: "Unit A charge nurse", Channel: "in_app", Address: "nurseA"},
+	}
+	for _, contact := range contacts {
+		if _, err := AddEscalationContact(db, contact); err != nil {
+			t.Fatalf("AddEscalationContact failed: %v", err)
+		}
+	}
+	return db
+}
+
+func TestCheckRoundNotifications(t *testing.T) {
+	smtpServer := startLocalSMTPServer(t)
+	webhookServer := startLocalWebhookServer(t)
+	db := setupNotificationRounds(t, webhookServer.URL)
+	now := time.Date(2022, time.January, 10, 8, 56, 0, 0, time.UTC)
+
+	// Without an SMTP notifier the supervisor's email fails and is kept for a retry
+	notifiers := map[string]Notifier{
+		"webhook": WebhookNotifier{},
+		"in_app":  InAppNotifier{},
+	}
+	notifications, err := CheckRoundNotifications(db, now, notifiers)
+	if err != nil {
+		t.Fatalf("CheckRoundNotifications failed: %v", err)
+	}
+
+	expected := []struct {
+		event          string
+		roundTimestamp string
+		unit           string
+		tier           string
+		channel        string
+		sent           bool
+	}{
+		{"MISSED", "2022-01-10T08:15:00Z", "", "CHARGE_NURSE", "webhook", true},
+		{"MISSED", "2022-01-10T08:15:00Z", "", "SUPERVISOR", "smtp", false},
+		{"OVERDUE", "2022-01-10T08:30:00Z", "", "CHARGE_NURSE", "webhook", true},
+		{"DUE_SOON", "2022-01-10T09:00:00Z", "", "CHARGE_NURSE", "webhook", true},
+		{"DUE_SOON", "2022-01-10T09:00:00Z", "A", "CHARGE_NURSE", "in_app", true},
+	}
+	if len(notifications) != len(expected) {
+		t.Fatalf("Expected %d notifications, got %+v", len(expected), notifications)
+	}
+	for i, e := range expected {
+		n := notifications[i]
+		if n.Event != e.event || n.RoundTimestamp != e.roundTimestamp || n.Unit != e.unit || n.Tier != e.tier || n.Channel != e.channel || (n.SentAt != "") != e.sent {
+			t.Errorf("Expected %+v, got %+v", e, n)
+		}
+	}
+	if notifications[4].Message != "60 Minute Round at 09:00 UTC for unit A is due in 5 minutes" {
+		t.Errorf("Unexpected message %q", notifications[4].Message)
+	}
+	if len(webhookServer.Notifications()) != 3 {
+		t.Errorf("Expected 3 webhook deliveries, got %+v", webhookServer.Notifications())
+	}
+
+	// The next check only retries the failed email
+	notifiers["smtp"] = SMTPNotifier{Addr: smtpServer.listener.Addr().String(), From: "rounds@example.com"}
+	notifications, err = CheckRoundNotifications(db, now.Add(time.Minute), notifiers)
+	if err != nil {
+		t.Fatalf("CheckRoundNotifications failed: %v", err)
+	}
+	if len(notifications) != 1 || notifications[0].Tier != "SUPERVISOR" || notifications[0].SentAt != "2022-01-10T08:57:00Z" {
+		t.Fatalf("Expected only the supervisor email to be retried, got %+v", notifications)
+	}
+	messages := smtpServer.Messages()
+	if len(messages) != 1 || !strings.Contains(messages[0], "To: supervisor@example.com") || !strings.Contains(messages[0], "was missed") {
+		t.Errorf("Expected one email to the supervisor about the missed round, got %q", messages)
+	}
+	if len(webhookServer.Notifications()) != 3 {
+		t.Errorf("Expected no repeat webhook deliveries, got %+v", webhookServer.Notifications())
+	}
+
+	// Starting the 9:00 round means nobody is told it is overdue
+	if _, err := StartRound(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC), "nurseA", now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	notifications, _ = CheckRoundNotifications(db, time.Date(2022, time.January, 10, 9, 16, 0, 0, time.UTC), notifiers)
+	for _, notification := range notifications {
+		if notification.RoundTimestamp == "2022-01-10T09:00:00Z" {
+			t.Errorf("Expected no notification for the started 9:00 round, got %+v", notification)
+		}
+	}
+}
+
+// Rounds scheduled off the hour get notifications for their own times, not for times lined up with midnight
+func TestCheckRoundNotificationsFollowsSchedule(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 8, 7, 0, 0, time.UTC))
+	db.Model(&Round{}).Where("1 = 1").Update("status", "COMPLETE")
+	if _, err := AddEscalationContact(db, EscalationContact{Tier: "CHARGE_NURSE", Channel: "in_app", Address: "nurseA"}); err != nil {
+		t.Fatalf("AddEscalationContact failed: %v", err)
+	}
+
+	notifications, err := CheckRoundNotifications(db, time.Date(2022, time.January, 10, 9, 3, 0, 0, time.UTC), map[string]Notifier{"in_app": InAppNotifier{}})
+	if err != nil {
+		t.Fatalf("CheckRoundNotifications failed: %v", err)
+	}
+	dueSoon := false
+	for _, notification := range notifications {
+		roundTime, _ := time.Parse(time.RFC3339, notification.RoundTimestamp)
+		if roundTime.Minute()%15 != 7 {
+			t.Errorf("Expected only rounds on the 8:07 schedule, got %+v", notification)
+		}
+		if notification.Event == "DUE_SOON" && notification.RoundTimestamp == "2022-01-10T09:07:00Z" {
+			dueSoon = true
+		}
+	}
+	if !dueSoon {
+		t.Errorf("Expected the 9:07 round to be due soon, got %+v", notifications)
+	}
+}
+
+// A failed send isn't tried again until its backoff is up, and each failure waits longer
+func TestCheckRoundNotificationsBackoff(t *testing.T) {
+	db := setupNotificationRounds(t, "http://localhost")
+	now := time.Date(2022, time.January, 10, 8, 56, 0, 0, time.UTC)
+	notifiers := map[string]Notifier{"webhook": WebhookNotifier{}, "in_app": InAppNotifier{}}
+	supervisorAttempts := func(notifications []Notification) []Notification {
+		var attempts []Notification
+		for _, notification := range notifications {
+			if notification.Tier == "SUPERVISOR" {
+				attempts = append(attempts, notification)
+			}
+		}
+		return attempts
+	}
+
+	attempts := supervisorAttempts(mustCheckRoundNotifications(t, db, now, notifiers))
+	if len(attempts) != 1 || attempts[0].Attempts != 1 || attempts[0].NextAttemptAt != "2022-01-10T08:56:30Z" {
+		t.Fatalf("Expected a failed email to retry in 30 seconds, got %+v", attempts)
+	}
+	if attempts := supervisorAttempts(mustCheckRoundNotifications(t, db, now.Add(10*time.Second), notifiers)); len(attempts) != 0 {
+		t.Errorf("Expected no retry before the backoff is up, got %+v", attempts)
+	}
+	attempts = supervisorAttempts(mustCheckRoundNotifications(t, db, now.Add(30*time.Second), notifiers))
+	if len(attempts) != 1 || attempts[0].Attempts != 2 || attempts[0].NextAttemptAt != "2022-01-10T08:57:30Z" {
+		t.Errorf("Expected the second failure to wait a minute, got %+v", attempts)
+	}
+}
+
+func mustCheckRoundNotifications(t *testing.T, db *gorm.DB, now time.Time, notifiers map[string]Notifier) []Notification {
+	notifications, err := CheckRoundNotifications(db, now, notifiers)
+	if err != nil {
+		t.Fatalf("CheckRoundNotifications failed: %v", err)
+	}
+	return notifications
+}
+
+func TestAddEscalationContactValidation(t *testing.T) {
+	db := setupDatabase()
+
+	invalid := []EscalationContact{
+		{Tier: "DIRECTOR", Channel: "webhook", Address: "http://localhost"},
+		{Tier: "SUPERVISOR", Channel: "pager", Address: "555"},
+		{Tier: "SUPERVISOR", Channel: "smtp"},
+		{Tier: "SUPERVISOR", Channel: "smtp", Address: "supervisor@example.com\r\nBcc: someone@example.com"},
+		{Tier: "SUPERVISOR", Channel: "smtp", Address: "Supervisor <supervisor@example.com>"},
+	}
+	for _, contact := range invalid {
+		if _, err := AddEscalationContact(db, contact); err == nil {
+			t.Errorf("Expected an error adding %+v", contact)
+		}
+	}
+}
+
+func TestInAppNotificationsEndpoint(t *testing.T) {
+	webhookServer := startLocalWebhookServer(t)
+	db := setupNotificationRounds(t, webhookServer.URL)
+	if _, err := CheckRoundNotifications(db, time.Date(2022, time.January, 10, 8, 56, 0, 0, time.UTC), map[string]Notifier{"webhook": WebhookNotifier{}, "in_app": InAppNotifier{}}); err != nil {
+		t.Fatalf("CheckRoundNotifications failed: %v", err)
+	}
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	defer server.Close()
+
+	getUnread := func() []Notification {
+		resp, err := http.Get(server.URL + "/notifications?staff=nurseA&unread=true")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var notifications []Notification
+		json.NewDecoder(resp.Body).Decode(&notifications)
+		return notifications
+	}
+
+	unread := getUnread()
+	if len(unread) != 1 || unread[0].Event != "DUE_SOON" || unread[0].Unit != "A" {
+		t.Fatalf("Expected one unread DUE_SOON notification for unit A, got %+v", unread)
+	}
+
+	resp, err := http.Post(server.URL+"/notifications/"+strconv.FormatUint(uint64(unread[0].ID), 10)+"/read", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if unread := getUnread(); len(unread) != 0 {
+		t.Errorf("Expected no unread notifications, got %+v", unread)
+	}
+}
+
+// A patient id can't add headers to the email
+func TestSMTPNotifierSubject(t *testing.T) {
+	smtpServer := startLocalSMTPServer(t)
+	notifier := SMTPNotifier{Addr: smtpServer.listener.Addr().String(), From: "rounds@example.com"}
+	err := notifier.Notify(Notification{Event: "OBSERVATION_GAP", PatientId: "patient1\r\nBcc: someone@example.com", Address: "supervisor@example.com", Message: "No observation"})
+	if err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	messages := smtpServer.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected one email, got %q", messages)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(messages[0]))
+	if err != nil {
+		t.Fatalf("Failed to read the email: %v", err)
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Errorf("Expected no Bcc header, got %q", msg.Header.Get("Bcc"))
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Patient patient1\r\nBcc: someone@example.com: observation gap" {
+		t.Errorf("Expected the patient id in the subject, got %q and %v", subject, err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The OpenAPI 3 document for the HTTP API. contract_test.go checks it against the routes in newServer and the responses they send
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+func serveOpenAPIDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How far back RecordMissedRoundEvents looks for rounds that were never started
+const missedEventLookback = 24 * time.Hour
+
+// The webhook event for each round status
+var roundEventTypes = map[string]string{
+	"CREATED":  "round.created",
+	"STARTED":  "round.started",
+	"COMPLETE": "round.completed",
+	"MISSED":   "round.missed",
+}
+
+// The body posted to webhook subscribers
+type RoundEventPayload struct {
+	Type       string            `json:"type"`
+	OccurredAt string            `json:"occurredAt"`
+	Round      RoundEventSummary `json:"round"`
+}
+
+type RoundEventSummary struct {
+	Id             uint   `json:"id"`
+	RoundTimestamp string `json:"roundTimestamp"`
+	Status         string `json:"status"`
+	StartedAt      string `json:"startedAt"`
+	StartedBy      string `json:"startedBy"`
+	CompletedAt    string `json:"completedAt"`
+	CompletedBy    string `json:"completedBy"`
+}
+
+// Write the event for a round's current status to the outbox
+// Call this with the transaction that changed the round, so the event is only kept if the change is
+func writeRoundEvent(tx *gorm.DB, round Round, at time.Time) error {
+	eventType, ok := roundEventTypes[round.Status]
+	if !ok {
+		return fmt.Errorf("no event for round status %q", round.Status)
+	}
+	return writeRoundEventOfType(tx, eventType, round, at)
+}
+
+func writeRoundEventOfType(tx *gorm.DB, eventType string, round Round, at time.Time) error {
+	event, err := newRoundEvent(eventType, round, at)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&event).Error
+}
+
+// Build the outbox event of a given type for a round, ready to be stored
+func newRoundEvent(eventType string, round Round, at time.Time) (OutboxEvent, error) {
+	payload, err := json.Marshal(RoundEventPayload{
+		Type:       eventType,
+		OccurredAt: at.UTC().Format(time.RFC3339),
+		Round: RoundEventSummary{
+			Id:             round.ID,
+			RoundTimestamp: round.RoundTimestamp,
+			Status:         round.Status,
+			StartedAt:      round.StartedAt,
+			StartedBy:      round.StartedBy,
+			CompletedAt:    round.CompletedAt,
+			CompletedBy:    round.CompletedBy,
+		},
+	})
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+
+	return OutboxEvent{
+		EventType:  eventType,
+		RoundId:    round.ID,
+		Payload:    string(payload),
+		OccurredAt: at.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// Create the rounds due by now, so slots nobody opened get a row, and a missed event, like rounds nobody started
+// CreateRounds panics on a database error, which comes back as an error so a worker can try again on its next run
+func createDueRounds(db *gorm.DB, now time.Time) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	CreateRounds(NewGormRoundsStore(db), now)
+	return nil
+}
+
+// Write a round.missed event for each round that was created but not started within missedRoundAfter
+// Rounds become MISSED by the passage of time rather than a write, so this is run periodically instead of from a transition
+// The round's status is left as is, so staff can still start it late
+func RecordMissedRoundEvents(db *gorm.DB, now time.Time) (int, error) {
+	var rounds []Round
+	db.Where("status = ? AND round_timestamp >= ? AND round_timestamp <= ?", "CREATED",
+		now.Add(-missedEventLookback).UTC().Format(time.RFC3339), now.Add(-missedRoundAfter).UTC().Format(time.RFC3339)).
+		Where("NOT EXISTS (SELECT 1 FROM outbox_events WHERE outbox_events.round_id = rounds.id AND outbox_events.event_type = ?)", "round.missed").
+		Order("round_timestamp").
+		Find(&rounds)
+
+	for _, round := range rounds {
+		roundTime, _ := time.Parse(time.RFC3339, round.RoundTimestamp)
+		// Subscribers see the status StartRounds displays
+		round.Status = "MISSED"
+		if err := writeRoundEventOfType(db, "round.missed", round, roundTime.Add(missedRoundAfter)); err != nil {
+			return 0, err
+		}
+	}
+	return len(rounds), nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How far past their ordered frequency a patient can go unobserved before it counts as a gap
+const observationGapGrace = 5 * time.Minute
+
+// How far back CheckObservationGaps looks for each patient's last observation
+const observationGapLookback = 24 * time.Hour
+
+// An interval in which a patient went unobserved for longer than their assignments allow
+// Open gaps are still ongoing at the end of the window, i.e. nobody has seen the patient yet
+type ObservationGap struct {
+	PatientId      string  `json:"patientId"`
+	From           string  `json:"from"`
+	To             string  `json:"to"`
+	GapMinutes     float64 `json:"gapMinutes"`
+	AllowedMinutes float64 `json:"allowedMinutes"`
+	Open           bool    `json:"open"`
+}
+
+// A stretch of time with a constant allowed interval between observations. Zero means the patient had no rounds ordered
+type observationFrequency struct {
+	start   time.Time
+	end     time.Time
+	allowed time.Duration
+}
+
+// Find every interval from start time to end time in which a patient went unobserved longer than allowed
+// The allowed interval at any time is the most frequent of the patient's round assignments active then
+// When the patient is put on rounds after a stretch without any, the clock starts from the assignment rather than their last observation
+// Observations on archived rounds count too
+func FindObservationGaps(db *gorm.DB, patientId string, startTime time.Time, endTime time.Time) ([]ObservationGap, error) {
+	gaps := []ObservationGap{}
+
+	frequencies, err := observationFrequencies(db, patientId, startTime, endTime)
+	if err != nil {
+		return gaps, err
+	}
+
+	// The points that restart the clock: the last observation before the window, each observation in it,
+	// and each time the patient goes on or off rounds
+	var points []time.Time
+	lastObserved, err := getLastObservedRoundMemberForPatient(withArchived(db, "round_members"), patientId, startTime)
+	if err != nil {
+		return gaps, err
+	}
+	if lastObserved.ID != 0 {
+		observedAt, _ := time.Parse(time.RFC3339, lastObserved.ObservedAt)
+		points = append(points, observedAt)
+	} else {
+		points = append(points, startTime)
+	}
+
+	observed, err := getObservedRoundMembersForPatient(withArchived(db, "round_members"), patientId, startTime, endTime)
+	if err != nil {
+		return gaps, err
+	}
+	for _, roundMember := range observed {
+		observedAt, _ := time.Parse(time.RFC3339, roundMember.ObservedAt)
+		points = append(points, observedAt)
+	}
+
+	observedPoints := make(map[time.Time]bool)
+	for _, point := range points {
+		observedPoints[point] = true
+	}
+	for i := 1; i < len(frequencies); i++ {
+		onRounds := frequencies[i].allowed > 0
+		wasOnRounds := frequencies[i-1].allowed > 0
+		if onRounds != wasOnRounds {
+			points = append(points, frequencies[i].start)
+		}
+	}
+	points = append(points, endTime)
+
+	sort.Slice(points, func(i, j int) bool { return points[i].Before(points[j]) })
+
+	// Check each interval between consecutive points against the frequencies it overlaps
+	for i := 1; i < len(points); i++ {
+		from, to := points[i-1], points[i]
+		if !to.After(from) {
+			continue
+		}
+
+		allowed, violated := observationGapViolation(frequencies, from, to)
+		if !violated {
+			continue
+		}
+		gaps = append(gaps, ObservationGap{
+			PatientId:      patientId,
+			From:           from.UTC().Format(time.RFC3339),
+			To:             to.UTC().Format(time.RFC3339),
+			GapMinutes:     to.Sub(from).Minutes(),
+			AllowedMinutes: allowed.Minutes(),
+			Open:           to.Equal(endTime) && !observedPoints[to],
+		})
+	}
+
+	return gaps, nil
+}
+
+// Check whether going unobserved from one time to another breaks any frequency in between
+// Returns the tightest allowed interval that was broken
+func observationGapViolation(frequencies []observationFrequency, from time.Time, to time.Time) (time.Duration, bool) {
+	var allowed time.Duration
+	violated := false
+	for _, frequency := range frequencies {
+		if frequency.allowed == 0 || !frequency.end.After(from) || !frequency.start.Before(to) {
+			continue
+		}
+
+		// The patient is overdue once the allowed interval has passed, if that is before both this frequency and the interval end
+		end := frequency.end
+		if to.Before(end) {
+			end = to
+		}
+		if from.Add(frequency.allowed + observationGapGrace).Before(end) {
+			if !violated || frequency.allowed < allowed {
+				allowed = frequency.allowed
+			}
+			violated = true
+		}
+	}
+	return allowed, violated
+}
+
+// Split a window into stretches with a constant allowed interval between observations,
+// based on the patient's round assignments for enabled round configs and the configs' time windows
+// As with CreateRounds, a patient on leave or not admitted isn't on rounds, and one with no census record always is
+func observationFrequencies(db *gorm.DB, patientId string, startTime time.Time, endTime time.Time) ([]observationFrequency, error) {
+	roundAssignments, err := getRoundAssignmentsForPatient(db, patientId)
+	if err != nil {
+		return nil, err
+	}
+	patient, err := getPatient(db, patientId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only round types with an enabled config get rounds scheduled
+	roundConfigs, err := getRoundConfigs(db)
+	if err != nil {
+		return nil, err
+	}
+	durations := make(map[uint]time.Duration)
+	configs := make(map[uint][]RoundConfig)
+	// Every assignment start and end inside the window is a boundary, and so is every config window opening or closing
+	boundaries := []time.Time{startTime, endTime}
+	for _, roundConfig := range roundConfigs {
+		if !roundConfig.Enabled {
+			continue
+		}
+		roundType, err := getRoundType(db, roundConfig.RoundTypeId)
+		if err != nil {
+			return nil, err
+		}
+		durations[roundType.ID] = time.Duration(roundType.DurationAmt) * time.Minute
+		configs[roundType.ID] = append(configs[roundType.ID], roundConfig)
+		boundaries = append(boundaries, roundConfigWindowBoundaries(roundConfig, startTime, endTime)...)
+	}
+
+	for _, roundAssignment := range roundAssignments {
+		for _, value := range []string{roundAssignment.EffectiveFrom, roundAssignment.EffectiveTo} {
+			if value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err == nil && t.After(startTime) && t.Before(endTime) {
+				boundaries = append(boundaries, t)
+			}
+		}
+	}
+	// So is every census change
+	if patient.ID != 0 {
+		censusEvents, err := getPatientCensusEvents(db, patientId, startTime, endTime)
+		if err != nil {
+			return nil, err
+		}
+		for _, censusEvent := range censusEvents {
+			if t, err := time.Parse(time.RFC3339, censusEvent.EffectiveAt); err == nil && t.Before(endTime) {
+				boundaries = append(boundaries, t)
+			}
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i].Before(boundaries[j]) })
+
+	var frequencies []observationFrequency
+	for i := 1; i < len(boundaries); i++ {
+		start, end := boundaries[i-1], boundaries[i]
+		if !end.After(start) {
+			continue
+		}
+
+		// The most frequent round type active at the start of this stretch
+		var allowed time.Duration
+		for _, roundAssignment := range roundAssignments {
+			duration, ok := durations[roundAssignment.RoundTypeId]
+			if !ok || duration == 0 || !assignmentActiveAt(roundAssignment, start) {
+				continue
+			}
+			active := false
+			for _, roundConfig := range configs[roundAssignment.RoundTypeId] {
+				active = active || roundConfigActiveAt(roundConfig, start)
+			}
+			if !active {
+				continue
+			}
+			if allowed == 0 || duration < allowed {
+				allowed = duration
+			}
+		}
+		if patient.ID != 0 && allowed != 0 {
+			census, err := getPatientCensusAtTime(db, patientId, start)
+			if err != nil {
+				return nil, err
+			}
+			if census.CensusStatus != "ADMITTED" {
+				allowed = 0
+			}
+		}
+
+		// Merge with the previous stretch if nothing changed
+		if len(frequencies) > 0 && frequencies[len(frequencies)-1].allowed == allowed {
+			frequencies[len(frequencies)-1].end = end
+			continue
+		}
+		frequencies = append(frequencies, observationFrequency{start: start, end: end, allowed: allowed})
+	}
+	return frequencies, nil
+}
+
+// Check whether an assignment was active at a given time
+func assignmentActiveAt(roundAssignment RoundAssignment, t time.Time) bool {
+	formatted := t.UTC().Format(time.RFC3339)
+	if roundAssignment.EffectiveFrom != "" && roundAssignment.EffectiveFrom > formatted {
+		return false
+	}
+	if roundAssignment.EffectiveTo != "" && roundAssignment.EffectiveTo <= formatted {
+		return false
+	}
+	return true
+}
+
+// Find patients who are currently overdue for an observation, for real-time alerting
+// Returns the open gap for each patient on rounds who has gone unobserved longer than allowed as of now
+func CheckObservationGaps(db *gorm.DB, now time.Time) ([]ObservationGap, error) {
+	alerts := []ObservationGap{}
+
+	patientIds, err := getAssignedPatientIds(db, now)
+	if err != nil {
+		return alerts, err
+	}
+
+	for _, patientId := range patientIds {
+		gaps, err := FindObservationGaps(db, patientId, now.Add(-observationGapLookback), now)
+		if err != nil {
+			return alerts, err
+		}
+		for _, gap := range gaps {
+			if gap.Open {
+				alerts = append(alerts, gap)
+			}
+		}
+	}
+	return alerts, nil
+}
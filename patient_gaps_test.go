@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func setupObservationHistory(db *gorm.DB) {
+	setupRoundConfigs(db)
+
+	// Patient 2 is on 30 minute rounds and was seen at 8:00, 8:30, 9:20 and 9:45
+	db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T08:00:00Z", Status: "COMPLETE"})
+	db.Create(&RoundMember{RoundId: 1, PatientId: "patient2", Observation: "SLEEPING", ObservedAt: "2022-01-10T08:00:00Z"})
+	db.Create(&RoundMember{RoundId: 1, PatientId: "patient2", Observation: "SLEEPING", ObservedAt: "2022-01-10T08:30:00Z"})
+	db.Create(&RoundMember{RoundId: 1, PatientId: "patient2", Observation: "AWAKE", ObservedAt: "2022-01-10T09:20:00Z"})
+	db.Create(&RoundMember{RoundId: 1, PatientId: "patient2", Observation: "AWAKE", ObservedAt: "2022-01-10T09:45:00Z"})
+
+	// Patient 4 was on 15 minute rounds from 9:00, stepped down to 60 minute rounds at 9:30, and was only seen at 9:05
+	db.Create(&RoundAssignment{RoundTypeId: 1, PatientId: "patient4", EffectiveFrom: "2022-01-10T09:00:00Z", EffectiveTo: "2022-01-10T09:30:00Z"})
+	db.Create(&RoundAssignment{RoundTypeId: 3, PatientId: "patient4", EffectiveFrom: "2022-01-10T09:30:00Z"})
+	db.Create(&RoundMember{RoundId: 1, PatientId: "patient4", Observation: "AWAKE", ObservedAt: "2022-01-10T09:05:00Z"})
+}
+
+func TestFindObservationGaps(t *testing.T) {
+	db := setupDatabase()
+	setupObservationHistory(db)
+
+	tests := []struct {
+		name         string
+		patientId    string
+		expectedGaps []ObservationGap
+	}{
+		{
+			name:      "Patient 2 went 50 minutes without an observation on 30 minute rounds",
+			patientId: "patient2",
+			expectedGaps: []ObservationGap{
+				{PatientId: "patient2", From: "2022-01-10T08:30:00Z", To: "2022-01-10T09:20:00Z", GapMinutes: 50, AllowedMinutes: 30},
+			},
+		},
+		{
+			name:      "Patient 4 has not been seen since 9:05, which broke their 15 minute rounds",
+			patientId: "patient4",
+			expectedGaps: []ObservationGap{
+				{PatientId: "patient4", From: "2022-01-10T09:05:00Z", To: "2022-01-10T10:00:00Z", GapMinutes: 55, AllowedMinutes: 15, Open: true},
+			},
+		},
+		{
+			name:         "Patient 5 has no rounds ordered",
+			patientId:    "patient5",
+			expectedGaps: []ObservationGap{},
+		},
+	}
+
+	for _, tt := range tests {
+		gaps, err := FindObservationGaps(db, tt.patientId, time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC), time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatalf("%s: FindObservationGaps failed: %v", tt.name, err)
+		}
+		if len(gaps) != len(tt.expectedGaps) {
+			t.Fatalf("%s: expected %d gaps, got %+v", tt.name, len(tt.expectedGaps), gaps)
+		}
+		for i, expectedGap := range tt.expectedGaps {
+			if gaps[i] != expectedGap {
+				t.Errorf("%s: expected %+v, got %+v", tt.name, expectedGap, gaps[i])
+			}
+		}
+	}
+}
+
+func TestCheckObservationGaps(t *testing.T) {
+	db := setupDatabase()
+	setupObservationHistory(db)
+
+	// At 10:00 patients 1 and 3 have never been seen, and patient 4 is overdue. Patient 2 was seen at 9:45
+	alerts, err := CheckObservationGaps(db, time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("CheckObservationGaps failed: %v", err)
+	}
+
+	expectedPatients := []string{"patient1", "patient3", "patient4"}
+	if len(alerts) != len(expectedPatients) {
+		t.Fatalf("Expected %d alerts, got %+v", len(expectedPatients), alerts)
+	}
+	for i, patientId := range expectedPatients {
+		if alerts[i].PatientId != patientId || !alerts[i].Open {
+			t.Errorf("Expected an open gap for %s, got %+v", patientId, alerts[i])
+		}
+	}
+}
+
+func TestObservationGapsEndpoint(t *testing.T) {
+	db := setupDatabase()
+	setupObservationHistory(db)
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/patients/patient2/observation-gaps?start=2022-01-10T08:00:00Z&end=2022-01-10T10:00:00Z")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var gaps []ObservationGap
+	if err := json.NewDecoder(resp.Body).Decode(&gaps); err != nil {
+		t.Fatalf("Failed to decode gaps: %v", err)
+	}
+	if len(gaps) != 1 || gaps[0].GapMinutes != 50 {
+		t.Errorf("Expected one 50 minute gap, got %+v", gaps)
+	}
+}
+
+// Time on leave or after discharge isn't a gap, and coming back from leave starts the clock again
+func TestObservationGapsFollowCensus(t *testing.T) {
+	db := setupDatabase()
+	setupObservationHistory(db)
+
+	// Patient 6 is on 15 minute rounds, seen at 8:00, on leave from 8:10 to 9:00, seen at 9:40 and discharged at 9:45
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2022, time.January, 10, hour, minute, 0, 0, time.UTC)
+	}
+	AdmitPatient(db, "patient6", "Pat Six", "A", "1", at(7, 0))
+	db.Create(&RoundAssignment{RoundTypeId: 1, PatientId: "patient6", EffectiveFrom: "2022-01-10T07:00:00Z"})
+	db.Create(&RoundMember{RoundId: 1, PatientId: "patient6", Observation: "AWAKE", ObservedAt: "2022-01-10T08:00:00Z"})
+	StartLeaveOfAbsence(db, "patient6", at(8, 10))
+	ReturnFromLeave(db, "patient6", at(9, 0))
+	db.Create(&RoundMember{RoundId: 1, PatientId: "patient6", Observation: "AWAKE", ObservedAt: "2022-01-10T09:40:00Z"})
+	DischargePatient(db, "patient6", at(9, 45))
+
+	gaps, err := FindObservationGaps(db, "patient6", at(8, 0), at(10, 0))
+	if err != nil {
+		t.Fatalf("FindObservationGaps failed: %v", err)
+	}
+	expected := ObservationGap{PatientId: "patient6", From: "2022-01-10T09:00:00Z", To: "2022-01-10T09:40:00Z", GapMinutes: 40, AllowedMinutes: 15}
+	if len(gaps) != 1 || gaps[0] != expected {
+		t.Errorf("Expected only the gap after returning from leave, got %+v", gaps)
+	}
+
+	alerts, err := CheckObservationGaps(db, at(10, 0))
+	if err != nil {
+		t.Fatalf("CheckObservationGaps failed: %v", err)
+	}
+	for _, alert := range alerts {
+		if alert.PatientId == "patient6" {
+			t.Errorf("Expected no alert for a discharged patient, got %+v", alert)
+		}
+	}
+}
+
+// Overdue patients are escalated to the charge nurse through the notifiers, once per gap
+func TestCheckObservationGapNotifications(t *testing.T) {
+	db := setupDatabase()
+	setupObservationHistory(db)
+	if _, err := AddEscalationContact(db, EscalationContact{Tier: "CHARGE_NURSE", Channel: "in_app", Address: "nurseA"}); err != nil {
+		t.Fatalf("AddEscalationContact failed: %v", err)
+	}
+	notifiers := map[string]Notifier{"in_app": InAppNotifier{}}
+	now := time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC)
+
+	notifications, err := CheckObservationGapNotifications(db, now, notifiers)
+	if err != nil {
+		t.Fatalf("CheckObservationGapNotifications failed: %v", err)
+	}
+	expectedPatients := []string{"patient1", "patient3", "patient4"}
+	if len(notifications) != len(expectedPatients) {
+		t.Fatalf("Expected %d notifications, got %+v", len(expectedPatients), notifications)
+	}
+	for i, patientId := range expectedPatients {
+		if notifications[i].Event != "OBSERVATION_GAP" || notifications[i].PatientId != patientId || notifications[i].SentAt == "" {
+			t.Errorf("Expected a sent observation gap notification for %s, got %+v", patientId, notifications[i])
+		}
+	}
+	if notifications[2].RoundTimestamp != "2022-01-10T09:05:00Z" || notifications[2].Message != "patient4 has not been observed since 09:05 UTC, and is on rounds every 15 minutes" {
+		t.Errorf("Expected patient 4's gap from 9:05, got %+v", notifications[2])
+	}
+
+	// The same gaps aren't sent again
+	notifications, err = CheckObservationGapNotifications(db, now.Add(time.Minute), notifiers)
+	if err != nil || len(notifications) != 0 {
+		t.Errorf("Expected nothing new to send, got %+v and %v", notifications, err)
+	}
+}
+
+// A patient isn't expected to be observed outside their round config's time window
+func TestObservationGapsFollowWindows(t *testing.T) {
+	db := setupDatabase()
+	setupNightRounds(t, db)
+	at := func(day int, hour int) time.Time { return time.Date(2022, time.January, day, hour, 0, 0, 0, time.UTC) }
+
+	if gaps, err := FindObservationGaps(db, "patient1", at(10, 2), at(10, 12)); err != nil || len(gaps) != 0 {
+		t.Errorf("Expected no gaps outside the window, got %+v and %v", gaps, err)
+	}
+
+	gaps, err := FindObservationGaps(db, "patient1", at(9, 21), at(10, 3))
+	expected := ObservationGap{PatientId: "patient1", From: "2022-01-09T22:00:00Z", To: "2022-01-10T02:00:00Z", GapMinutes: 240, AllowedMinutes: 60}
+	if err != nil || len(gaps) != 1 || gaps[0] != expected {
+		t.Errorf("Expected %+v, got %+v and %v", expected, gaps, err)
+	}
+}
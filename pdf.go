@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Landscape US Letter, in points
+const (
+	pdfPageWidth  = 792.0
+	pdfPageHeight = 612.0
+)
+
+// A minimal PDF document with Helvetica text, lines and boxes
+// Pages are built in memory and written out in one go, which is fine for documents of a few pages like the rounds sheet
+type pdfDocument struct {
+	pages []*pdfPage
+}
+
+// A page's content stream. Coordinates are in points from the top left corner
+type pdfPage struct {
+	content bytes.Buffer
+}
+
+func (d *pdfDocument) AddPage() *pdfPage {
+	page := &pdfPage{}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// Draw text with its baseline at y
+func (p *pdfPage) Text(x float64, y float64, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pdfPageHeight-y, pdfEscape(text))
+}
+
+// Draw the outline of a box with its top left corner at x, y
+func (p *pdfPage) Rect(x float64, y float64, width float64, height float64) {
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f re S\n", x, pdfPageHeight-y-height, width, height)
+}
+
+func (p *pdfPage) Line(x1 float64, y1 float64, x2 float64, y2 float64) {
+	fmt.Fprintf(&p.content, "%.2f %.2f m %.2f %.2f l S\n", x1, pdfPageHeight-y1, x2, pdfPageHeight-y2)
+}
+
+// Set the width of lines and box outlines
+func (p *pdfPage) LineWidth(width float64) {
+	fmt.Fprintf(&p.content, "%.2f w\n", width)
+}
+
+// Write the document: catalog, page tree, fonts, then a page and content stream per page, and the cross-reference table
+func (d *pdfDocument) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var offsets []int
+
+	writeObject := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1 to 4 are fixed, then each page takes two objects
+	var kids []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 5+2*i))
+	}
+	writeObject("<< /Type /Catalog /Pages 2 0 R >>")
+	writeObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		writeObject(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, 6+2*i))
+		writeObject(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.content.Len(), page.content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.WriteTo(w)
+}
+
+// Escape text for a PDF string. The standard fonts only cover Latin-1, so anything else is replaced with ?
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32:
+			b.WriteRune(' ')
+		case r > 255:
+			b.WriteRune('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
+
+// Rough width of Helvetica text, for truncating text to fit a column
+func pdfTextWidth(text string, size float64) float64 {
+	return float64(len([]rune(text))) * size * 0.55
+}
+
+// Shorten text to fit a width, marking the cut with ...
+func pdfFit(text string, size float64, width float64) string {
+	if pdfTextWidth(text, size) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && pdfTextWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
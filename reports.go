@@ -0,0 +1,390 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Rounds started within this long of their timestamp count as on time
+const defaultOnTimeGrace = 15 * time.Minute
+
+// Lateness of a round that was done, but with no record of when
+const unknownLateness = time.Duration(-1)
+
+// A shift starts at StartHour, in the report's location, and runs until the next shift starts
+type Shift struct {
+	Name      string `json:"name"`
+	StartHour int    `json:"startHour"`
+}
+
+var defaultShifts = []Shift{
+	{Name: "Night", StartHour: 23},
+	{Name: "Day", StartHour: 7},
+	{Name: "Evening", StartHour: 15},
+}
+
+// Which rounds to report on
+// Rounds are scheduled the same way StartRounds does it, walking each round type forward from StartTime
+type ComplianceFilter struct {
+	StartTime   time.Time
+	EndTime     time.Time
+	Unit        string
+	RoundTypeId uint
+	// Rounds less than missedRoundAfter before Now are still pending and left out of the rates
+	Now         time.Time
+	OnTimeGrace time.Duration
+	Shifts      []Shift
+	Location    *time.Location
+}
+
+type ComplianceStats struct {
+	Total                 int     `json:"total"`
+	OnTime                int     `json:"onTime"`
+	Late                  int     `json:"late"`
+	Missed                int     `json:"missed"`
+	Pending               int     `json:"pending"`
+	OnTimeRate            float64 `json:"onTimeRate"`
+	LateRate              float64 `json:"lateRate"`
+	MissedRate            float64 `json:"missedRate"`
+	MedianLatenessMinutes float64 `json:"medianLatenessMinutes"`
+	latenesses            []time.Duration
+}
+
+// The longest stretch a patient went without an observation
+type PatientObservationGap struct {
+	PatientId  string  `json:"patientId"`
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	GapMinutes float64 `json:"gapMinutes"`
+}
+
+type ComplianceReport struct {
+	StartTime   string                      `json:"startTime"`
+	EndTime     string                      `json:"endTime"`
+	Overall     *ComplianceStats            `json:"overall"`
+	ByUnit      map[string]*ComplianceStats `json:"byUnit"`
+	ByRoundType map[string]*ComplianceStats `json:"byRoundType"`
+	ByShift     map[string]*ComplianceStats `json:"byShift"`
+	ByStaff     map[string]*ComplianceStats `json:"byStaff"`
+	PatientGaps []PatientObservationGap     `json:"patientGaps"`
+}
+
+// A scheduled round, with the units and round types it was scheduled for
+type scheduledRound struct {
+	roundTime  time.Time
+	units      map[string]bool
+	roundTypes map[string]bool
+}
+
+// Build a compliance report of on time, late and missed rounds, plus the longest observation gap per patient
+// Clinic-wide round configs are reported under the unit "ALL"
+// Rounds the retention policy archived are read from the archive, so old windows report the same as before
+func BuildComplianceReport(db *gorm.DB, filter ComplianceFilter) (ComplianceReport, error) {
+	if filter.OnTimeGrace == 0 {
+		filter.OnTimeGrace = defaultOnTimeGrace
+	}
+	if filter.Shifts == nil {
+		filter.Shifts = defaultShifts
+	}
+	if filter.Location == nil {
+		filter.Location = time.UTC
+	}
+	if filter.Now.IsZero() {
+		filter.Now = filter.EndTime
+	}
+
+	report := ComplianceReport{
+		StartTime:   filter.StartTime.UTC().Format(time.RFC3339),
+		EndTime:     filter.EndTime.UTC().Format(time.RFC3339),
+		Overall:     &ComplianceStats{},
+		ByUnit:      make(map[string]*ComplianceStats),
+		ByRoundType: make(map[string]*ComplianceStats),
+		ByShift:     make(map[string]*ComplianceStats),
+		ByStaff:     make(map[string]*ComplianceStats),
+	}
+
+	// Work out every scheduled round in the window from the round configs
+	scheduled, err := scheduleRoundsForFilter(db, filter)
+	if err != nil {
+		return report, err
+	}
+
+	// Put existing rounds in a map as round timestamp -> Round
+	rounds, err := getRounds(withArchived(db, "rounds"), filter.StartTime, filter.EndTime)
+	if err != nil {
+		return report, err
+	}
+	roundsMap := make(map[string]Round)
+	var roundIds []uint
+	for _, round := range rounds {
+		roundsMap[round.RoundTimestamp] = round
+		roundIds = append(roundIds, round.ID)
+	}
+
+	// Rounds charted late count as late even without a start time
+	amendments, err := getAmendmentsForRounds(withArchived(db, "round_amendments"), roundIds)
+	if err != nil {
+		return report, err
+	}
+	lateCharted := make(map[uint]bool)
+	for _, amendment := range amendments {
+		if amendment.LateEntry && amendment.Field == "status" {
+			lateCharted[amendment.RoundId] = true
+		}
+	}
+
+	for _, slot := range scheduled {
+		round := roundsMap[slot.roundTime.UTC().Format(time.RFC3339)]
+		outcome, lateness := classifyRound(round, slot.roundTime, lateCharted[round.ID], filter)
+
+		stats := []*ComplianceStats{report.Overall, statsFor(report.ByShift, shiftFor(slot.roundTime, filter))}
+		for unit := range slot.units {
+			stats = append(stats, statsFor(report.ByUnit, unit))
+		}
+		for roundType := range slot.roundTypes {
+			stats = append(stats, statsFor(report.ByRoundType, roundType))
+		}
+		if staffId := roundStaff(round); staffId != "" {
+			stats = append(stats, statsFor(report.ByStaff, staffId))
+		}
+
+		for _, s := range stats {
+			s.add(outcome, lateness)
+		}
+	}
+
+	for _, group := range []map[string]*ComplianceStats{report.ByUnit, report.ByRoundType, report.ByShift, report.ByStaff} {
+		for _, s := range group {
+			s.finish()
+		}
+	}
+	report.Overall.finish()
+
+	// Longest gaps between observations, per patient
+	roundMembers, err := getRoundMembersForRounds(withArchived(db, "round_members"), roundIds)
+	if err != nil {
+		return report, err
+	}
+	report.PatientGaps = longestObservationGaps(roundMembers, filter.Unit)
+
+	return report, nil
+}
+
+// Schedule the rounds for every enabled config that matches the filter
+func scheduleRoundsForFilter(db *gorm.DB, filter ComplianceFilter) ([]*scheduledRound, error) {
+	roundConfigs, err := getRoundConfigs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	store := NewGormRoundsStore(db)
+	scheduledMap := make(map[string]*scheduledRound)
+	for _, roundConfig := range roundConfigs {
+		if !roundConfig.Enabled {
+			continue
+		}
+		if filter.RoundTypeId != 0 && roundConfig.RoundTypeId != filter.RoundTypeId {
+			continue
+		}
+		if filter.Unit != "" && roundConfig.Unit != "" && roundConfig.Unit != filter.Unit {
+			continue
+		}
+
+		roundType, err := getRoundType(db, roundConfig.RoundTypeId)
+		if err != nil {
+			return nil, err
+		}
+
+		unit := roundConfig.Unit
+		if unit == "" {
+			unit = "ALL"
+		}
+
+		// Slots follow the schedule CreateRounds keeps. A round type it has never scheduled has no schedule yet,
+		// so its slots run from the start of the window and a scheduler that never ran shows up as missed rounds
+		slots, scheduled, err := scheduledRoundTypeSlots(store, roundType, filter.StartTime, filter.EndTime)
+		if err != nil {
+			return nil, err
+		}
+		if !scheduled {
+			slots = roundTypeSlots(roundType, filter.StartTime, filter.EndTime)
+		}
+		for _, slot := range slots {
+			if !roundConfigActiveAt(roundConfig, slot) {
+				continue
+			}
+			key := slot.UTC().Format(time.RFC3339)
+			if _, ok := scheduledMap[key]; !ok {
+				scheduledMap[key] = &scheduledRound{
+					roundTime:  slot,
+					units:      make(map[string]bool),
+					roundTypes: make(map[string]bool),
+				}
+			}
+			scheduledMap[key].units[unit] = true
+			scheduledMap[key].roundTypes[roundType.Name] = true
+		}
+	}
+
+	var scheduled []*scheduledRound
+	for _, slot := range scheduledMap {
+		scheduled = append(scheduled, slot)
+	}
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].roundTime.Before(scheduled[j].roundTime)
+	})
+	return scheduled, nil
+}
+
+// Classify a scheduled round as ON_TIME, LATE, MISSED or PENDING
+// Lateness is how long after the round time it was started, or unknownLateness
+// A round charted late is given the round time as its start, which says nothing about when it was actually done
+func classifyRound(round Round, roundTime time.Time, lateCharted bool, filter ComplianceFilter) (string, time.Duration) {
+	actual := round.StartedAt
+	if actual == "" {
+		actual = round.CompletedAt
+	}
+	if lateCharted && actual == round.RoundTimestamp {
+		actual = ""
+	}
+
+	if actual != "" {
+		actualTime, _ := time.Parse(time.RFC3339, actual)
+		lateness := actualTime.Sub(roundTime)
+		if lateness < 0 {
+			lateness = 0
+		}
+		if lateness <= filter.OnTimeGrace && !lateCharted {
+			return "ON_TIME", lateness
+		}
+		return "LATE", lateness
+	}
+
+	if round.Status == "COMPLETE" || round.Status == "STARTED" {
+		// Done, but with no record of when. Charted after the fact is late, otherwise give the benefit of the doubt
+		if lateCharted {
+			return "LATE", unknownLateness
+		}
+		return "ON_TIME", unknownLateness
+	}
+
+	if round.Status == "MISSED" || filter.Now.Sub(roundTime) >= missedRoundAfter {
+		return "MISSED", unknownLateness
+	}
+	return "PENDING", unknownLateness
+}
+
+// Staff member accountable for a round: whoever completed it, or else whoever started it
+func roundStaff(round Round) string {
+	if round.CompletedBy != "" {
+		return round.CompletedBy
+	}
+	return round.StartedBy
+}
+
+// Name of the shift a time falls in
+func shiftFor(t time.Time, filter ComplianceFilter) string {
+	hour := t.In(filter.Location).Hour()
+
+	// The shift that started most recently before this hour, wrapping around midnight
+	name := ""
+	best := -1
+	for _, shift := range filter.Shifts {
+		sinceStart := (hour - shift.StartHour + 24) % 24
+		if best == -1 || sinceStart < best {
+			best = sinceStart
+			name = shift.Name
+		}
+	}
+	return name
+}
+
+func statsFor(group map[string]*ComplianceStats, key string) *ComplianceStats {
+	if _, ok := group[key]; !ok {
+		group[key] = &ComplianceStats{}
+	}
+	return group[key]
+}
+
+func (s *ComplianceStats) add(outcome string, lateness time.Duration) {
+	switch outcome {
+	case "ON_TIME":
+		s.OnTime++
+	case "LATE":
+		s.Late++
+	case "MISSED":
+		s.Missed++
+	case "PENDING":
+		s.Pending++
+		return
+	}
+	s.Total++
+	if lateness != unknownLateness {
+		s.latenesses = append(s.latenesses, lateness)
+	}
+}
+
+// Work out the rates and median lateness once all rounds are added
+func (s *ComplianceStats) finish() {
+	if s.Total > 0 {
+		s.OnTimeRate = float64(s.OnTime) / float64(s.Total)
+		s.LateRate = float64(s.Late) / float64(s.Total)
+		s.MissedRate = float64(s.Missed) / float64(s.Total)
+	}
+
+	if len(s.latenesses) == 0 {
+		return
+	}
+	sort.Slice(s.latenesses, func(i, j int) bool { return s.latenesses[i] < s.latenesses[j] })
+	middle := len(s.latenesses) / 2
+	median := s.latenesses[middle]
+	if len(s.latenesses)%2 == 0 {
+		median = (s.latenesses[middle-1] + s.latenesses[middle]) / 2
+	}
+	s.MedianLatenessMinutes = median.Minutes()
+}
+
+// Get the longest gap between consecutive observations for each patient, longest first
+// If unit is set, only observations made on that unit count
+func longestObservationGaps(roundMembers []RoundMember, unit string) []PatientObservationGap {
+	observations := make(map[string][]time.Time)
+	for _, roundMember := range roundMembers {
+		if roundMember.ObservedAt == "" || (unit != "" && roundMember.Unit != unit) {
+			continue
+		}
+		observedAt, err := time.Parse(time.RFC3339, roundMember.ObservedAt)
+		if err != nil {
+			continue
+		}
+		observations[roundMember.PatientId] = append(observations[roundMember.PatientId], observedAt)
+	}
+
+	gaps := []PatientObservationGap{}
+	for patientId, times := range observations {
+		if len(times) < 2 {
+			continue
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+		longest := PatientObservationGap{PatientId: patientId}
+		for i := 1; i < len(times); i++ {
+			gap := times[i].Sub(times[i-1])
+			if gap.Minutes() > longest.GapMinutes {
+				longest.From = times[i-1].UTC().Format(time.RFC3339)
+				longest.To = times[i].UTC().Format(time.RFC3339)
+				longest.GapMinutes = gap.Minutes()
+			}
+		}
+		gaps = append(gaps, longest)
+	}
+
+	sort.Slice(gaps, func(i, j int) bool {
+		if gaps[i].GapMinutes != gaps[j].GapMinutes {
+			return gaps[i].GapMinutes > gaps[j].GapMinutes
+		}
+		return gaps[i].PatientId < gaps[j].PatientId
+	})
+	return gaps
+}
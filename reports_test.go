@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func setupComplianceRounds(t *testing.T) *gorm.DB {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+
+	// 60 minute rounds only apply to unit B
+	db.Model(&RoundConfig{}).Where("round_type_id = ?", 3).Update("unit", "B")
+
+	// 8:00 started on time, 8:15 started late, 8:30 never happened, 8:45 started on time
+	db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T08:00:00Z", Status: "COMPLETE", StartedAt: "2022-01-10T08:05:00Z", StartedBy: "nurseA", CompletedAt: "2022-01-10T08:07:00Z", CompletedBy: "nurseA"})
+	db.Create(&Round{ID: 2, RoundTimestamp: "2022-01-10T08:15:00Z", Status: "COMPLETE", StartedAt: "2022-01-10T08:40:00Z", StartedBy: "nurseB", CompletedAt: "2022-01-10T08:42:00Z", CompletedBy: "nurseB"})
+	db.Create(&Round{ID: 3, RoundTimestamp: "2022-01-10T08:45:00Z", Status: "STARTED", StartedAt: "2022-01-10T08:50:00Z", StartedBy: "nurseA"})
+
+	// 9:00 was charted late
+	if _, err := AmendRoundStatus(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC), "COMPLETE", "LATE_ENTRY", "", "nurseA", time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("AmendRoundStatus failed: %v", err)
+	}
+
+	// Patient 1 was seen at 8:05, 8:40 and 8:50. Patient 2 at 8:05 and 8:50
+	db.Create(&RoundMember{RoundId: 1, PatientId: "patient1", Observation: "SLEEPING", ObservedAt: "2022-01-10T08:05:00Z"})
+	db.Create(&RoundMember{RoundId: 1, PatientId: "patient2", Observation: "SLEEPING", ObservedAt: "2022-01-10T08:05:00Z"})
+	db.Create(&RoundMember{RoundId: 2, PatientId: "patient1", Observation: "AWAKE", ObservedAt: "2022-01-10T08:40:00Z"})
+	db.Create(&RoundMember{RoundId: 3, PatientId: "patient1", Observation: "AWAKE", ObservedAt: "2022-01-10T08:50:00Z"})
+	db.Create(&RoundMember{RoundId: 3, PatientId: "patient2", Observation: "DAYROOM", ObservedAt: "2022-01-10T08:50:00Z"})
+
+	return db
+}
+
+func TestBuildComplianceReport(t *testing.T) {
+	db := setupComplianceRounds(t)
+
+	report, err := BuildComplianceReport(db, ComplianceFilter{
+		StartTime: time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC),
+		Now:       time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("BuildComplianceReport failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		stats      *ComplianceStats
+		total      int
+		onTime     int
+		late       int
+		missed     int
+		median     float64
+		rateOnTime float64
+	}{
+		{"Overall", report.Overall, 5, 2, 2, 1, 5, 0.4},
+		{"15 Minute Round", report.ByRoundType["15 Minute Round"], 5, 2, 2, 1, 5, 0.4},
+		{"30 Minute Round", report.ByRoundType["30 Minute Round"], 3, 1, 1, 1, 5, 1.0 / 3},
+		{"60 Minute Round", report.ByRoundType["60 Minute Round"], 2, 1, 1, 0, 5, 0.5},
+		{"Unit ALL", report.ByUnit["ALL"], 5, 2, 2, 1, 5, 0.4},
+		{"Unit B", report.ByUnit["B"], 2, 1, 1, 0, 5, 0.5},
+		{"Day shift", report.ByShift["Day"], 5, 2, 2, 1, 5, 0.4},
+		{"nurseA", report.ByStaff["nurseA"], 3, 2, 1, 0, 5, 2.0 / 3},
+		{"nurseB", report.ByStaff["nurseB"], 1, 0, 1, 0, 25, 0},
+	}
+	for _, tt := range tests {
+		if tt.stats == nil {
+			t.Errorf("%s: missing from the report", tt.name)
+			continue
+		}
+		if tt.stats.Total != tt.total || tt.stats.OnTime != tt.onTime || tt.stats.Late != tt.late || tt.stats.Missed != tt.missed {
+			t.Errorf("%s: expected %d total, %d on time, %d late, %d missed, got %+v", tt.name, tt.total, tt.onTime, tt.late, tt.missed, tt.stats)
+		}
+		if tt.stats.MedianLatenessMinutes != tt.median {
+			t.Errorf("%s: expected median lateness %v, got %v", tt.name, tt.median, tt.stats.MedianLatenessMinutes)
+		}
+		if tt.stats.OnTimeRate != tt.rateOnTime {
+			t.Errorf("%s: expected on time rate %v, got %v", tt.name, tt.rateOnTime, tt.stats.OnTimeRate)
+		}
+	}
+
+	expectedGaps := []PatientObservationGap{
+		{PatientId: "patient2", From: "2022-01-10T08:05:00Z", To: "2022-01-10T08:50:00Z", GapMinutes: 45},
+		{PatientId: "patient1", From: "2022-01-10T08:05:00Z", To: "2022-01-10T08:40:00Z", GapMinutes: 35},
+	}
+	if len(report.PatientGaps) != len(expectedGaps) {
+		t.Fatalf("Expected %d patient gaps, got %d", len(expectedGaps), len(report.PatientGaps))
+	}
+	for i, expectedGap := range expectedGaps {
+		if report.PatientGaps[i] != expectedGap {
+			t.Errorf("Expected %+v, got %+v", expectedGap, report.PatientGaps[i])
+		}
+	}
+}
+
+func TestComplianceReportPendingRounds(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+
+	// At 9:20 the 8:45 round is missed, and the 9:00 round is overdue but not yet missed, so it is pending
+	report, err := BuildComplianceReport(db, ComplianceFilter{
+		StartTime:   time.Date(2022, time.January, 10, 8, 45, 0, 0, time.UTC),
+		EndTime:     time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC),
+		RoundTypeId: 1,
+		Now:         time.Date(2022, time.January, 10, 9, 20, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("BuildComplianceReport failed: %v", err)
+	}
+	if report.Overall.Total != 1 || report.Overall.Missed != 1 || report.Overall.Pending != 1 {
+		t.Errorf("Expected 1 missed and 1 pending round, got %+v", report.Overall)
+	}
+}
+
+// Rounds scheduled off the quarter hour are reported at their own times, whatever time the window starts at
+func TestComplianceReportFollowsSchedule(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 8, 7, 0, 0, time.UTC))
+	for _, roundTime := range []time.Time{
+		time.Date(2022, time.January, 10, 8, 7, 0, 0, time.UTC),
+		time.Date(2022, time.January, 10, 8, 22, 0, 0, time.UTC),
+	} {
+		if _, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(time.Minute)); err != nil {
+			t.Fatalf("StartRound failed: %v", err)
+		}
+	}
+
+	// 8:07 and 8:22 were started on time, and 8:37 and 8:52 were missed
+	report, err := BuildComplianceReport(db, ComplianceFilter{
+		StartTime:   time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC),
+		EndTime:     time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC),
+		RoundTypeId: 1,
+		Now:         time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("BuildComplianceReport failed: %v", err)
+	}
+	if report.Overall.Total != 4 || report.Overall.OnTime != 2 || report.Overall.Missed != 2 {
+		t.Errorf("Expected 4 rounds with 2 on time and 2 missed, got %+v", report.Overall)
+	}
+}
+
+func TestComplianceReportEndpoint(t *testing.T) {
+	db := setupComplianceRounds(t)
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	defer server.Close()
+
+	// 8:00 to 9:00 UTC is 3:00 to 4:00 in New York, all in the night shift
+	resp, err := http.Get(server.URL + "/reports/compliance?start=2022-01-10T08:00:00Z&end=2022-01-10T09:00:00Z&unit=B&tz=America/New_York")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var report ComplianceReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.ByShift["Night"] == nil || report.ByShift["Night"].Total != 5 {
+		t.Errorf("Expected 5 rounds on the night shift, got %+v", report.ByShift)
+	}
+	if _, ok := report.ByUnit["B"]; !ok {
+		t.Errorf("Expected unit B in the report, got %+v", report.ByUnit)
+	}
+
+	for _, query := range []string{"roundType=abc", "tz=Mars/Olympus", "start=2022-01-10T10:00:00Z&end=2022-01-10T09:00:00Z"} {
+		resp, err := http.Get(server.URL + "/reports/compliance?" + query)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+// Only slots inside a config's time window are counted
+func TestComplianceReportFollowsWindows(t *testing.T) {
+	db := setupDatabase()
+	roundType := setupNightRounds(t, db)
+
+	tests := []struct {
+		start, end time.Time
+		expected   int
+	}{
+		{time.Date(2022, time.January, 10, 3, 0, 0, 0, time.UTC), time.Date(2022, time.January, 10, 12, 0, 0, 0, time.UTC), 0},
+		{time.Date(2022, time.January, 9, 21, 0, 0, 0, time.UTC), time.Date(2022, time.January, 10, 3, 0, 0, 0, time.UTC), 4},
+	}
+	for _, tt := range tests {
+		report, err := BuildComplianceReport(db, ComplianceFilter{
+			StartTime:   tt.start,
+			EndTime:     tt.end,
+			RoundTypeId: roundType.ID,
+			Now:         time.Date(2022, time.January, 10, 13, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatalf("BuildComplianceReport failed: %v", err)
+		}
+		if report.Overall.Total != tt.expected || report.Overall.Missed != tt.expected {
+			t.Errorf("Expected %d missed rounds from %v to %v, got %+v", tt.expected, tt.start, tt.end, report.Overall)
+		}
+	}
+}
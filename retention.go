@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How long rounds stay in the live tables, and how long after the round time they are kept at all
+// PurgeAfter of 0 keeps archived rounds forever
+type RetentionPolicy struct {
+	ArchiveAfter time.Duration
+	PurgeAfter   time.Duration
+}
+
+// What a retention run did. Held counts rounds that were due to be archived or purged but are under a hold
+type RetentionResult struct {
+	Archived int `json:"archived"`
+	Purged   int `json:"purged"`
+	Held     int `json:"held"`
+}
+
+var retentionHoldKinds = map[string]bool{
+	"LEGAL_HOLD": true,
+	"AUDIT":      true,
+}
+
+// Rounds are archived and purged this many at a time, each batch in its own transaction
+const retentionBatchSize = 500
+
+// The live table each archive table mirrors, and the column that holds the round id, parents first
+var archivedRoundTables = []struct {
+	live    string
+	archive string
+	roundId string
+}{
+	{live: "rounds", archive: "archived_rounds", roundId: "id"},
+	{live: "round_round_types", archive: "archived_round_round_types", roundId: "round_id"},
+	{live: "round_members", archive: "archived_round_members", roundId: "round_id"},
+	{live: "round_amendments", archive: "archived_round_amendments", roundId: "round_id"},
+}
+
+// The shortest ArchiveAfter allowed. CreateRounds backfills 12 hours, and StartRounds and the notification worker
+// read the live tables, so rounds archived inside that window would show as missed and be created again
+const minRetentionArchiveAfter = 24 * time.Hour
+
+func validateRetentionPolicy(policy RetentionPolicy) error {
+	if policy.ArchiveAfter < minRetentionArchiveAfter {
+		return fmt.Errorf("archive after must be at least %v, got %v", minRetentionArchiveAfter, policy.ArchiveAfter)
+	}
+	if policy.PurgeAfter != 0 && policy.PurgeAfter < policy.ArchiveAfter {
+		return fmt.Errorf("purge after must not be shorter than archive after")
+	}
+	return nil
+}
+
+// Archive rounds older than the policy's ArchiveAfter, then purge archived rounds older than its PurgeAfter
+// Rounds covered by a hold are left where they are, so a hold placed on archived rounds keeps them from being purged
+func RunRetention(db *gorm.DB, policy RetentionPolicy, now time.Time) (RetentionResult, error) {
+	var result RetentionResult
+	if err := validateRetentionPolicy(policy); err != nil {
+		return result, err
+	}
+
+	holds, err := getActiveRetentionHolds(db)
+	if err != nil {
+		return result, err
+	}
+
+	archiveCutoff := now.Add(-policy.ArchiveAfter).UTC().Format(time.RFC3339)
+	var rounds []Round
+	if err := db.Where("round_timestamp < ?", archiveCutoff).Order("round_timestamp").Find(&rounds).Error; err != nil {
+		return result, err
+	}
+	roundIds, held, err := unheldRoundIds(db, "round_members", rounds, holds)
+	if err != nil {
+		return result, err
+	}
+	result.Held += held
+	for _, batch := range batchRoundIds(roundIds) {
+		if err := db.Transaction(func(tx *gorm.DB) error { return archiveRounds(tx, batch, now) }); err != nil {
+			return result, err
+		}
+		result.Archived += len(batch)
+	}
+
+	if policy.PurgeAfter == 0 {
+		return result, nil
+	}
+	purgeCutoff := now.Add(-policy.PurgeAfter).UTC().Format(time.RFC3339)
+	var archived []ArchivedRound
+	if err := db.Where("round_timestamp < ?", purgeCutoff).Order("round_timestamp").Find(&archived).Error; err != nil {
+		return result, err
+	}
+	rounds = make([]Round, len(archived))
+	for i, round := range archived {
+		rounds[i] = round.Round
+	}
+	roundIds, held, err = unheldRoundIds(db, "archived_round_members", rounds, holds)
+	if err != nil {
+		return result, err
+	}
+	result.Held += held
+	for _, batch := range batchRoundIds(roundIds) {
+		if err := db.Transaction(func(tx *gorm.DB) error { return purgeArchivedRounds(tx, batch) }); err != nil {
+			return result, err
+		}
+		result.Purged += len(batch)
+	}
+
+	return result, nil
+}
+
+// Copy rounds and everything recorded against them to the archive tables, then remove them from the live tables
+// Deleting a round deletes its members and round types through their foreign keys; amendments are deleted here
+func archiveRounds(tx *gorm.DB, roundIds []uint, now time.Time) error {
+	archivedAt := now.UTC().Format(time.RFC3339)
+	for _, table := range archivedRoundTables {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(liveModelFor(table.live)); err != nil {
+			return err
+		}
+		columns := ""
+		for i, column := range stmt.Schema.DBNames {
+			if i > 0 {
+				columns += ", "
+			}
+			columns += tx.Statement.Quote(column)
+		}
+		archiveSQL := fmt.Sprintf("INSERT INTO %s (%s, archived_at) SELECT %s, ? FROM %s WHERE %s IN ?",
+			table.archive, columns, columns, table.live, table.roundId)
+		if err := tx.Exec(archiveSQL, archivedAt, roundIds).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Where("round_id IN ?", roundIds).Delete(&RoundAmendment{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("id IN ?", roundIds).Delete(&Round{}).Error
+}
+
+func purgeArchivedRounds(tx *gorm.DB, roundIds []uint) error {
+	for i := len(archivedRoundTables) - 1; i >= 0; i-- {
+		table := archivedRoundTables[i]
+		if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s IN ?", table.archive, table.roundId), roundIds).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func liveModelFor(table string) interface{} {
+	switch table {
+	case "rounds":
+		return &Round{}
+	case "round_round_types":
+		return &RoundRoundType{}
+	case "round_members":
+		return &RoundMember{}
+	default:
+		return &RoundAmendment{}
+	}
+}
+
+// The ids of rounds no hold covers, and how many rounds were held
+// membersTable is where to look for the patients on each round, live or archived
+func unheldRoundIds(db *gorm.DB, membersTable string, rounds []Round, holds []RetentionHold) ([]uint, int, error) {
+	// Patients on each round, for holds on a patient
+	var patientIds []string
+	for _, hold := range holds {
+		if hold.PatientId != "" {
+			patientIds = append(patientIds, hold.PatientId)
+		}
+	}
+	patientRounds := make(map[string]map[uint]bool)
+	if len(patientIds) > 0 && len(rounds) > 0 {
+		var members []RoundMember
+		err := db.Table(membersTable).Select("round_id, patient_id").Where("patient_id IN ?", patientIds).Find(&members).Error
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, member := range members {
+			if patientRounds[member.PatientId] == nil {
+				patientRounds[member.PatientId] = make(map[uint]bool)
+			}
+			patientRounds[member.PatientId][member.RoundId] = true
+		}
+	}
+
+	var roundIds []uint
+	held := 0
+	for _, round := range rounds {
+		isHeld := false
+		for _, hold := range holds {
+			if holdCoversRound(hold, round, patientRounds[hold.PatientId]) {
+				isHeld = true
+				break
+			}
+		}
+		if isHeld {
+			held++
+			continue
+		}
+		roundIds = append(roundIds, round.ID)
+	}
+	return roundIds, held, nil
+}
+
+func holdCoversRound(hold RetentionHold, round Round, patientRounds map[uint]bool) bool {
+	if hold.StartTime != "" && round.RoundTimestamp < hold.StartTime {
+		return false
+	}
+	if hold.EndTime != "" && round.RoundTimestamp > hold.EndTime {
+		return false
+	}
+	return hold.PatientId == "" || patientRounds[round.ID]
+}
+
+func batchRoundIds(roundIds []uint) [][]uint {
+	var batches [][]uint
+	for len(roundIds) > 0 {
+		n := min(len(roundIds), retentionBatchSize)
+		batches = append(batches, roundIds[:n])
+		roundIds = roundIds[n:]
+	}
+	return batches
+}
+
+// Holds that haven't been released
+func getActiveRetentionHolds(db *gorm.DB) ([]RetentionHold, error) {
+	var holds []RetentionHold
+	err := db.Where("released_at = ''").Order("id").Find(&holds).Error
+	return holds, err
+}
+
+// Place a legal or audit hold on a window of rounds, optionally only the ones a patient was on
+func PlaceRetentionHold(db *gorm.DB, hold RetentionHold, now time.Time) (RetentionHold, error) {
+	if !retentionHoldKinds[hold.Kind] {
+		return hold, fmt.Errorf("invalid hold kind %q, expected LEGAL_HOLD or AUDIT", hold.Kind)
+	}
+	if hold.Reason == "" {
+		return hold, fmt.Errorf("a hold needs a reason")
+	}
+	for _, value := range []string{hold.StartTime, hold.EndTime} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return hold, fmt.Errorf("invalid hold time %q, expected RFC3339", value)
+		}
+	}
+	if hold.StartTime != "" && hold.EndTime != "" && hold.EndTime < hold.StartTime {
+		return hold, fmt.Errorf("hold ends before it starts")
+	}
+
+	hold.ID = 0
+	hold.PlacedAt = now.UTC().Format(time.RFC3339)
+	hold.ReleasedAt = ""
+	if err := db.Create(&hold).Error; err != nil {
+		panic("Failed to create retention hold")
+	}
+	return hold, nil
+}
+
+// Lift a hold, so the rounds it covered are archived and purged on the policy's schedule again
+func ReleaseRetentionHold(db *gorm.DB, holdId uint, now time.Time) (RetentionHold, error) {
+	var hold RetentionHold
+	db.Where("id = ?", holdId).First(&hold)
+	if hold.ID == 0 {
+		return hold, fmt.Errorf("retention hold %d not found", holdId)
+	}
+	if hold.ReleasedAt != "" {
+		return hold, fmt.Errorf("retention hold %d was already released", holdId)
+	}
+
+	hold.ReleasedAt = now.UTC().Format(time.RFC3339)
+	if err := db.Save(&hold).Error; err != nil {
+		panic("Failed to release retention hold")
+	}
+	return hold, nil
+}
+
+// A session for reports that reads a round table together with its archive, aliased to the live table's name
+// Pass it to the data_utils getters in place of db, e.g. getRounds(withArchived(db, "rounds"), ...)
+func withArchived(db *gorm.DB, table string) *gorm.DB {
+	return db.Table("report_" + table + " AS " + table).Session(&gorm.Session{})
+}
+
+// Run the retention policy on an interval until the context is cancelled
+// Each run is for the time its tick fired
+func RunRetentionWorker(ctx context.Context, db *gorm.DB, clock Clock, policy RetentionPolicy, interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	now := clock.Now()
+	for {
+		if result, err := RunRetention(db, policy, now); err != nil {
+			log.Printf("Retention run failed: %v", err)
+		} else if result.Archived > 0 || result.Purged > 0 {
+			log.Printf("Retention archived %d rounds and purged %d, %d held", result.Archived, result.Purged, result.Held)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Rounds for the 12 hours up to 9:30 on Jan 10, with observations for patient 1 and an amendment at 22:00
+func setupRetentionRounds(t *testing.T) (*gorm.DB, func() string) {
+	t.Helper()
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC))
+
+	var rounds []Round
+	db.Order("round_timestamp").Find(&rounds)
+	for i, round := range rounds {
+		if i%2 == 0 {
+			db.Model(&RoundMember{}).Where("round_id = ? AND patient_id = ?", round.ID, "patient1").
+				Updates(map[string]interface{}{"observation": "sleeping", "observed_at": round.RoundTimestamp, "observed_by": "nurse1"})
+			db.Model(&round).Updates(map[string]interface{}{"status": "COMPLETE", "started_at": round.RoundTimestamp, "started_by": "nurse1"})
+		}
+	}
+	round, _ := getRoundForTime(db, time.Date(2022, time.January, 9, 22, 0, 0, 0, time.UTC))
+	db.Create(&RoundAmendment{RoundId: round.ID, Field: "status", OriginalValue: "CREATED", AmendedValue: "COMPLETE", LateEntry: true, AmendedAt: "2022-01-10T01:00:00Z"})
+
+	filter := ComplianceFilter{
+		StartTime: time.Date(2022, time.January, 9, 21, 30, 0, 0, time.UTC),
+		EndTime:   time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC),
+	}
+	// Everything reporting shows for the window, to check archiving doesn't change it
+	reported := func() string {
+		report, err := BuildComplianceReport(db, filter)
+		if err != nil {
+			t.Fatalf("Failed to build report: %v", err)
+		}
+		gaps, _ := FindObservationGaps(db, "patient1", filter.StartTime, filter.EndTime)
+		bundle, _ := BuildRoundsBundle(db, filter.StartTime, filter.EndTime, filter.EndTime)
+		var export bytes.Buffer
+		WriteExport(db, &export, ExportOptions{Dataset: "observations", StartTime: filter.StartTime, EndTime: filter.EndTime, Location: time.UTC})
+		out, _ := json.Marshal([]interface{}{report, gaps, bundle, export.String()})
+		return string(out)
+	}
+	return db, reported
+}
+
+func countRows(db *gorm.DB, table string) int64 {
+	var count int64
+	db.Table(table).Count(&count)
+	return count
+}
+
+func TestRunRetention(t *testing.T) {
+	db, reported := setupRetentionRounds(t)
+	before := reported()
+
+	// Patient 3 is on the hourly rounds at half past, and an audit covers 8:00 to 9:00
+	legalHold, err := PlaceRetentionHold(db, RetentionHold{Kind: "LEGAL_HOLD", PatientId: "patient3", Reason: "case 1234"}, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to place hold: %v", err)
+	}
+	audit, err := PlaceRetentionHold(db, RetentionHold{Kind: "AUDIT", StartTime: "2022-01-10T08:00:00Z", EndTime: "2022-01-10T09:00:00Z", Reason: "Q1 audit"}, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to place hold: %v", err)
+	}
+
+	now := time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)
+	policy := RetentionPolicy{ArchiveAfter: 30 * 24 * time.Hour}
+	result, err := RunRetention(db, policy, now)
+	if err != nil {
+		t.Fatalf("Retention failed: %v", err)
+	}
+	// 13 rounds with patient 3, and 8:00, 8:15, 8:45 and 9:00 for the audit
+	if result != (RetentionResult{Archived: 32, Held: 17}) {
+		t.Errorf("Expected 32 archived and 17 held, got %+v", result)
+	}
+	if live, archived := countRows(db, "rounds"), countRows(db, "archived_rounds"); live != 17 || archived != 32 {
+		t.Errorf("Expected 17 live and 32 archived rounds, got %d and %d", live, archived)
+	}
+	if live, archived := countRows(db, "round_members"), countRows(db, "archived_round_members"); live+archived != 87 || archived == 0 {
+		t.Errorf("Expected the 87 members split between live and archived, got %d and %d", live, archived)
+	}
+	if live, archived := countRows(db, "round_round_types"), countRows(db, "archived_round_round_types"); live+archived != 87 || archived == 0 {
+		t.Errorf("Expected the 87 round types split between live and archived, got %d and %d", live, archived)
+	}
+	if live, archived := countRows(db, "round_amendments"), countRows(db, "archived_round_amendments"); live != 0 || archived != 1 {
+		t.Errorf("Expected the amendment to be archived, got %d live and %d archived", live, archived)
+	}
+
+	// Reports read the archive, so nothing changes
+	if after := reported(); after != before {
+		t.Errorf("Expected reports to be unchanged by archiving\nbefore %s\nafter  %s", before, after)
+	}
+
+	// Running again with nothing newly due does nothing
+	if result, _ := RunRetention(db, policy, now); result != (RetentionResult{Held: 17}) {
+		t.Errorf("Expected nothing to do, got %+v", result)
+	}
+
+	// With the audit over, its rounds are archived. A hold on rounds that are already archived keeps them from being purged
+	if _, err := ReleaseRetentionHold(db, audit.ID, time.Now()); err != nil {
+		t.Fatalf("Failed to release hold: %v", err)
+	}
+	if _, err := ReleaseRetentionHold(db, audit.ID, time.Now()); err == nil {
+		t.Errorf("Expected an error releasing a hold twice")
+	}
+	PlaceRetentionHold(db, RetentionHold{Kind: "LEGAL_HOLD", StartTime: "2022-01-09T22:00:00Z", EndTime: "2022-01-09T22:15:00Z", Reason: "case 5678"}, time.Now())
+
+	policy.PurgeAfter = 40 * 24 * time.Hour
+	result, err = RunRetention(db, policy, now)
+	if err != nil {
+		t.Fatalf("Retention failed: %v", err)
+	}
+	if result != (RetentionResult{Archived: 4, Purged: 34, Held: 15}) {
+		t.Errorf("Expected 4 archived, 34 purged and 15 held, got %+v", result)
+	}
+	if live, archived := countRows(db, "rounds"), countRows(db, "archived_rounds"); live != 13 || archived != 2 {
+		t.Errorf("Expected patient 3's 13 rounds live and 2 held in the archive, got %d and %d", live, archived)
+	}
+	if archived := countRows(db, "archived_round_amendments"); archived != 1 {
+		t.Errorf("Expected the held round's amendment to be kept, got %d", archived)
+	}
+	var orphans int64
+	db.Table("archived_round_members").Where("round_id NOT IN (SELECT id FROM archived_rounds)").Count(&orphans)
+	if orphans != 0 {
+		t.Errorf("Expected purged rounds' members to be purged, got %d left", orphans)
+	}
+
+	// The legal hold is never released, so patient 3's rounds stay put
+	if holds, _ := getActiveRetentionHolds(db); len(holds) != 2 || holds[0].ID != legalHold.ID {
+		t.Errorf("Expected 2 holds in effect, got %+v", holds)
+	}
+}
+
+func TestRetentionValidation(t *testing.T) {
+	db := setupDatabase()
+
+	policies := []RetentionPolicy{
+		{},
+		{ArchiveAfter: -time.Hour},
+		{ArchiveAfter: 48 * time.Hour, PurgeAfter: 24 * time.Hour},
+		// Inside the window CreateRounds backfills and the board reads from the live tables
+		{ArchiveAfter: time.Minute},
+		{ArchiveAfter: 12 * time.Hour},
+		{ArchiveAfter: minRetentionArchiveAfter - time.Second},
+	}
+	for _, policy := range policies {
+		if _, err := RunRetention(db, policy, time.Now()); err == nil {
+			t.Errorf("Expected an error for %+v", policy)
+		}
+	}
+	if _, err := RunRetention(db, RetentionPolicy{ArchiveAfter: minRetentionArchiveAfter}, time.Now()); err != nil {
+		t.Errorf("Expected archiving after %v to be allowed, got %v", minRetentionArchiveAfter, err)
+	}
+
+	holds := []RetentionHold{
+		{Kind: "HOLD", Reason: "case 1234"},
+		{Kind: "LEGAL_HOLD"},
+		{Kind: "AUDIT", Reason: "audit", StartTime: "yesterday"},
+		{Kind: "AUDIT", Reason: "audit", StartTime: "2022-01-10T09:00:00Z", EndTime: "2022-01-10T08:00:00Z"},
+	}
+	for _, hold := range holds {
+		if _, err := PlaceRetentionHold(db, hold, time.Now()); err == nil {
+			t.Errorf("Expected an error for %+v", hold)
+		}
+	}
+	if _, err := ReleaseRetentionHold(db, 99, time.Now()); err == nil {
+		t.Errorf("Expected an error releasing a hold that doesn't exist")
+	}
+}
+
+func TestRunRetentionWorker(t *testing.T) {
+	db, _ := setupRetentionRounds(t)
+	policy := RetentionPolicy{ArchiveAfter: 30 * 24 * time.Hour}
+
+	// Rounds up to 2:00 on Jan 10 are due when the worker starts, and up to 6:00 four hourly runs later
+	clock := NewFakeClock(time.Date(2022, time.February, 9, 2, 0, 0, 0, time.UTC))
+	var due int64
+	db.Model(&Round{}).Where("round_timestamp < ?", "2022-01-10T06:00:00Z").Count(&due)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunRetentionWorker(ctx, db, clock, policy, time.Hour)
+		close(done)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(4 * time.Hour)
+	cancel()
+	<-done
+
+	if archived := countRows(db, "archived_rounds"); archived != due {
+		t.Errorf("Expected the %d rounds before 6:00 archived, got %d", due, archived)
+	}
+	var early int64
+	db.Model(&Round{}).Where("round_timestamp < ?", "2022-01-10T06:00:00Z").Count(&early)
+	if early != 0 {
+		t.Errorf("Expected no live rounds before 6:00, got %d", early)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Add a round type. Only minute durations are supported, as in CreateRounds
+func AddRoundType(db *gorm.DB, roundType RoundType) (RoundType, error) {
+	if roundType.Name == "" {
+		return roundType, errors.New("round type name is required")
+	}
+	if roundType.DurationUnit == "" {
+		roundType.DurationUnit = "minutes"
+	}
+	if roundType.DurationUnit != "minutes" {
+		return roundType, fmt.Errorf("invalid duration unit %q, only minutes is supported", roundType.DurationUnit)
+	}
+	if roundType.DurationAmt <= 0 {
+		return roundType, fmt.Errorf("invalid duration %d, expected a positive number of minutes", roundType.DurationAmt)
+	}
+
+	roundType.ID = 0
+	if err := db.Create(&roundType).Error; err != nil {
+		return roundType, err
+	}
+	return roundType, nil
+}
+
+// Add a round config for a round type, for one unit or the whole clinic
+func AddRoundConfig(db *gorm.DB, roundConfig RoundConfig) (RoundConfig, error) {
+	roundType, err := getRoundType(db, roundConfig.RoundTypeId)
+	if err != nil {
+		panic("Failed to get round type")
+	}
+	if roundType.ID == 0 {
+		return roundConfig, fmt.Errorf("round type %d not found", roundConfig.RoundTypeId)
+	}
+	if err := validateRoundConfigWindow(roundConfig.WindowStart, roundConfig.WindowEnd); err != nil {
+		return roundConfig, err
+	}
+
+	roundConfig.ID = 0
+	if err := db.Create(&roundConfig).Error; err != nil {
+		return roundConfig, err
+	}
+	return roundConfig, nil
+}
+
+// Check a round config's window is either empty, or two different HH:MM times
+func validateRoundConfigWindow(windowStart string, windowEnd string) error {
+	if windowStart == "" && windowEnd == "" {
+		return nil
+	}
+	for _, value := range []string{windowStart, windowEnd} {
+		parsed, err := time.Parse("15:04", value)
+		if err != nil || parsed.Format("15:04") != value {
+			return fmt.Errorf("invalid window time %q, expected HH:MM with both a start and an end", value)
+		}
+	}
+	if windowStart == windowEnd {
+		return fmt.Errorf("window start and end are both %s, leave them empty to schedule rounds all day", windowStart)
+	}
+	return nil
+}
+
+// Whether a round config schedules rounds at a time, from its window start (inclusive) up to its end (exclusive)
+func roundConfigActiveAt(roundConfig RoundConfig, t time.Time) bool {
+	if roundConfig.WindowStart == "" {
+		return true
+	}
+	clock := t.UTC().Format("15:04")
+	if roundConfig.WindowStart < roundConfig.WindowEnd {
+		return clock >= roundConfig.WindowStart && clock < roundConfig.WindowEnd
+	}
+	return clock >= roundConfig.WindowStart || clock < roundConfig.WindowEnd
+}
+
+// Get the times a round config's window opens or closes strictly between start time and end time
+func roundConfigWindowBoundaries(roundConfig RoundConfig, startTime time.Time, endTime time.Time) []time.Time {
+	var boundaries []time.Time
+	if roundConfig.WindowStart == "" {
+		return boundaries
+	}
+	day := startTime.UTC().Truncate(24 * time.Hour)
+	for ; day.Before(endTime); day = day.Add(24 * time.Hour) {
+		for _, value := range []string{roundConfig.WindowStart, roundConfig.WindowEnd} {
+			clock, _ := time.Parse("15:04", value)
+			t := day.Add(time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute)
+			if t.After(startTime) && t.Before(endTime) {
+				boundaries = append(boundaries, t)
+			}
+		}
+	}
+	return boundaries
+}
+
+// Describe a round config's window for the CLI and config changes
+func roundConfigWindowString(windowStart string, windowEnd string) string {
+	if windowStart == "" {
+		return "all day"
+	}
+	return windowStart + "-" + windowEnd
+}
+
+// Turn a round config on or off. Rounds already created are left as they are
+func SetRoundConfigEnabled(db *gorm.DB, roundConfigId uint, enabled bool) (RoundConfig, error) {
+	var roundConfig RoundConfig
+	db.Where("id = ?", roundConfigId).First(&roundConfig)
+	if roundConfig.ID == 0 {
+		return roundConfig, fmt.Errorf("round config %d not found", roundConfigId)
+	}
+
+	roundConfig.Enabled = enabled
+	if err := db.Model(&roundConfig).Update("enabled", enabled).Error; err != nil {
+		return roundConfig, err
+	}
+	return roundConfig, nil
+}
+
+// Seed demo data: 15, 30 and 60 minute round types with a clinic-wide config each,
+// patient1 on all three, patient2 on 30 minute rounds and patient3 on 60 minute rounds, with no start or end
+// A database that already has round types is left alone, so seeding twice does nothing. Returns whether it seeded
+func SeedDemoData(db *gorm.DB) (bool, error) {
+	var count int64
+	if err := db.Model(&RoundType{}).Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		roundTypeIds := make(map[int]uint)
+		for _, minutes := range []int{15, 30, 60} {
+			roundType, err := AddRoundType(tx, RoundType{
+				Name:         fmt.Sprintf("%d Minute Round", minutes),
+				DurationAmt:  minutes,
+				DurationUnit: "minutes",
+			})
+			if err != nil {
+				return err
+			}
+			roundTypeIds[minutes] = roundType.ID
+			if _, err := AddRoundConfig(tx, RoundConfig{RoundTypeId: roundType.ID, Enabled: true}); err != nil {
+				return err
+			}
+		}
+
+		assignments := []struct {
+			patientId string
+			minutes   int
+		}{
+			{"patient1", 15}, {"patient1", 30}, {"patient1", 60},
+			{"patient2", 30},
+			{"patient3", 60},
+		}
+		for _, assignment := range assignments {
+			roundAssignment := RoundAssignment{RoundTypeId: roundTypeIds[assignment.minutes], PatientId: assignment.patientId}
+			if err := tx.Create(&roundAssignment).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err == nil, err
+}
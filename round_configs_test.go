@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddRoundTypeAndConfig(t *testing.T) {
+	db := setupDatabase()
+
+	roundType, err := AddRoundType(db, RoundType{Name: "20 Minute Round", DurationAmt: 20})
+	if err != nil {
+		t.Fatalf("Failed to add round type: %v", err)
+	}
+	if roundType.ID == 0 || roundType.DurationUnit != "minutes" {
+		t.Errorf("Expected a saved round type in minutes, got %+v", roundType)
+	}
+
+	roundTypes := []RoundType{
+		{DurationAmt: 15},
+		{Name: "Hourly", DurationAmt: 1, DurationUnit: "hours"},
+		{Name: "Never", DurationAmt: 0},
+	}
+	for _, invalid := range roundTypes {
+		if _, err := AddRoundType(db, invalid); err == nil {
+			t.Errorf("Expected an error for %+v", invalid)
+		}
+	}
+
+	roundConfig, err := AddRoundConfig(db, RoundConfig{RoundTypeId: roundType.ID, Enabled: true, Unit: "4 West"})
+	if err != nil {
+		t.Fatalf("Failed to add round config: %v", err)
+	}
+	if _, err := AddRoundConfig(db, RoundConfig{RoundTypeId: 99, Enabled: true}); err == nil {
+		t.Errorf("Expected an error for a round type that doesn't exist")
+	}
+
+	roundConfig, err = SetRoundConfigEnabled(db, roundConfig.ID, false)
+	if err != nil || roundConfig.Enabled {
+		t.Errorf("Expected the config to be turned off, got %+v and %v", roundConfig, err)
+	}
+	roundConfigs, _ := getRoundConfigs(db)
+	if len(roundConfigs) != 1 || roundConfigs[0].Enabled || roundConfigs[0].Unit != "4 West" {
+		t.Errorf("Expected the saved config turned off, got %+v", roundConfigs)
+	}
+	if _, err := SetRoundConfigEnabled(db, 99, true); err == nil {
+		t.Errorf("Expected an error for a round config that doesn't exist")
+	}
+}
+
+// Seeded data creates the same rounds as the setupRoundConfigs test data
+func TestSeedDemoData(t *testing.T) {
+	currTime := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+
+	expectedDb := setupDatabase()
+	setupRoundConfigs(expectedDb)
+	expected, _ := createRoundsAt(expectedDb, currTime)
+	var expectedMembers int64
+	expectedDb.Model(&RoundMember{}).Count(&expectedMembers)
+
+	db := setupDatabase()
+	seeded, err := SeedDemoData(db)
+	if err != nil || !seeded {
+		t.Fatalf("Expected to seed, got %v and %v", seeded, err)
+	}
+	created, err := createRoundsAt(db, currTime)
+	if err != nil || created != expected {
+		t.Errorf("Expected %d rounds, got %d and %v", expected, created, err)
+	}
+	var members int64
+	db.Model(&RoundMember{}).Count(&members)
+	if members != expectedMembers {
+		t.Errorf("Expected %d round members, got %d", expectedMembers, members)
+	}
+
+	// Seeding again leaves the data alone
+	seeded, err = SeedDemoData(db)
+	if err != nil || seeded {
+		t.Errorf("Expected nothing seeded the second time, got %v and %v", seeded, err)
+	}
+	if count := countRows(db, "round_types"); count != 3 {
+		t.Errorf("Expected 3 round types, got %d", count)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How often the live feed checks the outbox for new events, and how often it sends a keepalive when there are none
+// A client more than roundFeedBuffer batches behind is dropped, and resumes from its last event id when it reconnects
+const (
+	roundFeedPollInterval = 500 * time.Millisecond
+	roundFeedKeepalive    = 15 * time.Second
+	roundFeedBatchSize    = 100
+	roundFeedBuffer       = 16
+)
+
+// A change to the rounds board. Id is the outbox event id, which clients send back as Last-Event-ID to resume
+type RoundFeedEvent struct {
+	Id   uint            `json:"id"`
+	Type string          `json:"type"`
+	Item StartRoundsItem `json:"item"`
+}
+
+// Get the round feed events after an outbox event id, for a unit or the whole clinic if unit is empty
+// A round is on a unit's board if a config for the unit (or the whole clinic) scheduled it, or it has a member on the unit
+func getRoundFeedEvents(db *gorm.DB, afterId uint, unit string, limit int) ([]RoundFeedEvent, error) {
+	feedEvents := []RoundFeedEvent{}
+
+	query := db.Where("id > ?", afterId).Order("id").Limit(limit)
+	if unit != "" {
+		query = query.Where("(EXISTS (SELECT 1 FROM round_round_types JOIN round_configs ON round_configs.round_type_id = round_round_types.round_type_id "+
+			"WHERE round_round_types.round_id = outbox_events.round_id "+
+			"AND round_configs.enabled = ? AND (round_configs.unit = ? OR round_configs.unit = '')) "+
+			"OR EXISTS (SELECT 1 FROM round_members WHERE round_members.round_id = outbox_events.round_id AND round_members.unit = ?))",
+			true, unit, unit)
+	}
+	var events []OutboxEvent
+	if err := query.Find(&events).Error; err != nil {
+		return feedEvents, err
+	}
+
+	var roundIds []uint
+	for _, event := range events {
+		roundIds = append(roundIds, event.RoundId)
+	}
+	amendments, err := getAmendmentsForRounds(db, roundIds)
+	if err != nil {
+		return feedEvents, err
+	}
+
+	for _, event := range events {
+		var payload RoundEventPayload
+		if err := json.Unmarshal([]byte(event.Payload), &payload); err != nil {
+			return feedEvents, err
+		}
+
+		// Flag amendments made up to this event, the same way StartRounds does
+		item := StartRoundsItem{
+			RoundTimestamp: payload.Round.RoundTimestamp,
+			Status:         payload.Round.Status,
+		}
+		for _, amendment := range amendments {
+			if amendment.RoundId != event.RoundId || amendment.AmendedAt > event.OccurredAt {
+				continue
+			}
+			if amendment.LateEntry {
+				item.LateCharted = true
+			} else {
+				item.Amended = true
+			}
+		}
+
+		feedEvents = append(feedEvents, RoundFeedEvent{Id: event.ID, Type: event.EventType, Item: item})
+	}
+	return feedEvents, nil
+}
+
+// Get the id of the latest outbox event, where a new feed starts when the client has nothing to resume from
+func getLastOutboxEventId(db *gorm.DB) (uint, error) {
+	var event OutboxEvent
+	db.Order("id desc").Limit(1).Find(&event)
+	return event.ID, nil
+}
+
+// One poller per database, shared by every SSE and gRPC client watching the rounds board
+var (
+	roundFeedsMu sync.Mutex
+	roundFeeds   = make(map[*gorm.DB]*roundFeed)
+)
+
+// Polls the outbox every roundFeedPollInterval, once for each unit someone is watching, and hands the events to
+// the unit's subscribers. It starts with the first subscriber and stops when the last one leaves
+// units is guarded by roundFeedsMu
+type roundFeed struct {
+	db    *gorm.DB
+	clock Clock
+	units map[string]*roundFeedUnit
+	stop  chan struct{}
+}
+
+// LastId is the last outbox event id the poller has handed to the unit's subscribers
+type roundFeedUnit struct {
+	lastId      uint
+	subscribers map[*roundFeedSubscriber]bool
+}
+
+// Events brings batches from the poller, and is closed if the subscriber falls more than roundFeedBuffer behind
+// A subscriber that starts behind the poller reads the events up to catchUpTo from the database itself first
+type roundFeedSubscriber struct {
+	feed      *roundFeed
+	unit      string
+	events    chan []RoundFeedEvent
+	afterId   uint
+	catchUpTo uint
+}
+
+// Subscribe to the round feed events after an outbox event id, for a unit or the whole clinic if unit is empty
+// The poller starts from the latest outbox event, not the client's id, and an id past the latest event is treated
+// as the latest, so a stale or made up id can't hold the feed up for everyone else watching the unit
+func subscribeRoundFeed(db *gorm.DB, clock Clock, unit string, afterId uint) (*roundFeedSubscriber, error) {
+	lastId, err := getLastOutboxEventId(db)
+	if err != nil {
+		return nil, err
+	}
+	if afterId > lastId {
+		afterId = lastId
+	}
+
+	roundFeedsMu.Lock()
+	defer roundFeedsMu.Unlock()
+
+	feed, ok := roundFeeds[db]
+	if !ok {
+		feed = &roundFeed{db: db, clock: clock, units: make(map[string]*roundFeedUnit), stop: make(chan struct{})}
+		roundFeeds[db] = feed
+		go feed.run()
+	}
+	feedUnit, ok := feed.units[unit]
+	if !ok {
+		feedUnit = &roundFeedUnit{lastId: lastId, subscribers: make(map[*roundFeedSubscriber]bool)}
+		feed.units[unit] = feedUnit
+	}
+
+	subscriber := &roundFeedSubscriber{
+		feed:      feed,
+		unit:      unit,
+		events:    make(chan []RoundFeedEvent, roundFeedBuffer),
+		afterId:   afterId,
+		catchUpTo: feedUnit.lastId,
+	}
+	feedUnit.subscribers[subscriber] = true
+	return subscriber, nil
+}
+
+// Stop getting events, stopping the poller if this was the last subscriber
+func (s *roundFeedSubscriber) unsubscribe() {
+	roundFeedsMu.Lock()
+	defer roundFeedsMu.Unlock()
+
+	feedUnit, ok := s.feed.units[s.unit]
+	if !ok {
+		return
+	}
+	delete(feedUnit.subscribers, s)
+	if len(feedUnit.subscribers) == 0 {
+		delete(s.feed.units, s.unit)
+	}
+	if len(s.feed.units) == 0 && roundFeeds[s.feed.db] == s.feed {
+		delete(roundFeeds, s.feed.db)
+		close(s.feed.stop)
+	}
+}
+
+// Send the events from the subscriber's starting point up to where the poller was when it subscribed, a batch at a time
+func (s *roundFeedSubscriber) catchUp(send func([]RoundFeedEvent) error) error {
+	for s.afterId < s.catchUpTo {
+		feedEvents, err := getRoundFeedEvents(s.feed.db, s.afterId, s.unit, roundFeedBatchSize)
+		if err != nil {
+			return err
+		}
+		var batch []RoundFeedEvent
+		for _, feedEvent := range feedEvents {
+			if feedEvent.Id <= s.catchUpTo {
+				batch = append(batch, feedEvent)
+			}
+		}
+		if len(batch) > 0 {
+			if err := send(batch); err != nil {
+				return err
+			}
+			s.afterId = batch[len(batch)-1].Id
+		}
+		if len(batch) < roundFeedBatchSize {
+			s.afterId = s.catchUpTo
+		}
+	}
+	return nil
+}
+
+// Drop the events in a batch from the poller that the subscriber has already sent
+func (s *roundFeedSubscriber) unseen(feedEvents []RoundFeedEvent) []RoundFeedEvent {
+	var batch []RoundFeedEvent
+	for _, feedEvent := range feedEvents {
+		if feedEvent.Id > s.afterId {
+			batch = append(batch, feedEvent)
+			s.afterId = feedEvent.Id
+		}
+	}
+	return batch
+}
+
+func (f *roundFeed) run() {
+	ticker := f.clock.NewTicker(roundFeedPollInterval)
+	defer ticker.Stop()
+	for {
+		f.poll()
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// Fetch each watched unit's new events and hand them to its subscribers. A failed query is tried again next tick
+func (f *roundFeed) poll() {
+	roundFeedsMu.Lock()
+	lastIds := make(map[string]uint)
+	for unit, feedUnit := range f.units {
+		lastIds[unit] = feedUnit.lastId
+	}
+	roundFeedsMu.Unlock()
+
+	for unit, lastId := range lastIds {
+		// A full batch means there is more to catch up on
+		for {
+			feedEvents, err := getRoundFeedEvents(f.db, lastId, unit, roundFeedBatchSize)
+			if err != nil || len(feedEvents) == 0 {
+				break
+			}
+
+			roundFeedsMu.Lock()
+			feedUnit, ok := f.units[unit]
+			// Everyone watching the unit left, and maybe came back, while the query ran
+			if !ok || feedUnit.lastId != lastId {
+				roundFeedsMu.Unlock()
+				break
+			}
+			lastId = feedEvents[len(feedEvents)-1].Id
+			feedUnit.lastId = lastId
+			for subscriber := range feedUnit.subscribers {
+				select {
+				case subscriber.events <- feedEvents:
+				default:
+					close(subscriber.events)
+					delete(feedUnit.subscribers, subscriber)
+				}
+			}
+			roundFeedsMu.Unlock()
+
+			if len(feedEvents) < roundFeedBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// Stream round feed events to a client as server-sent events until it disconnects
+// The client resumes with the Last-Event-ID header (sent by EventSource on reconnect) or a lastEventId query param
+func serveRoundFeed(db *gorm.DB, clock Clock, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	var afterId uint
+	if lastEventId != "" {
+		parsed, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid last event id %q", lastEventId))
+			return
+		}
+		afterId = uint(parsed)
+	} else {
+		id, err := getLastOutboxEventId(db)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		afterId = id
+	}
+	unit := r.URL.Query().Get("unit")
+
+	subscriber, err := subscribeRoundFeed(db, clock, unit, afterId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer subscriber.unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// Tell EventSource how long to wait before reconnecting
+	fmt.Fprintf(w, "retry: %d\n\n", (2 * time.Second).Milliseconds())
+	flusher.Flush()
+
+	sent := false
+	send := func(feedEvents []RoundFeedEvent) error {
+		for _, feedEvent := range feedEvents {
+			data, _ := json.Marshal(feedEvent)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", feedEvent.Id, feedEvent.Type, data)
+		}
+		if len(feedEvents) > 0 {
+			flusher.Flush()
+			sent = true
+		}
+		return nil
+	}
+	if err := subscriber.catchUp(send); err != nil {
+		return
+	}
+
+	// A keepalive goes out on each tick that follows a whole interval with no events
+	ticker := clock.NewTicker(roundFeedKeepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case feedEvents, ok := <-subscriber.events:
+			// Dropped for falling behind, so end the stream and let EventSource resume from the last event id
+			if !ok {
+				return
+			}
+			send(subscriber.unseen(feedEvents))
+		case <-ticker.C():
+			if !sent {
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			}
+			sent = false
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Hourly rounds on unit A and half-hourly rounds on unit B, created up to 9:00
+func setupRoundFeed(t *testing.T) *gorm.DB {
+	db := setupDatabase()
+	db.Create(&RoundType{ID: 1, Name: "60 Minute Round", DurationAmt: 60, DurationUnit: "minutes"})
+	db.Create(&RoundType{ID: 2, Name: "30 Minute Round", DurationAmt: 30, DurationUnit: "minutes"})
+	db.Create(&RoundConfig{RoundTypeId: 1, Enabled: true, Unit: "A"})
+	db.Create(&RoundConfig{RoundTypeId: 2, Enabled: true, Unit: "B"})
+	CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC))
+	return db
+}
+
+func TestGetRoundFeedEvents(t *testing.T) {
+	db := setupRoundFeed(t)
+
+	// From 21:00 to 9:00 there are 13 hourly rounds and 25 half-hourly ones
+	tests := []struct {
+		unit     string
+		expected int
+	}{
+		{"", 25},
+		{"A", 13},
+		{"B", 25},
+		{"C", 0},
+	}
+	for _, tt := range tests {
+		feedEvents, err := getRoundFeedEvents(db, 0, tt.unit, 1000)
+		if err != nil {
+			t.Fatalf("getRoundFeedEvents failed: %v", err)
+		}
+		if len(feedEvents) != tt.expected {
+			t.Errorf("Expected %d events for unit %q, got %d", tt.expected, tt.unit, len(feedEvents))
+		}
+	}
+
+	lastEventId, _ := getLastOutboxEventId(db)
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	if _, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(time.Minute)); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	if _, err := AmendRoundStatus(NewGormRoundsStore(db), roundTime.Add(-30*time.Minute), "COMPLETE", "LATE_ENTRY", "", "nurseA", roundTime.Add(10*time.Minute)); err != nil {
+		t.Fatalf("AmendRoundStatus failed: %v", err)
+	}
+
+	// Resuming from the last event only gets what happened since. The 8:30 round is only on unit B
+	expected := map[string][]StartRoundsItem{
+		"A": {
+			{RoundTimestamp: "2022-01-10T09:00:00Z", Status: "STARTED"},
+		},
+		"B": {
+			{RoundTimestamp: "2022-01-10T09:00:00Z", Status: "STARTED"},
+			{RoundTimestamp: "2022-01-10T08:30:00Z", Status: "COMPLETE", LateCharted: true},
+		},
+	}
+	for unit, expectedItems := range expected {
+		feedEvents, err := getRoundFeedEvents(db, lastEventId, unit, 1000)
+		if err != nil {
+			t.Fatalf("getRoundFeedEvents failed: %v", err)
+		}
+		if len(feedEvents) != len(expectedItems) {
+			t.Fatalf("Expected %d events for unit %s, got %+v", len(expectedItems), unit, feedEvents)
+		}
+		for i, item := range expectedItems {
+			if feedEvents[i].Item != item {
+				t.Errorf("Expected %+v for unit %s, got %+v", item, unit, feedEvents[i].Item)
+			}
+		}
+	}
+}
+
+// Read server-sent events from a stream until count events have arrived
+func readRoundFeed(t *testing.T, url string, lastEventId string, count int) []RoundFeedEvent {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	var feedEvents []RoundFeedEvent
+	var id, eventType string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(feedEvents) < count && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var feedEvent RoundFeedEvent
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &feedEvent); err != nil {
+				t.Fatalf("Invalid event data: %v", err)
+			}
+			if strconv.FormatUint(uint64(feedEvent.Id), 10) != id || feedEvent.Type != eventType {
+				t.Errorf("Expected the id and event lines to match the data, got %s %s %+v", id, eventType, feedEvent)
+			}
+			feedEvents = append(feedEvents, feedEvent)
+		}
+	}
+	if len(feedEvents) < count {
+		t.Fatalf("Expected %d events, got %d", count, len(feedEvents))
+	}
+	return feedEvents
+}
+
+func TestRoundFeedStream(t *testing.T) {
+	db := setupRoundFeed(t)
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	defer server.Close()
+
+	// Replay unit A's board from the beginning
+	feedEvents := readRoundFeed(t, server.URL+"/start-round-items/stream?unit=A&lastEventId=0", "", 13)
+	if feedEvents[0].Item.RoundTimestamp != "2022-01-09T21:00:00Z" || feedEvents[12].Item.RoundTimestamp != "2022-01-10T09:00:00Z" {
+		t.Errorf("Expected unit A's rounds from 21:00 to 9:00, got %+v to %+v", feedEvents[0], feedEvents[12])
+	}
+
+	// Reconnecting with the last event id picks up a round started while disconnected
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	if _, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(time.Minute)); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	lastEventId := strconv.FormatUint(uint64(feedEvents[12].Id), 10)
+	feedEvents = readRoundFeed(t, server.URL+"/start-round-items/stream?unit=A", lastEventId, 1)
+	if feedEvents[0].Type != "round.started" || feedEvents[0].Item.Status != "STARTED" {
+		t.Errorf("Expected the 9:00 round to be started, got %+v", feedEvents[0])
+	}
+
+	// A live client hears about a round completed after it connected
+	go func() {
+		time.Sleep(2 * roundFeedPollInterval)
+		CompleteRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(5*time.Minute))
+	}()
+	feedEvents = readRoundFeed(t, server.URL+"/start-round-items/stream?unit=A", "", 1)
+	if feedEvents[0].Type != "round.completed" {
+		t.Errorf("Expected the 9:00 round to be completed, got %+v", feedEvents[0])
+	}
+}
+
+// A quiet feed sends a keepalive once roundFeedKeepalive has passed on the server's clock, and not before
+func TestRoundFeedKeepalive(t *testing.T) {
+	db := setupRoundFeed(t)
+	clock := NewFakeClock(time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC))
+	server := httptest.NewServer(newServer(db, clock))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/start-round-items/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				lines <- scanner.Text()
+			}
+		}
+		close(lines)
+	}()
+	if line := <-lines; !strings.HasPrefix(line, "retry: ") {
+		t.Fatalf("Expected the retry line first, got %q", line)
+	}
+
+	// The shared poller's ticker and the stream's keepalive ticker. Once the poller has had its ticks up to just
+	// before the keepalive is due, nothing has been sent
+	clock.BlockUntil(2)
+	clock.Advance(roundFeedKeepalive - roundFeedPollInterval)
+	select {
+	case line := <-lines:
+		t.Fatalf("Expected nothing before the keepalive is due, got %q", line)
+	default:
+	}
+
+	clock.Advance(roundFeedPollInterval)
+	if line := <-lines; line != ": keepalive" {
+		t.Errorf("Expected a keepalive, got %q", line)
+	}
+}
+
+func mustSubscribeRoundFeed(t *testing.T, db *gorm.DB, clock Clock, unit string, afterId uint) *roundFeedSubscriber {
+	t.Helper()
+	subscriber, err := subscribeRoundFeed(db, clock, unit, afterId)
+	if err != nil {
+		t.Fatalf("subscribeRoundFeed failed: %v", err)
+	}
+	return subscriber
+}
+
+// Every client watching the board shares one poller, which stops when the last of them leaves
+func TestRoundFeedSharesOnePoller(t *testing.T) {
+	db := setupRoundFeed(t)
+	clock := NewFakeClock(time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC))
+	lastEventId, _ := getLastOutboxEventId(db)
+
+	var subscribers []*roundFeedSubscriber
+	for i := 0; i < 3; i++ {
+		subscribers = append(subscribers, mustSubscribeRoundFeed(t, db, clock, "A", lastEventId))
+	}
+	subscribers = append(subscribers, mustSubscribeRoundFeed(t, db, clock, "B", lastEventId))
+	clock.BlockUntil(1)
+	roundFeedsMu.Lock()
+	if len(clock.waiters) != 1 || len(roundFeeds[db].units) != 2 || len(roundFeeds[db].units["A"].subscribers) != 3 {
+		t.Errorf("Expected one poller for units A and B, got %d tickers and %+v", len(clock.waiters), roundFeeds[db].units)
+	}
+	roundFeedsMu.Unlock()
+
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	if _, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(time.Minute)); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	clock.Advance(roundFeedPollInterval)
+	for _, subscriber := range subscribers {
+		select {
+		case feedEvents := <-subscriber.events:
+			if len(feedEvents) != 1 || feedEvents[0].Type != "round.started" {
+				t.Errorf("Expected the 9:00 round started on unit %s, got %+v", subscriber.unit, feedEvents)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected an event on unit %s", subscriber.unit)
+		}
+	}
+
+	// A client resuming from further back reads what it missed itself, then joins the poller
+	late := mustSubscribeRoundFeed(t, db, clock, "A", 0)
+	var caughtUp []RoundFeedEvent
+	err := late.catchUp(func(feedEvents []RoundFeedEvent) error {
+		caughtUp = append(caughtUp, feedEvents...)
+		return nil
+	})
+	if err != nil || len(caughtUp) != 14 || caughtUp[13].Type != "round.started" {
+		t.Errorf("Expected unit A's 13 rounds and the start, got %d events and %v", len(caughtUp), err)
+	}
+
+	for _, subscriber := range append(subscribers, late) {
+		subscriber.unsubscribe()
+	}
+	roundFeedsMu.Lock()
+	if _, ok := roundFeeds[db]; ok {
+		t.Errorf("Expected the poller to stop with no one watching")
+	}
+	roundFeedsMu.Unlock()
+}
+
+// A client that stops reading is dropped once it's roundFeedBuffer batches behind, rather than holding up the rest
+func TestRoundFeedDropsSlowSubscriber(t *testing.T) {
+	db := setupRoundFeed(t)
+	clock := NewFakeClock(time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC))
+	lastEventId, _ := getLastOutboxEventId(db)
+	subscriber := mustSubscribeRoundFeed(t, db, clock, "", lastEventId)
+	defer subscriber.unsubscribe()
+	clock.BlockUntil(1)
+
+	store := NewGormRoundsStore(db)
+	for i := 0; i <= roundFeedBuffer; i++ {
+		round := Round{RoundTimestamp: time.Date(2022, time.January, 10, 10, i, 0, 0, time.UTC).Format(time.RFC3339), Status: "CREATED"}
+		if err := store.CreateRound(&round, clock.Now()); err != nil {
+			t.Fatalf("CreateRound failed: %v", err)
+		}
+		// The poller has taken the tick after the one that polled, so it has handed the round over on its own
+		clock.Advance(roundFeedPollInterval)
+		clock.Advance(roundFeedPollInterval)
+	}
+
+	batches := 0
+	for range subscriber.events {
+		batches++
+	}
+	if batches != roundFeedBuffer {
+		t.Errorf("Expected %d batches before the subscriber was dropped, got %d", roundFeedBuffer, batches)
+	}
+}
+
+// A client resuming from an id past the latest event doesn't hold up the feed for the others on its unit
+func TestRoundFeedIgnoresFutureLastEventId(t *testing.T) {
+	db := setupRoundFeed(t)
+	clock := NewFakeClock(time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC))
+	lastEventId, _ := getLastOutboxEventId(db)
+	forged := mustSubscribeRoundFeed(t, db, clock, "A", 1000000)
+	defer forged.unsubscribe()
+	honest := mustSubscribeRoundFeed(t, db, clock, "A", lastEventId)
+	defer honest.unsubscribe()
+	clock.BlockUntil(1)
+
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	if _, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(time.Minute)); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	clock.Advance(roundFeedPollInterval)
+	for _, subscriber := range []*roundFeedSubscriber{forged, honest} {
+		select {
+		case feedEvents := <-subscriber.events:
+			if feedEvents = subscriber.unseen(feedEvents); len(feedEvents) != 1 || feedEvents[0].Type != "round.started" {
+				t.Errorf("Expected the 9:00 round started, got %+v", feedEvents)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the start to reach every subscriber")
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// How far after now a round can be started or completed, so staff can start a round a few minutes early
+const maxRoundTimeAhead = 5 * time.Minute
+
+// Returned, wrapped, for a round time too far after now
+var errRoundInFuture = errors.New("round is in the future")
+
+// Get the round at a given time, creating rounds up to that time if the task runner hasn't yet
+// Rounds are never created more than maxRoundTimeAhead past now, so a wrong round time can't fill the tables with future rounds
+func getOrCreateRoundForTime(store RoundsStore, roundTime time.Time, now time.Time) (Round, error) {
+	if roundTime.Sub(now) > maxRoundTimeAhead {
+		return Round{}, fmt.Errorf("%w: %s is more than %v after %s", errRoundInFuture, roundTime.UTC().Format(time.RFC3339), maxRoundTimeAhead, now.UTC().Format(time.RFC3339))
+	}
+
+	round, err := store.GetRoundForTime(roundTime)
+	if err != nil {
+		panic("Failed to get round for time")
+	}
+	if round.ID != 0 {
+		return round, nil
+	}
+
+	CreateRounds(store, roundTime)
+	round, err = store.GetRoundForTime(roundTime)
+	if err != nil {
+		panic("Failed to get round for time")
+	}
+	if round.ID == 0 {
+		return round, fmt.Errorf("no round is scheduled at %s", roundTime.UTC().Format(time.RFC3339))
+	}
+	return round, nil
+}
+
+// Start the round at a given time
+func StartRound(store RoundsStore, roundTime time.Time, staffId string, at time.Time) (Round, error) {
+	round, err := getOrCreateRoundForTime(store, roundTime, at)
+	if err != nil {
+		return round, err
+	}
+	if round.Status != "CREATED" {
+		return round, fmt.Errorf("round at %s is already %s", round.RoundTimestamp, round.Status)
+	}
+
+	round.Status = "STARTED"
+	round.StartedAt = at.UTC().Format(time.RFC3339)
+	round.StartedBy = staffId
+	err = store.UpdateRoundStatus(&round, at)
+	return round, err
+}
+
+// Complete the round at a given time. A round that was never started is started and completed at once
+func CompleteRound(store RoundsStore, roundTime time.Time, staffId string, at time.Time) (Round, error) {
+	round, err := getOrCreateRoundForTime(store, roundTime, at)
+	if err != nil {
+		return round, err
+	}
+	if round.Status != "CREATED" && round.Status != "STARTED" {
+		return round, fmt.Errorf("round at %s is already %s", round.RoundTimestamp, round.Status)
+	}
+
+	if round.StartedAt == "" {
+		round.StartedAt = at.UTC().Format(time.RFC3339)
+		round.StartedBy = staffId
+	}
+	round.Status = "COMPLETE"
+	round.CompletedAt = at.UTC().Format(time.RFC3339)
+	round.CompletedBy = staffId
+	err = store.UpdateRoundStatus(&round, at)
+	return round, err
+}
+
+// Record the observation for a round member while their round is in progress
+// Once the round is COMPLETE, changes go through AmendObservation instead
+func RecordObservation(store RoundsStore, roundMemberId uint, observation string, staffId string, at time.Time) (RoundMember, error) {
+	if observation == "" {
+		return RoundMember{}, errors.New("observation is required")
+	}
+
+	roundMember, err := store.GetRoundMember(roundMemberId)
+	if err != nil {
+		panic("Failed to get round member")
+	}
+	if roundMember.ID == 0 {
+		return roundMember, fmt.Errorf("round member %d not found", roundMemberId)
+	}
+
+	round, err := store.GetRound(roundMember.RoundId)
+	if err != nil {
+		panic("Failed to get round")
+	}
+	if round.Status == "COMPLETE" || round.Status == "MISSED" {
+		return roundMember, fmt.Errorf("round at %s is %s, amend the observation instead", round.RoundTimestamp, round.Status)
+	}
+
+	roundMember.Observation = observation
+	roundMember.ObservedAt = at.UTC().Format(time.RFC3339)
+	roundMember.ObservedBy = staffId
+	err = store.UpdateRoundMemberObservation(&roundMember)
+	return roundMember, err
+}
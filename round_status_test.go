@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoundStatusTransitions(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+
+	// Starting a round that the task runner hasn't created yet creates it, with its members
+	round, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	if round.Status != "STARTED" || round.StartedAt != "2022-01-10T09:02:00Z" || round.StartedBy != "nurseA" {
+		t.Errorf("Expected round STARTED at 9:02 by nurseA, got %+v", round)
+	}
+	if _, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseB", roundTime.Add(3*time.Minute)); err == nil {
+		t.Errorf("Expected an error starting a STARTED round")
+	}
+
+	roundMembers, _ := getRoundMembersForRound(db, round.ID)
+	if len(roundMembers) != 3 {
+		t.Fatalf("Expected 3 round members, got %d", len(roundMembers))
+	}
+	roundMember, err := RecordObservation(NewGormRoundsStore(db), roundMembers[0].ID, "SLEEPING", "nurseA", roundTime.Add(4*time.Minute))
+	if err != nil {
+		t.Fatalf("RecordObservation failed: %v", err)
+	}
+	if roundMember.ObservedAt != "2022-01-10T09:04:00Z" || roundMember.ObservedBy != "nurseA" {
+		t.Errorf("Expected observation at 9:04 by nurseA, got %+v", roundMember)
+	}
+
+	round, err = CompleteRound(NewGormRoundsStore(db), roundTime, "nurseB", roundTime.Add(5*time.Minute))
+	if err != nil {
+		t.Fatalf("CompleteRound failed: %v", err)
+	}
+	if round.Status != "COMPLETE" || round.StartedBy != "nurseA" || round.CompletedBy != "nurseB" {
+		t.Errorf("Expected round started by nurseA and completed by nurseB, got %+v", round)
+	}
+
+	// Once complete, observations have to be amended
+	if _, err := RecordObservation(NewGormRoundsStore(db), roundMembers[1].ID, "AWAKE", "nurseA", roundTime.Add(6*time.Minute)); err == nil {
+		t.Errorf("Expected an error recording an observation on a COMPLETE round")
+	}
+	if _, err := CompleteRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(6*time.Minute)); err == nil {
+		t.Errorf("Expected an error completing a COMPLETE round")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Behavior codes staff write in the observation boxes, printed as a legend on every page of the rounds sheet
+var behaviorCodes = []struct {
+	Code        string
+	Description string
+}{
+	{"SLEEPING", "Asleep, breathing observed"},
+	{"AWAKE", "Awake in room"},
+	{"DAYROOM", "In the dayroom"},
+	{"GROUP", "In group or activity"},
+	{"BATHROOM", "In the bathroom, checked verbally"},
+	{"MEAL", "At a meal"},
+	{"AGITATED", "Agitated or distressed"},
+	{"OFF_UNIT", "Off the unit with staff"},
+	{"REFUSED", "Refused to be checked"},
+}
+
+// A paper rounds sheet for downtime, listing each round due in a window and the patients to check on it
+type RoundsSheet struct {
+	Unit      string
+	StartTime time.Time
+	EndTime   time.Time
+	Slots     []RoundsSheetSlot
+}
+
+// A round that is due, with the round types that schedule it and the patients on it
+type RoundsSheetSlot struct {
+	RoundTime  time.Time
+	RoundTypes []string
+	Patients   []RoundsSheetPatient
+}
+
+type RoundsSheetPatient struct {
+	PatientId string
+	Name      string
+	Bed       string
+	Status    string
+}
+
+// The longest sheet, or sync snapshot, that can be asked for. Both are built in memory
+const maxRoundsSheetHours = 48
+
+// Build the rounds sheet for a unit, or the whole clinic if unit is empty, for the hours after start time
+// Slots come from the schedule CreateRounds keeps and patients from the round assignments active at each slot,
+// filtered by the census the same way CreateRounds adds round members
+func BuildRoundsSheet(db *gorm.DB, unit string, startTime time.Time, hours int) (RoundsSheet, error) {
+	sheet := RoundsSheet{
+		Unit:      unit,
+		StartTime: startTime,
+		EndTime:   startTime.Add(time.Duration(hours) * time.Hour),
+	}
+	if hours <= 0 || hours > maxRoundsSheetHours {
+		return sheet, fmt.Errorf("hours must be between 1 and %d, got %d", maxRoundsSheetHours, hours)
+	}
+
+	roundConfigs, err := getRoundConfigs(db)
+	if err != nil {
+		return sheet, err
+	}
+
+	store := NewGormRoundsStore(db)
+	slots := make(map[time.Time]*RoundsSheetSlot)
+	slotPatients := make(map[time.Time]map[string]bool)
+	for _, roundConfig := range roundConfigs {
+		if !roundConfig.Enabled {
+			continue
+		}
+		// Configs for other units don't put anyone from this unit on rounds
+		if unit != "" && roundConfig.Unit != "" && roundConfig.Unit != unit {
+			continue
+		}
+
+		roundType, err := getRoundType(db, roundConfig.RoundTypeId)
+		if err != nil {
+			return sheet, err
+		}
+
+		// Slots follow the schedule CreateRounds keeps, or run from the start of the sheet for a round type it
+		// hasn't scheduled yet
+		slotTimes, scheduled, err := scheduledRoundTypeSlots(store, roundType, sheet.StartTime, sheet.EndTime)
+		if err != nil {
+			return sheet, err
+		}
+		if !scheduled {
+			slotTimes = roundTypeSlots(roundType, sheet.StartTime, sheet.EndTime)
+		}
+
+		// The window is exclusive of its end, since the next sheet starts there
+		for _, slotTime := range slotTimes {
+			if !slotTime.Before(sheet.EndTime) || !roundConfigActiveAt(roundConfig, slotTime) {
+				continue
+			}
+
+			slot, ok := slots[slotTime]
+			if !ok {
+				slot = &RoundsSheetSlot{RoundTime: slotTime}
+				slots[slotTime] = slot
+				slotPatients[slotTime] = make(map[string]bool)
+			}
+			slot.RoundTypes = append(slot.RoundTypes, roundType.Name)
+
+			// Clinic-wide configs are narrowed to the sheet's unit
+			configUnit := roundConfig.Unit
+			if configUnit == "" {
+				configUnit = unit
+			}
+			patients, err := roundsSheetPatients(db, roundType.ID, configUnit, slotTime)
+			if err != nil {
+				return sheet, err
+			}
+			for _, patient := range patients {
+				if slotPatients[slotTime][patient.PatientId] {
+					continue
+				}
+				slotPatients[slotTime][patient.PatientId] = true
+				slot.Patients = append(slot.Patients, patient)
+			}
+		}
+	}
+
+	for _, slot := range slots {
+		sort.Slice(slot.Patients, func(i, j int) bool {
+			if slot.Patients[i].Bed != slot.Patients[j].Bed {
+				return slot.Patients[i].Bed < slot.Patients[j].Bed
+			}
+			return slot.Patients[i].PatientId < slot.Patients[j].PatientId
+		})
+		sheet.Slots = append(sheet.Slots, *slot)
+	}
+	sort.Slice(sheet.Slots, func(i, j int) bool { return sheet.Slots[i].RoundTime.Before(sheet.Slots[j].RoundTime) })
+
+	return sheet, nil
+}
+
+// Get the patients assigned to a round type at a slot who would be added to the round
+func roundsSheetPatients(db *gorm.DB, roundTypeId uint, unit string, slotTime time.Time) ([]RoundsSheetPatient, error) {
+	var patients []RoundsSheetPatient
+
+	roundAssignments, err := getRoundAssignmentsForRoundType(db, roundTypeId, slotTime)
+	if err != nil {
+		return patients, err
+	}
+
+	for _, roundAssignment := range roundAssignments {
+		roundMember, ok := memberForCensus(NewGormRoundsStore(db), 0, roundAssignment.PatientId, unit, slotTime)
+		if !ok {
+			continue
+		}
+
+		patient, err := getPatient(db, roundAssignment.PatientId)
+		if err != nil {
+			return patients, err
+		}
+		census, err := getPatientCensusAtTime(db, roundAssignment.PatientId, slotTime)
+		if err != nil {
+			return patients, err
+		}
+
+		patients = append(patients, RoundsSheetPatient{
+			PatientId: roundAssignment.PatientId,
+			Name:      patient.Name,
+			Bed:       census.Bed,
+			Status:    roundMember.Status,
+		})
+	}
+	return patients, nil
+}
+
+// Layout of the rounds sheet, in points
+const (
+	roundsSheetMargin       = 36.0
+	roundsSheetRowHeight    = 20.0
+	roundsSheetSlotHeader   = 22.0
+	roundsSheetLegendHeight = 58.0
+)
+
+// Columns of each slot's patient table. Observation, time and initials are left blank for staff to fill in
+var roundsSheetColumns = []struct {
+	title string
+	width float64
+}{
+	{"Bed", 60},
+	{"Patient", 110},
+	{"Name", 170},
+	{"Status", 80},
+	{"Observation", 170},
+	{"Time", 60},
+	{"Initials", 70},
+}
+
+// Write the rounds sheet as a PDF, with times shown in a location
+// Each slot gets a heading and a row per patient, slots are not split across pages, and every page carries the legend
+func WriteRoundsSheetPDF(w io.Writer, sheet RoundsSheet, location *time.Location, printedAt time.Time) error {
+	if location == nil {
+		location = time.UTC
+	}
+	unit := sheet.Unit
+	if unit == "" {
+		unit = "All units"
+	}
+
+	doc := &pdfDocument{}
+	var page *pdfPage
+	var y float64
+	bottom := pdfPageHeight - roundsSheetMargin - roundsSheetLegendHeight
+
+	newPage := func() {
+		page = doc.AddPage()
+		page.LineWidth(0.5)
+		page.Text(roundsSheetMargin, roundsSheetMargin+4, 16, true, "Downtime rounds sheet - "+unit)
+		page.Text(roundsSheetMargin, roundsSheetMargin+22, 10, false, fmt.Sprintf("%s to %s (%s)",
+			sheet.StartTime.In(location).Format("Mon 2 Jan 2006 15:04"), sheet.EndTime.In(location).Format("Mon 2 Jan 2006 15:04"), location))
+		page.Text(pdfPageWidth-roundsSheetMargin-200, roundsSheetMargin+22, 8, false, "Printed "+printedAt.In(location).Format("2006-01-02 15:04"))
+		drawRoundsSheetLegend(page)
+		y = roundsSheetMargin + 40
+	}
+	newPage()
+
+	if len(sheet.Slots) == 0 {
+		page.Text(roundsSheetMargin, y+14, 11, false, "No rounds are scheduled in this window.")
+	}
+
+	for _, slot := range sheet.Slots {
+		rows := len(slot.Patients)
+		if rows == 0 {
+			rows = 1
+		}
+		height := roundsSheetSlotHeader + float64(rows+1)*roundsSheetRowHeight + 8
+		// Start a new page rather than splitting a slot, unless the slot doesn't fit on a page by itself
+		if y+height > bottom && y > roundsSheetMargin+40 {
+			newPage()
+		}
+
+		page.Text(roundsSheetMargin, y+15, 12, true, slot.RoundTime.In(location).Format("Mon 2 Jan 15:04"))
+		page.Text(roundsSheetMargin+110, y+15, 9, false, pdfFit(strings.Join(slot.RoundTypes, ", "), 9, 300))
+		page.Text(pdfPageWidth-roundsSheetMargin-250, y+15, 9, false, "Started by ____________  Completed by ____________")
+		y += roundsSheetSlotHeader
+
+		x := roundsSheetMargin
+		for _, column := range roundsSheetColumns {
+			page.Rect(x, y, column.width, roundsSheetRowHeight)
+			page.Text(x+4, y+14, 9, true, column.title)
+			x += column.width
+		}
+		y += roundsSheetRowHeight
+
+		if len(slot.Patients) == 0 {
+			page.Text(roundsSheetMargin+4, y+14, 9, false, "No patients assigned")
+			y += roundsSheetRowHeight
+		}
+		for _, patient := range slot.Patients {
+			if y+roundsSheetRowHeight > bottom {
+				newPage()
+			}
+			status := ""
+			if patient.Status == "LEAVE_OF_ABSENCE" {
+				status = "On leave"
+			}
+			values := []string{patient.Bed, patient.PatientId, patient.Name, status, "", "", ""}
+			x := roundsSheetMargin
+			for i, column := range roundsSheetColumns {
+				page.Rect(x, y, column.width, roundsSheetRowHeight)
+				if values[i] != "" {
+					page.Text(x+4, y+14, 9, false, pdfFit(values[i], 9, column.width-8))
+				}
+				x += column.width
+			}
+			y += roundsSheetRowHeight
+		}
+		y += 8
+	}
+
+	// Number the pages now that we know how many there are
+	for i, p := range doc.pages {
+		p.Text(pdfPageWidth-roundsSheetMargin-60, pdfPageHeight-roundsSheetMargin+16, 8, false, fmt.Sprintf("Page %d of %d", i+1, len(doc.pages)))
+	}
+
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+// Draw the behavior code legend at the bottom of a page, three codes to a line
+func drawRoundsSheetLegend(page *pdfPage) {
+	top := pdfPageHeight - roundsSheetMargin - roundsSheetLegendHeight
+	page.Line(roundsSheetMargin, top+4, pdfPageWidth-roundsSheetMargin, top+4)
+	page.Text(roundsSheetMargin, top+16, 9, true, "Behavior codes")
+
+	columnWidth := (pdfPageWidth - 2*roundsSheetMargin) / 3
+	for i, behaviorCode := range behaviorCodes {
+		x := roundsSheetMargin + float64(i%3)*columnWidth
+		y := top + 28 + float64(i/3)*10
+		page.Text(x, y, 8, true, behaviorCode.Code)
+		page.Text(x+55, y, 8, false, pdfFit(behaviorCode.Description, 8, columnWidth-60))
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func setupRoundsSheet(t *testing.T) *gorm.DB {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+
+	// Patient 1 has no census record, patient 2 is on unit A and goes on leave at 9:20, patient 3 is on unit B
+	admittedAt := time.Date(2022, time.January, 10, 7, 0, 0, 0, time.UTC)
+	if _, err := AdmitPatient(db, "patient2", "Jane (JD) Doe", "A", "A-2", admittedAt); err != nil {
+		t.Fatalf("AdmitPatient failed: %v", err)
+	}
+	if _, err := AdmitPatient(db, "patient3", "John Smith", "B", "B-1", admittedAt); err != nil {
+		t.Fatalf("AdmitPatient failed: %v", err)
+	}
+	if _, err := StartLeaveOfAbsence(db, "patient2", time.Date(2022, time.January, 10, 9, 20, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("StartLeaveOfAbsence failed: %v", err)
+	}
+	return db
+}
+
+func TestBuildRoundsSheet(t *testing.T) {
+	db := setupRoundsSheet(t)
+
+	sheet, err := BuildRoundsSheet(db, "A", time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC), 1)
+	if err != nil {
+		t.Fatalf("BuildRoundsSheet failed: %v", err)
+	}
+
+	expectedSlots := []struct {
+		roundTime  string
+		roundTypes int
+		patients   []RoundsSheetPatient
+	}{
+		{"2022-01-10T09:00:00Z", 3, []RoundsSheetPatient{{PatientId: "patient1"}, {PatientId: "patient2", Name: "Jane (JD) Doe", Bed: "A-2"}}},
+		{"2022-01-10T09:15:00Z", 1, []RoundsSheetPatient{{PatientId: "patient1"}}},
+		{"2022-01-10T09:30:00Z", 2, []RoundsSheetPatient{{PatientId: "patient1"}, {PatientId: "patient2", Name: "Jane (JD) Doe", Bed: "A-2", Status: "LEAVE_OF_ABSENCE"}}},
+		{"2022-01-10T09:45:00Z", 1, []RoundsSheetPatient{{PatientId: "patient1"}}},
+	}
+	if len(sheet.Slots) != len(expectedSlots) {
+		t.Fatalf("Expected %d slots, got %+v", len(expectedSlots), sheet.Slots)
+	}
+	for i, expectedSlot := range expectedSlots {
+		slot := sheet.Slots[i]
+		if slot.RoundTime.Format(time.RFC3339) != expectedSlot.roundTime || len(slot.RoundTypes) != expectedSlot.roundTypes {
+			t.Errorf("Expected slot %s with %d round types, got %+v", expectedSlot.roundTime, expectedSlot.roundTypes, slot)
+		}
+		if len(slot.Patients) != len(expectedSlot.patients) {
+			t.Errorf("Expected %d patients at %s, got %+v", len(expectedSlot.patients), expectedSlot.roundTime, slot.Patients)
+			continue
+		}
+		for j, expectedPatient := range expectedSlot.patients {
+			if slot.Patients[j] != expectedPatient {
+				t.Errorf("Expected %+v at %s, got %+v", expectedPatient, expectedSlot.roundTime, slot.Patients[j])
+			}
+		}
+	}
+
+	if _, err := BuildRoundsSheet(db, "A", time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC), 0); err == nil {
+		t.Errorf("Expected an error for a sheet of 0 hours")
+	}
+	if _, err := BuildRoundsSheet(db, "A", time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC), maxRoundsSheetHours+1); err == nil {
+		t.Errorf("Expected an error for a sheet longer than %d hours", maxRoundsSheetHours)
+	}
+}
+
+// Check the PDF structure: header, a cross-reference entry pointing at each object, trailer, and the page count
+// A sheet starting off the schedule lists the rounds at the times the scheduler keeps
+func TestBuildRoundsSheetFollowsSchedule(t *testing.T) {
+	db := setupRoundsSheet(t)
+	CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 8, 7, 0, 0, time.UTC))
+
+	sheet, err := BuildRoundsSheet(db, "A", time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC), 1)
+	if err != nil {
+		t.Fatalf("BuildRoundsSheet failed: %v", err)
+	}
+	var roundTimes []string
+	for _, slot := range sheet.Slots {
+		roundTimes = append(roundTimes, slot.RoundTime.Format("15:04"))
+	}
+	if strings.Join(roundTimes, ",") != "09:07,09:22,09:37,09:52" {
+		t.Errorf("Expected the 8:07 schedule's rounds, got %v", roundTimes)
+	}
+}
+
+func validatePDF(t *testing.T, body []byte) int {
+	if !bytes.HasPrefix(body, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(body, []byte("%%EOF\n")) {
+		t.Fatalf("Expected a PDF header and trailer")
+	}
+
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(body)
+	if startxref == nil {
+		t.Fatalf("Expected startxref")
+	}
+	xrefOffset, _ := strconv.Atoi(string(startxref[1]))
+	if !bytes.HasPrefix(body[xrefOffset:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at the xref table", xrefOffset)
+	}
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(body[xrefOffset:], -1)
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if !bytes.HasPrefix(body[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))) {
+			t.Errorf("xref entry for object %d does not point at it", i+1)
+		}
+	}
+
+	count := regexp.MustCompile(`/Type /Pages /Kids \[[^\]]*\] /Count (\d+)`).FindSubmatch(body)
+	if count == nil {
+		t.Fatalf("Expected a page tree")
+	}
+	pages, _ := strconv.Atoi(string(count[1]))
+	if strings.Count(string(body), "/Type /Page ") != pages {
+		t.Errorf("Expected %d page objects", pages)
+	}
+	return pages
+}
+
+func TestWriteRoundsSheetPDF(t *testing.T) {
+	db := setupRoundsSheet(t)
+
+	// A 12 hour clinic-wide sheet has a slot every 15 minutes, which doesn't fit on one page
+	sheet, err := BuildRoundsSheet(db, "", time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC), 12)
+	if err != nil {
+		t.Fatalf("BuildRoundsSheet failed: %v", err)
+	}
+	newYork, _ := time.LoadLocation("America/New_York")
+	var buf bytes.Buffer
+	if err := WriteRoundsSheetPDF(&buf, sheet, newYork, time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("WriteRoundsSheetPDF failed: %v", err)
+	}
+
+	body := buf.Bytes()
+	pages := validatePDF(t, body)
+	if pages < 2 {
+		t.Errorf("Expected the sheet to span pages, got %d", pages)
+	}
+
+	expected := []string{
+		"(Downtime rounds sheet - All units)",
+		"(Mon 10 Jan 04:00)",
+		`(Jane \(JD\) Doe)`,
+		"(On leave)",
+		"(Observation)",
+		fmt.Sprintf("(Page %d of %d)", pages, pages),
+	}
+	for _, behaviorCode := range behaviorCodes {
+		expected = append(expected, "("+behaviorCode.Code+")")
+	}
+	for _, text := range expected {
+		if !bytes.Contains(body, []byte(text)) {
+			t.Errorf("Expected the PDF to contain %s", text)
+		}
+	}
+	// Every page has the legend
+	if strings.Count(string(body), "(Behavior codes)") != pages {
+		t.Errorf("Expected the legend on each of %d pages", pages)
+	}
+}
+
+func TestRoundsSheetEndpoint(t *testing.T) {
+	db := setupRoundsSheet(t)
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/rounds-sheet?unit=B&start=2022-01-10T09:00:00Z&hours=2")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/pdf" {
+		t.Fatalf("Expected a PDF, got status %d and %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	validatePDF(t, buf.Bytes())
+	if !bytes.Contains(buf.Bytes(), []byte("(John Smith)")) || bytes.Contains(buf.Bytes(), []byte("(Jane")) {
+		t.Errorf("Expected only unit B patients on the sheet")
+	}
+
+	// Sheets and sync snapshots are built in memory, so their length is capped
+	for _, path := range []string{"/rounds-sheet?hours=49", "/rounds-sheet?hours=0", "/sync/download?hours=100000"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+// The sheet only has slots inside a config's time window
+func TestBuildRoundsSheetFollowsWindows(t *testing.T) {
+	db := setupDatabase()
+	setupNightRounds(t, db)
+
+	tests := []struct {
+		start    time.Time
+		hours    int
+		expected int
+	}{
+		{time.Date(2022, time.January, 10, 12, 0, 0, 0, time.UTC), 4, 0},
+		{time.Date(2022, time.January, 10, 21, 0, 0, 0, time.UTC), 6, 4},
+	}
+	for _, tt := range tests {
+		sheet, err := BuildRoundsSheet(db, "", tt.start, tt.hours)
+		if err != nil {
+			t.Fatalf("BuildRoundsSheet failed: %v", err)
+		}
+		if len(sheet.Slots) != tt.expected {
+			t.Errorf("Expected %d slots from %v, got %+v", tt.expected, tt.start, sheet.Slots)
+		}
+	}
+}
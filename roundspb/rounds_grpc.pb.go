@@ -0,0 +1,402 @@
+// gRPC API for the rounds system, for backend services that call the rounds logic directly
+// Timestamps are RFC3339 strings, the same as the HTTP API. An empty timestamp in a request means now
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v3.21.12
+// source: rounds/v1/rounds.proto
+
+package roundspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	RoundsService_ListStartRounds_FullMethodName   = "/rounds.v1.RoundsService/ListStartRounds"
+	RoundsService_StartRound_FullMethodName        = "/rounds.v1.RoundsService/StartRound"
+	RoundsService_CompleteRound_FullMethodName     = "/rounds.v1.RoundsService/CompleteRound"
+	RoundsService_RecordObservation_FullMethodName = "/rounds.v1.RoundsService/RecordObservation"
+	RoundsService_ListAssignments_FullMethodName   = "/rounds.v1.RoundsService/ListAssignments"
+	RoundsService_AssignRoundType_FullMethodName   = "/rounds.v1.RoundsService/AssignRoundType"
+	RoundsService_EndAssignment_FullMethodName     = "/rounds.v1.RoundsService/EndAssignment"
+	RoundsService_WatchRounds_FullMethodName       = "/rounds.v1.RoundsService/WatchRounds"
+)
+
+// RoundsServiceClient is the client API for RoundsService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RoundsServiceClient interface {
+	// Rounds for a time window, as displayed to staff. Setting any filter, a cursor or a limit gets a page instead
+	ListStartRounds(ctx context.Context, in *ListStartRoundsRequest, opts ...grpc.CallOption) (*ListStartRoundsResponse, error)
+	StartRound(ctx context.Context, in *StartRoundRequest, opts ...grpc.CallOption) (*Round, error)
+	// A round that was never started is started and completed at once
+	CompleteRound(ctx context.Context, in *CompleteRoundRequest, opts ...grpc.CallOption) (*Round, error)
+	// Record an observation while the round is in progress. Completed rounds are amended over HTTP instead
+	RecordObservation(ctx context.Context, in *RecordObservationRequest, opts ...grpc.CallOption) (*RoundMember, error)
+	ListAssignments(ctx context.Context, in *ListAssignmentsRequest, opts ...grpc.CallOption) (*ListAssignmentsResponse, error)
+	AssignRoundType(ctx context.Context, in *AssignRoundTypeRequest, opts ...grpc.CallOption) (*Assignment, error)
+	EndAssignment(ctx context.Context, in *EndAssignmentRequest, opts ...grpc.CallOption) (*Assignment, error)
+	// Live round status changes, optionally for one unit, until the client cancels
+	WatchRounds(ctx context.Context, in *WatchRoundsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RoundEvent], error)
+}
+
+type roundsServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRoundsServiceClient(cc grpc.ClientConnInterface) RoundsServiceClient {
+	return &roundsServiceClient{cc}
+}
+
+func (c *roundsServiceClient) ListStartRounds(ctx context.Context, in *ListStartRoundsRequest, opts ...grpc.CallOption) (*ListStartRoundsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListStartRoundsResponse)
+	err := c.cc.Invoke(ctx, RoundsService_ListStartRounds_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *roundsServiceClient) StartRound(ctx context.Context, in *StartRoundRequest, opts ...grpc.CallOption) (*Round, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Round)
+	err := c.cc.Invoke(ctx, RoundsService_StartRound_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *roundsServiceClient) CompleteRound(ctx context.Context, in *CompleteRoundRequest, opts ...grpc.CallOption) (*Round, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Round)
+	err := c.cc.Invoke(ctx, RoundsService_CompleteRound_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *roundsServiceClient) RecordObservation(ctx context.Context, in *RecordObservationRequest, opts ...grpc.CallOption) (*RoundMember, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RoundMember)
+	err := c.cc.Invoke(ctx, RoundsService_RecordObservation_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *roundsServiceClient) ListAssignments(ctx context.Context, in *ListAssignmentsRequest, opts ...grpc.CallOption) (*ListAssignmentsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListAssignmentsResponse)
+	err := c.cc.Invoke(ctx, RoundsService_ListAssignments_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *roundsServiceClient) AssignRoundType(ctx context.Context, in *AssignRoundTypeRequest, opts ...grpc.CallOption) (*Assignment, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Assignment)
+	err := c.cc.Invoke(ctx, RoundsService_AssignRoundType_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *roundsServiceClient) EndAssignment(ctx context.Context, in *EndAssignmentRequest, opts ...grpc.CallOption) (*Assignment, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Assignment)
+	err := c.cc.Invoke(ctx, RoundsService_EndAssignment_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *roundsServiceClient) WatchRounds(ctx context.Context, in *WatchRoundsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RoundEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &RoundsService_ServiceDesc.Streams[0], RoundsService_WatchRounds_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRoundsRequest, RoundEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RoundsService_WatchRoundsClient = grpc.ServerStreamingClient[RoundEvent]
+
+// RoundsServiceServer is the server API for RoundsService service.
+// All implementations must embed UnimplementedRoundsServiceServer
+// for forward compatibility.
+type RoundsServiceServer interface {
+	// Rounds for a time window, as displayed to staff. Setting any filter, a cursor or a limit gets a page instead
+	ListStartRounds(context.Context, *ListStartRoundsRequest) (*ListStartRoundsResponse, error)
+	StartRound(context.Context, *StartRoundRequest) (*Round, error)
+	// A round that was never started is started and completed at once
+	CompleteRound(context.Context, *CompleteRoundRequest) (*Round, error)
+	// Record an observation while the round is in progress. Completed rounds are amended over HTTP instead
+	RecordObservation(context.Context, *RecordObservationRequest) (*RoundMember, error)
+	ListAssignments(context.Context, *ListAssignmentsRequest) (*ListAssignmentsResponse, error)
+	AssignRoundType(context.Context, *AssignRoundTypeRequest) (*Assignment, error)
+	EndAssignment(context.Context, *EndAssignmentRequest) (*Assignment, error)
+	// Live round status changes, optionally for one unit, until the client cancels
+	WatchRounds(*WatchRoundsRequest, grpc.ServerStreamingServer[RoundEvent]) error
+	mustEmbedUnimplementedRoundsServiceServer()
+}
+
+// UnimplementedRoundsServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRoundsServiceServer struct{}
+
+func (UnimplementedRoundsServiceServer) ListStartRounds(context.Context, *ListStartRoundsRequest) (*ListStartRoundsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListStartRounds not implemented")
+}
+func (UnimplementedRoundsServiceServer) StartRound(context.Context, *StartRoundRequest) (*Round, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartRound not implemented")
+}
+func (UnimplementedRoundsServiceServer) CompleteRound(context.Context, *CompleteRoundRequest) (*Round, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CompleteRound not implemented")
+}
+func (UnimplementedRoundsServiceServer) RecordObservation(context.Context, *RecordObservationRequest) (*RoundMember, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RecordObservation not implemented")
+}
+func (UnimplementedRoundsServiceServer) ListAssignments(context.Context, *ListAssignmentsRequest) (*ListAssignmentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAssignments not implemented")
+}
+func (UnimplementedRoundsServiceServer) AssignRoundType(context.Context, *AssignRoundTypeRequest) (*Assignment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AssignRoundType not implemented")
+}
+func (UnimplementedRoundsServiceServer) EndAssignment(context.Context, *EndAssignmentRequest) (*Assignment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method EndAssignment not implemented")
+}
+func (UnimplementedRoundsServiceServer) WatchRounds(*WatchRoundsRequest, grpc.ServerStreamingServer[RoundEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRounds not implemented")
+}
+func (UnimplementedRoundsServiceServer) mustEmbedUnimplementedRoundsServiceServer() {}
+func (UnimplementedRoundsServiceServer) testEmbeddedByValue()                       {}
+
+// UnsafeRoundsServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RoundsServiceServer will
+// result in compilation errors.
+type UnsafeRoundsServiceServer interface {
+	mustEmbedUnimplementedRoundsServiceServer()
+}
+
+func RegisterRoundsServiceServer(s grpc.ServiceRegistrar, srv RoundsServiceServer) {
+	// If the following call pancis, it indicates UnimplementedRoundsServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&RoundsService_ServiceDesc, srv)
+}
+
+func _RoundsService_ListStartRounds_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListStartRoundsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RoundsServiceServer).ListStartRounds(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RoundsService_ListStartRounds_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RoundsServiceServer).ListStartRounds(ctx, req.(*ListStartRoundsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RoundsService_StartRound_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartRoundRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RoundsServiceServer).StartRound(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RoundsService_StartRound_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RoundsServiceServer).StartRound(ctx, req.(*StartRoundRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RoundsService_CompleteRound_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompleteRoundRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RoundsServiceServer).CompleteRound(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RoundsService_CompleteRound_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RoundsServiceServer).CompleteRound(ctx, req.(*CompleteRoundRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RoundsService_RecordObservation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RecordObservationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RoundsServiceServer).RecordObservation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RoundsService_RecordObservation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RoundsServiceServer).RecordObservation(ctx, req.(*RecordObservationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RoundsService_ListAssignments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAssignmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RoundsServiceServer).ListAssignments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RoundsService_ListAssignments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RoundsServiceServer).ListAssignments(ctx, req.(*ListAssignmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RoundsService_AssignRoundType_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AssignRoundTypeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RoundsServiceServer).AssignRoundType(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RoundsService_AssignRoundType_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RoundsServiceServer).AssignRoundType(ctx, req.(*AssignRoundTypeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RoundsService_EndAssignment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EndAssignmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RoundsServiceServer).EndAssignment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RoundsService_EndAssignment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RoundsServiceServer).EndAssignment(ctx, req.(*EndAssignmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RoundsService_WatchRounds_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRoundsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RoundsServiceServer).WatchRounds(m, &grpc.GenericServerStream[WatchRoundsRequest, RoundEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RoundsService_WatchRoundsServer = grpc.ServerStreamingServer[RoundEvent]
+
+// RoundsService_ServiceDesc is the grpc.ServiceDesc for RoundsService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RoundsService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rounds.v1.RoundsService",
+	HandlerType: (*RoundsServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListStartRounds",
+			Handler:    _RoundsService_ListStartRounds_Handler,
+		},
+		{
+			MethodName: "StartRound",
+			Handler:    _RoundsService_StartRound_Handler,
+		},
+		{
+			MethodName: "CompleteRound",
+			Handler:    _RoundsService_CompleteRound_Handler,
+		},
+		{
+			MethodName: "RecordObservation",
+			Handler:    _RoundsService_RecordObservation_Handler,
+		},
+		{
+			MethodName: "ListAssignments",
+			Handler:    _RoundsService_ListAssignments_Handler,
+		},
+		{
+			MethodName: "AssignRoundType",
+			Handler:    _RoundsService_AssignRoundType_Handler,
+		},
+		{
+			MethodName: "EndAssignment",
+			Handler:    _RoundsService_EndAssignment_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRounds",
+			Handler:       _RoundsService_WatchRounds_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rounds/v1/rounds.proto",
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Build the HTTP API for the rounds system
+func newServer(db *gorm.DB, clock Clock) http.Handler {
+	mux := http.NewServeMux()
+
+	// The OpenAPI document describing this API
+	mux.HandleFunc("GET /openapi.json", serveOpenAPIDocument)
+
+	// Rounds for a time window, as displayed to staff
+	mux.HandleFunc("GET /start-round-items", func(w http.ResponseWriter, r *http.Request) {
+		startTime, endTime, err := parseTimeWindow(r.URL.Query().Get("start"), r.URL.Query().Get("end"), clock.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// Without paging or filters this is the board as StartRounds shows it, upcoming round included
+		query, paged, err := parseStartRoundsQuery(r, startTime, endTime)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !paged {
+			if endTime.Sub(startTime) > maxStartRoundsWindow {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("window must be at most %v without paging, set limit to page through longer windows", maxStartRoundsWindow))
+				return
+			}
+			startRoundsItems, err := StartRounds(NewGormRoundsStore(db), startTime, endTime)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, startRoundsItems)
+			return
+		}
+
+		page, err := QueryStartRounds(NewGormRoundsStore(db), query)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if page.NextCursor != "" {
+			w.Header().Set("X-Next-Cursor", page.NextCursor)
+		}
+		writeJSON(w, http.StatusOK, page.Items)
+	})
+
+	// Live feed of changes to the rounds board as server-sent events, optionally for one unit
+	mux.HandleFunc("GET /start-round-items/stream", func(w http.ResponseWriter, r *http.Request) {
+		serveRoundFeed(db, clock, w, r)
+	})
+
+	// FHIR Bundle of rounds and observations for a time window
+	mux.HandleFunc("GET /fhir/export", func(w http.ResponseWriter, r *http.Request) {
+		startTime, endTime, err := parseTimeWindow(r.URL.Query().Get("start"), r.URL.Query().Get("end"), clock.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		bundle, err := BuildRoundsBundle(db, startTime, endTime, clock.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(bundle)
+	})
+
+	// Compliance report for a time window, optionally for one unit or round type
+	mux.HandleFunc("GET /reports/compliance", func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseComplianceFilter(r, clock.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		report, err := BuildComplianceReport(db, filter)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+
+	// Intervals in which a patient went unobserved longer than their round assignments allow
+	mux.HandleFunc("GET /patients/{patientId}/observation-gaps", func(w http.ResponseWriter, r *http.Request) {
+		startTime, endTime, err := parseTimeWindow(r.URL.Query().Get("start"), r.URL.Query().Get("end"), clock.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		gaps, err := FindObservationGaps(db, r.PathValue("patientId"), startTime, endTime)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, gaps)
+	})
+
+	// Patients who are overdue for an observation right now
+	mux.HandleFunc("GET /alerts/observation-gaps", func(w http.ResponseWriter, r *http.Request) {
+		alerts, err := CheckObservationGaps(db, clock.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, alerts)
+	})
+
+	// CSV or XLSX export of rounds, members, observations or compliance for a time window
+	mux.HandleFunc("GET /exports/{dataset}", func(w http.ResponseWriter, r *http.Request) {
+		options, err := parseExportOptions(r, clock.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, err := validateExportOptions(&options); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		contentType := "text/csv"
+		if options.Format == "xlsx" {
+			contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, options.Dataset, options.Format))
+		w.WriteHeader(http.StatusOK)
+
+		// The body is streamed, so errors past this point can only cut the export short
+		if err := WriteExport(db, w, options); err != nil {
+			log.Printf("Export of %s failed: %v", options.Dataset, err)
+		}
+	})
+
+	// Printable PDF rounds sheet for downtime, for a unit (or the whole clinic) from start for a number of hours
+	mux.HandleFunc("GET /rounds-sheet", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		now := clock.Now()
+
+		startTime, hours, err := parseSheetWindow(query.Get("start"), query.Get("hours"), now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		location := time.UTC
+		if tz := query.Get("tz"); tz != "" {
+			loaded, err := time.LoadLocation(tz)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid tz %q", tz))
+				return
+			}
+			location = loaded
+		}
+
+		sheet, err := BuildRoundsSheet(db, query.Get("unit"), startTime, hours)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.WriteHeader(http.StatusOK)
+		if err := WriteRoundsSheetPDF(w, sheet, location, now); err != nil {
+			log.Printf("Rounds sheet failed: %v", err)
+		}
+	})
+
+	// Upcoming slots and assignments for a device to work from offline, for a unit (or the whole clinic) from start for a number of hours
+	mux.HandleFunc("GET /sync/download", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		now := clock.Now()
+
+		startTime, hours, err := parseSheetWindow(query.Get("start"), query.Get("hours"), now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		snapshot, err := BuildSyncSnapshot(db, query.Get("unit"), startTime, hours, now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, snapshot)
+	})
+
+	// Operations a device recorded offline. Each one gets an outcome, so the device can reconcile its local state,
+	// and the ones the server refused are listed by client id so the device can flag them for staff
+	mux.HandleFunc("POST /sync/upload", func(w http.ResponseWriter, r *http.Request) {
+		var upload SyncUpload
+		if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid upload: %v", err))
+			return
+		}
+		if upload.DeviceId == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("device id is required"))
+			return
+		}
+		results, err := ApplySyncUpload(NewGormRoundsStore(db), upload, clock.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		rejected := []string{}
+		for _, result := range results {
+			if result.Outcome == "REJECTED" {
+				rejected = append(rejected, result.ClientId)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"results": results, "rejected": rejected})
+	})
+
+	// Correct a round's status, or document a round late. The round is created if it was never started
+	mux.HandleFunc("POST /round-amendments", func(w http.ResponseWriter, r *http.Request) {
+		var request RoundStatusAmendmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid round amendment: %v", err))
+			return
+		}
+		roundTime, err := parseRoundRequest(request.RoundTimestamp, request.StaffId)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		amendment, err := AmendRoundStatus(NewGormRoundsStore(db), roundTime, request.Status, request.ReasonCode, request.Note, request.StaffId, clock.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, amendment)
+	})
+
+	// Correct a round member's observation, or chart a blank one late
+	mux.HandleFunc("POST /round-members/{roundMemberId}/amendments", func(w http.ResponseWriter, r *http.Request) {
+		roundMemberId, err := strconv.ParseUint(r.PathValue("roundMemberId"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid round member id %q", r.PathValue("roundMemberId")))
+			return
+		}
+		var request ObservationAmendmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid observation amendment: %v", err))
+			return
+		}
+		roundMember, err := getRoundMember(db, uint(roundMemberId))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if roundMember.ID == 0 {
+			writeError(w, http.StatusNotFound, fmt.Errorf("round member %d not found", roundMemberId))
+			return
+		}
+
+		amendment, err := AmendObservation(NewGormRoundsStore(db), roundMember.ID, request.Observation, request.ReasonCode, request.Note, clock.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, amendment)
+	})
+
+	// Add someone to notify about rounds on a unit
+	mux.HandleFunc("POST /escalation-contacts", func(w http.ResponseWriter, r *http.Request) {
+		var contact EscalationContact
+		if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid escalation contact: %v", err))
+			return
+		}
+
+		contact, err := AddEscalationContact(db, contact)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, contact)
+	})
+
+	// In-app notifications for a staff member, optionally only the unread ones
+	mux.HandleFunc("GET /notifications", func(w http.ResponseWriter, r *http.Request) {
+		staffId := r.URL.Query().Get("staff")
+		if staffId == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("staff is required"))
+			return
+		}
+
+		notifications, err := getInAppNotifications(db, staffId, r.URL.Query().Get("unread") == "true")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, notifications)
+	})
+
+	mux.HandleFunc("POST /notifications/{notificationId}/read", func(w http.ResponseWriter, r *http.Request) {
+		notificationId, err := strconv.ParseUint(r.PathValue("notificationId"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid notification id %q", r.PathValue("notificationId")))
+			return
+		}
+
+		notification, err := MarkNotificationRead(db, uint(notificationId), clock.Now())
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, notification)
+	})
+
+	// Subscribe a URL to round lifecycle events. The response includes the signing secret
+	mux.HandleFunc("POST /webhook-subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		var subscription WebhookSubscription
+		if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid webhook subscription: %v", err))
+			return
+		}
+
+		subscription, err := AddWebhookSubscription(db, subscription)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, subscription)
+	})
+
+	// Delivery log for a subscription, newest first
+	mux.HandleFunc("GET /webhook-subscriptions/{subscriptionId}/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		subscriptionId, err := strconv.ParseUint(r.PathValue("subscriptionId"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid subscription id %q", r.PathValue("subscriptionId")))
+			return
+		}
+
+		var attempts []WebhookDeliveryAttempt
+		db.Where("subscription_id = ?", subscriptionId).Order("id desc").Limit(500).Find(&attempts)
+		writeJSON(w, http.StatusOK, attempts)
+	})
+
+	mux.HandleFunc("GET /webhook-dead-letters", func(w http.ResponseWriter, r *http.Request) {
+		var deadLetters []WebhookDeadLetter
+		db.Where("replayed_at = ''").Order("id").Find(&deadLetters)
+		writeJSON(w, http.StatusOK, deadLetters)
+	})
+
+	mux.HandleFunc("POST /webhook-dead-letters/{deadLetterId}/replay", func(w http.ResponseWriter, r *http.Request) {
+		deadLetterId, err := strconv.ParseUint(r.PathValue("deadLetterId"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid dead letter id %q", r.PathValue("deadLetterId")))
+			return
+		}
+
+		delivery, err := ReplayWebhookDeadLetter(db, uint(deadLetterId), clock.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, delivery)
+	})
+
+	return mux
+}
+
+// Parse export options from the path and query params: format (csv or xlsx), start, end, unit,
+// columns (comma separated) and tz (an IANA time zone for timestamps). The window ends at now by default
+func parseExportOptions(r *http.Request, now time.Time) (ExportOptions, error) {
+	query := r.URL.Query()
+
+	startTime, endTime, err := parseTimeWindow(query.Get("start"), query.Get("end"), now)
+	if err != nil {
+		return ExportOptions{}, err
+	}
+	options := ExportOptions{
+		Dataset:   r.PathValue("dataset"),
+		Format:    query.Get("format"),
+		StartTime: startTime,
+		EndTime:   endTime,
+		Unit:      query.Get("unit"),
+		Now:       now,
+	}
+	if options.Format == "" {
+		options.Format = "csv"
+	}
+	if columns := query.Get("columns"); columns != "" {
+		options.Columns = strings.Split(columns, ",")
+	}
+
+	if tz := query.Get("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return ExportOptions{}, fmt.Errorf("invalid tz %q", tz)
+		}
+		options.Location = location
+	}
+
+	return options, nil
+}
+
+// Parse the compliance report filter from query params: start, end, unit, roundType and tz (an IANA time zone for shifts)
+// The window ends at now by default
+func parseComplianceFilter(r *http.Request, now time.Time) (ComplianceFilter, error) {
+	query := r.URL.Query()
+
+	startTime, endTime, err := parseTimeWindow(query.Get("start"), query.Get("end"), now)
+	if err != nil {
+		return ComplianceFilter{}, err
+	}
+	filter := ComplianceFilter{
+		StartTime: startTime,
+		EndTime:   endTime,
+		Unit:      query.Get("unit"),
+		Now:       now,
+	}
+
+	if roundType := query.Get("roundType"); roundType != "" {
+		roundTypeId, err := strconv.ParseUint(roundType, 10, 64)
+		if err != nil {
+			return ComplianceFilter{}, fmt.Errorf("invalid roundType %q", roundType)
+		}
+		filter.RoundTypeId = uint(roundTypeId)
+	}
+
+	if tz := query.Get("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return ComplianceFilter{}, fmt.Errorf("invalid tz %q", tz)
+		}
+		filter.Location = location
+	}
+
+	return filter, nil
+}
+
+// Parse the paging and filter params for start round items: status and roundType (comma separated), order (asc or desc),
+// cursor and limit. Paged is false when none of them were given
+func parseStartRoundsQuery(r *http.Request, startTime time.Time, endTime time.Time) (StartRoundsQuery, bool, error) {
+	params := r.URL.Query()
+	query := StartRoundsQuery{
+		StartTime: startTime,
+		CurrTime:  endTime,
+		Cursor:    params.Get("cursor"),
+		Limit:     defaultStartRoundsPageSize,
+	}
+	paged := false
+	for _, name := range []string{"status", "roundType", "order", "cursor", "limit"} {
+		if params.Has(name) {
+			paged = true
+		}
+	}
+
+	for _, status := range strings.Split(params.Get("status"), ",") {
+		if status = strings.TrimSpace(status); status != "" {
+			query.Statuses = append(query.Statuses, strings.ToUpper(status))
+		}
+	}
+	for _, value := range strings.Split(params.Get("roundType"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		roundTypeId, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return query, paged, fmt.Errorf("invalid round type %q", value)
+		}
+		query.RoundTypeIds = append(query.RoundTypeIds, uint(roundTypeId))
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, paged, fmt.Errorf("invalid order %q, expected asc or desc", params.Get("order"))
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return query, paged, fmt.Errorf("invalid limit %q", value)
+		}
+		query.Limit = limit
+	}
+	return query, paged, nil
+}
+
+// Parse the start and hours of a sheet. Start defaults to the start of the current hour and hours to 8
+func parseSheetWindow(start string, hours string, now time.Time) (time.Time, int, error) {
+	startTime := now.Truncate(time.Hour).UTC()
+	if start != "" {
+		t, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("invalid start time %q, expected RFC3339", start)
+		}
+		startTime = t.UTC()
+	}
+	parsedHours := 8
+	if hours != "" {
+		parsed, err := strconv.Atoi(hours)
+		if err != nil || parsed <= 0 || parsed > maxRoundsSheetHours {
+			return time.Time{}, 0, fmt.Errorf("invalid hours %q, expected 1 to %d", hours, maxRoundsSheetHours)
+		}
+		parsedHours = parsed
+	}
+	return startTime, parsedHours, nil
+}
+
+// Parse an RFC3339 start and end. End defaults to now and start to 12 hours before end
+func parseTimeWindow(start string, end string, now time.Time) (time.Time, time.Time, error) {
+	endTime := now
+	if end != "" {
+		t, err := time.Parse(time.RFC3339, end)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid end time %q, expected RFC3339", end)
+		}
+		endTime = t
+	}
+
+	startTime := endTime.Add(-12 * time.Hour)
+	if start != "" {
+		t, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start time %q, expected RFC3339", start)
+		}
+		startTime = t
+	}
+
+	if startTime.After(endTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("start time %s is after end time %s", startTime.UTC().Format(time.RFC3339), endTime.UTC().Format(time.RFC3339))
+	}
+	return startTime.UTC(), endTime.UTC(), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
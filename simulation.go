@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How long simulated staff take to do a round once they start it
+const simulatedRoundDuration = 5 * time.Minute
+
+// How synthetic staff behave. LateRate and SkipRate are the fractions of rounds started late and never started,
+// and the rest are started on time. On time rounds start within the on time grace of their round time, and late ones
+// between the grace and MaxLateness after it. Rounds go to Staff in turn
+type StaffBehavior struct {
+	LateRate    float64
+	SkipRate    float64
+	MaxLateness time.Duration
+	Staff       []string
+	// The same seed gives the same behavior, so two configs can be compared on the same staff
+	Seed int64
+}
+
+// A simulation of Config from StartTime to EndTime, moving the virtual clock, a FakeClock, Step at a time
+type SimulationOptions struct {
+	Config    ClinicConfig
+	StartTime time.Time
+	EndTime   time.Time
+	Step      time.Duration
+	Behavior  StaffBehavior
+}
+
+// Something that happened to a round on the virtual clock. Event is CREATED, STARTED, COMPLETED or MISSED
+// Patients is how many patients were on the round when it was created
+type SimulationEvent struct {
+	At             string `json:"at"`
+	RoundTimestamp string `json:"roundTimestamp"`
+	Event          string `json:"event"`
+	StaffId        string `json:"staffId,omitempty"`
+	Patients       int    `json:"patients,omitempty"`
+}
+
+type SimulationResult struct {
+	Timeline []SimulationEvent `json:"timeline"`
+	Report   ComplianceReport  `json:"report"`
+}
+
+// What a simulated staff member will do with a round. A skipped round has a zero start
+type plannedRound struct {
+	roundTime time.Time
+	staffId   string
+	start     time.Time
+	started   bool
+	completed bool
+	missed    bool
+}
+
+func validateSimulationOptions(options *SimulationOptions) error {
+	if options.Step == 0 {
+		options.Step = 5 * time.Minute
+	}
+	if options.Behavior.MaxLateness == 0 {
+		options.Behavior.MaxLateness = missedRoundAfter
+	}
+	if len(options.Behavior.Staff) == 0 {
+		options.Behavior.Staff = []string{"staff1"}
+	}
+
+	if !options.EndTime.After(options.StartTime) {
+		return errors.New("simulation must end after it starts")
+	}
+	if options.Step < 0 {
+		return errors.New("step must be positive")
+	}
+	behavior := options.Behavior
+	if behavior.LateRate < 0 || behavior.SkipRate < 0 || behavior.LateRate+behavior.SkipRate > 1 {
+		return fmt.Errorf("late rate %v and skip rate %v must be between 0 and 1 and add up to at most 1", behavior.LateRate, behavior.SkipRate)
+	}
+	if behavior.MaxLateness <= defaultOnTimeGrace {
+		return fmt.Errorf("max lateness must be longer than the %v on time grace", defaultOnTimeGrace)
+	}
+	return ValidateClinicConfig(options.Config)
+}
+
+// Replay a clinic config on a virtual clock against an empty database, with synthetic staff starting, completing and
+// skipping rounds, and report the timeline and compliance for the window
+// Each step creates rounds up to the clock as the scheduler would, does whatever staff planned to do by then, and reads
+// the start rounds board to see which rounds have been missed
+// The first CreateRounds backfills 12 hours as it does for any new clinic, and those rounds are left out
+func RunSimulation(db *gorm.DB, options SimulationOptions) (SimulationResult, error) {
+	var result SimulationResult
+	if err := validateSimulationOptions(&options); err != nil {
+		return result, err
+	}
+	if _, err := ApplyClinicConfig(db, options.Config, false); err != nil {
+		return result, err
+	}
+
+	store := NewGormRoundsStore(db)
+	rng := rand.New(rand.NewSource(options.Behavior.Seed))
+	startTime, endTime := options.StartTime.UTC(), options.EndTime.UTC()
+	planned := make(map[string]*plannedRound)
+	var plannedOrder []*plannedRound
+
+	virtualClock := NewFakeClock(startTime)
+	for ; !virtualClock.Now().After(endTime); virtualClock.Advance(options.Step) {
+		now := virtualClock.Now()
+
+		// Rounds the scheduler creates by now, each given to the next staff member with what they'll do with it
+		CreateRounds(store, now)
+		rounds, err := store.GetRounds(startTime, now)
+		if err != nil {
+			return result, err
+		}
+		for _, round := range rounds {
+			if _, ok := planned[round.RoundTimestamp]; ok {
+				continue
+			}
+			roundTime, _ := time.Parse(time.RFC3339, round.RoundTimestamp)
+			plan := planRound(rng, options.Behavior, roundTime, len(plannedOrder))
+			planned[round.RoundTimestamp] = plan
+			plannedOrder = append(plannedOrder, plan)
+
+			members, err := store.GetRoundMembersForRound(round.ID)
+			if err != nil {
+				return result, err
+			}
+			result.Timeline = append(result.Timeline, SimulationEvent{
+				At:             now.UTC().Format(time.RFC3339),
+				RoundTimestamp: round.RoundTimestamp,
+				Event:          "CREATED",
+				Patients:       len(members),
+			})
+		}
+
+		// Starts and completions that are due, at the times staff did them
+		for _, plan := range plannedOrder {
+			events, err := doPlannedRound(store, plan, now)
+			if err != nil {
+				return result, err
+			}
+			result.Timeline = append(result.Timeline, events...)
+		}
+
+		// Rounds the board shows as missed, and rounds still not started long enough after their time to count as missed
+		items, err := StartRounds(store, startTime, now)
+		if err != nil {
+			return result, err
+		}
+		for _, item := range items {
+			roundTime, _ := time.Parse(time.RFC3339, item.RoundTimestamp)
+			plan := planned[item.RoundTimestamp]
+			overdue := item.Status == "CREATED" && now.Sub(roundTime) >= missedRoundAfter && plan != nil && plan.start.IsZero()
+			if item.Status != "MISSED" && !overdue {
+				continue
+			}
+			if plan == nil {
+				plan = &plannedRound{roundTime: roundTime}
+				planned[item.RoundTimestamp] = plan
+			}
+			if plan.missed {
+				continue
+			}
+			plan.missed = true
+			result.Timeline = append(result.Timeline, SimulationEvent{
+				At:             roundTime.Add(missedRoundAfter).UTC().Format(time.RFC3339),
+				RoundTimestamp: item.RoundTimestamp,
+				Event:          "MISSED",
+			})
+		}
+	}
+
+	// Events from one step happened at different times, so put them in the order they happened
+	sort.SliceStable(result.Timeline, func(i, j int) bool {
+		return result.Timeline[i].At < result.Timeline[j].At
+	})
+
+	report, err := BuildComplianceReport(db, ComplianceFilter{StartTime: startTime, EndTime: endTime, Now: endTime})
+	if err != nil {
+		return result, err
+	}
+	result.Report = report
+	return result, nil
+}
+
+// Decide what the staff member whose turn it is will do with a round
+func planRound(rng *rand.Rand, behavior StaffBehavior, roundTime time.Time, turn int) *plannedRound {
+	plan := &plannedRound{roundTime: roundTime, staffId: behavior.Staff[turn%len(behavior.Staff)]}
+	roll := rng.Float64()
+	switch {
+	case roll < behavior.SkipRate:
+	case roll < behavior.SkipRate+behavior.LateRate:
+		lateMinutes := int64((behavior.MaxLateness - defaultOnTimeGrace) / time.Minute)
+		plan.start = roundTime.Add(defaultOnTimeGrace + time.Duration(1+rng.Int63n(max(lateMinutes, 1)))*time.Minute)
+	default:
+		onTimeMinutes := int64(defaultOnTimeGrace / time.Minute)
+		plan.start = roundTime.Add(time.Duration(rng.Int63n(onTimeMinutes+1)) * time.Minute)
+	}
+	return plan
+}
+
+// Start and complete a planned round once the clock reaches the times staff do them, observing every patient on it
+func doPlannedRound(store RoundsStore, plan *plannedRound, now time.Time) ([]SimulationEvent, error) {
+	var events []SimulationEvent
+	if plan.start.IsZero() {
+		return events, nil
+	}
+	roundTimestamp := plan.roundTime.UTC().Format(time.RFC3339)
+
+	if !plan.started && !plan.start.After(now) {
+		round, err := StartRound(store, plan.roundTime, plan.staffId, plan.start)
+		if err != nil {
+			return events, err
+		}
+		roundMembers, err := store.GetRoundMembersForRound(round.ID)
+		if err != nil {
+			return events, err
+		}
+		for _, roundMember := range roundMembers {
+			if roundMember.Status == "LEAVE_OF_ABSENCE" {
+				continue
+			}
+			if _, err := RecordObservation(store, roundMember.ID, "observed", plan.staffId, plan.start); err != nil {
+				return events, err
+			}
+		}
+		plan.started = true
+		events = append(events, SimulationEvent{At: plan.start.UTC().Format(time.RFC3339), RoundTimestamp: roundTimestamp, Event: "STARTED", StaffId: plan.staffId})
+	}
+
+	completeAt := plan.start.Add(simulatedRoundDuration)
+	if plan.started && !plan.completed && !completeAt.After(now) {
+		if _, err := CompleteRound(store, plan.roundTime, plan.staffId, completeAt); err != nil {
+			return events, err
+		}
+		plan.completed = true
+		events = append(events, SimulationEvent{At: completeAt.UTC().Format(time.RFC3339), RoundTimestamp: roundTimestamp, Event: "COMPLETED", StaffId: plan.staffId})
+	}
+	return events, nil
+}
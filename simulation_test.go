@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func simulationOptions(t *testing.T, behavior StaffBehavior) SimulationOptions {
+	t.Helper()
+	return SimulationOptions{
+		Config:    parseTestClinicConfig(t, "clinic.yaml", clinicConfigYAML),
+		StartTime: time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2022, time.January, 10, 11, 0, 0, 0, time.UTC),
+		Behavior:  behavior,
+	}
+}
+
+func countSimulationEvents(timeline []SimulationEvent, event string) int {
+	count := 0
+	for _, simulated := range timeline {
+		if simulated.Event == event {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRunSimulationOnTime(t *testing.T) {
+	result, err := RunSimulation(setupDatabase(), simulationOptions(t, StaffBehavior{Staff: []string{"nurse1", "nurse2"}}))
+	if err != nil {
+		t.Fatalf("Simulation failed: %v", err)
+	}
+
+	// 15 minute rounds from 8:00 to 11:00, the last one still pending at the end
+	if created := countSimulationEvents(result.Timeline, "CREATED"); created != 13 {
+		t.Errorf("Expected 13 rounds created, got %d", created)
+	}
+	if missed := countSimulationEvents(result.Timeline, "MISSED"); missed != 0 {
+		t.Errorf("Expected no rounds missed, got %d", missed)
+	}
+	first := result.Timeline[0]
+	if first.Event != "CREATED" || first.RoundTimestamp != "2022-01-10T08:00:00Z" || first.Patients != 3 {
+		t.Errorf("Expected the 8:00 round created with 3 patients first, got %+v", first)
+	}
+	for i := 1; i < len(result.Timeline); i++ {
+		if result.Timeline[i].At < result.Timeline[i-1].At {
+			t.Fatalf("Expected the timeline in order, got %+v before %+v", result.Timeline[i-1], result.Timeline[i])
+		}
+	}
+
+	overall := result.Report.Overall
+	if overall.Total == 0 || overall.OnTime != overall.Total || overall.Missed != 0 {
+		t.Errorf("Expected every round on time, got %+v", overall)
+	}
+	if len(result.Report.ByStaff) != 2 {
+		t.Errorf("Expected rounds shared between 2 staff, got %v", result.Report.ByStaff)
+	}
+	// Patient 3 is only on hourly rounds, and on time rounds start up to the grace late
+	for _, gap := range result.Report.PatientGaps {
+		if gap.GapMinutes > 75 {
+			t.Errorf("Expected no long observation gaps, got %+v", gap)
+		}
+	}
+}
+
+func TestRunSimulationLateAndSkipped(t *testing.T) {
+	behavior := StaffBehavior{LateRate: 0.3, SkipRate: 0.2, Seed: 42}
+	result, err := RunSimulation(setupDatabase(), simulationOptions(t, behavior))
+	if err != nil {
+		t.Fatalf("Simulation failed: %v", err)
+	}
+
+	overall := result.Report.Overall
+	if overall.Late == 0 || overall.Missed == 0 || overall.OnTime == 0 {
+		t.Errorf("Expected on time, late and missed rounds, got %+v", overall)
+	}
+	if missed := countSimulationEvents(result.Timeline, "MISSED"); missed != overall.Missed {
+		t.Errorf("Expected the timeline's %d missed rounds to match the report's %d", missed, overall.Missed)
+	}
+
+	// The same seed plays out the same way
+	again, _ := RunSimulation(setupDatabase(), simulationOptions(t, behavior))
+	if !reflect.DeepEqual(again.Timeline, result.Timeline) {
+		t.Errorf("Expected the same timeline from the same seed")
+	}
+
+	skipped, err := RunSimulation(setupDatabase(), simulationOptions(t, StaffBehavior{SkipRate: 1}))
+	if err != nil {
+		t.Fatalf("Simulation failed: %v", err)
+	}
+	if skipped.Report.Overall.Missed != skipped.Report.Overall.Total || countSimulationEvents(skipped.Timeline, "STARTED") != 0 {
+		t.Errorf("Expected every round missed, got %+v", skipped.Report.Overall)
+	}
+}
+
+func TestSimulationValidation(t *testing.T) {
+	invalid := []func(*SimulationOptions){
+		func(options *SimulationOptions) { options.EndTime = options.StartTime },
+		func(options *SimulationOptions) { options.Step = -time.Minute },
+		func(options *SimulationOptions) { options.Behavior.LateRate = 0.6; options.Behavior.SkipRate = 0.6 },
+		func(options *SimulationOptions) { options.Behavior.SkipRate = -0.1 },
+		func(options *SimulationOptions) { options.Behavior.MaxLateness = 10 * time.Minute },
+		func(options *SimulationOptions) { options.Config.RoundTypes[0].Minutes = 0 },
+	}
+	for i, change := range invalid {
+		options := simulationOptions(t, StaffBehavior{})
+		change(&options)
+		if _, err := RunSimulation(setupDatabase(), options); err == nil {
+			t.Errorf("Expected an error for case %d", i)
+		}
+	}
+}
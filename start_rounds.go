@@ -1,21 +1,60 @@
 package main
 
 import (
+	"fmt"
 	"sort"
 	"time"
+)
+
+// Rounds that are NOT_STARTED this long after their timestamp are considered MISSED
+const missedRoundAfter = 30 * time.Minute
 
-	"gorm.io/gorm"
+// Page sizes for QueryStartRounds
+const (
+	defaultStartRoundsPageSize = 100
+	maxStartRoundsPageSize     = 1000
 )
 
-func StartRounds(db *gorm.DB, startTime time.Time, currTime time.Time) ([]StartRoundsItem, error) {
+// The longest window the unpaged start rounds board is built for, as it holds every slot in memory at once
+const maxStartRoundsWindow = 7 * 24 * time.Hour
+
+// The statuses a start rounds item can have. NOT_STARTED and MISSED can also be slots with no round yet
+var startRoundsStatuses = map[string]bool{
+	"NOT_STARTED": true,
+	"CREATED":     true,
+	"STARTED":     true,
+	"COMPLETE":    true,
+	"MISSED":      true,
+}
+
+// A page of start rounds items from StartTime to CurrTime
+// Statuses and RoundTypeIds narrow the items when they aren't empty. Cursor is the NextCursor of the previous page,
+// and a Limit of 0 gets every item
+type StartRoundsQuery struct {
+	StartTime    time.Time
+	CurrTime     time.Time
+	Statuses     []string
+	RoundTypeIds []uint
+	Descending   bool
+	Cursor       string
+	Limit        int
+}
+
+// NextCursor is empty on the last page
+type StartRoundsPage struct {
+	Items      []StartRoundsItem `json:"items"`
+	NextCursor string            `json:"nextCursor"`
+}
+
+func StartRounds(store RoundsStore, startTime time.Time, currTime time.Time) ([]StartRoundsItem, error) {
 	// Fetch all round configs for the clinic
-	roundConfigs, err := getRoundConfigs(db)
+	roundConfigs, err := store.GetRoundConfigs()
 	if err != nil {
 		panic("Failed to get round configs")
 	}
 
 	// Fetch all rounds for the clinic udring time window
-	rounds, err := getRounds(db, startTime, currTime)
+	rounds, err := store.GetRounds(startTime, currTime)
 	if err != nil {
 		panic("Failed to get rounds")
 	}
@@ -23,11 +62,30 @@ func StartRounds(db *gorm.DB, startTime time.Time, currTime time.Time) ([]StartR
 	// Put exisisting rounds in a map as round timestamp -> StartRoundItems
 	// TODO: When we add building & program info, we could build a composite key here
 	roundsMap := make(map[string]StartRoundsItem)
+	roundTimestamps := make(map[uint]string)
+	var roundIds []uint
 	for _, round := range rounds {
 		roundsMap[round.RoundTimestamp] = StartRoundsItem{
 			Status:         round.Status,
 			RoundTimestamp: round.RoundTimestamp,
 		}
+		roundTimestamps[round.ID] = round.RoundTimestamp
+		roundIds = append(roundIds, round.ID)
+	}
+
+	// Flag rounds that were corrected after the fact or documented late
+	amendments, err := store.GetAmendmentsForRounds(roundIds)
+	if err != nil {
+		panic("Failed to get round amendments")
+	}
+	for _, amendment := range amendments {
+		item := roundsMap[roundTimestamps[amendment.RoundId]]
+		if amendment.LateEntry {
+			item.LateCharted = true
+		} else {
+			item.Amended = true
+		}
+		roundsMap[item.RoundTimestamp] = item
 	}
 
 	// Create rounds for each round config
@@ -37,10 +95,8 @@ func StartRounds(db *gorm.DB, startTime time.Time, currTime time.Time) ([]StartR
 			continue
 		}
 
-		// TODO: the "enabled time window" logic would go here
-
 		// Get the round type for this config
-		roundType, err := getRoundType(db, roundConfig.RoundTypeId)
+		roundType, err := store.GetRoundType(roundConfig.RoundTypeId)
 		if err != nil {
 			panic("Failed to get round types")
 		}
@@ -52,7 +108,7 @@ func StartRounds(db *gorm.DB, startTime time.Time, currTime time.Time) ([]StartR
 		}
 
 		// Walk through the time window and add new rounds to map as needed
-		roundsMap = createRoundsForConfig(roundType, startTime, currTime, roundsMap)
+		roundsMap = createRoundsForConfig(roundType, roundConfig, startTime, currTime, roundsMap)
 	}
 
 	// Convert the map to a slice
@@ -70,37 +126,112 @@ func StartRounds(db *gorm.DB, startTime time.Time, currTime time.Time) ([]StartR
 	startRounds = formatMissedRounds(startRounds, currTime)
 
 	// Add a next round if needed
-	startRounds = appendFutureRoundIfNeeded(db, startRounds, currTime, roundConfigs)
+	startRounds = appendFutureRoundIfNeeded(store, startRounds, currTime, roundConfigs)
 
 	return startRounds, nil
 }
 
-// Create rounds for a given round type and add to the rounds map
+// Create rounds for a given round type and add to the rounds map, leaving out times outside the config's window
 func createRoundsForConfig(
-	roundType RoundType, startTime time.Time, currTime time.Time, roundsMap map[string]StartRoundsItem) map[string]StartRoundsItem {
-	tempTime := startTime
-
+	roundType RoundType, roundConfig RoundConfig, startTime time.Time, currTime time.Time, roundsMap map[string]StartRoundsItem) map[string]StartRoundsItem {
 	// Walk forward in time, creating rounds as needed, until we reach the current time
-	for !tempTime.After(currTime) {
-		_, ok := roundsMap[tempTime.Format(time.RFC3339)]
+	for _, slot := range roundTypeSlots(roundType, startTime, currTime) {
+		if !roundConfigActiveAt(roundConfig, slot) {
+			continue
+		}
+		_, ok := roundsMap[slot.UTC().Format(time.RFC3339)]
 		if !ok {
 			existingRound := StartRoundsItem{
 				Status:         "NOT_STARTED",
-				RoundTimestamp: tempTime.Format(time.RFC3339),
+				RoundTimestamp: slot.UTC().Format(time.RFC3339),
 			}
-			roundsMap[tempTime.Format(time.RFC3339)] = existingRound
+			roundsMap[slot.UTC().Format(time.RFC3339)] = existingRound
 		}
-		tempTime = tempTime.Add(time.Duration(roundType.DurationAmt) * time.Minute)
 	}
 	return roundsMap
 }
 
+// Get the times a round type is due between start time and end time, inclusive
+func roundTypeSlots(roundType RoundType, startTime time.Time, endTime time.Time) []time.Time {
+	var slots []time.Time
+	if roundType.DurationAmt <= 0 {
+		return slots
+	}
+
+	for tempTime := startTime; !tempTime.After(endTime); tempTime = tempTime.Add(time.Duration(roundType.DurationAmt) * time.Minute) {
+		slots = append(slots, tempTime)
+	}
+	return slots
+}
+
+// Get the times a round type is due between start time and end time, inclusive, on the schedule CreateRounds keeps
+// CreateRounds steps each round type on from its last round, so all its rounds are a whole number of intervals from
+// that one. Returns false if the round type has no rounds yet, and so no schedule to line up with
+func scheduledRoundTypeSlots(store RoundsStore, roundType RoundType, startTime time.Time, endTime time.Time) ([]time.Time, bool, error) {
+	lastRound, err := store.GetLastRoundForType(roundType.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	if lastRound.ID == 0 || roundType.DurationAmt <= 0 {
+		return nil, false, nil
+	}
+	lastTime, err := time.Parse(time.RFC3339, lastRound.RoundTimestamp)
+	if err != nil {
+		return nil, false, err
+	}
+
+	first := firstSlotFrom(lastTime, time.Duration(roundType.DurationAmt)*time.Minute, startTime)
+	return roundTypeSlots(roundType, first, endTime), true, nil
+}
+
+// Get the first time a whole number of intervals from anchor that is at or after from
+func firstSlotFrom(anchor time.Time, interval time.Duration, from time.Time) time.Time {
+	first := anchor.Add(from.Sub(anchor) / interval * interval)
+	if first.Before(from) {
+		first = first.Add(interval)
+	}
+	return first
+}
+
+// Check whether a round is due at a time on the schedule CreateRounds keeps, for any enabled config active then
+// Before any round type has rounds there is no schedule to line up with, and every time is allowed, as CreateRounds
+// starts the schedule from whenever it first runs
+func onRoundSchedule(store RoundsStore, roundTime time.Time) (bool, error) {
+	roundConfigs, err := store.GetRoundConfigs()
+	if err != nil {
+		return false, err
+	}
+
+	anyScheduled := false
+	for _, roundConfig := range roundConfigs {
+		if !roundConfig.Enabled {
+			continue
+		}
+		roundType, err := store.GetRoundType(roundConfig.RoundTypeId)
+		if err != nil {
+			return false, err
+		}
+		slots, scheduled, err := scheduledRoundTypeSlots(store, roundType, roundTime, roundTime)
+		if err != nil {
+			return false, err
+		}
+		if !scheduled {
+			continue
+		}
+		anyScheduled = true
+		if len(slots) > 0 && roundConfigActiveAt(roundConfig, roundTime) {
+			return true, nil
+		}
+	}
+	return !anyScheduled, nil
+}
+
 // Mark old rounds as MISSED
 func formatMissedRounds(roundItems []StartRoundsItem, currTime time.Time) []StartRoundsItem {
 	// Mark all rounds that are NOT_STARTED as MISSED if they are 30 minutes old compared to currTime
 	for i, round := range roundItems {
 		roundTime, _ := time.Parse(time.RFC3339, round.RoundTimestamp)
-		if round.Status == "NOT_STARTED" && currTime.Sub(roundTime) >= 30*time.Minute {
+		if round.Status == "NOT_STARTED" && currTime.Sub(roundTime) >= missedRoundAfter {
 			roundItems[i].Status = "MISSED"
 		}
 	}
@@ -108,7 +239,7 @@ func formatMissedRounds(roundItems []StartRoundsItem, currTime time.Time) []Star
 }
 
 // Add a future round if there is no NOT_STARTED round in the list
-func appendFutureRoundIfNeeded(db *gorm.DB, roundItems []StartRoundsItem, currTime time.Time, configs []RoundConfig) []StartRoundsItem {
+func appendFutureRoundIfNeeded(store RoundsStore, roundItems []StartRoundsItem, currTime time.Time, configs []RoundConfig) []StartRoundsItem {
 	// Look for a round that is NOT_STARTED anywhere in the list
 	hasNotStarted := false
 	for _, round := range roundItems {
@@ -126,7 +257,7 @@ func appendFutureRoundIfNeeded(db *gorm.DB, roundItems []StartRoundsItem, currTi
 	// When we have building/program info for these configs, we might have a few configs we need to hold onto
 	minDuration := 0
 	for _, config := range configs {
-		roundType, err := getRoundType(db, config.RoundTypeId)
+		roundType, err := store.GetRoundType(config.RoundTypeId)
 		if err != nil {
 			panic("Failed to get round type")
 		}
@@ -137,9 +268,215 @@ func appendFutureRoundIfNeeded(db *gorm.DB, roundItems []StartRoundsItem, currTi
 
 	newRound := StartRoundsItem{
 		Status:         "NOT_STARTED",
-		RoundTimestamp: currTime.Add(time.Duration(minDuration) * time.Minute).Format(time.RFC3339),
+		RoundTimestamp: currTime.Add(time.Duration(minDuration) * time.Minute).UTC().Format(time.RFC3339),
 	}
 	roundItems = append(roundItems, newRound)
 
 	return roundItems
 }
+
+// Get a page of start rounds items. Unlike StartRounds, no upcoming round is added past the end of the window
+// Stored rounds are filtered and limited by the database, and slots with no round are only generated for the
+// round types asked for and checked against the database until the page is full
+func QueryStartRounds(store RoundsStore, query StartRoundsQuery) (StartRoundsPage, error) {
+	page := StartRoundsPage{Items: []StartRoundsItem{}}
+	if query.Limit < 0 || query.Limit > maxStartRoundsPageSize {
+		return page, fmt.Errorf("limit must be between 0 and %d", maxStartRoundsPageSize)
+	}
+
+	// Split the status filter between stored rounds and slots with no round
+	var roundStatuses []string
+	wantNotStarted, wantMissed, wantRounds := true, true, true
+	if len(query.Statuses) > 0 {
+		wantNotStarted, wantMissed = false, false
+		for _, status := range query.Statuses {
+			if !startRoundsStatuses[status] {
+				return page, fmt.Errorf("unknown status %q", status)
+			}
+			switch status {
+			case "NOT_STARTED":
+				wantNotStarted = true
+			case "MISSED":
+				wantMissed = true
+				roundStatuses = append(roundStatuses, status)
+			default:
+				roundStatuses = append(roundStatuses, status)
+			}
+		}
+		wantRounds = len(roundStatuses) > 0
+	}
+
+	// The cursor is the timestamp of the last item on the previous page, and timestamps are to the second
+	lowerTime, upperTime := query.StartTime.UTC(), query.CurrTime.UTC()
+	if query.Cursor != "" {
+		cursorTime, err := time.Parse(time.RFC3339, query.Cursor)
+		if err != nil {
+			return page, fmt.Errorf("invalid cursor %q", query.Cursor)
+		}
+		if query.Descending {
+			upperTime = cursorTime.UTC().Add(-time.Second)
+		} else {
+			lowerTime = cursorTime.UTC().Add(time.Second)
+		}
+	}
+	if lowerTime.After(upperTime) {
+		return page, nil
+	}
+
+	// Fetch one more than the limit to know whether there is another page
+	fetch := 0
+	if query.Limit > 0 {
+		fetch = query.Limit + 1
+	}
+
+	var roundItems []StartRoundsItem
+	if wantRounds {
+		rounds, err := store.GetRoundsPage(lowerTime.UTC().Format(time.RFC3339), upperTime.UTC().Format(time.RFC3339), roundStatuses, query.RoundTypeIds, query.Descending, fetch)
+		if err != nil {
+			panic("Failed to get rounds")
+		}
+		roundItems, err = startRoundsItemsForRounds(store, rounds)
+		if err != nil {
+			return page, err
+		}
+	}
+
+	var slotItems []StartRoundsItem
+	if wantNotStarted || wantMissed {
+		slots := startRoundsSlots(store, query.StartTime.UTC(), lowerTime, upperTime, query.RoundTypeIds, query.Descending)
+
+		// Keep the slots with the wanted status, then drop the ones that have a round a batch at a time
+		var candidates []StartRoundsItem
+		for _, slot := range slots {
+			status := "NOT_STARTED"
+			if query.CurrTime.Sub(slot) >= missedRoundAfter {
+				status = "MISSED"
+			}
+			if (status == "NOT_STARTED" && wantNotStarted) || (status == "MISSED" && wantMissed) {
+				candidates = append(candidates, StartRoundsItem{RoundTimestamp: slot.UTC().Format(time.RFC3339), Status: status})
+			}
+		}
+		batchSize := defaultStartRoundsPageSize
+		if fetch > batchSize {
+			batchSize = fetch
+		}
+		for start := 0; start < len(candidates) && (fetch == 0 || len(slotItems) < fetch); start += batchSize {
+			batch := candidates[start:min(start+batchSize, len(candidates))]
+			var roundTimestamps []string
+			for _, candidate := range batch {
+				roundTimestamps = append(roundTimestamps, candidate.RoundTimestamp)
+			}
+			existing, err := store.GetExistingRoundTimestamps(roundTimestamps)
+			if err != nil {
+				panic("Failed to get rounds")
+			}
+			for _, candidate := range batch {
+				if !existing[candidate.RoundTimestamp] && (fetch == 0 || len(slotItems) < fetch) {
+					slotItems = append(slotItems, candidate)
+				}
+			}
+		}
+	}
+
+	// Merge the two, which are both in order
+	before := func(a StartRoundsItem, b StartRoundsItem) bool {
+		if query.Descending {
+			return a.RoundTimestamp > b.RoundTimestamp
+		}
+		return a.RoundTimestamp < b.RoundTimestamp
+	}
+	i, j := 0, 0
+	for (i < len(roundItems) || j < len(slotItems)) && (fetch == 0 || len(page.Items) < fetch) {
+		if j == len(slotItems) || (i < len(roundItems) && before(roundItems[i], slotItems[j])) {
+			page.Items = append(page.Items, roundItems[i])
+			i++
+		} else {
+			page.Items = append(page.Items, slotItems[j])
+			j++
+		}
+	}
+
+	if query.Limit > 0 && len(page.Items) > query.Limit {
+		page.Items = page.Items[:query.Limit]
+		page.NextCursor = page.Items[query.Limit-1].RoundTimestamp
+	}
+	return page, nil
+}
+
+// Turn stored rounds into start rounds items, keeping their order and flagging amendments the same way StartRounds does
+func startRoundsItemsForRounds(store RoundsStore, rounds []Round) ([]StartRoundsItem, error) {
+	var roundIds []uint
+	for _, round := range rounds {
+		roundIds = append(roundIds, round.ID)
+	}
+	amendments, err := store.GetAmendmentsForRounds(roundIds)
+	if err != nil {
+		panic("Failed to get round amendments")
+	}
+
+	var items []StartRoundsItem
+	for _, round := range rounds {
+		item := StartRoundsItem{Status: round.Status, RoundTimestamp: round.RoundTimestamp}
+		for _, amendment := range amendments {
+			if amendment.RoundId != round.ID {
+				continue
+			}
+			if amendment.LateEntry {
+				item.LateCharted = true
+			} else {
+				item.Amended = true
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Get the slots enabled configs are due from lower time to upper time, walking from start time like StartRounds
+// Only configs for the given round types are used when there are any
+func startRoundsSlots(store RoundsStore, startTime time.Time, lowerTime time.Time, upperTime time.Time, roundTypeIds []uint, descending bool) []time.Time {
+	roundConfigs, err := store.GetRoundConfigs()
+	if err != nil {
+		panic("Failed to get round configs")
+	}
+	wantedRoundTypes := make(map[uint]bool)
+	for _, roundTypeId := range roundTypeIds {
+		wantedRoundTypes[roundTypeId] = true
+	}
+
+	seen := make(map[time.Time]bool)
+	var slots []time.Time
+	for _, roundConfig := range roundConfigs {
+		if !roundConfig.Enabled || (len(wantedRoundTypes) > 0 && !wantedRoundTypes[roundConfig.RoundTypeId]) {
+			continue
+		}
+		roundType, err := store.GetRoundType(roundConfig.RoundTypeId)
+		if err != nil {
+			panic("Failed to get round types")
+		}
+		if roundType.DurationUnit != "minutes" {
+			panic("Only minutes round duration is supported for now")
+		}
+
+		// Walk from the first slot of this page rather than from the start of the window
+		first := startTime
+		if roundType.DurationAmt > 0 && lowerTime.After(startTime) {
+			first = firstSlotFrom(startTime, time.Duration(roundType.DurationAmt)*time.Minute, lowerTime)
+		}
+		for _, slot := range roundTypeSlots(roundType, first, upperTime) {
+			if seen[slot] || !roundConfigActiveAt(roundConfig, slot) {
+				continue
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+
+	sort.Slice(slots, func(i, j int) bool {
+		if descending {
+			return slots[i].After(slots[j])
+		}
+		return slots[i].Before(slots[j])
+	})
+	return slots
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 func TestStartRounds(t *testing.T) {
@@ -152,33 +158,236 @@ func TestStartRounds(t *testing.T) {
 		},
 	}
 
-	for _, tt := range tests {
-		db := setupDatabase()
-		setupRoundConfigs(db)
+	for _, database := range testDatabases() {
+		t.Run(database.name, func(t *testing.T) {
+			for _, tt := range tests {
+				db := database.setup()
+				setupRoundConfigs(db)
 
-		// Create existing rounds
-		for _, round := range tt.existingRounds {
-			db.Create(&round)
-		}
+				// Create existing rounds
+				for _, round := range tt.existingRounds {
+					db.Create(&round)
+				}
+				resetTestSequences(db)
+
+				startRoundsItems, err := StartRounds(NewGormRoundsStore(db), tt.startTime, tt.currTime)
+				if err != nil {
+					t.Fatalf("StartRounds failed: %v", err)
+				}
+
+				// Check the number of rounds created
+				if len(startRoundsItems) != tt.expectedRoundsCount {
+					t.Fatalf("Expected %v rounds, got %v", tt.expectedRoundsCount, len(startRoundsItems))
+				}
+
+				// Check contents of the rounds created
+				for i, expectedRound := range tt.expectedRounds {
+					if startRoundsItems[i].Status != expectedRound.Status {
+						t.Fatalf("Expected round status %v, got %v", expectedRound.Status, startRoundsItems[i].Status)
+					}
+					if startRoundsItems[i].RoundTimestamp != expectedRound.RoundTimestamp {
+						t.Fatalf("Expected round timestamp %v, got %v", expectedRound.RoundTimestamp, startRoundsItems[i].RoundTimestamp)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Rounds from 8:00 to 9:30, with the 8:30 round complete, the 8:45 round missed and the 9:00 round started
+func setupStartRoundsQuery(t *testing.T, setup func() *gorm.DB) *gorm.DB {
+	db := setup()
+	setupRoundConfigs(db)
+	db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T08:30:00Z", Status: "COMPLETE"})
+	db.Create(&Round{ID: 2, RoundTimestamp: "2022-01-10T08:45:00Z", Status: "MISSED"})
+	db.Create(&Round{ID: 3, RoundTimestamp: "2022-01-10T09:00:00Z", Status: "STARTED"})
+	for _, roundRoundType := range []RoundRoundType{{RoundID: 1, RoundTypeID: 1}, {RoundID: 1, RoundTypeID: 2}, {RoundID: 2, RoundTypeID: 1}, {RoundID: 3, RoundTypeID: 1}, {RoundID: 3, RoundTypeID: 2}, {RoundID: 3, RoundTypeID: 3}} {
+		db.Create(&roundRoundType)
+	}
+	resetTestSequences(db)
+	return db
+}
 
-		startRoundsItems, err := StartRounds(db, tt.startTime, tt.currTime)
+// Get every page of a query, checking each is no longer than the limit
+func queryAllStartRounds(t *testing.T, db *gorm.DB, query StartRoundsQuery) ([]string, int) {
+	var items []string
+	pages := 0
+	for {
+		page, err := QueryStartRounds(NewGormRoundsStore(db), query)
 		if err != nil {
-			t.Fatalf("StartRounds failed: %v", err)
+			t.Fatalf("QueryStartRounds failed: %v", err)
 		}
-
-		// Check the number of rounds created
-		if len(startRoundsItems) != tt.expectedRoundsCount {
-			t.Fatalf("Expected %v rounds, got %v", tt.expectedRoundsCount, len(startRoundsItems))
+		pages++
+		if query.Limit > 0 && len(page.Items) > query.Limit {
+			t.Fatalf("Expected at most %d items, got %d", query.Limit, len(page.Items))
+		}
+		for _, item := range page.Items {
+			items = append(items, item.RoundTimestamp[11:16]+" "+item.Status)
+		}
+		if page.NextCursor == "" {
+			return items, pages
 		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+func TestQueryStartRounds(t *testing.T) {
+	for _, database := range testDatabases() {
+		t.Run(database.name, func(t *testing.T) {
+			db := setupStartRoundsQuery(t, database.setup)
+			startTime := time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC)
+			currTime := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+
+			tests := []struct {
+				name          string
+				query         StartRoundsQuery
+				expectedItems []string
+				expectedPages int
+			}{
+				{
+					name:          "Pages of 3 in order",
+					query:         StartRoundsQuery{Limit: 3},
+					expectedItems: []string{"08:00 MISSED", "08:15 MISSED", "08:30 COMPLETE", "08:45 MISSED", "09:00 STARTED", "09:15 NOT_STARTED", "09:30 NOT_STARTED"},
+					expectedPages: 3,
+				},
+				{
+					name:          "Pages of 4 newest first",
+					query:         StartRoundsQuery{Limit: 4, Descending: true},
+					expectedItems: []string{"09:30 NOT_STARTED", "09:15 NOT_STARTED", "09:00 STARTED", "08:45 MISSED", "08:30 COMPLETE", "08:15 MISSED", "08:00 MISSED"},
+					expectedPages: 2,
+				},
+				{
+					name:          "Missed rounds include slots that were never created",
+					query:         StartRoundsQuery{Statuses: []string{"MISSED"}, Limit: 2},
+					expectedItems: []string{"08:00 MISSED", "08:15 MISSED", "08:45 MISSED"},
+					expectedPages: 2,
+				},
+				{
+					name:          "More than one status",
+					query:         StartRoundsQuery{Statuses: []string{"NOT_STARTED", "COMPLETE"}},
+					expectedItems: []string{"08:30 COMPLETE", "09:15 NOT_STARTED", "09:30 NOT_STARTED"},
+					expectedPages: 1,
+				},
+				{
+					name:          "Hourly rounds only",
+					query:         StartRoundsQuery{RoundTypeIds: []uint{3}},
+					expectedItems: []string{"08:00 MISSED", "09:00 STARTED"},
+					expectedPages: 1,
+				},
+				{
+					name:          "Half-hourly rounds that are not started, newest first",
+					query:         StartRoundsQuery{RoundTypeIds: []uint{2}, Statuses: []string{"NOT_STARTED", "STARTED"}, Descending: true, Limit: 1},
+					expectedItems: []string{"09:30 NOT_STARTED", "09:00 STARTED"},
+					expectedPages: 2,
+				},
+			}
+
+			for _, tt := range tests {
+				tt.query.StartTime = startTime
+				tt.query.CurrTime = currTime
+				items, pages := queryAllStartRounds(t, db, tt.query)
+				if strings.Join(items, ", ") != strings.Join(tt.expectedItems, ", ") {
+					t.Errorf("%s: expected %v, got %v", tt.name, tt.expectedItems, items)
+				}
+				if pages != tt.expectedPages {
+					t.Errorf("%s: expected %d pages, got %d", tt.name, tt.expectedPages, pages)
+				}
+			}
+
+			// An unfiltered query matches StartRounds, which has no upcoming round to add here
+			startRoundsItems, _ := StartRounds(NewGormRoundsStore(db), startTime, currTime)
+			page, _ := QueryStartRounds(NewGormRoundsStore(db), StartRoundsQuery{StartTime: startTime, CurrTime: currTime})
+			if len(page.Items) != len(startRoundsItems) {
+				t.Fatalf("Expected %d items like StartRounds, got %d", len(startRoundsItems), len(page.Items))
+			}
+			for i := range startRoundsItems {
+				if page.Items[i] != startRoundsItems[i] {
+					t.Errorf("Expected %+v like StartRounds, got %+v", startRoundsItems[i], page.Items[i])
+				}
+			}
 
-		// Check contents of the rounds created
-		for i, expectedRound := range tt.expectedRounds {
-			if startRoundsItems[i].Status != expectedRound.Status {
-				t.Fatalf("Expected round status %v, got %v", expectedRound.Status, startRoundsItems[i].Status)
+			invalid := []StartRoundsQuery{
+				{StartTime: startTime, CurrTime: currTime, Statuses: []string{"DONE"}},
+				{StartTime: startTime, CurrTime: currTime, Limit: maxStartRoundsPageSize + 1},
+				{StartTime: startTime, CurrTime: currTime, Cursor: "next"},
 			}
-			if startRoundsItems[i].RoundTimestamp != expectedRound.RoundTimestamp {
-				t.Fatalf("Expected round timestamp %v, got %v", expectedRound.RoundTimestamp, startRoundsItems[i].RoundTimestamp)
+			for _, query := range invalid {
+				if _, err := QueryStartRounds(NewGormRoundsStore(db), query); err == nil {
+					t.Errorf("Expected an error for %+v", query)
+				}
 			}
+		})
+	}
+}
+
+func TestStartRoundItemsEndpointPaging(t *testing.T) {
+	db := setupStartRoundsQuery(t, setupDatabase)
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	defer server.Close()
+
+	url := server.URL + "/start-round-items?start=2022-01-10T08:00:00Z&end=2022-01-10T09:30:00Z&status=missed,not_started&order=desc&limit=3"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	var items []StartRoundsItem
+	json.NewDecoder(resp.Body).Decode(&items)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(items) != 3 || items[0].RoundTimestamp != "2022-01-10T09:30:00Z" {
+		t.Fatalf("Expected the 3 newest items, got %d %+v", resp.StatusCode, items)
+	}
+	cursor := resp.Header.Get("X-Next-Cursor")
+	if cursor != "2022-01-10T08:45:00Z" {
+		t.Fatalf("Expected a cursor at 8:45, got %q", cursor)
+	}
+
+	resp, _ = http.Get(url + "&cursor=" + cursor)
+	json.NewDecoder(resp.Body).Decode(&items)
+	resp.Body.Close()
+	if len(items) != 2 || items[1].RoundTimestamp != "2022-01-10T08:00:00Z" || resp.Header.Get("X-Next-Cursor") != "" {
+		t.Errorf("Expected the last 2 items and no cursor, got %+v", items)
+	}
+
+	resp, _ = http.Get(server.URL + "/start-round-items?order=sideways")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid order, got %d", resp.StatusCode)
+	}
+
+	// Only pages can cover more than a week
+	resp, _ = http.Get(server.URL + "/start-round-items?start=2022-01-01T08:00:00Z&end=2022-01-10T08:00:00Z")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unpaged window over a week, got %d", resp.StatusCode)
+	}
+	resp, _ = http.Get(server.URL + "/start-round-items?start=2022-01-01T08:00:00Z&end=2022-01-10T08:00:00Z&limit=1")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for a paged window over a week, got %d", resp.StatusCode)
+	}
+}
+
+// Slots for a page start at its lower time but stay on the intervals from the start of the window
+func TestStartRoundsSlotsFromLowerTime(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+
+	startTime := time.Date(2022, time.January, 10, 8, 5, 0, 0, time.UTC)
+	lowerTime := time.Date(2022, time.January, 10, 9, 1, 0, 0, time.UTC)
+	upperTime := time.Date(2022, time.January, 10, 9, 40, 0, 0, time.UTC)
+	slots := startRoundsSlots(NewGormRoundsStore(db), startTime, lowerTime, upperTime, []uint{1}, false)
+
+	expected := []time.Time{
+		time.Date(2022, time.January, 10, 9, 5, 0, 0, time.UTC),
+		time.Date(2022, time.January, 10, 9, 20, 0, 0, time.UTC),
+		time.Date(2022, time.January, 10, 9, 35, 0, 0, time.UTC),
+	}
+	if len(slots) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, slots)
+	}
+	for i := range expected {
+		if !slots[i].Equal(expected[i]) {
+			t.Errorf("Expected %v, got %v", expected[i], slots[i])
 		}
 	}
 }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Data access for the rounds engine, so the scheduling logic can run against something other than a database
+// Getters follow the data_utils conventions: a record that isn't there comes back as the zero value with an ID of 0
+// Create methods fill in the new record's ID
+type RoundsStore interface {
+	GetRoundConfigs() ([]RoundConfig, error)
+	GetRoundType(roundTypeId uint) (RoundType, error)
+	GetLastRoundForType(roundTypeId uint) (Round, error)
+	GetRounds(startTime time.Time, endTime time.Time) ([]Round, error)
+	GetRoundsPage(startTime string, endTime string, statuses []string, roundTypeIds []uint, descending bool, limit int) ([]Round, error)
+	GetExistingRoundTimestamps(roundTimestamps []string) (map[string]bool, error)
+	GetRound(roundId uint) (Round, error)
+	GetRoundForTime(t time.Time) (Round, error)
+	RoundHasRoundType(roundId uint, roundTypeId uint) (bool, error)
+	GetRoundMember(roundMemberId uint) (RoundMember, error)
+	GetRoundMembersForRound(roundId uint) ([]RoundMember, error)
+	GetRoundMembersForRounds(roundIds []uint) ([]RoundMember, error)
+	GetObservedRoundMembersForPatient(patientId string, startTime time.Time, endTime time.Time) ([]RoundMember, error)
+	GetLastObservedRoundMemberForPatient(patientId string, t time.Time) (RoundMember, error)
+	GetAmendmentsForRounds(roundIds []uint) ([]RoundAmendment, error)
+	GetRoundAssignment(roundAssignmentId uint) (RoundAssignment, error)
+	GetRoundAssignmentsForRoundType(roundTypeId uint, t time.Time) ([]RoundAssignment, error)
+	GetRoundAssignmentsForPatient(patientId string) ([]RoundAssignment, error)
+	GetOpenRoundAssignmentsForPatient(patientId string) ([]RoundAssignment, error)
+	GetAssignedPatientIds(t time.Time) ([]string, error)
+	GetPatient(patientId string) (Patient, error)
+	GetPatientCensusAtTime(patientId string, t time.Time) (PatientCensusEvent, error)
+	GetEscalationContacts(unit string, tier string) ([]EscalationContact, error)
+	GetNotification(event string, roundTimestamp string, unit string, contactId uint) (Notification, error)
+	GetInAppNotifications(address string, unreadOnly bool) ([]Notification, error)
+	GetSyncOperation(clientId string) (SyncOperation, error)
+	GetAppliedSyncClientId(roundTimestamp string, patientId string, deviceTime string, types []string) (string, error)
+
+	CreateRoundType(roundType *RoundType) error
+	CreateRoundConfig(roundConfig *RoundConfig) error
+	CreateRoundAssignment(roundAssignment *RoundAssignment) error
+	// The round and its outbox event for the round's status are stored together, or not at all
+	// If another scheduler already created a round at the same time, round is set to that one and no event is written
+	CreateRound(round *Round, at time.Time) error
+	CreateRoundRoundType(roundRoundType *RoundRoundType) error
+	CreateRoundMember(roundMember *RoundMember) error
+	CreateRoundAmendment(amendment *RoundAmendment) error
+	CreatePatient(patient *Patient) error
+	CreatePatientCensusEvent(censusEvent *PatientCensusEvent) error
+	CreateEscalationContact(contact *EscalationContact) error
+	CreateNotification(notification *Notification) error
+	CreateSyncOperation(operation *SyncOperation) error
+
+	// Update methods write the fields the engine changes, identified by the record's ID
+	// The round's status, start and completion are stored together with the outbox event for its status, or not at all
+	UpdateRoundStatus(round *Round, at time.Time) error
+	UpdateRoundMemberObservation(roundMember *RoundMember) error
+	// The round's new status, start and completion, its amendment and its outbox event are stored together, or not at all
+	// A round with an ID of 0 was never materialized and is created with the new status
+	AmendRoundStatus(round *Round, amendment *RoundAmendment, at time.Time) error
+	// The member's new observation and its amendment are stored together, or not at all
+	AmendRoundMemberObservation(roundMember *RoundMember, amendment *RoundAmendment) error
+	// The round's status, start and completion and the sync operation that set them are stored together, or not at
+	// all, with an outbox event for the round's status when statusChanged
+	ApplySyncRound(round *Round, operation *SyncOperation, statusChanged bool, at time.Time) error
+	// The member's observation and the sync operation that set it are stored together, or not at all
+	ApplySyncObservation(roundMember *RoundMember, operation *SyncOperation) error
+
+	// Run fn while holding the lock that keeps concurrent schedulers from creating the same rounds
+	WithSchedulingLock(fn func() error) error
+}
+
+// The RoundsStore backed by gorm, using the queries in data_utils.go
+type GormRoundsStore struct {
+	db *gorm.DB
+}
+
+func NewGormRoundsStore(db *gorm.DB) *GormRoundsStore {
+	return &GormRoundsStore{db: db}
+}
+
+func (s *GormRoundsStore) GetRoundConfigs() ([]RoundConfig, error) {
+	return getRoundConfigs(s.db)
+}
+
+func (s *GormRoundsStore) GetRoundType(roundTypeId uint) (RoundType, error) {
+	return getRoundType(s.db, roundTypeId)
+}
+
+func (s *GormRoundsStore) GetLastRoundForType(roundTypeId uint) (Round, error) {
+	return getLastRoundForType(s.db, roundTypeId)
+}
+
+func (s *GormRoundsStore) GetRounds(startTime time.Time, endTime time.Time) ([]Round, error) {
+	return getRounds(s.db, startTime, endTime)
+}
+
+func (s *GormRoundsStore) GetRoundsPage(startTime string, endTime string, statuses []string, roundTypeIds []uint, descending bool, limit int) ([]Round, error) {
+	return getRoundsPage(s.db, startTime, endTime, statuses, roundTypeIds, descending, limit)
+}
+
+func (s *GormRoundsStore) GetExistingRoundTimestamps(roundTimestamps []string) (map[string]bool, error) {
+	return getExistingRoundTimestamps(s.db, roundTimestamps)
+}
+
+func (s *GormRoundsStore) GetRound(roundId uint) (Round, error) {
+	return getRound(s.db, roundId)
+}
+
+func (s *GormRoundsStore) GetRoundForTime(t time.Time) (Round, error) {
+	return getRoundForTime(s.db, t)
+}
+
+func (s *GormRoundsStore) RoundHasRoundType(roundId uint, roundTypeId uint) (bool, error) {
+	return roundHasRoundType(s.db, roundId, roundTypeId)
+}
+
+func (s *GormRoundsStore) GetRoundMember(roundMemberId uint) (RoundMember, error) {
+	return getRoundMember(s.db, roundMemberId)
+}
+
+func (s *GormRoundsStore) GetRoundMembersForRound(roundId uint) ([]RoundMember, error) {
+	return getRoundMembersForRound(s.db, roundId)
+}
+
+func (s *GormRoundsStore) GetRoundMembersForRounds(roundIds []uint) ([]RoundMember, error) {
+	return getRoundMembersForRounds(s.db, roundIds)
+}
+
+func (s *GormRoundsStore) GetObservedRoundMembersForPatient(patientId string, startTime time.Time, endTime time.Time) ([]RoundMember, error) {
+	return getObservedRoundMembersForPatient(s.db, patientId, startTime, endTime)
+}
+
+func (s *GormRoundsStore) GetLastObservedRoundMemberForPatient(patientId string, t time.Time) (RoundMember, error) {
+	return getLastObservedRoundMemberForPatient(s.db, patientId, t)
+}
+
+func (s *GormRoundsStore) GetAmendmentsForRounds(roundIds []uint) ([]RoundAmendment, error) {
+	return getAmendmentsForRounds(s.db, roundIds)
+}
+
+func (s *GormRoundsStore) GetRoundAssignment(roundAssignmentId uint) (RoundAssignment, error) {
+	return getRoundAssignment(s.db, roundAssignmentId)
+}
+
+func (s *GormRoundsStore) GetRoundAssignmentsForRoundType(roundTypeId uint, t time.Time) ([]RoundAssignment, error) {
+	return getRoundAssignmentsForRoundType(s.db, roundTypeId, t)
+}
+
+func (s *GormRoundsStore) GetRoundAssignmentsForPatient(patientId string) ([]RoundAssignment, error) {
+	return getRoundAssignmentsForPatient(s.db, patientId)
+}
+
+func (s *GormRoundsStore) GetOpenRoundAssignmentsForPatient(patientId string) ([]RoundAssignment, error) {
+	return getOpenRoundAssignmentsForPatient(s.db, patientId)
+}
+
+func (s *GormRoundsStore) GetAssignedPatientIds(t time.Time) ([]string, error) {
+	return getAssignedPatientIds(s.db, t)
+}
+
+func (s *GormRoundsStore) GetPatient(patientId string) (Patient, error) {
+	return getPatient(s.db, patientId)
+}
+
+func (s *GormRoundsStore) GetPatientCensusAtTime(patientId string, t time.Time) (PatientCensusEvent, error) {
+	return getPatientCensusAtTime(s.db, patientId, t)
+}
+
+func (s *GormRoundsStore) GetEscalationContacts(unit string, tier string) ([]EscalationContact, error) {
+	return getEscalationContacts(s.db, unit, tier)
+}
+
+func (s *GormRoundsStore) GetNotification(event string, roundTimestamp string, unit string, contactId uint) (Notification, error) {
+	return getNotification(s.db, event, roundTimestamp, unit, contactId)
+}
+
+func (s *GormRoundsStore) GetInAppNotifications(address string, unreadOnly bool) ([]Notification, error) {
+	return getInAppNotifications(s.db, address, unreadOnly)
+}
+
+func (s *GormRoundsStore) GetSyncOperation(clientId string) (SyncOperation, error) {
+	return getSyncOperation(s.db, clientId)
+}
+
+func (s *GormRoundsStore) GetAppliedSyncClientId(roundTimestamp string, patientId string, deviceTime string, types []string) (string, error) {
+	return getAppliedSyncClientId(s.db, roundTimestamp, patientId, deviceTime, types)
+}
+
+func (s *GormRoundsStore) CreateRoundType(roundType *RoundType) error {
+	return s.db.Create(roundType).Error
+}
+
+func (s *GormRoundsStore) CreateRoundConfig(roundConfig *RoundConfig) error {
+	return s.db.Create(roundConfig).Error
+}
+
+func (s *GormRoundsStore) CreateRoundAssignment(roundAssignment *RoundAssignment) error {
+	return s.db.Create(roundAssignment).Error
+}
+
+// The round and its event are written together so webhook subscribers hear about every round
+// It upserts on the round timestamp, so a scheduler in another process that got there first isn't an error
+func (s *GormRoundsStore) CreateRound(round *Round, at time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "round_timestamp"}},
+			DoNothing: true,
+		}).Create(round)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return tx.Where("round_timestamp = ?", round.RoundTimestamp).First(round).Error
+		}
+		return writeRoundEvent(tx, *round, at)
+	})
+}
+
+func (s *GormRoundsStore) CreateRoundRoundType(roundRoundType *RoundRoundType) error {
+	return s.db.Create(roundRoundType).Error
+}
+
+func (s *GormRoundsStore) CreateRoundMember(roundMember *RoundMember) error {
+	return s.db.Create(roundMember).Error
+}
+
+func (s *GormRoundsStore) CreateRoundAmendment(amendment *RoundAmendment) error {
+	return s.db.Create(amendment).Error
+}
+
+func (s *GormRoundsStore) CreatePatient(patient *Patient) error {
+	return s.db.Create(patient).Error
+}
+
+func (s *GormRoundsStore) CreatePatientCensusEvent(censusEvent *PatientCensusEvent) error {
+	return s.db.Create(censusEvent).Error
+}
+
+func (s *GormRoundsStore) CreateEscalationContact(contact *EscalationContact) error {
+	return s.db.Create(contact).Error
+}
+
+func (s *GormRoundsStore) CreateNotification(notification *Notification) error {
+	return s.db.Create(notification).Error
+}
+
+func (s *GormRoundsStore) CreateSyncOperation(operation *SyncOperation) error {
+	return s.db.Create(operation).Error
+}
+
+func (s *GormRoundsStore) UpdateRoundStatus(round *Round, at time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(round).Updates(map[string]interface{}{
+			"status":       round.Status,
+			"started_at":   round.StartedAt,
+			"started_by":   round.StartedBy,
+			"completed_at": round.CompletedAt,
+			"completed_by": round.CompletedBy,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return writeRoundEvent(tx, *round, at)
+	})
+}
+
+func (s *GormRoundsStore) UpdateRoundMemberObservation(roundMember *RoundMember) error {
+	return s.db.Model(roundMember).Updates(map[string]interface{}{
+		"observation": roundMember.Observation,
+		"observed_at": roundMember.ObservedAt,
+		"observed_by": roundMember.ObservedBy,
+	}).Error
+}
+
+func (s *GormRoundsStore) AmendRoundStatus(round *Round, amendment *RoundAmendment, at time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if round.ID == 0 {
+			if err := tx.Create(round).Error; err != nil {
+				return err
+			}
+		} else {
+			err := tx.Model(round).Updates(map[string]interface{}{
+				"status":       round.Status,
+				"started_at":   round.StartedAt,
+				"started_by":   round.StartedBy,
+				"completed_at": round.CompletedAt,
+				"completed_by": round.CompletedBy,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		amendment.RoundId = round.ID
+		if err := tx.Create(amendment).Error; err != nil {
+			return err
+		}
+		return writeRoundEvent(tx, *round, at)
+	})
+}
+
+func (s *GormRoundsStore) AmendRoundMemberObservation(roundMember *RoundMember, amendment *RoundAmendment) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(roundMember).Updates(map[string]interface{}{
+			"observation": roundMember.Observation,
+			"observed_at": roundMember.ObservedAt,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(amendment).Error
+	})
+}
+
+func (s *GormRoundsStore) ApplySyncRound(round *Round, operation *SyncOperation, statusChanged bool, at time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(round).Updates(map[string]interface{}{
+			"status":       round.Status,
+			"started_at":   round.StartedAt,
+			"started_by":   round.StartedBy,
+			"completed_at": round.CompletedAt,
+			"completed_by": round.CompletedBy,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if statusChanged {
+			if err := writeRoundEvent(tx, *round, at); err != nil {
+				return err
+			}
+		}
+		return tx.Create(operation).Error
+	})
+}
+
+func (s *GormRoundsStore) ApplySyncObservation(roundMember *RoundMember, operation *SyncOperation) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(roundMember).Updates(map[string]interface{}{
+			"observation": roundMember.Observation,
+			"observed_at": roundMember.ObservedAt,
+			"observed_by": roundMember.ObservedBy,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(operation).Error
+	})
+}
+
+// Postgres takes a session advisory lock, which works across instances. SQLite only has this process to worry about
+func (s *GormRoundsStore) WithSchedulingLock(fn func() error) error {
+	return withDatabaseLock(s.db, schedulingLockKey, &sqliteSchedulingLock, fn)
+}
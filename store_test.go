@@ -0,0 +1,465 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Every RoundsStore implementation runs the same conformance suite. TestMain adds Postgres when it has a database for it
+var roundsStoreFactories = map[string]func() RoundsStore{
+	"gorm":   func() RoundsStore { return NewGormRoundsStore(setupDatabase()) },
+	"memory": func() RoundsStore { return NewMemoryRoundsStore() },
+}
+
+// Seed a store with round types, configs and assignments along the lines of setupRoundConfigs, plus a census, rounds, observations and notifications
+func seedRoundsStore(t *testing.T, store RoundsStore) {
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Failed to seed store: %v", err)
+		}
+	}
+
+	for i, duration := range []int{15, 30, 60} {
+		must(store.CreateRoundType(&RoundType{Name: "Round", DurationAmt: duration, DurationUnit: "minutes"}))
+		must(store.CreateRoundConfig(&RoundConfig{RoundTypeId: uint(i + 1), Enabled: duration != 60}))
+	}
+	must(store.CreateRoundAssignment(&RoundAssignment{RoundTypeId: 1, PatientId: "patient1"}))
+	must(store.CreateRoundAssignment(&RoundAssignment{RoundTypeId: 2, PatientId: "patient2", EffectiveFrom: "2022-01-10T09:00:00Z"}))
+	must(store.CreateRoundAssignment(&RoundAssignment{RoundTypeId: 1, PatientId: "patient2", EffectiveFrom: "2022-01-10T08:00:00Z", EffectiveTo: "2022-01-10T09:00:00Z"}))
+	must(store.CreateRoundAssignment(&RoundAssignment{RoundTypeId: 3, PatientId: "patient3", EffectiveTo: "2022-01-10T10:00:00Z"}))
+
+	must(store.CreatePatient(&Patient{PatientId: "patient1", Name: "Pat One", CensusStatus: "ADMITTED", Unit: "A"}))
+	must(store.CreatePatientCensusEvent(&PatientCensusEvent{PatientId: "patient1", CensusStatus: "ADMITTED", Unit: "A", EffectiveAt: "2022-01-10T08:00:00Z"}))
+	must(store.CreatePatientCensusEvent(&PatientCensusEvent{PatientId: "patient1", CensusStatus: "ON_LEAVE", Unit: "A", EffectiveAt: "2022-01-10T09:00:00Z"}))
+	must(store.CreatePatientCensusEvent(&PatientCensusEvent{PatientId: "patient1", CensusStatus: "ADMITTED", Unit: "B", EffectiveAt: "2022-01-10T09:00:00Z"}))
+
+	rounds := []Round{
+		{RoundTimestamp: "2022-01-10T09:00:00Z", Status: "COMPLETE", StartedAt: "2022-01-10T09:01:00Z", CompletedAt: "2022-01-10T09:05:00Z"},
+		{RoundTimestamp: "2022-01-10T09:15:00Z", Status: "STARTED", StartedAt: "2022-01-10T09:16:00Z"},
+		{RoundTimestamp: "2022-01-10T09:30:00Z", Status: "CREATED"},
+	}
+	for i := range rounds {
+		must(store.CreateRound(&rounds[i], time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)))
+	}
+	must(store.CreateRoundRoundType(&RoundRoundType{RoundID: 1, RoundTypeID: 1}))
+	must(store.CreateRoundRoundType(&RoundRoundType{RoundID: 1, RoundTypeID: 2}))
+	must(store.CreateRoundRoundType(&RoundRoundType{RoundID: 2, RoundTypeID: 1}))
+	must(store.CreateRoundRoundType(&RoundRoundType{RoundID: 3, RoundTypeID: 1}))
+
+	must(store.CreateRoundMember(&RoundMember{RoundId: 1, PatientId: "patient2", Observation: "AWAKE", ObservedAt: "2022-01-10T09:03:00Z"}))
+	must(store.CreateRoundMember(&RoundMember{RoundId: 1, PatientId: "patient1", Observation: "SLEEPING", ObservedAt: "2022-01-10T09:02:00Z"}))
+	must(store.CreateRoundMember(&RoundMember{RoundId: 2, PatientId: "patient1", Observation: "MEAL", ObservedAt: "2022-01-10T09:17:00Z"}))
+	must(store.CreateRoundMember(&RoundMember{RoundId: 3, PatientId: "patient1"}))
+
+	must(store.CreateRoundAmendment(&RoundAmendment{RoundId: 1, Field: "status", AmendedAt: "2022-01-10T11:00:00Z"}))
+	must(store.CreateRoundAmendment(&RoundAmendment{RoundId: 1, Field: "observation", AmendedAt: "2022-01-10T10:00:00Z", LateEntry: true}))
+	must(store.CreateRoundAmendment(&RoundAmendment{RoundId: 2, Field: "status", AmendedAt: "2022-01-10T10:30:00Z"}))
+
+	must(store.CreateEscalationContact(&EscalationContact{Unit: "A", Tier: "CHARGE_NURSE", Channel: "in_app", Address: "nurseA"}))
+	must(store.CreateEscalationContact(&EscalationContact{Unit: "", Tier: "CHARGE_NURSE", Channel: "in_app", Address: "nurseB"}))
+	must(store.CreateEscalationContact(&EscalationContact{Unit: "A", Tier: "CHARGE_NURSE", Channel: "smtp", Address: "a@example.com"}))
+
+	must(store.CreateNotification(&Notification{Event: "OVERDUE", RoundTimestamp: "2022-01-10T09:30:00Z", Unit: "A", ContactId: 1, Channel: "in_app", Address: "nurseA", SentAt: "2022-01-10T09:45:00Z"}))
+	must(store.CreateNotification(&Notification{Event: "DUE_SOON", RoundTimestamp: "2022-01-10T09:30:00Z", Unit: "A", ContactId: 1, Channel: "in_app", Address: "nurseA", SentAt: "2022-01-10T09:25:00Z", ReadAt: "2022-01-10T09:26:00Z"}))
+	must(store.CreateNotification(&Notification{Event: "MISSED", RoundTimestamp: "2022-01-10T09:30:00Z", Unit: "A", ContactId: 1, Channel: "in_app", Address: "nurseA"}))
+}
+
+func roundTimestamps(rounds []Round) []string {
+	var timestamps []string
+	for _, round := range rounds {
+		timestamps = append(timestamps, round.RoundTimestamp)
+	}
+	return timestamps
+}
+
+func roundMemberKeys(roundMembers []RoundMember) []string {
+	var keys []string
+	for _, roundMember := range roundMembers {
+		keys = append(keys, roundMember.PatientId+"@"+roundMember.ObservedAt)
+	}
+	return keys
+}
+
+func roundAssignmentIds(roundAssignments []RoundAssignment) []uint {
+	var ids []uint
+	for _, roundAssignment := range roundAssignments {
+		ids = append(ids, roundAssignment.ID)
+	}
+	return ids
+}
+
+func TestRoundsStoreConformance(t *testing.T) {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2022, time.January, 10, hour, minute, 0, 0, time.UTC)
+	}
+
+	for name, newStore := range roundsStoreFactories {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+			seedRoundsStore(t, store)
+
+			roundConfigs, _ := store.GetRoundConfigs()
+			if len(roundConfigs) != 3 || !roundConfigs[0].Enabled || roundConfigs[2].Enabled {
+				t.Errorf("Expected 3 round configs with the last disabled, got %+v", roundConfigs)
+			}
+			roundType, _ := store.GetRoundType(2)
+			if roundType.ID != 2 || roundType.DurationAmt != 30 {
+				t.Errorf("Expected the 30 minute round type, got %+v", roundType)
+			}
+			if roundType, _ := store.GetRoundType(9); roundType.ID != 0 {
+				t.Errorf("Expected no round type 9, got %+v", roundType)
+			}
+
+			// Rounds and their round types
+			if round, _ := store.GetLastRoundForType(1); round.RoundTimestamp != "2022-01-10T09:30:00Z" {
+				t.Errorf("Expected the 9:30 round to be the last 15 minute round, got %+v", round)
+			}
+			if round, _ := store.GetLastRoundForType(3); round.ID != 0 {
+				t.Errorf("Expected no 60 minute round, got %+v", round)
+			}
+			rounds, _ := store.GetRounds(at(9, 0), at(9, 15))
+			if got := roundTimestamps(rounds); !reflect.DeepEqual(got, []string{"2022-01-10T09:00:00Z", "2022-01-10T09:15:00Z"}) {
+				t.Errorf("Expected the 9:00 and 9:15 rounds, got %v", got)
+			}
+			if round, _ := store.GetRound(2); round.RoundTimestamp != "2022-01-10T09:15:00Z" || round.Status != "STARTED" {
+				t.Errorf("Expected round 2 to be the started 9:15 round, got %+v", round)
+			}
+			if round, _ := store.GetRoundForTime(at(9, 30)); round.ID != 3 {
+				t.Errorf("Expected round 3 at 9:30, got %+v", round)
+			}
+			if round, _ := store.GetRoundForTime(at(9, 45)); round.ID != 0 {
+				t.Errorf("Expected no round at 9:45, got %+v", round)
+			}
+			if has, _ := store.RoundHasRoundType(1, 2); !has {
+				t.Errorf("Expected round 1 to have round type 2")
+			}
+			if has, _ := store.RoundHasRoundType(2, 2); has {
+				t.Errorf("Expected round 2 not to have round type 2")
+			}
+
+			pages := []struct {
+				statuses     []string
+				roundTypeIds []uint
+				descending   bool
+				limit        int
+				expected     []string
+			}{
+				{nil, nil, false, 0, []string{"2022-01-10T09:00:00Z", "2022-01-10T09:15:00Z", "2022-01-10T09:30:00Z"}},
+				{nil, nil, true, 2, []string{"2022-01-10T09:30:00Z", "2022-01-10T09:15:00Z"}},
+				{[]string{"CREATED", "COMPLETE"}, nil, false, 0, []string{"2022-01-10T09:00:00Z", "2022-01-10T09:30:00Z"}},
+				{nil, []uint{2, 3}, false, 0, []string{"2022-01-10T09:00:00Z"}},
+			}
+			for _, page := range pages {
+				rounds, _ := store.GetRoundsPage("2022-01-10T09:00:00Z", "2022-01-10T09:30:00Z", page.statuses, page.roundTypeIds, page.descending, page.limit)
+				if got := roundTimestamps(rounds); !reflect.DeepEqual(got, page.expected) {
+					t.Errorf("Expected page %+v to be %v, got %v", page, page.expected, got)
+				}
+			}
+			existing, _ := store.GetExistingRoundTimestamps([]string{"2022-01-10T09:15:00Z", "2022-01-10T09:45:00Z"})
+			if !reflect.DeepEqual(existing, map[string]bool{"2022-01-10T09:15:00Z": true}) {
+				t.Errorf("Expected only 9:15 to exist, got %v", existing)
+			}
+
+			// Round members and observations
+			if roundMember, _ := store.GetRoundMember(3); roundMember.Observation != "MEAL" {
+				t.Errorf("Expected round member 3 to be the MEAL observation, got %+v", roundMember)
+			}
+			roundMembers, _ := store.GetRoundMembersForRound(1)
+			if got := roundMemberKeys(roundMembers); !reflect.DeepEqual(got, []string{"patient2@2022-01-10T09:03:00Z", "patient1@2022-01-10T09:02:00Z"}) {
+				t.Errorf("Expected round 1's members in the order they were added, got %v", got)
+			}
+			roundMembers, _ = store.GetRoundMembersForRounds([]uint{2, 1})
+			if got := roundMemberKeys(roundMembers); !reflect.DeepEqual(got, []string{"patient1@2022-01-10T09:02:00Z", "patient2@2022-01-10T09:03:00Z", "patient1@2022-01-10T09:17:00Z"}) {
+				t.Errorf("Expected members ordered by round then patient, got %v", got)
+			}
+			if roundMembers, _ := store.GetRoundMembersForRounds(nil); len(roundMembers) != 0 {
+				t.Errorf("Expected no members for no rounds, got %+v", roundMembers)
+			}
+			roundMembers, _ = store.GetObservedRoundMembersForPatient("patient1", at(9, 0), at(9, 30))
+			if got := roundMemberKeys(roundMembers); !reflect.DeepEqual(got, []string{"patient1@2022-01-10T09:02:00Z", "patient1@2022-01-10T09:17:00Z"}) {
+				t.Errorf("Expected patient 1's observations oldest first, got %v", got)
+			}
+			if roundMember, _ := store.GetLastObservedRoundMemberForPatient("patient1", at(9, 10)); roundMember.Observation != "SLEEPING" {
+				t.Errorf("Expected the SLEEPING observation to be the last before 9:10, got %+v", roundMember)
+			}
+			if roundMember, _ := store.GetLastObservedRoundMemberForPatient("patient1", at(8, 0)); roundMember.ID != 0 {
+				t.Errorf("Expected no observation before 8:00, got %+v", roundMember)
+			}
+
+			amendments, _ := store.GetAmendmentsForRounds([]uint{1, 2})
+			if len(amendments) != 3 || amendments[0].AmendedAt != "2022-01-10T10:00:00Z" || amendments[2].AmendedAt != "2022-01-10T11:00:00Z" {
+				t.Errorf("Expected 3 amendments in amended order, got %+v", amendments)
+			}
+
+			// Assignments, active from EffectiveFrom up to EffectiveTo
+			if roundAssignment, _ := store.GetRoundAssignment(2); roundAssignment.PatientId != "patient2" || roundAssignment.RoundTypeId != 2 {
+				t.Errorf("Expected assignment 2 to be patient 2's 30 minute round, got %+v", roundAssignment)
+			}
+			roundAssignments, _ := store.GetRoundAssignmentsForRoundType(1, at(8, 30))
+			if got := roundAssignmentIds(roundAssignments); !reflect.DeepEqual(got, []uint{1, 3}) {
+				t.Errorf("Expected assignments 1 and 3 at 8:30, got %v", got)
+			}
+			roundAssignments, _ = store.GetRoundAssignmentsForRoundType(1, at(9, 0))
+			if got := roundAssignmentIds(roundAssignments); !reflect.DeepEqual(got, []uint{1}) {
+				t.Errorf("Expected only assignment 1 at 9:00, got %v", got)
+			}
+			roundAssignments, _ = store.GetRoundAssignmentsForPatient("patient2")
+			if got := roundAssignmentIds(roundAssignments); !reflect.DeepEqual(got, []uint{2, 3}) {
+				t.Errorf("Expected patient 2's assignments 2 and 3, got %v", got)
+			}
+			roundAssignments, _ = store.GetOpenRoundAssignmentsForPatient("patient2")
+			if got := roundAssignmentIds(roundAssignments); !reflect.DeepEqual(got, []uint{2}) {
+				t.Errorf("Expected patient 2's open assignment 2, got %v", got)
+			}
+			if patientIds, _ := store.GetAssignedPatientIds(at(8, 30)); !reflect.DeepEqual(patientIds, []string{"patient1", "patient2", "patient3"}) {
+				t.Errorf("Expected every patient assigned at 8:30, got %v", patientIds)
+			}
+			if patientIds, _ := store.GetAssignedPatientIds(at(10, 0)); !reflect.DeepEqual(patientIds, []string{"patient1", "patient2"}) {
+				t.Errorf("Expected patient 3's assignment to have ended by 10:00, got %v", patientIds)
+			}
+
+			// Patients and census, where the later of two events at the same time wins
+			if patient, _ := store.GetPatient("patient1"); patient.Name != "Pat One" {
+				t.Errorf("Expected patient 1, got %+v", patient)
+			}
+			if patient, _ := store.GetPatient("patient9"); patient.ID != 0 {
+				t.Errorf("Expected no patient 9, got %+v", patient)
+			}
+			if census, _ := store.GetPatientCensusAtTime("patient1", at(9, 30)); census.CensusStatus != "ADMITTED" || census.Unit != "B" {
+				t.Errorf("Expected patient 1 admitted to unit B at 9:30, got %+v", census)
+			}
+			if census, _ := store.GetPatientCensusAtTime("patient1", at(7, 0)); census.ID != 0 {
+				t.Errorf("Expected no census for patient 1 before admission, got %+v", census)
+			}
+			if err := store.CreatePatient(&Patient{PatientId: "patient1"}); err == nil {
+				t.Errorf("Expected a duplicate patient id to be refused")
+			}
+
+			// Escalation contacts and notifications
+			contacts, _ := store.GetEscalationContacts("A", "CHARGE_NURSE")
+			if len(contacts) != 2 || contacts[0].Address != "nurseA" || contacts[1].Address != "a@example.com" {
+				t.Errorf("Expected unit A's two charge nurse contacts in order, got %+v", contacts)
+			}
+			if notification, _ := store.GetNotification("DUE_SOON", "2022-01-10T09:30:00Z", "A", 1); notification.ID != 2 {
+				t.Errorf("Expected notification 2, got %+v", notification)
+			}
+			if notification, _ := store.GetNotification("DUE_SOON", "2022-01-10T09:30:00Z", "B", 1); notification.ID != 0 {
+				t.Errorf("Expected no notification for unit B, got %+v", notification)
+			}
+			notifications, _ := store.GetInAppNotifications("nurseA", false)
+			if len(notifications) != 2 || notifications[0].Event != "OVERDUE" || notifications[1].Event != "DUE_SOON" {
+				t.Errorf("Expected the two sent notifications newest first, got %+v", notifications)
+			}
+			if notifications, _ := store.GetInAppNotifications("nurseA", true); len(notifications) != 1 || notifications[0].Event != "OVERDUE" {
+				t.Errorf("Expected only the unread notification, got %+v", notifications)
+			}
+
+			// Updates write the fields the engine changes
+			round, _ := store.GetRound(3)
+			round.Status, round.StartedAt, round.StartedBy = "STARTED", "2022-01-10T09:31:00Z", "nurseA"
+			if err := store.UpdateRoundStatus(&round, at(9, 31)); err != nil {
+				t.Fatalf("UpdateRoundStatus failed: %v", err)
+			}
+			if round, _ := store.GetRound(3); round.Status != "STARTED" || round.StartedAt != "2022-01-10T09:31:00Z" || round.StartedBy != "nurseA" {
+				t.Errorf("Expected round 3 started by nurseA, got %+v", round)
+			}
+			roundMember, _ := store.GetRoundMember(3)
+			roundMember.Observation, roundMember.ObservedAt, roundMember.ObservedBy = "SLEEPING", "2022-01-10T09:32:00Z", "nurseA"
+			if err := store.UpdateRoundMemberObservation(&roundMember); err != nil {
+				t.Fatalf("UpdateRoundMemberObservation failed: %v", err)
+			}
+			if roundMember, _ := store.GetRoundMember(3); roundMember.Observation != "SLEEPING" || roundMember.ObservedBy != "nurseA" {
+				t.Errorf("Expected round member 3 to be SLEEPING, got %+v", roundMember)
+			}
+
+			// Amendments are stored with the change they record, creating a round that was never materialized
+			missed := Round{RoundTimestamp: "2022-01-10T09:45:00Z", Status: "MISSED"}
+			amendment := RoundAmendment{Field: "status", OriginalValue: "NOT_STARTED", AmendedValue: "MISSED", ReasonCode: "LATE_ENTRY", AmendedAt: "2022-01-10T12:00:00Z"}
+			if err := store.AmendRoundStatus(&missed, &amendment, at(12, 0)); err != nil {
+				t.Fatalf("AmendRoundStatus failed: %v", err)
+			}
+			if round, _ := store.GetRoundForTime(at(9, 45)); round.ID == 0 || round.ID != missed.ID || round.Status != "MISSED" {
+				t.Errorf("Expected a MISSED round at 9:45, got %+v", round)
+			}
+			if amendments, _ := store.GetAmendmentsForRounds([]uint{missed.ID}); len(amendments) != 1 || amendments[0].ID != amendment.ID || amendments[0].RoundId != missed.ID {
+				t.Errorf("Expected the amendment on the 9:45 round, got %+v", amendments)
+			}
+			duplicate := Round{RoundTimestamp: "2022-01-10T09:45:00Z", Status: "COMPLETE"}
+			if err := store.AmendRoundStatus(&duplicate, &RoundAmendment{Field: "status", AmendedAt: "2022-01-10T12:00:00Z"}, at(12, 0)); err == nil {
+				t.Errorf("Expected a second round at 9:45 to be refused")
+			}
+			roundMember.Observation = "AWAKE"
+			amendment = RoundAmendment{RoundId: roundMember.RoundId, RoundMemberId: roundMember.ID, Field: "observation", OriginalValue: "SLEEPING", AmendedValue: "AWAKE", ReasonCode: "DOCUMENTATION_ERROR", AmendedAt: "2022-01-10T12:00:00Z"}
+			if err := store.AmendRoundMemberObservation(&roundMember, &amendment); err != nil {
+				t.Fatalf("AmendRoundMemberObservation failed: %v", err)
+			}
+			if roundMember, _ := store.GetRoundMember(3); roundMember.Observation != "AWAKE" {
+				t.Errorf("Expected round member 3 to be AWAKE, got %+v", roundMember)
+			}
+			if amendments, _ := store.GetAmendmentsForRounds([]uint{roundMember.RoundId}); amendments[len(amendments)-1].ID != amendment.ID {
+				t.Errorf("Expected the observation amendment to be stored, got %+v", amendments)
+			}
+		})
+	}
+}
+
+// CreateRounds and StartRounds give the same results on every store
+func TestRoundsEngineConformance(t *testing.T) {
+	currTime := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+	results := make(map[string][]StartRoundsItem)
+	members := make(map[string][]string)
+
+	for name, newStore := range roundsStoreFactories {
+		store := newStore()
+		for _, duration := range []int{15, 30} {
+			store.CreateRoundType(&RoundType{Name: "Round", DurationAmt: duration, DurationUnit: "minutes"})
+		}
+		store.CreateRoundConfig(&RoundConfig{RoundTypeId: 1, Enabled: true, Unit: "A"})
+		store.CreateRoundConfig(&RoundConfig{RoundTypeId: 2, Enabled: true})
+		store.CreateRoundAssignment(&RoundAssignment{RoundTypeId: 1, PatientId: "patient1", EffectiveFrom: "2022-01-10T09:00:00Z"})
+		store.CreateRoundAssignment(&RoundAssignment{RoundTypeId: 2, PatientId: "patient2"})
+		store.CreatePatient(&Patient{PatientId: "patient1", CensusStatus: "ADMITTED", Unit: "A"})
+		store.CreatePatientCensusEvent(&PatientCensusEvent{PatientId: "patient1", CensusStatus: "ADMITTED", Unit: "A", EffectiveAt: "2022-01-10T08:00:00Z"})
+
+		CreateRounds(store, time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC))
+		CreateRounds(store, currTime)
+
+		startRoundsItems, err := StartRounds(store, currTime.Add(-time.Hour), currTime.Add(15*time.Minute))
+		if err != nil {
+			t.Fatalf("%s: StartRounds failed: %v", name, err)
+		}
+		results[name] = startRoundsItems
+
+		rounds, _ := store.GetRounds(currTime.Add(-12*time.Hour), currTime)
+		for _, round := range rounds {
+			roundMembers, _ := store.GetRoundMembersForRound(round.ID)
+			for _, roundMember := range roundMembers {
+				members[name] = append(members[name], round.RoundTimestamp+" "+roundMember.PatientId+" "+roundMember.Unit)
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(results["gorm"], results["memory"]) {
+		t.Errorf("Expected the same start rounds items, got gorm %+v and memory %+v", results["gorm"], results["memory"])
+	}
+	if len(members["gorm"]) == 0 || !reflect.DeepEqual(members["gorm"], members["memory"]) {
+		t.Errorf("Expected the same round members, got gorm %v and memory %v", members["gorm"], members["memory"])
+	}
+}
+
+// Offline uploads are applied the same way on every store
+func TestApplySyncUploadConformance(t *testing.T) {
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	upload := SyncUpload{DeviceId: "tabletA", Operations: []SyncOperation{
+		{ClientId: "a-1", Type: "start_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:02:00Z"},
+		{ClientId: "a-2", Type: "start_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseB", DeviceTime: "2022-01-10T09:01:00Z"},
+		{ClientId: "a-3", Type: "record_observation", RoundTimestamp: "2022-01-10T09:00:00Z", PatientId: "patient1", Observation: "SLEEPING", StaffId: "nurseA", DeviceTime: "2022-01-10T09:03:00Z"},
+		{ClientId: "a-4", Type: "record_observation", RoundTimestamp: "2022-01-10T09:00:00Z", PatientId: "patient1", Observation: "AWAKE", StaffId: "nurseB", DeviceTime: "2022-01-10T09:04:00Z"},
+		{ClientId: "a-5", Type: "complete_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:05:00Z"},
+		{ClientId: "a-6", Type: "complete_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T07:00:00Z"},
+	}}
+	expected := []string{"SUPERSEDED", "APPLIED", "APPLIED", "SUPERSEDED", "APPLIED", "REJECTED"}
+
+	for name, newStore := range roundsStoreFactories {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+			store.CreateRoundType(&RoundType{Name: "Round", DurationAmt: 15, DurationUnit: "minutes"})
+			store.CreateRoundConfig(&RoundConfig{RoundTypeId: 1, Enabled: true})
+			store.CreateRoundAssignment(&RoundAssignment{RoundTypeId: 1, PatientId: "patient1"})
+			CreateRounds(store, roundTime)
+
+			results, err := ApplySyncUpload(store, upload, roundTime.Add(time.Hour))
+			if err != nil {
+				t.Fatalf("ApplySyncUpload failed: %v", err)
+			}
+			for i, result := range results {
+				if result.Outcome != expected[i] {
+					t.Errorf("Expected %s to be %s, got %+v", result.ClientId, expected[i], result)
+				}
+			}
+
+			// The earlier start wins whatever order the operations were uploaded in
+			round, _ := store.GetRoundForTime(roundTime)
+			if round.Status != "COMPLETE" || round.StartedAt != "2022-01-10T09:01:00Z" || round.StartedBy != "nurseB" || round.CompletedBy != "nurseA" {
+				t.Errorf("Expected the round started by nurseB at 9:01 and completed by nurseA, got %+v", round)
+			}
+			roundMembers, _ := store.GetRoundMembersForRound(round.ID)
+			if len(roundMembers) != 1 || roundMembers[0].Observation != "SLEEPING" || roundMembers[0].ObservedBy != "nurseA" {
+				t.Errorf("Expected nurseA's observation to stand, got %+v", roundMembers)
+			}
+			if operation, _ := store.GetSyncOperation("a-6"); operation.Outcome != "REJECTED" {
+				t.Errorf("Expected the rejected operation to be recorded, got %+v", operation)
+			}
+			if clientId, _ := store.GetAppliedSyncClientId("2022-01-10T09:00:00Z", "", "2022-01-10T09:01:00Z", []string{"start_round"}); clientId != "a-2" {
+				t.Errorf("Expected a-2 to have set the start, got %q", clientId)
+			}
+
+			// Uploading again answers from the recorded outcomes
+			again, _ := ApplySyncUpload(store, upload, roundTime.Add(2*time.Hour))
+			for i, result := range again {
+				if !result.Duplicate || result.Outcome != expected[i] {
+					t.Errorf("Expected %s to be a duplicate %s, got %+v", result.ClientId, expected[i], result)
+				}
+			}
+		})
+	}
+}
+
+// The scheduling logic runs without a database
+func TestCreateRoundsInMemory(t *testing.T) {
+	store := NewMemoryRoundsStore()
+	store.CreateRoundType(&RoundType{Name: "15 Minute Round", DurationAmt: 15, DurationUnit: "minutes"})
+	store.CreateRoundConfig(&RoundConfig{RoundTypeId: 1, Enabled: true})
+	store.CreateRoundAssignment(&RoundAssignment{RoundTypeId: 1, PatientId: "patient1"})
+
+	CreateRounds(store, time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC))
+
+	// 12 hours back from 9:30, every 15 minutes, inclusive
+	rounds, _ := store.GetRounds(time.Date(2022, time.January, 9, 0, 0, 0, 0, time.UTC), time.Date(2022, time.January, 11, 0, 0, 0, 0, time.UTC))
+	if len(rounds) != 49 {
+		t.Fatalf("Expected 49 rounds, got %d", len(rounds))
+	}
+	events := store.OutboxEvents()
+	if len(events) != 49 || events[0].EventType != "round.created" || events[0].RoundId != rounds[0].ID {
+		t.Errorf("Expected a round.created event per round, got %d events starting %+v", len(events), events[0])
+	}
+	roundMembers, _ := store.GetRoundMembersForRound(rounds[48].ID)
+	if len(roundMembers) != 1 || roundMembers[0].PatientId != "patient1" {
+		t.Errorf("Expected patient 1 on the 9:30 round, got %+v", roundMembers)
+	}
+}
+
+// Rounds are documented and amended without a database too, with the outbox events that go with them
+func TestRoundStatusInMemory(t *testing.T) {
+	store := NewMemoryRoundsStore()
+	store.CreateRoundType(&RoundType{Name: "15 Minute Round", DurationAmt: 15, DurationUnit: "minutes"})
+	store.CreateRoundConfig(&RoundConfig{RoundTypeId: 1, Enabled: true})
+	store.CreateRoundAssignment(&RoundAssignment{RoundTypeId: 1, PatientId: "patient1"})
+	roundTime := time.Date(2022, time.January, 10, 9, 30, 0, 0, time.UTC)
+
+	if _, err := StartRound(store, roundTime, "nurseA", roundTime); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	roundMembers, _ := store.GetRoundMembersForRound(1)
+	if _, err := RecordObservation(store, roundMembers[len(roundMembers)-1].ID, "SLEEPING", "nurseA", roundTime); err != nil {
+		t.Fatalf("RecordObservation failed: %v", err)
+	}
+	round, err := CompleteRound(store, roundTime, "nurseA", roundTime.Add(5*time.Minute))
+	if err != nil || round.Status != "COMPLETE" {
+		t.Fatalf("Expected the round completed, got %+v and %v", round, err)
+	}
+	if _, err := AmendRoundStatus(store, roundTime, "MISSED", "DOCUMENTATION_ERROR", "", "nurseA", roundTime.Add(2*time.Hour)); err != nil {
+		t.Fatalf("AmendRoundStatus failed: %v", err)
+	}
+
+	events := store.OutboxEvents()
+	var types []string
+	for _, event := range events[len(events)-3:] {
+		types = append(types, event.EventType)
+	}
+	if !reflect.DeepEqual(types, []string{"round.started", "round.completed", "round.missed"}) {
+		t.Errorf("Expected the started, completed and missed events last, got %v", types)
+	}
+}
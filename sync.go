@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How far ahead of the server a device clock can be before its operations are rejected
+const syncMaxClockSkew = 5 * time.Minute
+
+var syncOperationTypes = map[string]bool{
+	"start_round":        true,
+	"complete_round":     true,
+	"record_observation": true,
+}
+
+// What a device needs to do rounds offline: the upcoming slots with their patients, and the assignments behind them
+type SyncSnapshot struct {
+	GeneratedAt string           `json:"generatedAt"`
+	Unit        string           `json:"unit"`
+	Slots       []SyncSlot       `json:"slots"`
+	Assignments []SyncAssignment `json:"assignments"`
+}
+
+// Status is the round's status on the server, or NOT_STARTED if it hasn't been created yet
+type SyncSlot struct {
+	RoundTimestamp string        `json:"roundTimestamp"`
+	Status         string        `json:"status"`
+	RoundTypes     []string      `json:"roundTypes"`
+	Patients       []SyncPatient `json:"patients"`
+}
+
+type SyncPatient struct {
+	PatientId   string `json:"patientId"`
+	Name        string `json:"name"`
+	Bed         string `json:"bed"`
+	Status      string `json:"status"`
+	Observation string `json:"observation"`
+	ObservedAt  string `json:"observedAt"`
+}
+
+type SyncAssignment struct {
+	PatientId     string `json:"patientId"`
+	RoundTypeId   uint   `json:"roundType"`
+	RoundTypeName string `json:"roundTypeName"`
+	EffectiveFrom string `json:"effectiveFrom"`
+	EffectiveTo   string `json:"effectiveTo"`
+}
+
+// A batch of operations recorded offline by one device
+type SyncUpload struct {
+	DeviceId   string          `json:"deviceId"`
+	Operations []SyncOperation `json:"operations"`
+}
+
+// What happened to an uploaded operation, with the server's state of the round and member afterwards
+// Duplicate is set when the operation had already been uploaded; the outcome is the one from the first upload
+type SyncResult struct {
+	ClientId    string       `json:"clientId"`
+	Type        string       `json:"type"`
+	Outcome     string       `json:"outcome"`
+	Detail      string       `json:"detail"`
+	Duplicate   bool         `json:"duplicate"`
+	Round       *Round       `json:"round,omitempty"`
+	RoundMember *RoundMember `json:"roundMember,omitempty"`
+}
+
+// Build the snapshot a device downloads before going offline, for a unit (or the whole clinic) for the hours after start time
+func BuildSyncSnapshot(db *gorm.DB, unit string, startTime time.Time, hours int, now time.Time) (SyncSnapshot, error) {
+	snapshot := SyncSnapshot{
+		GeneratedAt: now.UTC().Format(time.RFC3339),
+		Unit:        unit,
+		Slots:       []SyncSlot{},
+		Assignments: []SyncAssignment{},
+	}
+
+	sheet, err := BuildRoundsSheet(db, unit, startTime, hours)
+	if err != nil {
+		return snapshot, err
+	}
+
+	patientIds := make(map[string]bool)
+	for _, sheetSlot := range sheet.Slots {
+		slot := SyncSlot{
+			RoundTimestamp: sheetSlot.RoundTime.UTC().Format(time.RFC3339),
+			Status:         "NOT_STARTED",
+			RoundTypes:     sheetSlot.RoundTypes,
+			Patients:       []SyncPatient{},
+		}
+
+		// Rounds that already exist carry their status and any observations made so far
+		observations := make(map[string]RoundMember)
+		round, err := getRoundForTime(db, sheetSlot.RoundTime)
+		if err != nil {
+			return snapshot, err
+		}
+		if round.ID != 0 {
+			slot.Status = round.Status
+			roundMembers, err := getRoundMembersForRound(db, round.ID)
+			if err != nil {
+				return snapshot, err
+			}
+			for _, roundMember := range roundMembers {
+				observations[roundMember.PatientId] = roundMember
+			}
+		}
+
+		for _, patient := range sheetSlot.Patients {
+			patientIds[patient.PatientId] = true
+			slot.Patients = append(slot.Patients, SyncPatient{
+				PatientId:   patient.PatientId,
+				Name:        patient.Name,
+				Bed:         patient.Bed,
+				Status:      patient.Status,
+				Observation: observations[patient.PatientId].Observation,
+				ObservedAt:  observations[patient.PatientId].ObservedAt,
+			})
+		}
+		snapshot.Slots = append(snapshot.Slots, slot)
+	}
+
+	// The assignments that overlap the window for the patients on the snapshot
+	roundTypeNames := make(map[uint]string)
+	var sortedPatientIds []string
+	for patientId := range patientIds {
+		sortedPatientIds = append(sortedPatientIds, patientId)
+	}
+	sort.Strings(sortedPatientIds)
+	for _, patientId := range sortedPatientIds {
+		roundAssignments, err := getRoundAssignmentsForPatient(db, patientId)
+		if err != nil {
+			return snapshot, err
+		}
+		for _, roundAssignment := range roundAssignments {
+			if roundAssignment.EffectiveTo != "" && roundAssignment.EffectiveTo <= sheet.StartTime.UTC().Format(time.RFC3339) {
+				continue
+			}
+			if roundAssignment.EffectiveFrom != "" && roundAssignment.EffectiveFrom >= sheet.EndTime.UTC().Format(time.RFC3339) {
+				continue
+			}
+			if _, ok := roundTypeNames[roundAssignment.RoundTypeId]; !ok {
+				roundType, err := getRoundType(db, roundAssignment.RoundTypeId)
+				if err != nil {
+					return snapshot, err
+				}
+				roundTypeNames[roundAssignment.RoundTypeId] = roundType.Name
+			}
+			snapshot.Assignments = append(snapshot.Assignments, SyncAssignment{
+				PatientId:     roundAssignment.PatientId,
+				RoundTypeId:   roundAssignment.RoundTypeId,
+				RoundTypeName: roundTypeNames[roundAssignment.RoundTypeId],
+				EffectiveFrom: roundAssignment.EffectiveFrom,
+				EffectiveTo:   roundAssignment.EffectiveTo,
+			})
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Apply the operations a device recorded offline and report what happened to each, in the order they were uploaded
+// Operations are applied in device time order, so the result doesn't depend on which device uploads first:
+// the earliest start, completion or observation of a round or member wins, with ties going to the lower client id
+// Operations that lose are kept with a SUPERSEDED outcome so nothing a device recorded is lost
+func ApplySyncUpload(store RoundsStore, upload SyncUpload, receivedAt time.Time) ([]SyncResult, error) {
+	operations := make([]SyncOperation, len(upload.Operations))
+	copy(operations, upload.Operations)
+	sort.SliceStable(operations, func(i, j int) bool {
+		return syncBefore(normalizeSyncTime(operations[i].DeviceTime), operations[i].ClientId, normalizeSyncTime(operations[j].DeviceTime), operations[j].ClientId)
+	})
+
+	resultsByClientId := make(map[string]SyncResult)
+	for _, operation := range operations {
+		operation.DeviceId = upload.DeviceId
+		result, err := applySyncOperation(store, operation, receivedAt)
+		if err != nil {
+			return nil, err
+		}
+		resultsByClientId[operation.ClientId] = result
+	}
+
+	results := []SyncResult{}
+	for _, operation := range upload.Operations {
+		results = append(results, resultsByClientId[operation.ClientId])
+	}
+	return results, nil
+}
+
+// Parse a device timestamp into the UTC RFC3339 form stored on rounds, or return it unchanged if it isn't valid
+func normalizeSyncTime(value string) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Order operations by device time, then client id
+func syncBefore(aTime string, aClientId string, bTime string, bClientId string) bool {
+	if aTime != bTime {
+		return aTime < bTime
+	}
+	return aClientId < bClientId
+}
+
+// Check an operation, returning why it can't be applied
+func validateSyncOperation(operation SyncOperation, receivedAt time.Time) error {
+	if !syncOperationTypes[operation.Type] {
+		return fmt.Errorf("unknown operation type %q", operation.Type)
+	}
+	roundTime, err := time.Parse(time.RFC3339, operation.RoundTimestamp)
+	if err != nil {
+		return fmt.Errorf("invalid round timestamp %q, expected RFC3339", operation.RoundTimestamp)
+	}
+	if roundTime.Sub(receivedAt) > syncMaxClockSkew {
+		return fmt.Errorf("round timestamp %s is ahead of the server, rounds can't be recorded before they happen", operation.RoundTimestamp)
+	}
+	deviceTime, err := time.Parse(time.RFC3339, operation.DeviceTime)
+	if err != nil {
+		return fmt.Errorf("invalid device time %q, expected RFC3339", operation.DeviceTime)
+	}
+	if deviceTime.Sub(receivedAt) > syncMaxClockSkew {
+		return fmt.Errorf("device time %s is ahead of the server, check the device clock", operation.DeviceTime)
+	}
+	// A round can be started a little ahead of time, as online, but nothing is done on it before that
+	if roundTime.Sub(deviceTime) > maxRoundTimeAhead {
+		return fmt.Errorf("device time %s is more than %v before the round at %s, check the device clock", operation.DeviceTime, maxRoundTimeAhead, operation.RoundTimestamp)
+	}
+	if operation.StaffId == "" {
+		return errors.New("staff id is required")
+	}
+	if operation.Type == "record_observation" && (operation.PatientId == "" || operation.Observation == "") {
+		return errors.New("patient id and observation are required")
+	}
+	return nil
+}
+
+// Apply one operation, or return the outcome from when it was first uploaded
+func applySyncOperation(store RoundsStore, operation SyncOperation, receivedAt time.Time) (SyncResult, error) {
+	result := SyncResult{ClientId: operation.ClientId, Type: operation.Type}
+	if operation.ClientId == "" {
+		result.Outcome = "REJECTED"
+		result.Detail = "client id is required"
+		return result, nil
+	}
+
+	existing, err := store.GetSyncOperation(operation.ClientId)
+	if err != nil {
+		return result, err
+	}
+	if existing.ID != 0 {
+		result.Outcome = existing.Outcome
+		result.Detail = existing.Detail
+		result.Duplicate = true
+		return result, nil
+	}
+
+	operation.ID = 0
+	operation.ReceivedAt = receivedAt.UTC().Format(time.RFC3339)
+	operation.Outcome = "REJECTED"
+
+	// Rejected operations are still recorded, so a retry gets the same answer
+	if err := validateSyncOperation(operation, receivedAt); err != nil {
+		operation.Detail = err.Error()
+		result.Outcome, result.Detail = operation.Outcome, operation.Detail
+		return result, store.CreateSyncOperation(&operation)
+	}
+	operation.DeviceTime = normalizeSyncTime(operation.DeviceTime)
+	operation.RoundTimestamp = normalizeSyncTime(operation.RoundTimestamp)
+	if operation.Type != "record_observation" {
+		operation.PatientId = ""
+		operation.Observation = ""
+	}
+
+	// The round may not have been created yet if the task runner was behind
+	roundTime, _ := time.Parse(time.RFC3339, operation.RoundTimestamp)
+	round, err := getOrCreateRoundForTime(store, roundTime, receivedAt)
+	if err != nil {
+		operation.Detail = err.Error()
+		result.Outcome, result.Detail = operation.Outcome, operation.Detail
+		return result, store.CreateSyncOperation(&operation)
+	}
+
+	// Each change goes in with the operation that made it, so a failed write leaves neither
+	deviceTime, _ := time.Parse(time.RFC3339, operation.DeviceTime)
+	var roundMember RoundMember
+	statusChanged := false
+	switch operation.Type {
+	case "start_round":
+		operation.Outcome, operation.Detail, statusChanged, err = applySyncStart(store, &round, operation)
+	case "complete_round":
+		operation.Outcome, operation.Detail, statusChanged, err = applySyncComplete(store, &round, operation)
+	case "record_observation":
+		roundMember, operation.Outcome, operation.Detail, err = applySyncObservation(store, round, operation)
+	}
+	if err != nil {
+		return result, err
+	}
+	switch {
+	case operation.Outcome != "APPLIED":
+		err = store.CreateSyncOperation(&operation)
+	case operation.Type == "record_observation":
+		err = store.ApplySyncObservation(&roundMember, &operation)
+	default:
+		err = store.ApplySyncRound(&round, &operation, statusChanged, deviceTime)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	result.Round = &round
+	if roundMember.ID != 0 {
+		result.RoundMember = &roundMember
+	}
+	result.Outcome, result.Detail = operation.Outcome, operation.Detail
+	return result, nil
+}
+
+// Start a round, or move its start earlier if this device started it first
+// The round is changed in place when the start applies, and whether its status changed is returned for the event
+func applySyncStart(store RoundsStore, round *Round, operation SyncOperation) (string, string, bool, error) {
+	if round.Status == "MISSED" {
+		return "REJECTED", "round was documented as MISSED", false, nil
+	}
+
+	if round.StartedAt != "" {
+		startedBy, err := store.GetAppliedSyncClientId(round.RoundTimestamp, "", round.StartedAt, []string{"start_round", "complete_round"})
+		if err != nil {
+			return "", "", false, err
+		}
+		if !syncBefore(operation.DeviceTime, operation.ClientId, round.StartedAt, startedBy) {
+			return "SUPERSEDED", fmt.Sprintf("round was already started at %s by %s", round.StartedAt, round.StartedBy), false, nil
+		}
+	}
+
+	detail := "round started"
+	if round.StartedAt != "" {
+		detail = fmt.Sprintf("earlier start replaces the start at %s by %s", round.StartedAt, round.StartedBy)
+	}
+	statusChanged := round.Status == "CREATED"
+	if statusChanged {
+		round.Status = "STARTED"
+	}
+	round.StartedAt = operation.DeviceTime
+	round.StartedBy = operation.StaffId
+	return "APPLIED", detail, statusChanged, nil
+}
+
+// Complete a round, or move its completion earlier if this device completed it first
+// The round is changed in place when the completion applies, and whether its status changed is returned for the event
+func applySyncComplete(store RoundsStore, round *Round, operation SyncOperation) (string, string, bool, error) {
+	if round.Status == "MISSED" {
+		return "REJECTED", "round was documented as MISSED", false, nil
+	}
+
+	if round.Status == "COMPLETE" {
+		completedBy, err := store.GetAppliedSyncClientId(round.RoundTimestamp, "", round.CompletedAt, []string{"complete_round"})
+		if err != nil {
+			return "", "", false, err
+		}
+		if !syncBefore(operation.DeviceTime, operation.ClientId, round.CompletedAt, completedBy) {
+			return "SUPERSEDED", fmt.Sprintf("round was already completed at %s by %s", round.CompletedAt, round.CompletedBy), false, nil
+		}
+	}
+
+	detail := "round completed"
+	if round.Status == "COMPLETE" {
+		detail = fmt.Sprintf("earlier completion replaces the completion at %s by %s", round.CompletedAt, round.CompletedBy)
+	}
+	statusChanged := round.Status != "COMPLETE"
+	// A round can't be completed before it was started, so a completion before the start moves the start back to it
+	if round.StartedAt == "" || operation.DeviceTime < round.StartedAt {
+		if round.StartedAt != "" {
+			detail += fmt.Sprintf(", and moves the start at %s by %s back to it", round.StartedAt, round.StartedBy)
+		}
+		round.StartedAt = operation.DeviceTime
+		round.StartedBy = operation.StaffId
+	}
+	round.Status = "COMPLETE"
+	round.CompletedAt = operation.DeviceTime
+	round.CompletedBy = operation.StaffId
+	return "APPLIED", detail, statusChanged, nil
+}
+
+// Record an observation, or replace one recorded later by another device
+// Observations made after the round was completed have to go through AmendObservation
+// The member is changed in place when the observation applies
+func applySyncObservation(store RoundsStore, round Round, operation SyncOperation) (RoundMember, string, string, error) {
+	var roundMember RoundMember
+	roundMembers, err := store.GetRoundMembersForRound(round.ID)
+	if err != nil {
+		return roundMember, "", "", err
+	}
+	for _, member := range roundMembers {
+		if member.PatientId == operation.PatientId {
+			roundMember = member
+			break
+		}
+	}
+	if roundMember.ID == 0 {
+		return roundMember, "REJECTED", fmt.Sprintf("patient %s is not on the round at %s", operation.PatientId, round.RoundTimestamp), nil
+	}
+	if round.Status == "MISSED" {
+		return roundMember, "REJECTED", "round was documented as MISSED", nil
+	}
+	if round.Status == "COMPLETE" && operation.DeviceTime > round.CompletedAt {
+		return roundMember, "REJECTED", fmt.Sprintf("round was completed at %s before this observation, amend it instead", round.CompletedAt), nil
+	}
+
+	if roundMember.ObservedAt != "" {
+		observedBy, err := store.GetAppliedSyncClientId(round.RoundTimestamp, operation.PatientId, roundMember.ObservedAt, []string{"record_observation"})
+		if err != nil {
+			return roundMember, "", "", err
+		}
+		if !syncBefore(operation.DeviceTime, operation.ClientId, roundMember.ObservedAt, observedBy) {
+			return roundMember, "SUPERSEDED", fmt.Sprintf("patient was already observed %s at %s by %s", roundMember.Observation, roundMember.ObservedAt, roundMember.ObservedBy), nil
+		}
+	}
+
+	detail := "observation recorded"
+	if roundMember.ObservedAt != "" {
+		detail = fmt.Sprintf("earlier observation replaces %s at %s by %s", roundMember.Observation, roundMember.ObservedAt, roundMember.ObservedBy)
+	}
+	roundMember.Observation = operation.Observation
+	roundMember.ObservedAt = operation.DeviceTime
+	roundMember.ObservedBy = operation.StaffId
+	return roundMember, "APPLIED", detail, nil
+}
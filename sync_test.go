@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildSyncSnapshot(t *testing.T) {
+	db := setupRoundsSheet(t)
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	if _, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(time.Minute)); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	round, _ := getRoundForTime(db, roundTime)
+	roundMembers, _ := getRoundMembersForRound(db, round.ID)
+	for _, roundMember := range roundMembers {
+		if roundMember.PatientId == "patient1" {
+			RecordObservation(NewGormRoundsStore(db), roundMember.ID, "SLEEPING", "nurseA", roundTime.Add(2*time.Minute))
+		}
+	}
+
+	snapshot, err := BuildSyncSnapshot(db, "A", roundTime, 1, roundTime)
+	if err != nil {
+		t.Fatalf("BuildSyncSnapshot failed: %v", err)
+	}
+	if len(snapshot.Slots) != 4 {
+		t.Fatalf("Expected 4 slots, got %+v", snapshot.Slots)
+	}
+
+	// The 9:00 round exists and carries the observation made so far. The rest haven't been created yet
+	if snapshot.Slots[0].Status != "STARTED" || snapshot.Slots[1].Status != "NOT_STARTED" {
+		t.Errorf("Expected the 9:00 round started and the 9:15 round not started, got %+v", snapshot.Slots[:2])
+	}
+	patient := snapshot.Slots[0].Patients[0]
+	if patient.PatientId != "patient1" || patient.Observation != "SLEEPING" || patient.ObservedAt != "2022-01-10T09:02:00Z" {
+		t.Errorf("Expected patient 1's observation on the 9:00 slot, got %+v", patient)
+	}
+
+	// Patient 1 has three assignments and patient 2 has one. Patient 3 is on unit B
+	if len(snapshot.Assignments) != 4 {
+		t.Fatalf("Expected 4 assignments, got %+v", snapshot.Assignments)
+	}
+	if snapshot.Assignments[3].PatientId != "patient2" || snapshot.Assignments[3].RoundTypeName != "30 Minute Round" {
+		t.Errorf("Expected patient 2's 30 minute assignment, got %+v", snapshot.Assignments[3])
+	}
+}
+
+// Two devices completing the 9:00 round offline, uploaded in either order
+func TestApplySyncUploadCompletionConflict(t *testing.T) {
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	receivedAt := roundTime.Add(time.Hour)
+	deviceA := SyncUpload{DeviceId: "tabletA", Operations: []SyncOperation{
+		{ClientId: "a-1", Type: "start_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:01:00Z"},
+		{ClientId: "a-2", Type: "complete_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:06:00Z"},
+	}}
+	deviceB := SyncUpload{DeviceId: "tabletB", Operations: []SyncOperation{
+		// Device times in other zones are compared in UTC
+		{ClientId: "b-1", Type: "complete_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseB", DeviceTime: "2022-01-10T04:04:00-05:00"},
+	}}
+
+	for _, uploads := range [][]SyncUpload{{deviceA, deviceB}, {deviceB, deviceA}} {
+		db := setupDatabase()
+		setupRoundConfigs(db)
+		for _, upload := range uploads {
+			if _, err := ApplySyncUpload(NewGormRoundsStore(db), upload, receivedAt); err != nil {
+				t.Fatalf("ApplySyncUpload failed: %v", err)
+			}
+		}
+
+		// Device B completed it first, and device A started it first
+		round, _ := getRoundForTime(db, roundTime)
+		if round.Status != "COMPLETE" || round.CompletedBy != "nurseB" || round.CompletedAt != "2022-01-10T09:04:00Z" {
+			t.Errorf("Expected nurseB's completion at 9:04 to win, got %+v", round)
+		}
+		if round.StartedBy != "nurseA" || round.StartedAt != "2022-01-10T09:01:00Z" {
+			t.Errorf("Expected nurseA's start at 9:01 to win, got %+v", round)
+		}
+
+		// The round was completed once, whichever device uploaded first
+		var completed int64
+		db.Model(&OutboxEvent{}).Where("event_type = ?", "round.completed").Count(&completed)
+		if completed != 1 {
+			t.Errorf("Expected 1 round.completed event, got %d", completed)
+		}
+		var operation SyncOperation
+		db.Where("client_id = ?", "a-2").First(&operation)
+		if operation.DeviceId != "tabletA" || operation.ReceivedAt != "2022-01-10T10:00:00Z" {
+			t.Errorf("Expected the operation to be recorded, got %+v", operation)
+		}
+	}
+}
+
+// One device starting and completing the 9:00 round after another device completed it, uploaded in either order
+func TestApplySyncUploadCompletionBeforeStart(t *testing.T) {
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	receivedAt := roundTime.Add(time.Hour)
+	deviceA := SyncUpload{DeviceId: "tabletA", Operations: []SyncOperation{
+		{ClientId: "a-1", Type: "start_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:08:00Z"},
+		{ClientId: "a-2", Type: "complete_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:10:00Z"},
+	}}
+	deviceB := SyncUpload{DeviceId: "tabletB", Operations: []SyncOperation{
+		{ClientId: "b-1", Type: "complete_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseB", DeviceTime: "2022-01-10T09:05:00Z"},
+	}}
+
+	for _, uploads := range [][]SyncUpload{{deviceA, deviceB}, {deviceB, deviceA}} {
+		db := setupDatabase()
+		setupRoundConfigs(db)
+		for _, upload := range uploads {
+			if _, err := ApplySyncUpload(NewGormRoundsStore(db), upload, receivedAt); err != nil {
+				t.Fatalf("ApplySyncUpload failed: %v", err)
+			}
+		}
+
+		// Device B's completion wins, and the round can't have started after it was completed
+		round, _ := getRoundForTime(db, roundTime)
+		if round.CompletedAt != "2022-01-10T09:05:00Z" || round.CompletedBy != "nurseB" {
+			t.Errorf("Expected nurseB's completion at 9:05 to win, got %+v", round)
+		}
+		if round.StartedAt != "2022-01-10T09:05:00Z" || round.StartedBy != "nurseB" {
+			t.Errorf("Expected the start moved back to nurseB's completion at 9:05, got %+v", round)
+		}
+	}
+}
+
+func TestApplySyncUploadObservations(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	receivedAt := time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC)
+
+	upload := SyncUpload{DeviceId: "tabletA", Operations: []SyncOperation{
+		{ClientId: "a-3", Type: "record_observation", RoundTimestamp: "2022-01-10T09:00:00Z", PatientId: "patient1", Observation: "AWAKE", StaffId: "nurseA", DeviceTime: "2022-01-10T09:03:00Z"},
+		{ClientId: "a-1", Type: "record_observation", RoundTimestamp: "2022-01-10T09:00:00Z", PatientId: "patient1", Observation: "SLEEPING", StaffId: "nurseA", DeviceTime: "2022-01-10T09:02:00Z"},
+		{ClientId: "a-2", Type: "complete_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:05:00Z"},
+		{ClientId: "a-4", Type: "record_observation", RoundTimestamp: "2022-01-10T09:00:00Z", PatientId: "patient3", Observation: "AWAKE", StaffId: "nurseA", DeviceTime: "2022-01-10T09:07:00Z"},
+		{ClientId: "a-5", Type: "record_observation", RoundTimestamp: "2022-01-10T09:15:00Z", PatientId: "patient2", Observation: "AWAKE", StaffId: "nurseA", DeviceTime: "2022-01-10T09:16:00Z"},
+		{ClientId: "a-6", Type: "start_round", RoundTimestamp: "2022-01-10T09:30:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T10:30:00Z"},
+		{ClientId: "a-7", Type: "start_round", RoundTimestamp: "2022-01-10T09:07:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:07:00Z"},
+	}}
+	results, err := ApplySyncUpload(NewGormRoundsStore(db), upload, receivedAt)
+	if err != nil {
+		t.Fatalf("ApplySyncUpload failed: %v", err)
+	}
+
+	// Results come back in upload order. The earliest observation wins, and nothing can be recorded after completion
+	expected := []struct {
+		clientId string
+		outcome  string
+	}{
+		{"a-3", "SUPERSEDED"},
+		{"a-1", "APPLIED"},
+		{"a-2", "APPLIED"},
+		{"a-4", "REJECTED"},
+		{"a-5", "REJECTED"},
+		{"a-6", "REJECTED"},
+		{"a-7", "REJECTED"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %+v", len(expected), results)
+	}
+	for i, result := range expected {
+		if results[i].ClientId != result.clientId || results[i].Outcome != result.outcome {
+			t.Errorf("Expected %s to be %s, got %+v", result.clientId, result.outcome, results[i])
+		}
+	}
+	if results[1].RoundMember == nil || results[1].RoundMember.Observation != "SLEEPING" {
+		t.Errorf("Expected the applied observation to come back with the round member, got %+v", results[1])
+	}
+
+	// An observation made after completion on another device is rejected, one made before it replaces a later one
+	late := SyncUpload{DeviceId: "tabletB", Operations: []SyncOperation{
+		{ClientId: "b-1", Type: "record_observation", RoundTimestamp: "2022-01-10T09:00:00Z", PatientId: "patient3", Observation: "MEAL", StaffId: "nurseB", DeviceTime: "2022-01-10T09:06:00Z"},
+		{ClientId: "b-2", Type: "record_observation", RoundTimestamp: "2022-01-10T09:00:00Z", PatientId: "patient3", Observation: "GROUP", StaffId: "nurseB", DeviceTime: "2022-01-10T09:04:00Z"},
+	}}
+	results, _ = ApplySyncUpload(NewGormRoundsStore(db), late, receivedAt)
+	if results[0].Outcome != "REJECTED" || results[1].Outcome != "APPLIED" {
+		t.Errorf("Expected the observation after completion rejected and the one before it applied, got %+v", results)
+	}
+
+	// Uploading again after a lost response returns the first outcomes without applying anything twice
+	results, _ = ApplySyncUpload(NewGormRoundsStore(db), upload, receivedAt.Add(time.Minute))
+	for i, result := range expected {
+		if !results[i].Duplicate || results[i].Outcome != result.outcome {
+			t.Errorf("Expected %s to be a duplicate %s, got %+v", result.clientId, result.outcome, results[i])
+		}
+	}
+	var operations int64
+	db.Model(&SyncOperation{}).Count(&operations)
+	if operations != 9 {
+		t.Errorf("Expected 9 recorded operations, got %d", operations)
+	}
+}
+
+// A round timestamp past the server's now is rejected without creating any rounds ahead of it
+func TestApplySyncUploadFutureRound(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	receivedAt := time.Date(2022, time.January, 10, 10, 0, 0, 0, time.UTC)
+	CreateRounds(NewGormRoundsStore(db), receivedAt)
+	var before int64
+	db.Model(&Round{}).Count(&before)
+
+	upload := SyncUpload{DeviceId: "tabletA", Operations: []SyncOperation{
+		{ClientId: "a-1", Type: "start_round", RoundTimestamp: "2022-01-20T10:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:59:00Z"},
+		{ClientId: "a-2", Type: "complete_round", RoundTimestamp: "2999-01-01T00:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T09:59:00Z"},
+	}}
+	results, err := ApplySyncUpload(NewGormRoundsStore(db), upload, receivedAt)
+	if err != nil {
+		t.Fatalf("ApplySyncUpload failed: %v", err)
+	}
+	for _, result := range results {
+		if result.Outcome != "REJECTED" {
+			t.Errorf("Expected %s to be rejected, got %+v", result.ClientId, result)
+		}
+	}
+
+	var after int64
+	db.Model(&Round{}).Count(&after)
+	if after != before {
+		t.Errorf("Expected no rounds to be created, went from %d to %d", before, after)
+	}
+
+	// Past the bound the engine won't create rounds either, whoever calls it
+	if _, err := StartRound(NewGormRoundsStore(db), time.Date(2022, time.January, 20, 10, 0, 0, 0, time.UTC), "nurseA", receivedAt); !errors.Is(err, errRoundInFuture) {
+		t.Errorf("Expected a round in the future error, got %v", err)
+	}
+	db.Model(&Round{}).Count(&after)
+	if after != before {
+		t.Errorf("Expected no rounds to be created, went from %d to %d", before, after)
+	}
+}
+
+// A device time well before the round it was recorded on is a device clock problem, not a round done early
+func TestApplySyncUploadDeviceTimeBeforeRound(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+
+	upload := SyncUpload{DeviceId: "tabletA", Operations: []SyncOperation{
+		{ClientId: "a-1", Type: "start_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2022-01-10T08:56:00Z"},
+		{ClientId: "a-2", Type: "complete_round", RoundTimestamp: "2022-01-10T09:00:00Z", StaffId: "nurseA", DeviceTime: "2021-01-10T09:05:00Z"},
+	}}
+	results, err := ApplySyncUpload(NewGormRoundsStore(db), upload, roundTime.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("ApplySyncUpload failed: %v", err)
+	}
+	if results[0].Outcome != "APPLIED" {
+		t.Errorf("Expected a start a few minutes early to be applied, got %+v", results[0])
+	}
+	if results[1].Outcome != "REJECTED" || !strings.Contains(results[1].Detail, "before the round") {
+		t.Errorf("Expected a completion a year early to be rejected, got %+v", results[1])
+	}
+	round, _ := getRoundForTime(db, roundTime)
+	if round.Status != "STARTED" || round.CompletedAt != "" {
+		t.Errorf("Expected the round to be left started, got %+v", round)
+	}
+}
+
+func TestSyncEndpoints(t *testing.T) {
+	db := setupRoundsSheet(t)
+	server := httptest.NewServer(newServer(db, RealClock{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/sync/download?unit=A&start=2022-01-10T09:00:00Z&hours=1")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	var snapshot SyncSnapshot
+	json.NewDecoder(resp.Body).Decode(&snapshot)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(snapshot.Slots) != 4 {
+		t.Errorf("Expected a snapshot with 4 slots, got %d %+v", resp.StatusCode, snapshot)
+	}
+
+	// Device times are checked against the server clock
+	deviceTime := time.Now().UTC().Truncate(time.Hour)
+	body, _ := json.Marshal(SyncUpload{DeviceId: "tabletA", Operations: []SyncOperation{
+		{ClientId: "a-1", Type: "start_round", RoundTimestamp: deviceTime.Format(time.RFC3339), StaffId: "nurseA", DeviceTime: deviceTime.Format(time.RFC3339)},
+		{ClientId: "a-2", Type: "complete_round", RoundTimestamp: deviceTime.Format(time.RFC3339), StaffId: "nurseA", DeviceTime: deviceTime.Add(-time.Hour).Format(time.RFC3339)},
+	}})
+	resp, err = http.Post(server.URL+"/sync/upload", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	var response struct {
+		Results  []SyncResult `json:"results"`
+		Rejected []string     `json:"rejected"`
+	}
+	json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(response.Results) != 2 || response.Results[0].Outcome != "APPLIED" {
+		t.Errorf("Expected the start to be applied, got %d %+v", resp.StatusCode, response)
+	}
+	if len(response.Rejected) != 1 || response.Rejected[0] != "a-2" {
+		t.Errorf("Expected the completion before the round to be listed as rejected, got %v", response.Rejected)
+	}
+
+	resp, _ = http.Post(server.URL+"/sync/upload", "application/json", bytes.NewReader([]byte(`{"operations": []}`)))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a device id, got %d", resp.StatusCode)
+	}
+}
@@ -1,53 +1,306 @@
 package main
 
 import (
-	"gorm.io/gorm"
+	"time"
 )
 
+// When a record was stored and last changed
+// Records are deleted outright, so there is no DeletedAt and no soft-deleted rows for queries to step around
+type Timestamps struct {
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
 type RoundType struct {
-	gorm.Model
 	ID           uint   `json:"id" gorm:"primaryKey"`
 	Name         string `json:"name"`
 	DurationAmt  int    `json:"durationAmt"`
 	DurationUnit string `json:"durationUnit"`
+	Timestamps
 }
 
+// Unit limits the config to patients on that unit. An empty unit applies to the whole clinic
+// AssignOnAdmit assigns the round type to every patient admitted or transferred to the unit
+// WindowStart and WindowEnd are HH:MM in UTC. Rounds are only scheduled from the start up to the end each day,
+// and the window runs overnight when the end is before the start. Both empty schedules rounds all day
 type RoundConfig struct {
-	gorm.Model
-	ID          uint `json:"id" gorm:"primaryKey"`
-	RoundTypeId uint `json:"roundType"`
-	Enabled     bool `json:"enabled"`
+	ID            uint   `json:"id" gorm:"primaryKey"`
+	RoundTypeId   uint   `json:"roundType"`
+	Enabled       bool   `json:"enabled"`
+	Unit          string `json:"unit"`
+	AssignOnAdmit bool   `json:"assignOnAdmit"`
+	WindowStart   string `json:"windowStart"`
+	WindowEnd     string `json:"windowEnd"`
+	Timestamps
 }
 
+// EffectiveFrom and EffectiveTo are RFC3339 timestamps. An empty value leaves that end of the assignment open
+// The assignment is active from EffectiveFrom (inclusive) up to EffectiveTo (exclusive)
 type RoundAssignment struct {
-	gorm.Model
-	ID          uint   `json:"id" gorm:"primaryKey"`
-	RoundTypeId uint   `json:"roundType"`
-	PatientId   string `json:"patientId"`
+	ID            uint   `json:"id" gorm:"primaryKey"`
+	RoundTypeId   uint   `json:"roundType"`
+	PatientId     string `json:"patientId"`
+	EffectiveFrom string `json:"effectiveFrom"`
+	EffectiveTo   string `json:"effectiveTo"`
+	Timestamps
 }
 
+// StartedAt and CompletedAt are when staff actually did the round, as opposed to the scheduled RoundTimestamp
+// There is one round per RoundTimestamp, which round creation relies on to upsert on Postgres
 type Round struct {
-	gorm.Model
 	ID             uint   `json:"id" gorm:"primaryKey"`
-	RoundTimestamp string `json:"roundTimestamp"`
+	RoundTimestamp string `json:"roundTimestamp" gorm:"uniqueIndex"`
 	Status         string `json:"status"`
+	StartedAt      string `json:"startedAt"`
+	StartedBy      string `json:"startedBy"`
+	CompletedAt    string `json:"completedAt"`
+	CompletedBy    string `json:"completedBy"`
+	Timestamps
 }
 
+// RoundID references rounds and is deleted with its round
+// RoundTypeID references round_types, and a round type can't be deleted while rounds use it
 type RoundRoundType struct {
-	gorm.Model
-	RoundID     uint `json:"round"`
-	RoundTypeID uint `json:"roundType"`
+	ID          uint `json:"id" gorm:"primaryKey"`
+	RoundID     uint `json:"round" gorm:"not null;index"`
+	RoundTypeID uint `json:"roundType" gorm:"not null;index"`
+	Timestamps
 }
 
+// RoundId references rounds and the member is deleted with its round
 type RoundMember struct {
-	gorm.Model
-	ID        uint   `json:"id" gorm:"primaryKey"`
-	RoundId   uint   `json:"round"`
-	Status    string `json:"status"`
-	PatientId string `json:"patientId"`
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	RoundId     uint   `json:"round" gorm:"not null;index"`
+	Status      string `json:"status"`
+	PatientId   string `json:"patientId"`
+	Unit        string `json:"unit"`
+	Observation string `json:"observation"`
+	ObservedAt  string `json:"observedAt"`
+	ObservedBy  string `json:"observedBy"`
+	Timestamps
+}
+
+// CensusStatus is one of ADMITTED, ON_LEAVE or DISCHARGED
+// The fields here reflect the patient's current state; PatientCensusEvent keeps the history
+type Patient struct {
+	ID           uint   `json:"id" gorm:"primaryKey"`
+	PatientId    string `json:"patientId" gorm:"uniqueIndex"`
+	Name         string `json:"name"`
+	CensusStatus string `json:"censusStatus"`
+	Unit         string `json:"unit"`
+	Bed          string `json:"bed"`
+	Timestamps
+}
+
+// A change to a patient's census state or location, effective from EffectiveAt
+type PatientCensusEvent struct {
+	ID           uint   `json:"id" gorm:"primaryKey"`
+	PatientId    string `json:"patientId" gorm:"index"`
+	CensusStatus string `json:"censusStatus"`
+	Unit         string `json:"unit"`
+	Bed          string `json:"bed"`
+	EffectiveAt  string `json:"effectiveAt"`
+	Timestamps
+}
+
+// An amendment keeps the original value alongside the corrected one
+// AmendedAt is when the correction was charted, which is separate from the clinical round time
+type RoundAmendment struct {
+	ID            uint   `json:"id" gorm:"primaryKey"`
+	RoundId       uint   `json:"round"`
+	RoundMemberId uint   `json:"roundMember"`
+	Field         string `json:"field"`
+	OriginalValue string `json:"originalValue"`
+	AmendedValue  string `json:"amendedValue"`
+	ReasonCode    string `json:"reasonCode"`
+	Note          string `json:"note"`
+	LateEntry     bool   `json:"lateEntry"`
+	AmendedAt     string `json:"amendedAt"`
+	Timestamps
+}
+
+// Someone to notify about rounds on a unit. An empty unit is the clinic-wide fallback for units without their own contact
+// Tier is CHARGE_NURSE or SUPERVISOR, Channel is webhook, smtp or in_app, and Address is the URL, email or staff id for the channel
+type EscalationContact struct {
+	ID      uint   `json:"id" gorm:"primaryKey"`
+	Unit    string `json:"unit"`
+	Tier    string `json:"tier"`
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+	Address string `json:"address"`
+	Timestamps
+}
+
+// A DUE_SOON, OVERDUE or MISSED notification about a round, or an OBSERVATION_GAP about a patient, sent to one contact
+// There is at most one per event, round, unit and contact. A gap's RoundTimestamp is when it started, so each gap is its own
+// SentAt is empty until delivery succeeds
+type Notification struct {
+	ID             uint   `json:"id" gorm:"primaryKey"`
+	Event          string `json:"event"`
+	RoundTimestamp string `json:"roundTimestamp"`
+	PatientId      string `json:"patientId"`
+	Unit           string `json:"unit"`
+	Tier           string `json:"tier"`
+	ContactId      uint   `json:"contact"`
+	Channel        string `json:"channel"`
+	Address        string `json:"address"`
+	Message        string `json:"message"`
+	SentAt         string `json:"sentAt"`
+	Error          string `json:"error"`
+	Attempts       int    `json:"attempts"`
+	NextAttemptAt  string `json:"nextAttemptAt"`
+	ReadAt         string `json:"readAt"`
+	Timestamps
+}
+
+// A round lifecycle event waiting to be fanned out to webhook subscriptions
+// It is written in the same transaction as the round change, so an event exists for every change that was committed
+// ProcessedAt is set once a delivery has been queued for each subscription
+type OutboxEvent struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	EventType   string `json:"eventType"`
+	RoundId     uint   `json:"round" gorm:"index"`
+	Payload     string `json:"payload"`
+	OccurredAt  string `json:"occurredAt"`
+	ProcessedAt string `json:"processedAt" gorm:"index"`
+	Timestamps
+}
+
+// EventTypes is a comma separated list of the event types to send, or empty for all of them
+// Payloads are signed with Secret so the receiver can check they came from us
+type WebhookSubscription struct {
+	ID         uint   `json:"id" gorm:"primaryKey"`
+	URL        string `json:"url"`
+	Secret     string `json:"secret"`
+	EventTypes string `json:"eventTypes"`
+	Active     bool   `json:"active"`
+	Timestamps
+}
+
+// The delivery of one outbox event to one subscription. Status is PENDING, DELIVERED or DEAD
+type WebhookDelivery struct {
+	ID             uint   `json:"id" gorm:"primaryKey"`
+	SubscriptionId uint   `json:"subscription" gorm:"index"`
+	OutboxEventId  uint   `json:"outboxEvent"`
+	Status         string `json:"status" gorm:"index"`
+	Attempts       int    `json:"attempts"`
+	NextAttemptAt  string `json:"nextAttemptAt"`
+	DeliveredAt    string `json:"deliveredAt"`
+	Timestamps
+}
+
+// The delivery log: one row per attempt to deliver a webhook
+type WebhookDeliveryAttempt struct {
+	ID             uint   `json:"id" gorm:"primaryKey"`
+	DeliveryId     uint   `json:"delivery" gorm:"index"`
+	SubscriptionId uint   `json:"subscription" gorm:"index"`
+	OutboxEventId  uint   `json:"outboxEvent"`
+	Attempt        int    `json:"attempt"`
+	AttemptedAt    string `json:"attemptedAt"`
+	ResponseStatus int    `json:"responseStatus"`
+	Error          string `json:"error"`
+	Timestamps
+}
+
+// A delivery that ran out of retries, kept with its payload so it can be replayed
+type WebhookDeadLetter struct {
+	ID             uint   `json:"id" gorm:"primaryKey"`
+	DeliveryId     uint   `json:"delivery"`
+	SubscriptionId uint   `json:"subscription"`
+	OutboxEventId  uint   `json:"outboxEvent"`
+	EventType      string `json:"eventType"`
+	Payload        string `json:"payload"`
+	Attempts       int    `json:"attempts"`
+	LastError      string `json:"lastError"`
+	DeadAt         string `json:"deadAt"`
+	ReplayedAt     string `json:"replayedAt"`
+	Timestamps
+}
+
+// An operation a device recorded offline and uploaded through the sync API
+// ClientId is the device's UUID for the operation, so uploading it again is harmless
+// Outcome is APPLIED, SUPERSEDED or REJECTED, with Detail explaining what happened
+type SyncOperation struct {
+	ID             uint   `json:"id" gorm:"primaryKey"`
+	ClientId       string `json:"clientId" gorm:"uniqueIndex"`
+	DeviceId       string `json:"deviceId"`
+	Type           string `json:"type"`
+	RoundTimestamp string `json:"roundTimestamp"`
+	PatientId      string `json:"patientId"`
+	Observation    string `json:"observation"`
+	StaffId        string `json:"staffId"`
+	DeviceTime     string `json:"deviceTime"`
+	ReceivedAt     string `json:"receivedAt"`
+	Outcome        string `json:"outcome"`
+	Detail         string `json:"detail"`
+	Timestamps
+}
+
+// An ADT message that was applied, kept by its MSH-10 control ID so a resend is answered with the original ACK
+// instead of being applied twice. Control IDs are only unique to the sender, so MSH-3 and MSH-4 are part of the key
+type HL7MessageReceipt struct {
+	ID                 uint   `json:"id" gorm:"primaryKey"`
+	SendingApplication string `json:"sendingApplication" gorm:"uniqueIndex:idx_hl7_message_receipts_control_id"`
+	SendingFacility    string `json:"sendingFacility" gorm:"uniqueIndex:idx_hl7_message_receipts_control_id"`
+	ControlId          string `json:"controlId" gorm:"uniqueIndex:idx_hl7_message_receipts_control_id"`
+	Ack                string `json:"ack"`
+	ReceivedAt         string `json:"receivedAt"`
+	Timestamps
 }
 
 type StartRoundsItem struct {
 	RoundTimestamp string `json:"roundTimestamp"`
 	Status         string `json:"status"`
+	Amended        bool   `json:"amended"`
+	LateCharted    bool   `json:"lateCharted"`
+}
+
+// Keeps rounds from being archived or purged while it is in effect. Kind is LEGAL_HOLD or AUDIT
+// It covers rounds from StartTime to EndTime, either of which can be empty to leave that end open,
+// and only the rounds a patient was on when PatientId is set. ReleasedAt is empty until the hold is lifted
+type RetentionHold struct {
+	ID         uint   `json:"id" gorm:"primaryKey"`
+	Kind       string `json:"kind"`
+	PatientId  string `json:"patientId"`
+	StartTime  string `json:"startTime"`
+	EndTime    string `json:"endTime"`
+	Reason     string `json:"reason"`
+	PlacedBy   string `json:"placedBy"`
+	PlacedAt   string `json:"placedAt"`
+	ReleasedAt string `json:"releasedAt"`
+	Timestamps
+}
+
+// A round the retention policy moved out of the live tables, kept with its original ID until it is purged
+// Its members, round types and amendments are archived with it
+type ArchivedRound struct {
+	Round      `gorm:"embedded"`
+	ArchivedAt string `json:"archivedAt"`
+}
+
+type ArchivedRoundRoundType struct {
+	RoundRoundType `gorm:"embedded"`
+	ArchivedAt     string `json:"archivedAt"`
+}
+
+type ArchivedRoundMember struct {
+	RoundMember `gorm:"embedded"`
+	ArchivedAt  string `json:"archivedAt"`
+}
+
+type ArchivedRoundAmendment struct {
+	RoundAmendment `gorm:"embedded"`
+	ArchivedAt     string `json:"archivedAt"`
+}
+
+// A row a migration couldn't carry over, such as a soft-deleted row or one whose parent is gone
+// It is kept as JSON rather than discarded, and rolling the migration back puts it back where it was
+type QuarantinedRow struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	Migration   int    `json:"migration" gorm:"index"`
+	SourceTable string `json:"sourceTable"`
+	RowId       uint   `json:"rowId"`
+	Reason      string `json:"reason"`
+	Data        string `json:"data"`
+	Timestamps
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Deliveries are retried with exponential backoff from webhookBaseBackoff, up to webhookMaxBackoff between attempts,
+// and dead-lettered after webhookMaxAttempts
+const (
+	webhookMaxAttempts = 8
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = time.Hour
+)
+
+// Add a webhook subscription. A secret is generated if none is given
+func AddWebhookSubscription(db *gorm.DB, subscription WebhookSubscription) (WebhookSubscription, error) {
+	parsed, err := url.Parse(subscription.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return subscription, fmt.Errorf("invalid webhook url %q", subscription.URL)
+	}
+
+	var eventTypes []string
+	for _, eventType := range strings.Split(subscription.EventTypes, ",") {
+		eventType = strings.TrimSpace(eventType)
+		if eventType == "" {
+			continue
+		}
+		if !isRoundEventType(eventType) {
+			return subscription, fmt.Errorf("unknown event type %q", eventType)
+		}
+		eventTypes = append(eventTypes, eventType)
+	}
+	subscription.EventTypes = strings.Join(eventTypes, ",")
+
+	if subscription.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return subscription, err
+		}
+		subscription.Secret = hex.EncodeToString(secret)
+	}
+
+	subscription.ID = 0
+	subscription.Active = true
+	if err := db.Create(&subscription).Error; err != nil {
+		return subscription, err
+	}
+	return subscription, nil
+}
+
+func isRoundEventType(eventType string) bool {
+	for _, roundEventType := range roundEventTypes {
+		if roundEventType == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a subscription wants an event type
+func subscribedTo(subscription WebhookSubscription, eventType string) bool {
+	if subscription.EventTypes == "" {
+		return true
+	}
+	for _, subscribed := range strings.Split(subscription.EventTypes, ",") {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign a payload for a subscription. The signature covers the timestamp too, so receivers can reject replays
+func signWebhookPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// How long to wait before the next attempt after a number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// Fan unprocessed outbox events out to subscriptions, then attempt every delivery that is due
+func DispatchWebhooks(db *gorm.DB, client *http.Client, now time.Time) error {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if err := queueWebhookDeliveries(db, now); err != nil {
+		return err
+	}
+
+	var deliveries []WebhookDelivery
+	db.Where("status = ? AND next_attempt_at <= ?", "PENDING", now.UTC().Format(time.RFC3339)).Order("id").Find(&deliveries)
+	for _, delivery := range deliveries {
+		if err := attemptWebhookDelivery(db, client, delivery, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queue a delivery for each active subscription to each outbox event that hasn't been processed
+// The deliveries and the processed mark are written together, so an event is queued exactly once
+func queueWebhookDeliveries(db *gorm.DB, now time.Time) error {
+	var events []OutboxEvent
+	db.Where("processed_at = ''").Order("id").Find(&events)
+	if len(events) == 0 {
+		return nil
+	}
+
+	var subscriptions []WebhookSubscription
+	db.Where("active = ?", true).Order("id").Find(&subscriptions)
+
+	for _, event := range events {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, subscription := range subscriptions {
+				if !subscribedTo(subscription, event.EventType) {
+					continue
+				}
+				err := tx.Create(&WebhookDelivery{
+					SubscriptionId: subscription.ID,
+					OutboxEventId:  event.ID,
+					Status:         "PENDING",
+					NextAttemptAt:  now.UTC().Format(time.RFC3339),
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Model(&event).Update("processed_at", now.UTC().Format(time.RFC3339)).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Post an event to a subscription, log the attempt, and mark the delivery delivered, due for a retry, or dead
+func attemptWebhookDelivery(db *gorm.DB, client *http.Client, delivery WebhookDelivery, now time.Time) error {
+	var subscription WebhookSubscription
+	db.Where("id = ?", delivery.SubscriptionId).First(&subscription)
+	var event OutboxEvent
+	db.Where("id = ?", delivery.OutboxEventId).First(&event)
+
+	delivery.Attempts++
+	attempt := WebhookDeliveryAttempt{
+		DeliveryId:     delivery.ID,
+		SubscriptionId: delivery.SubscriptionId,
+		OutboxEventId:  delivery.OutboxEventId,
+		Attempt:        delivery.Attempts,
+		AttemptedAt:    now.UTC().Format(time.RFC3339),
+	}
+
+	var err error
+	if subscription.ID == 0 || !subscription.Active {
+		err = errors.New("subscription is no longer active")
+	} else {
+		attempt.ResponseStatus, err = postWebhook(client, subscription, event, delivery, now)
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&attempt).Error; err != nil {
+			return err
+		}
+
+		switch {
+		case err == nil:
+			delivery.Status = "DELIVERED"
+			delivery.DeliveredAt = now.UTC().Format(time.RFC3339)
+		case delivery.Attempts >= webhookMaxAttempts || subscription.ID == 0 || !subscription.Active:
+			delivery.Status = "DEAD"
+			deadLetter := WebhookDeadLetter{
+				DeliveryId:     delivery.ID,
+				SubscriptionId: delivery.SubscriptionId,
+				OutboxEventId:  delivery.OutboxEventId,
+				EventType:      event.EventType,
+				Payload:        event.Payload,
+				Attempts:       delivery.Attempts,
+				LastError:      attempt.Error,
+				DeadAt:         now.UTC().Format(time.RFC3339),
+			}
+			if err := tx.Create(&deadLetter).Error; err != nil {
+				return err
+			}
+		default:
+			delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts)).UTC().Format(time.RFC3339)
+		}
+		return tx.Save(&delivery).Error
+	})
+}
+
+// Post a signed event. Returns the response status, and an error unless it was 2xx
+func postWebhook(client *http.Client, subscription WebhookSubscription, event OutboxEvent, delivery WebhookDelivery, now time.Time) (int, error) {
+	payload := []byte(event.Payload)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Rounds-Event", event.EventType)
+	req.Header.Set("X-Rounds-Event-Id", strconv.FormatUint(uint64(event.ID), 10))
+	req.Header.Set("X-Rounds-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Rounds-Timestamp", timestamp)
+	req.Header.Set("X-Rounds-Signature", signWebhookPayload(subscription.Secret, timestamp, payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Put a dead-lettered delivery back in the queue with a fresh set of attempts
+func ReplayWebhookDeadLetter(db *gorm.DB, deadLetterId uint, now time.Time) (WebhookDelivery, error) {
+	var deadLetter WebhookDeadLetter
+	db.Where("id = ?", deadLetterId).First(&deadLetter)
+	if deadLetter.ID == 0 {
+		return WebhookDelivery{}, fmt.Errorf("dead letter %d not found", deadLetterId)
+	}
+	if deadLetter.ReplayedAt != "" {
+		return WebhookDelivery{}, fmt.Errorf("dead letter %d was already replayed at %s", deadLetterId, deadLetter.ReplayedAt)
+	}
+
+	delivery := WebhookDelivery{
+		SubscriptionId: deadLetter.SubscriptionId,
+		OutboxEventId:  deadLetter.OutboxEventId,
+		Status:         "PENDING",
+		NextAttemptAt:  now.UTC().Format(time.RFC3339),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&delivery).Error; err != nil {
+			return err
+		}
+		return tx.Model(&deadLetter).Update("replayed_at", now.UTC().Format(time.RFC3339)).Error
+	})
+	return delivery, err
+}
+
+// Create due rounds, record missed round events and dispatch webhooks every interval until the context is cancelled
+// Each run is for the time its tick fired
+func RunWebhookWorker(ctx context.Context, db *gorm.DB, clock Clock, client *http.Client, interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	now := clock.Now()
+	for {
+		if err := createDueRounds(db, now); err != nil {
+			log.Printf("Creating due rounds failed: %v", err)
+		}
+		if _, err := RecordMissedRoundEvents(db, now); err != nil {
+			log.Printf("Recording missed round events failed: %v", err)
+		}
+		if err := DispatchWebhooks(db, client, now); err != nil {
+			log.Printf("Webhook dispatch failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoundEventsWrittenToOutbox(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+
+	CreateRounds(NewGormRoundsStore(db), roundTime)
+	if _, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(2*time.Minute)); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+	if _, err := CompleteRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(5*time.Minute)); err != nil {
+		t.Fatalf("CompleteRound failed: %v", err)
+	}
+	if _, err := AmendRoundStatus(NewGormRoundsStore(db), roundTime.Add(-15*time.Minute), "MISSED", "DOCUMENTATION_ERROR", "", "nurseA", roundTime.Add(10*time.Minute)); err != nil {
+		t.Fatalf("AmendRoundStatus failed: %v", err)
+	}
+
+	var created int64
+	db.Model(&OutboxEvent{}).Where("event_type = ?", "round.created").Count(&created)
+	var rounds int64
+	db.Model(&Round{}).Count(&rounds)
+	if created != rounds {
+		t.Errorf("Expected a round.created event for each of %d created rounds, got %d", rounds, created)
+	}
+
+	var events []OutboxEvent
+	db.Where("event_type <> ?", "round.created").Order("id").Find(&events)
+	expected := []string{"round.started", "round.completed", "round.missed"}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), events)
+	}
+	for i, eventType := range expected {
+		if events[i].EventType != eventType {
+			t.Errorf("Expected event %d to be %s, got %s", i, eventType, events[i].EventType)
+		}
+	}
+
+	var payload RoundEventPayload
+	if err := json.Unmarshal([]byte(events[1].Payload), &payload); err != nil {
+		t.Fatalf("Invalid payload: %v", err)
+	}
+	if payload.Round.Status != "COMPLETE" || payload.Round.CompletedBy != "nurseA" || payload.OccurredAt != "2022-01-10T09:05:00Z" {
+		t.Errorf("Unexpected completed payload %+v", payload)
+	}
+}
+
+func TestRecordMissedRoundEvents(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	db.Create(&Round{ID: 1, RoundTimestamp: "2022-01-10T08:00:00Z", Status: "CREATED"})
+	db.Create(&Round{ID: 2, RoundTimestamp: "2022-01-10T08:15:00Z", Status: "STARTED"})
+	db.Create(&Round{ID: 3, RoundTimestamp: "2022-01-10T08:45:00Z", Status: "CREATED"})
+
+	// At 9:00 only the 8:00 round is 30 minutes past due without being started
+	now := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	for _, expectedCount := range []int{1, 0} {
+		count, err := RecordMissedRoundEvents(db, now)
+		if err != nil {
+			t.Fatalf("RecordMissedRoundEvents failed: %v", err)
+		}
+		if count != expectedCount {
+			t.Errorf("Expected %d missed events, got %d", expectedCount, count)
+		}
+	}
+
+	var event OutboxEvent
+	db.Where("event_type = ?", "round.missed").First(&event)
+	if event.RoundId != 1 || event.OccurredAt != "2022-01-10T08:30:00Z" {
+		t.Errorf("Expected a missed event for round 1 at 8:30, got %+v", event)
+	}
+}
+
+// Slots that came due with nobody opening them are created by the worker, so they get missed events too
+func TestRunWebhookWorkerRecordsMissedSlots(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	CreateRounds(NewGormRoundsStore(db), time.Date(2022, time.January, 10, 8, 0, 0, 0, time.UTC))
+	clock := NewFakeClock(time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunWebhookWorker(ctx, db, clock, nil, time.Minute)
+		close(done)
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	<-done
+
+	// At 9:00 the 8:15 and 8:30 rounds are missed, and the 8:45 round isn't yet
+	for _, tt := range []struct {
+		roundTimestamp string
+		missed         bool
+	}{
+		{"2022-01-10T08:15:00Z", true},
+		{"2022-01-10T08:30:00Z", true},
+		{"2022-01-10T08:45:00Z", false},
+	} {
+		var round Round
+		db.Where("round_timestamp = ?", tt.roundTimestamp).First(&round)
+		if round.ID == 0 {
+			t.Errorf("Expected the %s round to be created", tt.roundTimestamp)
+			continue
+		}
+		var events int64
+		db.Model(&OutboxEvent{}).Where("round_id = ? AND event_type = ?", round.ID, "round.missed").Count(&events)
+		if missed := events == 1; missed != tt.missed {
+			t.Errorf("Expected missed %v for the %s round, got %d events", tt.missed, tt.roundTimestamp, events)
+		}
+	}
+}
+
+// A webhook receiver that checks signatures and fails the first few requests
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	secret   string
+	failures int
+	received []RoundEventPayload
+	invalid  int
+}
+
+func startWebhookReceiver(t *testing.T, failures int) *webhookReceiver {
+	receiver := &webhookReceiver{failures: failures}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Rounds-Signature") != signWebhookPayload(receiver.secret, r.Header.Get("X-Rounds-Timestamp"), body) {
+			receiver.invalid++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if receiver.failures > 0 {
+			receiver.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload RoundEventPayload
+		json.Unmarshal(body, &payload)
+		receiver.received = append(receiver.received, payload)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func TestDispatchWebhooks(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	receiver := startWebhookReceiver(t, 2)
+
+	subscription, err := AddWebhookSubscription(db, WebhookSubscription{URL: receiver.URL, EventTypes: "round.started, round.completed"})
+	if err != nil {
+		t.Fatalf("AddWebhookSubscription failed: %v", err)
+	}
+	receiver.secret = subscription.Secret
+
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	if _, err := StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime.Add(2*time.Minute)); err != nil {
+		t.Fatalf("StartRound failed: %v", err)
+	}
+
+	// The first attempt fails and is retried after 30 seconds, then 60
+	now := roundTime.Add(3 * time.Minute)
+	steps := []struct {
+		at        time.Duration
+		delivered int
+	}{
+		{0, 0},
+		{20 * time.Second, 0},
+		{30 * time.Second, 0},
+		{90 * time.Second, 1},
+	}
+	for _, step := range steps {
+		if err := DispatchWebhooks(db, nil, now.Add(step.at)); err != nil {
+			t.Fatalf("DispatchWebhooks failed: %v", err)
+		}
+		if len(receiver.received) != step.delivered {
+			t.Errorf("Expected %d deliveries after %s, got %d", step.delivered, step.at, len(receiver.received))
+		}
+	}
+	if receiver.invalid != 0 {
+		t.Errorf("Expected every request to be signed, got %d invalid", receiver.invalid)
+	}
+	if receiver.received[0].Type != "round.started" || receiver.received[0].Round.StartedBy != "nurseA" {
+		t.Errorf("Unexpected payload %+v", receiver.received[0])
+	}
+
+	// The created events were not subscribed to, and every attempt is in the delivery log
+	var deliveries int64
+	db.Model(&WebhookDelivery{}).Count(&deliveries)
+	if deliveries != 1 {
+		t.Errorf("Expected 1 delivery, got %d", deliveries)
+	}
+	var attempts []WebhookDeliveryAttempt
+	db.Order("id").Find(&attempts)
+	if len(attempts) != 3 || attempts[0].ResponseStatus != http.StatusServiceUnavailable || attempts[2].ResponseStatus != http.StatusOK {
+		t.Errorf("Expected 2 failed attempts then a success in the log, got %+v", attempts)
+	}
+}
+
+func TestDispatchWebhooksDeadLetter(t *testing.T) {
+	db := setupDatabase()
+	setupRoundConfigs(db)
+	receiver := startWebhookReceiver(t, webhookMaxAttempts)
+	subscription, _ := AddWebhookSubscription(db, WebhookSubscription{URL: receiver.URL, EventTypes: "round.started"})
+	receiver.secret = subscription.Secret
+
+	roundTime := time.Date(2022, time.January, 10, 9, 0, 0, 0, time.UTC)
+	StartRound(NewGormRoundsStore(db), roundTime, "nurseA", roundTime)
+
+	// Run long enough for every retry to come due
+	for now := roundTime; now.Before(roundTime.Add(6 * time.Hour)); now = now.Add(time.Minute) {
+		if err := DispatchWebhooks(db, nil, now); err != nil {
+			t.Fatalf("DispatchWebhooks failed: %v", err)
+		}
+	}
+
+	var deadLetters []WebhookDeadLetter
+	db.Find(&deadLetters)
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != webhookMaxAttempts || deadLetters[0].EventType != "round.started" {
+		t.Fatalf("Expected one dead letter after %d attempts, got %+v", webhookMaxAttempts, deadLetters)
+	}
+
+	// Replaying it delivers it now that the receiver is healthy
+	replayAt := roundTime.Add(7 * time.Hour)
+	if _, err := ReplayWebhookDeadLetter(db, deadLetters[0].ID, replayAt); err != nil {
+		t.Fatalf("ReplayWebhookDeadLetter failed: %v", err)
+	}
+	if _, err := ReplayWebhookDeadLetter(db, deadLetters[0].ID, replayAt); err == nil {
+		t.Errorf("Expected an error replaying a dead letter twice")
+	}
+	if err := DispatchWebhooks(db, nil, replayAt); err != nil {
+		t.Fatalf("DispatchWebhooks failed: %v", err)
+	}
+	if len(receiver.received) != 1 {
+		t.Errorf("Expected the replayed delivery to arrive, got %d", len(receiver.received))
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	expected := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, backoff := range expected {
+		if webhookBackoff(i+1) != backoff {
+			t.Errorf("Expected backoff %s after %d attempts, got %s", backoff, i+1, webhookBackoff(i+1))
+		}
+	}
+	if webhookBackoff(20) != webhookMaxBackoff {
+		t.Errorf("Expected backoff to be capped at %s, got %s", webhookMaxBackoff, webhookBackoff(20))
+	}
+}
+
+func TestAddWebhookSubscriptionValidation(t *testing.T) {
+	db := setupDatabase()
+
+	if _, err := AddWebhookSubscription(db, WebhookSubscription{URL: "ftp://example.com"}); err == nil {
+		t.Errorf("Expected an error for a non-http url")
+	}
+	if _, err := AddWebhookSubscription(db, WebhookSubscription{URL: "https://example.com", EventTypes: "round.deleted"}); err == nil {
+		t.Errorf("Expected an error for an unknown event type")
+	}
+	subscription, err := AddWebhookSubscription(db, WebhookSubscription{URL: "https://example.com"})
+	if err != nil || len(subscription.Secret) != 64 || !subscription.Active {
+		t.Errorf("Expected an active subscription with a generated secret, got %+v, %v", subscription, err)
+	}
+}